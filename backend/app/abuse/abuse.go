@@ -0,0 +1,25 @@
+package abuse
+
+// Reporter receives reports of behavior that can only come from a modified or malicious
+// client. It is the single place to implement throttling or banning, so business logic
+// only has to report what it saw
+type Reporter interface {
+	// A redo carried a UUIDv7 stroke id with a timestamp in the future
+	ReportFutureUUID(userId string, strokeId string)
+	// A user tried to delete a stroke owned by another user
+	ReportNotOwnerDelete(userId string, strokeId string)
+}
+
+// Noop ignores all reports, used when a component is created without a reporter
+type Noop struct{}
+
+func (Noop) ReportFutureUUID(userId string, strokeId string)     {}
+func (Noop) ReportNotOwnerDelete(userId string, strokeId string) {}
+
+// OrNoop returns r, or a Noop reporter if r is nil
+func OrNoop(r Reporter) Reporter {
+	if r == nil {
+		return Noop{}
+	}
+	return r
+}
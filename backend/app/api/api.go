@@ -2,25 +2,111 @@ package api
 
 import (
 	"context"
+	"errors"
 	"log"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/zlnvch/webverse/abuse"
+	"github.com/zlnvch/webverse/api/netutil"
 	"github.com/zlnvch/webverse/api/rest"
 	"github.com/zlnvch/webverse/api/ws"
 	"github.com/zlnvch/webverse/cache"
+	"github.com/zlnvch/webverse/metrics"
 	"github.com/zlnvch/webverse/mq"
 	"github.com/zlnvch/webverse/service"
 	"github.com/zlnvch/webverse/store"
+	"github.com/zlnvch/webverse/webhook"
 	"github.com/zlnvch/webverse/worker"
 	"golang.org/x/oauth2"
 )
 
+// Config holds the settings of the API and the components it wires together
+type Config struct {
+	Service service.Config
+	// Serve the in-process metrics snapshot at /metrics
+	ExposeMetrics bool
+	// Number of proxies (e.g. the ALB) in front of the server whose X-Forwarded-For
+	// entries are trusted when resolving client IPs. 0 uses the connection's address
+	TrustedProxyCount int
+	// Per client IP limits of logins and websocket connections, which are made before a user
+	// is known. Zero values disable them
+	LoginRateLimit     netutil.IPRateLimit
+	WSConnectRateLimit netutil.IPRateLimit
+	// Receives reports of malicious client behavior, nil ignores them
+	AbuseReporter abuse.Reporter
+	// Deadline for the store, cache and OAuth calls of a REST request, 0 disables it
+	RequestTimeout time.Duration
+	// Websocket keepalive and write deadlines
+	WSTimeouts ws.ConnectionTimeouts
+	// New subscribers to a page beyond this many are rejected
+	MaxSubscribersPerPage int
+	// Distinct pages each websocket connection can load
+	WSLoadLimits ws.LoadLimits
+	// A connection exceeding the message rate limit is warned and closed only if it keeps exceeding
+	// it for this long, 0 closes it right away
+	WSRateLimitGrace time.Duration
+	// Messages queued for each websocket connection, and what happens to broadcasts once the queue is full
+	WSSendBufferSize int
+	WSSendOverflow   ws.SendOverflowPolicy
+	// User stroke counts are written to the store every CounterFlushInterval, or once CounterFlushUsers
+	// users have pending changes. A crash loses the counts changed since the last flush
+	CounterFlushInterval time.Duration
+	CounterFlushUsers    int
+	// Also keep the pending counts in the cache, so the changes of a crashed server are written
+	// by the next one to start. Costs a cache write per draw and undo
+	CounterWAL bool
+	// Strokes waiting to be written, beyond which draws wait for room or, with StrokeShedWhenFull,
+	// are acknowledged but never persisted
+	StrokeBufferSize   int
+	StrokeShedWhenFull bool
+	// Flushes of at most this many strokes write each one in a transaction with its user's counter,
+	// so the counts can't drift from the strokes. 0 always batches
+	StrokeTransactionalFlushSize int
+	// New strokes wait this long before they are written, so strokes undone within it cost no writes
+	// Held strokes are lost on a crash. 0 writes them on the next flush
+	StrokeGracePeriod time.Duration
+	// Messages of the delete user strokes queue processed at once, e.g. during a mass account deletion
+	MQConsumers int
+	// Time a consumer has to process a message before it is redelivered to another, in whole seconds
+	// Large accounts take longer to delete, shorter timeouts redeliver sooner after a crash
+	MQVisibilityTimeout time.Duration
+	// Every draw and undo is POSTed to each of these URLs, signed with WebhookSecret. Empty disables webhooks
+	WebhookURLs   []string
+	WebhookSecret []byte
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Service:               service.DefaultConfig(),
+		RequestTimeout:        10 * time.Second,
+		WSTimeouts:            ws.DefaultConnectionTimeouts(),
+		MaxSubscribersPerPage: ws.DefaultMaxSubscribersPerPage,
+		WSLoadLimits:          ws.DefaultLoadLimits(),
+		WSRateLimitGrace:      ws.DefaultRateLimitGrace,
+		WSSendBufferSize:      ws.DefaultSendBufferSize,
+		WSSendOverflow:        ws.SendOverflowBlock,
+		CounterFlushInterval:  60 * time.Second,
+		CounterFlushUsers:     worker.DefaultCounterFlushUsers,
+		StrokeBufferSize:      worker.DefaultStrokeBufferSize,
+		MQConsumers:           1,
+		MQVisibilityTimeout:   worker.DefaultVisibilityTimeout,
+	}
+}
+
 type WebverseAPI struct {
-	restHandler *rest.Handler
-	wsHandler   *ws.Handler
-	wsUpgrader  websocket.Upgrader
-	shutdownCtx context.Context
+	restHandler      *rest.Handler
+	wsHandler        *ws.Handler
+	wsUpgrader       websocket.Upgrader
+	loginLimiter     *netutil.IPRateLimiter
+	wsConnectLimiter *netutil.IPRateLimiter
+	metrics          *metrics.Registry
+	config           Config
+	shutdownCtx      context.Context
+	// Closed once the workers wrote their pending strokes and counters after shutdown
+	workersDone chan struct{}
 }
 
 func NewWebverseAPI(
@@ -28,10 +114,67 @@ func NewWebverseAPI(
 	deleteUserStrokesQueue mq.MessageQueue,
 	webverseCache cache.WebverseCache,
 	oauthConfigs map[string]*oauth2.Config,
-	jwtSecret []byte,
+	jwtSecrets [][]byte,
+	config Config,
 	shutdownCtx context.Context,
 ) (*WebverseAPI, error) {
+	metricsRegistry := metrics.NewRegistry()
+
+	if err := config.WSTimeouts.Validate(); err != nil {
+		log.Printf("Invalid websocket timeouts: %v", err)
+		return &WebverseAPI{}, err
+	}
+	if err := config.WSLoadLimits.Validate(); err != nil {
+		log.Printf("Invalid websocket load limits: %v", err)
+		return &WebverseAPI{}, err
+	}
+	if err := config.LoginRateLimit.Validate(); err != nil {
+		return &WebverseAPI{}, err
+	}
+	if err := config.WSConnectRateLimit.Validate(); err != nil {
+		return &WebverseAPI{}, err
+	}
+	if config.WSSendBufferSize <= 0 {
+		return &WebverseAPI{}, errors.New("websocket send buffer size must be positive")
+	}
+	if config.CounterFlushInterval < time.Millisecond || config.CounterFlushUsers <= 0 {
+		return &WebverseAPI{}, errors.New("counter flush interval and users must be positive")
+	}
+	if config.WSRateLimitGrace < 0 {
+		return &WebverseAPI{}, errors.New("websocket rate limit grace must not be negative")
+	}
+	if config.StrokeBufferSize <= 0 {
+		return &WebverseAPI{}, errors.New("stroke buffer size must be positive")
+	}
+	if config.StrokeTransactionalFlushSize < 0 {
+		return &WebverseAPI{}, errors.New("stroke transactional flush size must not be negative")
+	}
+	if config.StrokeGracePeriod < 0 {
+		return &WebverseAPI{}, errors.New("stroke grace period must not be negative")
+	}
+	// SQS accepts up to 12 hours
+	if config.MQVisibilityTimeout < 2*time.Second || config.MQVisibilityTimeout > 12*time.Hour || config.MQVisibilityTimeout%time.Second != 0 {
+		return &WebverseAPI{}, errors.New("mq visibility timeout must be whole seconds between 2s and 12h")
+	}
+	if config.MQConsumers <= 0 {
+		return &WebverseAPI{}, errors.New("mq consumers must be positive")
+	}
+	if len(config.WebhookURLs) > 0 && len(config.WebhookSecret) == 0 {
+		return &WebverseAPI{}, errors.New("webhook secret is required with webhook urls")
+	}
+
+	if config.ExposeMetrics {
+		webverseStore = store.NewInstrumentedStore(webverseStore, metricsRegistry)
+		webverseCache = cache.NewInstrumentedCache(webverseCache, metricsRegistry)
+	}
+
 	wsHub := ws.NewHub(webverseCache)
+	wsHub.Timeouts = config.WSTimeouts
+	wsHub.MaxSubscribersPerPage = config.MaxSubscribersPerPage
+	wsHub.LoadLimits = config.WSLoadLimits
+	wsHub.RateLimitGrace = config.WSRateLimitGrace
+	wsHub.SendBufferSize = config.WSSendBufferSize
+	wsHub.SendOverflow = config.WSSendOverflow
 	err := wsHub.InitSubscriptions(shutdownCtx)
 	if err != nil {
 		log.Printf("Failed to start WS Hub subscriptions service: %v", err)
@@ -39,14 +182,33 @@ func NewWebverseAPI(
 	}
 	go wsHub.Run()
 
-	counterBatcher := worker.NewCounterBatcher(webverseStore, 60000)
-	go counterBatcher.Run(shutdownCtx)
+	counterBatcher := worker.NewCounterBatcher(webverseStore, int(config.CounterFlushInterval/time.Millisecond), config.CounterFlushUsers)
+	if config.CounterWAL {
+		counterBatcher.Log = webverseCache
+	}
+	// The counter batcher stops after the stroke batcher and MQ consumers, whose final writes still send it updates
+	counterCtx, stopCounterBatcher := context.WithCancel(context.Background())
+	workersDone := make(chan struct{})
+	go func() {
+		counterBatcher.Run(counterCtx)
+		close(workersDone)
+	}()
+	var counterProducers sync.WaitGroup
+
+	abuseReporter := abuse.OrNoop(config.AbuseReporter)
 
-	strokeBatcher := worker.NewStrokeBatcher(webverseStore, 500, counterBatcher)
-	go strokeBatcher.Run(shutdownCtx)
+	strokeBatcher := worker.NewStrokeBatcher(webverseStore, 500, config.StrokeBufferSize, counterBatcher, metricsRegistry)
+	strokeBatcher.AbuseReporter = abuseReporter
+	strokeBatcher.ShedWhenFull = config.StrokeShedWhenFull
+	strokeBatcher.TransactionalFlushSize = config.StrokeTransactionalFlushSize
+	strokeBatcher.GracePeriod = config.StrokeGracePeriod
+	strokeBatcher.DropLog = webverseCache
 
 	mqConsumer := worker.NewMQConsumer(deleteUserStrokesQueue, webverseStore, webverseCache, counterBatcher)
-	go mqConsumer.Run(shutdownCtx)
+	mqConsumer.VisibilityTimeout = config.MQVisibilityTimeout
+	counterProducers.Go(func() {
+		mqConsumer.RunConcurrently(shutdownCtx, config.MQConsumers)
+	})
 
 	svc, err := service.NewService(
 		webverseStore,
@@ -55,23 +217,71 @@ func NewWebverseAPI(
 		strokeBatcher,
 		counterBatcher,
 		oauthConfigs,
-		jwtSecret,
+		jwtSecrets,
+		config.Service,
 	)
 	if err != nil {
 		log.Printf("Failed to create service: %v", err)
+		stopCounterBatcher()
 		return &WebverseAPI{}, err
 	}
+	svc.AbuseReporter = abuseReporter
+	svc.Metrics = metricsRegistry
+	if len(config.WebhookURLs) > 0 {
+		dispatcher := webhook.NewHTTPDispatcher(config.WebhookURLs, config.WebhookSecret, webhook.DefaultQueueSize)
+		dispatcher.Metrics = metricsRegistry
+		go dispatcher.Run(shutdownCtx)
+		svc.Webhook = dispatcher
+	}
+	if config.Service.PublishStrokePersisted {
+		strokeBatcher.OnPersisted = svc.PublishStrokesPersisted
+	}
+	counterProducers.Go(func() {
+		strokeBatcher.Run(shutdownCtx)
+	})
+	go func() {
+		counterProducers.Wait()
+		stopCounterBatcher()
+	}()
+	if config.Service.ReconcileInterval > 0 {
+		go svc.RunPageReconciler(shutdownCtx)
+	}
+	if config.Service.InactiveUserCleanupInterval > 0 {
+		go svc.RunInactiveUserCleanup(shutdownCtx)
+	}
 
 	restHandler := rest.NewHandler(svc)
+	restHandler.RequestTimeout = config.RequestTimeout
 	wsHandler := ws.NewHandler(svc, wsHub)
 
+	loginLimiter := netutil.NewIPRateLimiter(config.LoginRateLimit, config.TrustedProxyCount)
+	go loginLimiter.Run(shutdownCtx)
+	wsConnectLimiter := netutil.NewIPRateLimiter(config.WSConnectRateLimit, config.TrustedProxyCount)
+	go wsConnectLimiter.Run(shutdownCtx)
+
 	return &WebverseAPI{
-		restHandler: restHandler,
-		wsHandler:   wsHandler,
-		shutdownCtx: shutdownCtx,
+		restHandler:      restHandler,
+		wsHandler:        wsHandler,
+		loginLimiter:     loginLimiter,
+		wsConnectLimiter: wsConnectLimiter,
+		metrics:          metricsRegistry,
+		config:           config,
+		shutdownCtx:      shutdownCtx,
+		workersDone:      workersDone,
 	}, nil
 }
 
+// WaitForWorkers waits until the stroke batcher, counter batcher and MQ consumers have finished their
+// pending work after shutdownCtx is done, or until ctx is done. Reports whether they finished
+func (webverseAPI *WebverseAPI) WaitForWorkers(ctx context.Context) bool {
+	select {
+	case <-webverseAPI.workersDone:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
 func (webverseAPI *WebverseAPI) RegisterRoutes(mux *http.ServeMux, requiredOrigin string) {
 	// Health check endpoint (no auth required)
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -83,12 +293,31 @@ func (webverseAPI *WebverseAPI) RegisterRoutes(mux *http.ServeMux, requiredOrigi
 		w.Write([]byte("OK"))
 	})
 
-	mux.HandleFunc("/login", webverseAPI.restHandler.HandleLogin)
+	if webverseAPI.config.ExposeMetrics {
+		mux.Handle("/metrics", webverseAPI.metrics)
+	}
+
+	mux.HandleFunc("/login", webverseAPI.loginLimiter.Middleware(webverseAPI.restHandler.HandleLogin))
 	mux.HandleFunc("/me", webverseAPI.restHandler.HandleMe)
 	mux.HandleFunc("/me/encryption-keys", webverseAPI.restHandler.HandleEncryptionKeys)
+	mux.HandleFunc("/me/recent-pages", webverseAPI.restHandler.HandleRecentPages)
+	mux.HandleFunc("/me/usage", webverseAPI.restHandler.HandleUsage)
+	mux.HandleFunc("/me/pages", webverseAPI.restHandler.HandleUserPages)
+	mux.HandleFunc("/validate", webverseAPI.restHandler.HandleValidate)
+	mux.HandleFunc("/page", webverseAPI.restHandler.HandlePage)
+	mux.HandleFunc("/admin/ban", webverseAPI.restHandler.HandleAdminBan)
+	mux.HandleFunc("/admin/delete-users", webverseAPI.restHandler.HandleAdminDeleteUsers)
+	mux.HandleFunc("/admin/users", webverseAPI.restHandler.HandleAdminUsers)
+	mux.HandleFunc("/admin/stroke", webverseAPI.restHandler.HandleAdminStroke)
+	mux.HandleFunc("/admin/stroke/hidden", webverseAPI.restHandler.HandleAdminStrokeHidden)
+	mux.HandleFunc("/admin/page", webverseAPI.restHandler.HandleAdminPage)
+	mux.HandleFunc("/admin/invalidate", webverseAPI.restHandler.HandleAdminInvalidate)
+	mux.HandleFunc("/admin/page-settings", webverseAPI.restHandler.HandleAdminPageSettings)
+	mux.HandleFunc("/admin/pause", webverseAPI.restHandler.HandleAdminPause)
+	mux.HandleFunc("/admin/clear", webverseAPI.restHandler.HandleAdminClear)
 
 	wsUpgrader := webverseAPI.wsHandler.NewWsUpgrader(requiredOrigin)
-	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/ws", webverseAPI.wsConnectLimiter.Middleware(func(w http.ResponseWriter, r *http.Request) {
 		webverseAPI.wsHandler.ServeWS(wsUpgrader, w, r, webverseAPI.shutdownCtx)
-	})
+	}))
 }
@@ -0,0 +1,44 @@
+package netutil
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientIP returns the IP of the client that made the request
+// Behind a load balancer r.RemoteAddr is the balancer itself, so the X-Forwarded-For
+// header is walked right-to-left: each of the trustedProxyCount proxies in front of
+// the server appended the address it received the request from, so the entry added
+// by the outermost trusted proxy is the real client. Entries further left are set by
+// the client and can't be trusted.
+// Falls back to r.RemoteAddr if trustedProxyCount is 0 or the header is missing,
+// shorter than expected or malformed.
+func ClientIP(r *http.Request, trustedProxyCount int) string {
+	remoteIP := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		remoteIP = host
+	}
+
+	if trustedProxyCount <= 0 {
+		return remoteIP
+	}
+
+	// Multiple X-Forwarded-For headers are equivalent to a single comma-separated one
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+
+	if len(hops) < trustedProxyCount {
+		return remoteIP
+	}
+
+	ip := net.ParseIP(hops[len(hops)-trustedProxyCount])
+	if ip == nil {
+		return remoteIP
+	}
+	return ip.String()
+}
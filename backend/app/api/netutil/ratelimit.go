@@ -0,0 +1,156 @@
+package netutil
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// IPRateLimit is a token bucket per client IP, the zero value disables it
+type IPRateLimit struct {
+	// Requests each IP can make per minute on average
+	PerMinute int
+	// Requests an IP can make at once after being idle
+	Burst int
+}
+
+func (limit IPRateLimit) Validate() error {
+	if limit.PerMinute < 0 || limit.Burst < 0 {
+		return errors.New("ip rate limit must not be negative")
+	}
+	if limit.PerMinute > 0 && limit.Burst == 0 {
+		return errors.New("ip rate limit burst must be positive")
+	}
+	return nil
+}
+
+// maxTrackedIPs bounds the buckets held at once, the least recently seen IP is dropped past it
+const maxTrackedIPs = 100000
+
+// pruneInterval is how often Run drops the buckets of idle IPs
+const pruneInterval = time.Minute
+
+type ipBucket struct {
+	key      string
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// IPRateLimiter throttles requests by client IP, resolved like ClientIP
+// IPv6 clients are limited per /64, the smallest block a host is usually assigned
+type IPRateLimiter struct {
+	limit             IPRateLimit
+	trustedProxyCount int
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	// Buckets by last use, most recent first
+	recent *list.List
+}
+
+func NewIPRateLimiter(limit IPRateLimit, trustedProxyCount int) *IPRateLimiter {
+	return &IPRateLimiter{
+		limit:             limit,
+		trustedProxyCount: trustedProxyCount,
+		buckets:           make(map[string]*list.Element),
+		recent:            list.New(),
+	}
+}
+
+// Allow reports whether the IP can make another request now, taking a token if it can
+func (l *IPRateLimiter) Allow(ip string) bool {
+	if l.limit.PerMinute <= 0 {
+		return true
+	}
+	key := bucketKey(ip)
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	element, ok := l.buckets[key]
+	if ok {
+		l.recent.MoveToFront(element)
+	} else {
+		if l.recent.Len() >= maxTrackedIPs {
+			l.remove(l.recent.Back())
+		}
+		bucket := &ipBucket{key: key, limiter: rate.NewLimiter(rate.Limit(float64(l.limit.PerMinute)/60), l.limit.Burst)}
+		element = l.recent.PushFront(bucket)
+		l.buckets[key] = element
+	}
+	bucket := element.Value.(*ipBucket)
+	bucket.lastSeen = now
+	return bucket.limiter.AllowN(now, 1)
+}
+
+// Run drops the buckets of idle IPs every pruneInterval until ctx is done
+func (l *IPRateLimiter) Run(ctx context.Context) {
+	if l.limit.PerMinute <= 0 {
+		return
+	}
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.pruneIdle(time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// pruneIdle drops the IPs whose bucket has refilled, which a new bucket is equivalent to
+// Only the idle ones at the back of the list are visited
+func (l *IPRateLimiter) pruneIdle(now time.Time) {
+	refill := time.Duration(l.limit.Burst) * time.Minute / time.Duration(l.limit.PerMinute)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for element := l.recent.Back(); element != nil; element = l.recent.Back() {
+		if now.Sub(element.Value.(*ipBucket).lastSeen) < refill {
+			return
+		}
+		l.remove(element)
+	}
+}
+
+func (l *IPRateLimiter) remove(element *list.Element) {
+	l.recent.Remove(element)
+	delete(l.buckets, element.Value.(*ipBucket).key)
+}
+
+// bucketKey is the IP itself for IPv4, and its /64 for IPv6
+func bucketKey(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.To4() != nil {
+		return ip
+	}
+	return parsed.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// Middleware rejects requests past the client IP's limit with 429 Too Many Requests
+func (l *IPRateLimiter) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	if l.limit.PerMinute <= 0 {
+		return next
+	}
+	// Seconds until the next token, rounded up
+	retryAfter := strconv.Itoa((60 + l.limit.PerMinute - 1) / l.limit.PerMinute)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !l.Allow(ClientIP(r, l.trustedProxyCount)) {
+			w.Header().Set("Retry-After", retryAfter)
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,42 @@
+package netutil_test
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zlnvch/webverse/api/netutil"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name              string
+		remoteAddr        string
+		forwardedFor      []string
+		trustedProxyCount int
+		want              string
+	}{
+		{"No Proxy", "203.0.113.7:4321", nil, 0, "203.0.113.7"},
+		{"Header Ignored Without Trusted Proxies", "10.0.0.1:4321", []string{"203.0.113.7"}, 0, "10.0.0.1"},
+		{"Single Load Balancer", "10.0.0.1:4321", []string{"203.0.113.7"}, 1, "203.0.113.7"},
+		{"Spoofed Entries Skipped", "10.0.0.1:4321", []string{"1.2.3.4, 203.0.113.7"}, 1, "203.0.113.7"},
+		{"Two Trusted Hops", "10.0.0.2:4321", []string{"1.2.3.4, 203.0.113.7, 10.0.0.1"}, 2, "203.0.113.7"},
+		{"Multiple Headers", "10.0.0.2:4321", []string{"1.2.3.4", "203.0.113.7, 10.0.0.1"}, 2, "203.0.113.7"},
+		{"Missing Header", "10.0.0.1:4321", nil, 1, "10.0.0.1"},
+		{"Fewer Hops Than Trusted", "10.0.0.1:4321", []string{"203.0.113.7"}, 2, "10.0.0.1"},
+		{"Malformed Entry", "10.0.0.1:4321", []string{"not-an-ip"}, 1, "10.0.0.1"},
+		{"IPv6", "[2001:db8::2]:4321", []string{"2001:db8::1"}, 1, "2001:db8::1"},
+		{"RemoteAddr Without Port", "10.0.0.1", nil, 0, "10.0.0.1"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tc.remoteAddr
+			for _, header := range tc.forwardedFor {
+				r.Header.Add("X-Forwarded-For", header)
+			}
+			assert.Equal(t, tc.want, netutil.ClientIP(r, tc.trustedProxyCount))
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package netutil_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zlnvch/webverse/api/netutil"
+)
+
+func okHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+func request(handler http.HandlerFunc, remoteAddr string, forwardedFor string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/login", nil)
+	req.RemoteAddr = remoteAddr
+	if forwardedFor != "" {
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func TestIPRateLimiter_RejectsPastBurst(t *testing.T) {
+	limiter := netutil.NewIPRateLimiter(netutil.IPRateLimit{PerMinute: 6, Burst: 3}, 0)
+	handler := limiter.Middleware(okHandler)
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, request(handler, "203.0.113.7:1234", "").Code)
+	}
+	rec := request(handler, "203.0.113.7:5678", "")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "10", rec.Header().Get("Retry-After"))
+
+	// Other IPs have their own bucket
+	assert.Equal(t, http.StatusOK, request(handler, "203.0.113.8:1234", "").Code)
+}
+
+func TestIPRateLimiter_TrustedProxy(t *testing.T) {
+	limiter := netutil.NewIPRateLimiter(netutil.IPRateLimit{PerMinute: 60, Burst: 1}, 1)
+	handler := limiter.Middleware(okHandler)
+
+	// Every client comes through the same load balancer, but is limited by its forwarded IP
+	assert.Equal(t, http.StatusOK, request(handler, "10.0.0.1:1234", "203.0.113.7").Code)
+	assert.Equal(t, http.StatusOK, request(handler, "10.0.0.1:1234", "203.0.113.8").Code)
+	assert.Equal(t, http.StatusTooManyRequests, request(handler, "10.0.0.1:1234", "203.0.113.7").Code)
+
+	// Spoofed entries left of the trusted hop don't get a client a fresh bucket
+	assert.Equal(t, http.StatusTooManyRequests, request(handler, "10.0.0.1:1234", "1.2.3.4, 203.0.113.7").Code)
+}
+
+func TestIPRateLimiter_IPv6LimitedPer64(t *testing.T) {
+	limiter := netutil.NewIPRateLimiter(netutil.IPRateLimit{PerMinute: 60, Burst: 1}, 0)
+
+	assert.True(t, limiter.Allow("2001:db8:1:2::1"))
+	// Rotating addresses within the same /64 doesn't get a fresh bucket
+	assert.False(t, limiter.Allow("2001:db8:1:2:ffff::7"))
+	assert.True(t, limiter.Allow("2001:db8:1:3::1"))
+}
+
+func TestIPRateLimiter_DropsLeastRecentlySeenPastCap(t *testing.T) {
+	limiter := netutil.NewIPRateLimiter(netutil.IPRateLimit{PerMinute: 60, Burst: 1}, 0)
+
+	assert.True(t, limiter.Allow("203.0.113.7"))
+	assert.True(t, limiter.Allow("203.0.113.8"))
+	for i := range 100000 - 1 {
+		limiter.Allow(fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff))
+	}
+	// Still limited: one of the most recent IPs when the cap was reached
+	assert.False(t, limiter.Allow("10.0.0.0"))
+	// The least recently seen IP was dropped, so it starts over with a full bucket
+	assert.True(t, limiter.Allow("203.0.113.7"))
+}
+
+func TestIPRateLimiter_Disabled(t *testing.T) {
+	limiter := netutil.NewIPRateLimiter(netutil.IPRateLimit{}, 0)
+	handler := limiter.Middleware(okHandler)
+
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, http.StatusOK, request(handler, "203.0.113.7:1234", "").Code)
+	}
+}
+
+func TestIPRateLimit_Validate(t *testing.T) {
+	assert.NoError(t, netutil.IPRateLimit{}.Validate())
+	assert.NoError(t, netutil.IPRateLimit{PerMinute: 10, Burst: 5}.Validate())
+	assert.EqualError(t, netutil.IPRateLimit{PerMinute: -1}.Validate(), "ip rate limit must not be negative")
+	assert.EqualError(t, netutil.IPRateLimit{PerMinute: 10}.Validate(), "ip rate limit burst must be positive")
+}
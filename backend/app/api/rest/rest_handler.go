@@ -1,16 +1,25 @@
 package rest
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/zlnvch/webverse/models"
 	"github.com/zlnvch/webverse/service"
+	"github.com/zlnvch/webverse/store"
+	"golang.org/x/oauth2"
 )
 
 type Handler struct {
 	Service *service.Service
+	// Deadline for the service calls of a request, 0 disables it
+	RequestTimeout time.Duration
 }
 
 func NewHandler(svc *service.Service) *Handler {
@@ -47,10 +56,24 @@ func (h *Handler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, token, err := h.Service.Login(r.Context(), req.Provider, req.Code)
+	ctx, cancel := h.requestContext(r)
+	defer cancel()
+
+	user, token, err := h.Service.Login(ctx, req.Provider, req.Code)
+	if errors.Is(err, service.ErrEmailNotVerified) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if h.timedOut(w, ctx, err) {
+		log.Printf("Login timed out: %v", err)
+		return
+	}
 	if err != nil {
 		log.Printf("Login failed: %v", err)
-		http.Error(w, "login failed", http.StatusInternalServerError)
+		status, code := loginFailure(err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(loginErrorResponse{Error: "login failed", Code: code})
 		return
 	}
 
@@ -69,6 +92,37 @@ func (h *Handler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 	h.sendResponse(w, resp)
 }
 
+type loginErrorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// Codes of failed logins, so clients can tell a bad request from an outage worth retrying
+const (
+	loginCodeOAuthFailed = "OAUTH_FAILED"
+	loginCodeStoreFailed = "STORE_FAILED"
+	loginCodeTokenFailed = "TOKEN_FAILED"
+	loginCodeFailed      = "LOGIN_FAILED"
+)
+
+// loginFailure maps a Login error to its status and code
+func loginFailure(err error) (int, string) {
+	var retrieveErr *oauth2.RetrieveError
+	switch {
+	case errors.Is(err, service.ErrUnsupportedProvider), errors.As(err, &retrieveErr):
+		// The provider is unknown or rejected the code, retrying won't help
+		return http.StatusBadRequest, loginCodeOAuthFailed
+	case errors.Is(err, service.ErrOAuthFailed):
+		return http.StatusUnauthorized, loginCodeOAuthFailed
+	case errors.Is(err, service.ErrCreateUserFailed):
+		return http.StatusServiceUnavailable, loginCodeStoreFailed
+	case errors.Is(err, service.ErrTokenFailed):
+		return http.StatusInternalServerError, loginCodeTokenFailed
+	default:
+		return http.StatusInternalServerError, loginCodeFailed
+	}
+}
+
 type getUserResponse struct {
 	Username      string `json:"username"`
 	Id            string `json:"id"`
@@ -83,20 +137,26 @@ type getUserResponse struct {
 
 func (h *Handler) HandleMe(w http.ResponseWriter, r *http.Request) {
 	token := h.getTokenFromAuthHeader(r)
+	ctx, cancel := h.requestContext(r)
+	defer cancel()
+
 	switch r.Method {
 	case http.MethodGet:
-		h.handleGetUser(w, r, token)
+		h.handleGetUser(w, ctx, token)
 
 	case http.MethodDelete:
-		h.handleDeleteUser(w, r, token)
+		h.handleDeleteUser(w, ctx, token)
 
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func (h *Handler) handleGetUser(w http.ResponseWriter, r *http.Request, token string) {
-	user, err := h.Service.AuthenticateToken(r.Context(), token)
+func (h *Handler) handleGetUser(w http.ResponseWriter, ctx context.Context, token string) {
+	user, err := h.Service.AuthenticateToken(ctx, token)
+	if h.timedOut(w, ctx, err) {
+		return
+	}
 	if err != nil {
 		http.Error(w, "invalid token", http.StatusUnauthorized)
 		return
@@ -120,14 +180,21 @@ type deleteUserResponse struct {
 	Success bool `json:"success"`
 }
 
-func (h *Handler) handleDeleteUser(w http.ResponseWriter, r *http.Request, token string) {
-	user, err := h.Service.AuthenticateToken(r.Context(), token)
+func (h *Handler) handleDeleteUser(w http.ResponseWriter, ctx context.Context, token string) {
+	user, err := h.Service.AuthenticateToken(ctx, token)
+	if h.timedOut(w, ctx, err) {
+		return
+	}
 	if err != nil {
 		http.Error(w, "invalid token", http.StatusUnauthorized)
 		return
 	}
 
-	if err := h.Service.DeleteUser(r.Context(), user); err != nil {
+	err = h.Service.DeleteUser(ctx, user)
+	if h.timedOut(w, ctx, err) {
+		return
+	}
+	if err != nil {
 		http.Error(w, "failed to delete user", http.StatusInternalServerError)
 		return
 	}
@@ -138,7 +205,105 @@ func (h *Handler) handleDeleteUser(w http.ResponseWriter, r *http.Request, token
 	h.sendResponse(w, resp)
 }
 
-func (h *Handler) HandleEncryptionKeys(w http.ResponseWriter, r *http.Request) {
+type recentPage struct {
+	PageKey   string `json:"pageKey"`
+	LastDrawn int64  `json:"lastDrawn"`
+}
+
+type recentPagesResponse struct {
+	Pages []recentPage `json:"pages"`
+}
+
+func (h *Handler) HandleRecentPages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := h.getTokenFromAuthHeader(r)
+	user, err := h.Service.AuthenticateToken(r.Context(), token)
+	if err != nil {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	// Optional, defaults to the configured max
+	limit := 0
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	pages, err := h.Service.GetRecentPages(r.Context(), user, limit)
+	if err != nil {
+		log.Printf("Get recent pages failed: %v", err)
+		http.Error(w, "failed to get recent pages", http.StatusInternalServerError)
+		return
+	}
+
+	resp := recentPagesResponse{
+		Pages: make([]recentPage, 0, len(pages)),
+	}
+	for _, page := range pages {
+		resp.Pages = append(resp.Pages, recentPage{PageKey: page.PageKey, LastDrawn: page.LastDrawn})
+	}
+	h.sendResponse(w, resp)
+}
+
+type userPagesResponse struct {
+	Pages []string `json:"pages"`
+	// Empty after the last page of results
+	Cursor string `json:"cursor"`
+}
+
+// HandleUserPages lists the pages the user has drawn on, page by page
+func (h *Handler) HandleUserPages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := h.getTokenFromAuthHeader(r)
+	user, err := h.Service.AuthenticateToken(r.Context(), token)
+	if err != nil {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	// Optional, defaults to the service's page size
+	limit := 0
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	pages, cursor, err := h.Service.GetUserPages(r.Context(), user, limit, r.URL.Query().Get("cursor"))
+	if err != nil {
+		log.Printf("Get user pages failed: %v", err)
+		http.Error(w, "failed to get pages", http.StatusInternalServerError)
+		return
+	}
+
+	h.sendResponse(w, userPagesResponse{Pages: pages, Cursor: cursor})
+}
+
+type usageResponse struct {
+	StrokeCount    int   `json:"strokeCount"`
+	PageCount      int   `json:"pageCount"`
+	EstimatedBytes int64 `json:"estimatedBytes"`
+	Computed       int64 `json:"computed"`
+}
+
+func (h *Handler) HandleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
 	token := h.getTokenFromAuthHeader(r)
 	user, err := h.Service.AuthenticateToken(r.Context(), token)
 	if err != nil {
@@ -146,6 +311,35 @@ func (h *Handler) HandleEncryptionKeys(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	usage, err := h.Service.GetUsage(r.Context(), user)
+	if err != nil {
+		log.Printf("Get usage failed: %v", err)
+		http.Error(w, "failed to get usage", http.StatusInternalServerError)
+		return
+	}
+
+	h.sendResponse(w, usageResponse{
+		StrokeCount:    usage.StrokeCount,
+		PageCount:      usage.PageCount,
+		EstimatedBytes: usage.EstimatedBytes,
+		Computed:       usage.Computed,
+	})
+}
+
+func (h *Handler) HandleEncryptionKeys(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := h.requestContext(r)
+	defer cancel()
+
+	token := h.getTokenFromAuthHeader(r)
+	user, err := h.Service.AuthenticateToken(ctx, token)
+	if h.timedOut(w, ctx, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
 	switch r.Method {
 	case http.MethodPost, http.MethodPut:
 		var req encryptionKeysRequest
@@ -162,8 +356,17 @@ func (h *Handler) HandleEncryptionKeys(w http.ResponseWriter, r *http.Request) {
 			NonceDEK2:     req.NonceDEK2,
 		}
 
-		keyVersion, err := h.Service.SetEncryptionKeys(r.Context(), user, keys, r.Method == http.MethodPost)
+		keyVersion, err := h.Service.SetEncryptionKeys(ctx, user, keys, r.Method == http.MethodPost)
+		if h.timedOut(w, ctx, err) {
+			return
+		}
 		if err != nil {
+			// Keys the client got wrong are reported back, so it can tell which field to fix
+			var invalidKeyErr *service.InvalidKeyError
+			if errors.As(err, &invalidKeyErr) || errors.Is(err, service.ErrNoKeysToRotate) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 			log.Printf("Set encryption keys failed: %v", err)
 			http.Error(w, "failed to store encryption keys", http.StatusInternalServerError)
 			return
@@ -175,8 +378,53 @@ func (h *Handler) HandleEncryptionKeys(w http.ResponseWriter, r *http.Request) {
 		}
 		h.sendResponse(w, resp)
 
+	case http.MethodPatch:
+		// KEK-only rotation, e.g. after a password change: the data keys stay the same, re-wrapped with the new KEK
+		var req encryptionKeysRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		rewrappedDEKs := service.WrappedDEKs{
+			EncryptedDEK1: req.EncryptedDEK1,
+			NonceDEK1:     req.NonceDEK1,
+			EncryptedDEK2: req.EncryptedDEK2,
+			NonceDEK2:     req.NonceDEK2,
+		}
+
+		keyVersion, err := h.Service.RotateKEK(ctx, user, req.KeyVersion, req.SaltKEK, rewrappedDEKs)
+		if h.timedOut(w, ctx, err) {
+			return
+		}
+		if err != nil {
+			// The keys changed since the client read them, it must reload them before wrapping again
+			if errors.Is(err, service.ErrKeyVersionMismatch) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			var invalidKeyErr *service.InvalidKeyError
+			if errors.As(err, &invalidKeyErr) || errors.Is(err, service.ErrNoKeysToRotate) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("Rotate KEK failed: %v", err)
+			http.Error(w, "failed to store encryption keys", http.StatusInternalServerError)
+			return
+		}
+
+		resp := encryptionKeysResponse{
+			Success:    true,
+			KeyVersion: keyVersion,
+		}
+		h.sendResponse(w, resp)
+
 	case http.MethodDelete:
-		if err := h.Service.DeleteEncryptionKeys(r.Context(), user); err != nil {
+		err := h.Service.DeleteEncryptionKeys(ctx, user)
+		if h.timedOut(w, ctx, err) {
+			return
+		}
+		if err != nil {
 			http.Error(w, "failed to delete encryption keys", http.StatusInternalServerError)
 			return
 		}
@@ -190,12 +438,96 @@ func (h *Handler) HandleEncryptionKeys(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+type pageResponse struct {
+	PageKey string           `json:"pageKey"`
+	Layer   models.LayerType `json:"layer"`
+	Strokes []models.Stroke  `json:"strokes"`
+	// Display seed of each stroke author, by user id
+	DisplaySeeds map[string]uint32 `json:"displaySeeds"`
+}
+
+// HandlePage returns a page's strokes, like a websocket load
+// Responses carry an ETag so clients can skip re-downloading unchanged pages with If-None-Match
+func (h *Handler) HandlePage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := h.getTokenFromAuthHeader(r)
+	if _, err := h.Service.AuthenticateToken(r.Context(), token); err != nil {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	pageKey := r.URL.Query().Get("pageKey")
+	layer := models.LayerPublic
+	if l := r.URL.Query().Get("layer"); l != "" {
+		layerInt, err := strconv.Atoi(l)
+		if err != nil {
+			http.Error(w, "invalid layer", http.StatusBadRequest)
+			return
+		}
+		layer = models.LayerType(layerInt)
+	}
+	pageKey = h.Service.Config.PageKeyPolicy.NormalizePageKey(pageKey, layer == models.LayerPrivate)
+	if err := h.Service.CheckPageKey(pageKey, layer == models.LayerPrivate); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The tag is read before the strokes: if the page changes in between, the response
+	// carries an older tag than its content and the client simply downloads it again next time
+	tag, err := h.Service.GetPageVersionTag(r.Context(), pageKey, layer)
+	if err != nil {
+		log.Printf("Get page version tag failed: %v", err)
+		http.Error(w, "failed to load page", http.StatusInternalServerError)
+		return
+	}
+	etag := `"` + tag + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	strokes, err := h.Service.LoadPage(r.Context(), pageKey, layer)
+	if err != nil {
+		log.Printf("LoadPage failed: %v", err)
+		http.Error(w, "failed to load page", http.StatusInternalServerError)
+		return
+	}
+
+	resp := pageResponse{
+		PageKey:      pageKey,
+		Layer:        layer,
+		Strokes:      strokes,
+		DisplaySeeds: service.UserDisplaySeeds(strokes),
+	}
+	h.sendResponse(w, resp)
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, comparing weakly as RFC 9110 requires
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
 type encryptionKeysRequest struct {
 	SaltKEK       string `json:"saltKEK"`
 	EncryptedDEK1 string `json:"encryptedDEK1"`
 	NonceDEK1     string `json:"nonceDEK1"`
 	EncryptedDEK2 string `json:"encryptedDEK2"`
 	NonceDEK2     string `json:"nonceDEK2"`
+	// KeyVersion is the version the client unwrapped, required when rotating the KEK
+	KeyVersion int `json:"keyVersion"`
 }
 
 type encryptionKeysResponse struct {
@@ -207,11 +539,663 @@ type deleteEncryptionKeysResponse struct {
 	Success bool `json:"success"`
 }
 
-func (h *Handler) sendResponse(w http.ResponseWriter, resp any) {
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+type validateRequest struct {
+	PageKey string           `json:"pageKey"`
+	Layer   models.LayerType `json:"layer"`
+	Stroke  models.Stroke    `json:"stroke"`
+}
+
+type validateResponse struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Same limit as a websocket message
+const maxValidateBodySize = 1024 * 16
+
+// HandleValidate is a dry run of a draw: it only runs validation and never touches
+// the store, cache or quota, so it doesn't require authentication
+func (h *Handler) HandleValidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req validateRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxValidateBodySize)).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	resp := validateResponse{Success: true}
+	if err := h.Service.ValidateStroke(req.PageKey, req.Layer, req.Stroke.Content); err != nil {
+		resp.Success = false
+		resp.Error = err.Error()
+	}
+	h.sendResponse(w, resp)
+}
+
+type banRequest struct {
+	UserId string    `json:"userId"`
+	Until  time.Time `json:"until"`
+}
+
+type banResponse struct {
+	Success bool `json:"success"`
+}
+
+func (h *Handler) HandleAdminBan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := h.getTokenFromAuthHeader(r)
+	user, err := h.Service.AuthenticateToken(r.Context(), token)
+	if err != nil {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var req banRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.UserId == "" || !req.Until.After(time.Now()) {
+		http.Error(w, "userId and a future until are required", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.Service.BanUser(r.Context(), user, req.UserId, req.Until); err != nil {
+		if errors.Is(err, service.ErrNotAdmin) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		log.Printf("Ban user failed: %v", err)
+		http.Error(w, "failed to ban user", http.StatusInternalServerError)
+		return
+	}
+
+	resp := banResponse{
+		Success: true,
+	}
+	h.sendResponse(w, resp)
+}
+
+type adminUser struct {
+	Id          string `json:"id"`
+	Username    string `json:"username"`
+	Provider    string `json:"provider"`
+	ProviderId  string `json:"providerId"`
+	Created     int64  `json:"created"`
+	StrokeCount int    `json:"strokeCount"`
+}
+
+type adminUsersResponse struct {
+	Users []adminUser `json:"users"`
+	// Passed back as the cursor parameter for the next page, empty after the last one
+	Cursor string `json:"cursor"`
+}
+
+// HandleAdminUsers lists the users created between the from and to Unix timestamps, page by page
+func (h *Handler) HandleAdminUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := h.getTokenFromAuthHeader(r)
+	user, err := h.Service.AuthenticateToken(r.Context(), token)
+	if err != nil {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	from, err := strconv.ParseInt(query.Get("from"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid from", http.StatusBadRequest)
+		return
+	}
+	to, err := strconv.ParseInt(query.Get("to"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid to", http.StatusBadRequest)
+		return
+	}
+	// Optional, defaults to the largest page
+	limit := 0
+	if l := query.Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	users, cursor, err := h.Service.ListUsersCreatedBetween(r.Context(), user, from, to, limit, query.Get("cursor"))
+	if err != nil {
+		if errors.Is(err, service.ErrNotAdmin) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, store.ErrInvalidCursor) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("List users failed: %v", err)
+		http.Error(w, "failed to list users", http.StatusInternalServerError)
+		return
+	}
+
+	resp := adminUsersResponse{
+		Users:  make([]adminUser, 0, len(users)),
+		Cursor: cursor,
+	}
+	for _, u := range users {
+		resp.Users = append(resp.Users, adminUser{
+			Id:          u.Id,
+			Username:    u.Username,
+			Provider:    u.Provider,
+			ProviderId:  u.ProviderId,
+			Created:     u.Created,
+			StrokeCount: u.StrokeCount,
+		})
+	}
+	h.sendResponse(w, resp)
+}
+
+type strokeAuthor struct {
+	Id         string `json:"id"`
+	Username   string `json:"username"`
+	Provider   string `json:"provider"`
+	ProviderId string `json:"providerId"`
+}
+
+type adminStrokeResponse struct {
+	Stroke models.Stroke `json:"stroke"`
+	// Null if the author's account was deleted
+	Author *strokeAuthor `json:"author"`
+}
+
+// HandleAdminStroke looks up a stroke on a page and the user who drew it
+func (h *Handler) HandleAdminStroke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := h.getTokenFromAuthHeader(r)
+	user, err := h.Service.AuthenticateToken(r.Context(), token)
+	if err != nil {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	pageKey, strokeId := query.Get("page"), query.Get("id")
+	if pageKey == "" || strokeId == "" {
+		http.Error(w, "page and id are required", http.StatusBadRequest)
+		return
+	}
+	pageKey = h.Service.Config.PageKeyPolicy.NormalizePageKey(pageKey, false)
+	if err := h.Service.Config.PageKeyPolicy.ValidatePageKey(pageKey, false); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stroke, author, err := h.Service.GetStrokeOwner(r.Context(), user, pageKey, strokeId)
+	if err != nil {
+		if errors.Is(err, service.ErrNotAdmin) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, service.ErrStrokeNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Printf("Get stroke owner failed: %v", err)
+		http.Error(w, "failed to get stroke", http.StatusInternalServerError)
+		return
+	}
+
+	resp := adminStrokeResponse{Stroke: stroke}
+	if author != nil {
+		resp.Author = &strokeAuthor{
+			Id:         author.Id,
+			Username:   author.Username,
+			Provider:   author.Provider,
+			ProviderId: author.ProviderId,
+		}
+	}
+	h.sendResponse(w, resp)
+}
+
+type strokeHiddenResponse struct {
+	Success bool `json:"success"`
+}
+
+// HandleAdminStrokeHidden hides a stroke pending review with hidden=true, or restores it with hidden=false
+func (h *Handler) HandleAdminStrokeHidden(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := h.getTokenFromAuthHeader(r)
+	user, err := h.Service.AuthenticateToken(r.Context(), token)
+	if err != nil {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	pageKey, strokeId := query.Get("page"), query.Get("id")
+	if pageKey == "" || strokeId == "" {
+		http.Error(w, "page and id are required", http.StatusBadRequest)
+		return
+	}
+	hidden, err := strconv.ParseBool(query.Get("hidden"))
+	if err != nil {
+		http.Error(w, "invalid hidden", http.StatusBadRequest)
+		return
+	}
+	pageKey = h.Service.Config.PageKeyPolicy.NormalizePageKey(pageKey, false)
+	if err := h.Service.Config.PageKeyPolicy.ValidatePageKey(pageKey, false); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.Service.SetStrokeHidden(r.Context(), user, pageKey, strokeId, hidden); err != nil {
+		if errors.Is(err, service.ErrNotAdmin) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, service.ErrStrokeNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Printf("Set stroke hidden failed: %v", err)
+		http.Error(w, "failed to set stroke hidden", http.StatusInternalServerError)
+		return
+	}
+
+	resp := strokeHiddenResponse{
+		Success: true,
+	}
+	h.sendResponse(w, resp)
+}
+
+// HandleAdminPage returns a public page's strokes from the store, including hidden ones
+func (h *Handler) HandleAdminPage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := h.getTokenFromAuthHeader(r)
+	user, err := h.Service.AuthenticateToken(r.Context(), token)
+	if err != nil {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	pageKey := r.URL.Query().Get("key")
+	pageKey = h.Service.Config.PageKeyPolicy.NormalizePageKey(pageKey, false)
+	if err := h.Service.Config.PageKeyPolicy.ValidatePageKey(pageKey, false); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	strokes, err := h.Service.LoadPageAdmin(r.Context(), user, pageKey)
+	if err != nil {
+		if errors.Is(err, service.ErrNotAdmin) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		log.Printf("Admin load page failed: %v", err)
+		http.Error(w, "failed to load page", http.StatusInternalServerError)
+		return
+	}
+
+	resp := pageResponse{
+		PageKey:      pageKey,
+		Layer:        models.LayerPublic,
+		Strokes:      strokes,
+		DisplaySeeds: service.UserDisplaySeeds(strokes),
+	}
+	h.sendResponse(w, resp)
+}
+
+type invalidateResponse struct {
+	Success bool `json:"success"`
+}
+
+// HandleAdminInvalidate drops the page given by key from the cache, so its next load reads the store,
+// e.g. after its strokes were edited there directly, and tells its live clients to reload it
+func (h *Handler) HandleAdminInvalidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := h.getTokenFromAuthHeader(r)
+	user, err := h.Service.AuthenticateToken(r.Context(), token)
+	if err != nil {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	// EvictPage leaves authorization to its callers
+	if !h.Service.IsAdmin(user) {
+		http.Error(w, service.ErrNotAdmin.Error(), http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	pageKey := query.Get("key")
+	layer := models.LayerPublic
+	if l := query.Get("layer"); l != "" {
+		layerInt, err := strconv.Atoi(l)
+		if err != nil {
+			http.Error(w, "invalid layer", http.StatusBadRequest)
+			return
+		}
+		layer = models.LayerType(layerInt)
+	}
+	pageKey = h.Service.Config.PageKeyPolicy.NormalizePageKey(pageKey, layer == models.LayerPrivate)
+	if err := h.Service.Config.PageKeyPolicy.ValidatePageKey(pageKey, layer == models.LayerPrivate); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.Service.EvictPage(r.Context(), pageKey); err != nil {
+		log.Printf("Invalidate page failed: %v", err)
+		http.Error(w, "failed to invalidate page", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Admin %s invalidated page %s", user.Id, pageKey)
+
+	resp := invalidateResponse{
+		Success: true,
+	}
+	h.sendResponse(w, resp)
+}
+
+type pageSettingsResponse struct {
+	Success bool `json:"success"`
+}
+
+// HandleAdminPageSettings overrides the stroke limits of the public page given by key
+// The body is the page's settings, zero fields restore the global limits
+func (h *Handler) HandleAdminPageSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := h.getTokenFromAuthHeader(r)
+	user, err := h.Service.AuthenticateToken(r.Context(), token)
+	if err != nil {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	pageKey := r.URL.Query().Get("key")
+	pageKey = h.Service.Config.PageKeyPolicy.NormalizePageKey(pageKey, false)
+	if err := h.Service.Config.PageKeyPolicy.ValidatePageKey(pageKey, false); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var settings models.PageSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := h.Service.Config.StrokeLimits.ValidatePageSettings(settings); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.Service.SetPageSettings(r.Context(), user, pageKey, settings); err != nil {
+		if errors.Is(err, service.ErrNotAdmin) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		log.Printf("Set page settings failed: %v", err)
+		http.Error(w, "failed to set page settings", http.StatusInternalServerError)
+		return
+	}
+
+	resp := pageSettingsResponse{
+		Success: true,
+	}
+	h.sendResponse(w, resp)
+}
+
+type pausePageResponse struct {
+	Success bool `json:"success"`
+	// Unix milliseconds the pause ends at, only set when pausing
+	Until int64 `json:"until,omitempty"`
+}
+
+// HandleAdminPause freezes drawing on the page given by key with POST, for seconds (default 10 minutes,
+// at most 24 hours), and lifts the pause early with DELETE. Live clients are told either way
+func (h *Handler) HandleAdminPause(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := h.getTokenFromAuthHeader(r)
+	user, err := h.Service.AuthenticateToken(r.Context(), token)
+	if err != nil {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	// Checked before the key, so non-admins can't probe key validation
+	if !h.Service.IsAdmin(user) {
+		http.Error(w, service.ErrNotAdmin.Error(), http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	layer := models.LayerPublic
+	if l := query.Get("layer"); l != "" {
+		layerInt, err := strconv.Atoi(l)
+		if err != nil {
+			http.Error(w, "invalid layer", http.StatusBadRequest)
+			return
+		}
+		layer = models.LayerType(layerInt)
+	}
+	pageKey := h.Service.Config.PageKeyPolicy.NormalizePageKey(query.Get("key"), layer == models.LayerPrivate)
+	if err := h.Service.Config.PageKeyPolicy.ValidatePageKey(pageKey, layer == models.LayerPrivate); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := h.Service.ResumePage(r.Context(), user, pageKey, layer); err != nil {
+			log.Printf("Resume page failed: %v", err)
+			http.Error(w, "failed to resume page", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Admin %s resumed page %s", user.Id, pageKey)
+		h.sendResponse(w, pausePageResponse{Success: true})
+		return
+	}
+
+	var duration time.Duration
+	if s := query.Get("seconds"); s != "" {
+		seconds, err := strconv.Atoi(s)
+		if err != nil || seconds <= 0 {
+			http.Error(w, "invalid seconds", http.StatusBadRequest)
+			return
+		}
+		duration = time.Duration(seconds) * time.Second
+	}
+
+	until, err := h.Service.PausePage(r.Context(), user, pageKey, layer, duration)
+	if err != nil {
+		log.Printf("Pause page failed: %v", err)
+		http.Error(w, "failed to pause page", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Admin %s paused page %s until %v", user.Id, pageKey, until)
+
+	resp := pausePageResponse{
+		Success: true,
+		Until:   until.UnixMilli(),
+	}
+	h.sendResponse(w, resp)
+}
+
+type clearPageResponse struct {
+	Deleted int `json:"deleted"`
+}
+
+// HandleAdminClear deletes all public strokes of the page given by key, e.g. after vandalism
+// Live clients are told to reload the page, private layer strokes are left alone
+func (h *Handler) HandleAdminClear(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := h.getTokenFromAuthHeader(r)
+	user, err := h.Service.AuthenticateToken(r.Context(), token)
+	if err != nil {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	// Checked before the key, so non-admins can't probe key validation
+	if !h.Service.IsAdmin(user) {
+		http.Error(w, service.ErrNotAdmin.Error(), http.StatusForbidden)
+		return
+	}
+
+	pageKey := h.Service.Config.PageKeyPolicy.NormalizePageKey(r.URL.Query().Get("key"), false)
+	if err := h.Service.Config.PageKeyPolicy.ValidatePageKey(pageKey, false); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := h.Service.ClearPage(r.Context(), user, pageKey)
+	if err != nil {
+		log.Printf("Clear page failed after deleting %d strokes: %v", deleted, err)
+		http.Error(w, "failed to clear page", http.StatusInternalServerError)
+		return
+	}
+
+	resp := clearPageResponse{
+		Deleted: deleted,
+	}
+	h.sendResponse(w, resp)
+}
+
+type deleteUsersRequest struct {
+	Users []userIdentity `json:"users"`
+}
+
+type userIdentity struct {
+	Provider   string `json:"provider"`
+	ProviderId string `json:"providerId"`
+}
+
+type deleteUsersResponse struct {
+	Deleted int                  `json:"deleted"`
+	Failed  int                  `json:"failed"`
+	Results []userDeletionResult `json:"results"`
+}
+
+type userDeletionResult struct {
+	Provider   string `json:"provider"`
+	ProviderId string `json:"providerId"`
+	Success    bool   `json:"success"`
+	Error      string `json:"error,omitempty"`
+}
+
+// HandleAdminDeleteUsers deletes a batch of users, partial failures are reported per user with a 200
+func (h *Handler) HandleAdminDeleteUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := h.getTokenFromAuthHeader(r)
+	user, err := h.Service.AuthenticateToken(r.Context(), token)
+	if err != nil {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var req deleteUsersRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	identities := make([]service.UserIdentity, 0, len(req.Users))
+	for _, u := range req.Users {
+		identities = append(identities, service.UserIdentity{Provider: u.Provider, ProviderId: u.ProviderId})
+	}
+
+	results, err := h.Service.DeleteUsers(r.Context(), user, identities)
+	if err != nil {
+		if errors.Is(err, service.ErrNotAdmin) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		// Only request validation fails the whole batch
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := deleteUsersResponse{
+		Results: make([]userDeletionResult, 0, len(results)),
+	}
+	for _, result := range results {
+		if result.Error == "" {
+			resp.Deleted++
+		} else {
+			resp.Failed++
+		}
+		resp.Results = append(resp.Results, userDeletionResult{
+			Provider:   result.Provider,
+			ProviderId: result.ProviderId,
+			Success:    result.Error == "",
+			Error:      result.Error,
+		})
+	}
+	h.sendResponse(w, resp)
+}
+
+func (h *Handler) sendResponse(w http.ResponseWriter, resp any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+	}
+}
+
+// requestContext bounds the request's service calls by RequestTimeout
+func (h *Handler) requestContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if h.RequestTimeout <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	return context.WithTimeout(r.Context(), h.RequestTimeout)
+}
+
+// timedOut responds with 504 if err is from the request running out of time
+// Not every client library wraps the context's error, so the context itself is checked too
+func (h *Handler) timedOut(w http.ResponseWriter, ctx context.Context, err error) bool {
+	if err == nil {
+		return false
+	}
+	if !errors.Is(err, context.DeadlineExceeded) && ctx.Err() != context.DeadlineExceeded {
+		return false
 	}
+	http.Error(w, "request timed out", http.StatusGatewayTimeout)
+	return true
 }
 
 func (h *Handler) getTokenFromAuthHeader(r *http.Request) string {
@@ -0,0 +1,629 @@
+package rest_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/zlnvch/webverse/api/rest"
+	cachemocks "github.com/zlnvch/webverse/cache/mocks"
+	"github.com/zlnvch/webverse/models"
+	mqmocks "github.com/zlnvch/webverse/mq/mocks"
+	"github.com/zlnvch/webverse/service"
+	"github.com/zlnvch/webverse/store"
+	storemocks "github.com/zlnvch/webverse/store/mocks"
+	"github.com/zlnvch/webverse/worker"
+	"golang.org/x/oauth2"
+)
+
+func setupHandler(t *testing.T) (*rest.Handler, *storemocks.MockStore, *cachemocks.MockCache) {
+	mockStore := new(storemocks.MockStore)
+	mockCache := new(cachemocks.MockCache)
+
+	counterBatcher := worker.NewCounterBatcher(mockStore, 1000, worker.DefaultCounterFlushUsers)
+	strokeBatcher := worker.NewStrokeBatcher(mockStore, 1000, worker.DefaultStrokeBufferSize, counterBatcher, nil)
+
+	svc, err := service.NewService(
+		mockStore,
+		mockCache,
+		new(mqmocks.MockMQ),
+		strokeBatcher,
+		counterBatcher,
+		nil,
+		[][]byte{[]byte("secret")},
+		service.DefaultConfig(),
+	)
+	assert.NoError(t, err)
+
+	return rest.NewHandler(svc), mockStore, mockCache
+}
+
+// Helper that returns a valid token for a user the store knows about
+func authenticate(t *testing.T, handler *rest.Handler, mockStore *storemocks.MockStore) string {
+	user := models.User{Id: "user1", Provider: "github", ProviderId: "123"}
+	token, err := handler.Service.CreateJWT(user.Id, user.Provider, user.ProviderId)
+	assert.NoError(t, err)
+	mockStore.On("GetUser", mock.Anything, user.Provider, user.ProviderId).Return(user, nil)
+	return token
+}
+
+func TestHandlePage_ReturnsStrokesWithETag(t *testing.T) {
+	handler, mockStore, mockCache := setupHandler(t)
+	token := authenticate(t, handler, mockStore)
+
+	stroke := models.Stroke{Id: "018e38d7-0000-7000-8000-000000000000", UserId: "user2", Content: []byte("data")}
+	strokeBytes, _ := json.Marshal(stroke)
+	mockCache.On("IsPageComplete", mock.Anything, "example.com").Return(true, nil)
+	mockCache.On("GetPageVersionTag", mock.Anything, "example.com").Return("v2", nil)
+	mockCache.On("GetStrokes", mock.Anything, "example.com").Return([][]byte{strokeBytes}, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/page?pageKey=example.com", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("If-None-Match", `"v1"`)
+	rec := httptest.NewRecorder()
+	handler.HandlePage(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `"v2"`, rec.Header().Get("ETag"))
+
+	var resp struct {
+		Strokes []models.Stroke `json:"strokes"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, []models.Stroke{stroke}, resp.Strokes)
+}
+
+func TestHandlePage_MatchingETagNotModified(t *testing.T) {
+	handler, mockStore, mockCache := setupHandler(t)
+	token := authenticate(t, handler, mockStore)
+
+	mockCache.On("IsPageComplete", mock.Anything, "example.com").Return(true, nil)
+	mockCache.On("GetPageVersionTag", mock.Anything, "example.com").Return("v1", nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/page?pageKey=example.com", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("If-None-Match", `"v0", W/"v1"`)
+	rec := httptest.NewRecorder()
+	handler.HandlePage(rec, req)
+
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Equal(t, `"v1"`, rec.Header().Get("ETag"))
+	assert.Empty(t, rec.Body.Bytes())
+	mockCache.AssertNotCalled(t, "GetStrokes", mock.Anything, mock.Anything)
+}
+
+func TestHandlePage_LoadsUncachedPageBeforeTagging(t *testing.T) {
+	handler, mockStore, mockCache := setupHandler(t)
+	token := authenticate(t, handler, mockStore)
+
+	// Not in the cache yet: the tag is only derived once the page is loaded
+	mockCache.On("IsPageComplete", mock.Anything, "example.com").Return(false, nil)
+	mockCache.On("GetStrokes", mock.Anything, "example.com").Return([][]byte{}, nil)
+	mockStore.On("GetVisibleStrokeRecords", mock.Anything, "example.com", mock.Anything).Return([]models.Stroke{}, nil)
+	mockCache.On("SetPageComplete", mock.Anything, "example.com").Return(nil)
+	mockCache.On("GetPageVersionTag", mock.Anything, "example.com").Return("empty", nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/page?pageKey=example.com", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("If-None-Match", `"empty"`)
+	rec := httptest.NewRecorder()
+	handler.HandlePage(rec, req)
+
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	mockCache.AssertCalled(t, "SetPageComplete", mock.Anything, "example.com")
+}
+
+func TestHandlePage_Unauthenticated(t *testing.T) {
+	handler, _, mockCache := setupHandler(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/page?pageKey=example.com", nil)
+	rec := httptest.NewRecorder()
+	handler.HandlePage(rec, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	mockCache.AssertNotCalled(t, "GetPageVersionTag", mock.Anything, mock.Anything)
+}
+
+func TestHandlePage_InvalidPageKey(t *testing.T) {
+	handler, mockStore, _ := setupHandler(t)
+	token := authenticate(t, handler, mockStore)
+
+	req := httptest.NewRequest(http.MethodGet, "/page?pageKey=https://example.com", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	handler.HandlePage(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestHandleUserPages_Paginated(t *testing.T) {
+	handler, mockStore, mockCache := setupHandler(t)
+	token := authenticate(t, handler, mockStore)
+
+	mockCache.On("GetUserPages", mock.Anything, "user1").Return([]string{"b.com", "a.com", "c.com"}, true, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/me/pages?limit=2&cursor=a.com", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	handler.HandleUserPages(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var resp struct {
+		Pages  []string `json:"pages"`
+		Cursor string   `json:"cursor"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, []string{"b.com", "c.com"}, resp.Pages)
+	assert.Empty(t, resp.Cursor)
+}
+
+func TestHandleAdminDeleteUsers_PartialFailure(t *testing.T) {
+	handler, mockStore, mockCache := setupHandler(t)
+	token := authenticate(t, handler, mockStore)
+	handler.Service.Config.AdminUserIds = []string{"user1"}
+	mockMQ := handler.Service.MQ.(*mqmocks.MockMQ)
+
+	mockStore.On("GetUser", mock.Anything, "google", "1").Return(models.User{Id: "user2", Provider: "google", ProviderId: "1"}, nil)
+	mockStore.On("GetUser", mock.Anything, "google", "2").Return(models.User{Id: "user3", Provider: "google", ProviderId: "2"}, nil)
+	mockStore.On("DeleteUser", mock.Anything, "google", "1").Return(nil)
+	mockStore.On("DeleteUser", mock.Anything, "google", "2").Return(errors.New("dynamodb unavailable"))
+	mockCache.On("ClearRecentPages", mock.Anything, mock.Anything).Return(nil).Maybe()
+	mockCache.On("Publish", mock.Anything, "user-deleted", mock.Anything).Return(nil).Maybe()
+	mockMQ.On("Send", mock.Anything, mock.Anything).Return(nil).Maybe()
+
+	body := `{"users":[{"provider":"google","providerId":"1"},{"provider":"google","providerId":"2"}]}`
+	req := httptest.NewRequest(http.MethodPost, "/admin/delete-users", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	handler.HandleAdminDeleteUsers(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{
+		"deleted": 1,
+		"failed": 1,
+		"results": [
+			{"provider": "google", "providerId": "1", "success": true},
+			{"provider": "google", "providerId": "2", "success": false, "error": "dynamodb unavailable"}
+		]
+	}`, rec.Body.String())
+}
+
+func TestHandleAdminInvalidate_InvalidatesAndBroadcasts(t *testing.T) {
+	handler, mockStore, mockCache := setupHandler(t)
+	token := authenticate(t, handler, mockStore)
+	handler.Service.Config.AdminUserIds = []string{"user1"}
+
+	mockCache.On("InvalidatePages", mock.Anything, []string{"example.com"}).Return(nil).Once()
+	published := make(chan []byte, 1)
+	mockCache.On("Publish", mock.Anything, "page:example.com", mock.Anything).Run(func(args mock.Arguments) {
+		published <- args.Get(2).([]byte)
+	}).Return(nil).Once()
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/invalidate?key=example.com", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	handler.HandleAdminInvalidate(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	mockCache.AssertCalled(t, "InvalidatePages", mock.Anything, []string{"example.com"})
+	select {
+	case msg := <-published:
+		assert.JSONEq(t, `{"type":"page_evicted","data":{"pageKey":"example.com","layer":0}}`, string(msg))
+	case <-time.After(1 * time.Second):
+		t.Fatal("page_evicted was not published")
+	}
+}
+
+func TestHandleAdminInvalidate_Rejected(t *testing.T) {
+	for _, tc := range []struct {
+		name, key  string
+		admin      bool
+		wantStatus int
+	}{
+		{"not admin", "example.com", false, http.StatusForbidden},
+		// Admin is checked first, so non-admins can't probe key validation
+		{"not admin with invalid key", "https://example.com", false, http.StatusForbidden},
+		{"invalid key", "https://example.com", true, http.StatusBadRequest},
+		{"missing key", "", true, http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			handler, mockStore, mockCache := setupHandler(t)
+			token := authenticate(t, handler, mockStore)
+			if tc.admin {
+				handler.Service.Config.AdminUserIds = []string{"user1"}
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/admin/invalidate?key="+url.QueryEscape(tc.key), nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			handler.HandleAdminInvalidate(rec, req)
+
+			assert.Equal(t, tc.wantStatus, rec.Code)
+			mockCache.AssertNotCalled(t, "InvalidatePages", mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestHandleAdminPause_PausesAndResumes(t *testing.T) {
+	handler, mockStore, mockCache := setupHandler(t)
+	token := authenticate(t, handler, mockStore)
+	handler.Service.Config.AdminUserIds = []string{"user1"}
+
+	published := make(chan []byte, 2)
+	mockCache.On("Publish", mock.Anything, "page:example.com", mock.Anything).Run(func(args mock.Arguments) {
+		published <- args.Get(2).([]byte)
+	}).Return(nil)
+	mockCache.On("SetPagePaused", mock.Anything, "example.com", 5*time.Minute).Return(nil).Once()
+	mockCache.On("ClearPagePaused", mock.Anything, "example.com").Return(nil).Once()
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/pause?key=example.com&seconds=300", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	handler.HandleAdminPause(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var resp struct {
+		Success bool  `json:"success"`
+		Until   int64 `json:"until"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.True(t, resp.Success)
+	assert.InDelta(t, time.Now().Add(5*time.Minute).UnixMilli(), resp.Until, 5000)
+	select {
+	case msg := <-published:
+		assert.Contains(t, string(msg), `"type":"page_paused"`)
+	case <-time.After(1 * time.Second):
+		t.Fatal("page_paused was not published")
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/admin/pause?key=example.com", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec = httptest.NewRecorder()
+	handler.HandleAdminPause(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	select {
+	case msg := <-published:
+		assert.Contains(t, string(msg), `"type":"page_resumed"`)
+	case <-time.After(1 * time.Second):
+		t.Fatal("page_resumed was not published")
+	}
+	mockCache.AssertExpectations(t)
+}
+
+func TestHandleAdminPause_Rejected(t *testing.T) {
+	for _, tc := range []struct {
+		name, method, query string
+		admin               bool
+		wantStatus          int
+	}{
+		{"not admin", http.MethodPost, "key=example.com", false, http.StatusForbidden},
+		{"not admin resuming", http.MethodDelete, "key=example.com", false, http.StatusForbidden},
+		{"invalid key", http.MethodPost, "key=" + url.QueryEscape("https://example.com"), true, http.StatusBadRequest},
+		{"invalid seconds", http.MethodPost, "key=example.com&seconds=-5", true, http.StatusBadRequest},
+		{"wrong method", http.MethodGet, "key=example.com", true, http.StatusMethodNotAllowed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			handler, mockStore, mockCache := setupHandler(t)
+			token := authenticate(t, handler, mockStore)
+			if tc.admin {
+				handler.Service.Config.AdminUserIds = []string{"user1"}
+			}
+
+			req := httptest.NewRequest(tc.method, "/admin/pause?"+tc.query, nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			handler.HandleAdminPause(rec, req)
+
+			assert.Equal(t, tc.wantStatus, rec.Code)
+			mockCache.AssertNotCalled(t, "SetPagePaused", mock.Anything, mock.Anything, mock.Anything)
+			mockCache.AssertNotCalled(t, "ClearPagePaused", mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestHandleAdminClear_DeletesPublicStrokes(t *testing.T) {
+	handler, mockStore, mockCache := setupHandler(t)
+	token := authenticate(t, handler, mockStore)
+	handler.Service.Config.AdminUserIds = []string{"user1"}
+
+	mockStore.On("DeletePageStrokesByLayer", mock.Anything, "example.com", "Public").Return(map[string]int{"author1": 2, "author2": 1}, nil).Once()
+	mockCache.On("InvalidatePages", mock.Anything, []string{"example.com"}).Return(nil).Once()
+	mockCache.On("InvalidateUserPages", mock.Anything, mock.Anything, "").Return(nil)
+	mockCache.On("AddUserStrokeCount", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockStore.On("GetUserById", mock.Anything, mock.Anything).Return(models.User{Provider: "github", ProviderId: "123"}, nil)
+	mockCache.On("Publish", mock.Anything, "page:example.com", mock.Anything).Return(nil).Maybe()
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/clear?key=example.com", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	handler.HandleAdminClear(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"deleted":3}`, rec.Body.String())
+	mockStore.AssertExpectations(t)
+	mockCache.AssertCalled(t, "InvalidatePages", mock.Anything, []string{"example.com"})
+}
+
+func TestHandleAdminClear_Rejected(t *testing.T) {
+	for _, tc := range []struct {
+		name, key  string
+		admin      bool
+		wantStatus int
+	}{
+		{"not admin", "example.com", false, http.StatusForbidden},
+		{"not admin with invalid key", "https://example.com", false, http.StatusForbidden},
+		{"invalid key", "https://example.com", true, http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			handler, mockStore, _ := setupHandler(t)
+			token := authenticate(t, handler, mockStore)
+			if tc.admin {
+				handler.Service.Config.AdminUserIds = []string{"user1"}
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/admin/clear?key="+url.QueryEscape(tc.key), nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			handler.HandleAdminClear(rec, req)
+
+			assert.Equal(t, tc.wantStatus, rec.Code)
+			mockStore.AssertNotCalled(t, "DeletePageStrokesByLayer", mock.Anything, mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestHandleAdminPageSettings(t *testing.T) {
+	handler, mockStore, mockCache := setupHandler(t)
+	token := authenticate(t, handler, mockStore)
+	handler.Service.Config.AdminUserIds = []string{"user1"}
+
+	settings := models.PageSettings{MaxWidth: 3, MaxPoints: 1500}
+	mockStore.On("SetPageSettings", mock.Anything, "example.com", settings).Return(nil).Once()
+	mockCache.On("SetPageSettings", mock.Anything, "example.com", settings, mock.Anything).Return(nil).Once()
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/page-settings?key=example.com", strings.NewReader(`{"maxWidth":3,"maxPoints":1500}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	handler.HandleAdminPageSettings(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	mockStore.AssertExpectations(t)
+	mockCache.AssertExpectations(t)
+}
+
+func TestHandleAdminPageSettings_Rejected(t *testing.T) {
+	for _, tc := range []struct {
+		name, key, body string
+		admin           bool
+		wantStatus      int
+	}{
+		{"not admin", "example.com", `{"maxWidth":3}`, false, http.StatusForbidden},
+		{"invalid key", "https://example.com", `{"maxWidth":3}`, true, http.StatusBadRequest},
+		{"invalid body", "example.com", `{bad}`, true, http.StatusBadRequest},
+		{"invalid settings", "example.com", `{"maxPoints":-1}`, true, http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			handler, mockStore, _ := setupHandler(t)
+			token := authenticate(t, handler, mockStore)
+			if tc.admin {
+				handler.Service.Config.AdminUserIds = []string{"user1"}
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/admin/page-settings?key="+url.QueryEscape(tc.key), strings.NewReader(tc.body))
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			handler.HandleAdminPageSettings(rec, req)
+
+			assert.Equal(t, tc.wantStatus, rec.Code)
+			mockStore.AssertNotCalled(t, "SetPageSettings", mock.Anything, mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestHandleAdminDeleteUsers_NotAdmin(t *testing.T) {
+	handler, mockStore, _ := setupHandler(t)
+	token := authenticate(t, handler, mockStore)
+
+	body := `{"users":[{"provider":"google","providerId":"1"}]}`
+	req := httptest.NewRequest(http.MethodPost, "/admin/delete-users", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	handler.HandleAdminDeleteUsers(rec, req)
+
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	mockStore.AssertNotCalled(t, "DeleteUser", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestHandleLogin_SlowOAuthProviderTimesOut(t *testing.T) {
+	handler, mockStore, _ := setupHandler(t)
+	handler.RequestTimeout = 50 * time.Millisecond
+
+	// Never answers the token exchange before the request gives up
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	t.Cleanup(server.Close)
+	handler.Service.OAuthConfigs = map[string]service.OAuthConfig{
+		"github": {
+			Config: &oauth2.Config{Endpoint: oauth2.Endpoint{AuthURL: server.URL + "/auth", TokenURL: server.URL + "/token"}},
+		},
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"provider":"github","code":"code"}`))
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	handler.HandleLogin(rec, req)
+
+	assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+	assert.Less(t, time.Since(start), 2*time.Second)
+	mockStore.AssertNotCalled(t, "CreateUser", mock.Anything, mock.Anything)
+}
+
+func TestHandleLogin_FailureStatusAndCode(t *testing.T) {
+	// Rejects the code "bad", and any user info request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/token":
+			r.ParseForm()
+			if r.Form.Get("code") == "bad" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"bad_verification_code"}`))
+				return
+			}
+			w.Write([]byte(`{"access_token":"access","token_type":"bearer"}`))
+		case "/userinfo-ok":
+			w.Write([]byte(`{"login":"alice","id":42}`))
+		default:
+			w.Write([]byte(`not json`))
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	for _, tc := range []struct {
+		name, provider, code, userInfoPath string
+		storeErr                           error
+		wantStatus                         int
+		wantCode                           string
+	}{
+		{"unsupported provider", "myspace", "code", "/userinfo-ok", nil, http.StatusBadRequest, "OAUTH_FAILED"},
+		{"rejected code", "github", "bad", "/userinfo-ok", nil, http.StatusBadRequest, "OAUTH_FAILED"},
+		{"bad user info", "github", "code", "/userinfo-bad", nil, http.StatusUnauthorized, "OAUTH_FAILED"},
+		{"store down", "github", "code", "/userinfo-ok", errors.New("dynamodb unavailable"), http.StatusServiceUnavailable, "STORE_FAILED"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			handler, mockStore, _ := setupHandler(t)
+			handler.Service.OAuthConfigs = map[string]service.OAuthConfig{
+				"github": {
+					Config:      &oauth2.Config{Endpoint: oauth2.Endpoint{AuthURL: server.URL + "/auth", TokenURL: server.URL + "/token"}},
+					UserInfoURL: server.URL + tc.userInfoPath,
+				},
+			}
+			mockStore.On("CreateUser", mock.Anything, mock.Anything).Return(models.User{}, tc.storeErr)
+
+			body, _ := json.Marshal(map[string]string{"provider": tc.provider, "code": tc.code})
+			req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(string(body)))
+			rec := httptest.NewRecorder()
+			handler.HandleLogin(rec, req)
+
+			assert.Equal(t, tc.wantStatus, rec.Code)
+			var resp struct {
+				Error string `json:"error"`
+				Code  string `json:"code"`
+			}
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+			assert.Equal(t, "login failed", resp.Error)
+			assert.Equal(t, tc.wantCode, resp.Code)
+		})
+	}
+}
+
+// Valid keys for the default 192-bit nonces, with one field replaced by the caller
+func encryptionKeysBody(field string, value string) string {
+	keys := map[string]string{
+		"saltKEK":       "salt",
+		"encryptedDEK1": strings.Repeat("A", 64),
+		"nonceDEK1":     strings.Repeat("A", 32),
+		"encryptedDEK2": strings.Repeat("A", 64),
+		"nonceDEK2":     strings.Repeat("A", 32),
+	}
+	if field != "" {
+		keys[field] = value
+	}
+	body, _ := json.Marshal(keys)
+	return string(body)
+}
+
+func TestHandleEncryptionKeys_InvalidKeysAreBadRequest(t *testing.T) {
+	handler, mockStore, _ := setupHandler(t)
+	token := authenticate(t, handler, mockStore)
+
+	for _, tc := range []struct {
+		field, value, want string
+	}{
+		{"encryptedDEK2", strings.Repeat("A", 32), "EncryptedDEK2: invalid length, got 192 bits, want 384 bits"},
+		{"nonceDEK1", "!!!notbase64!!!", "NonceDEK1: invalid Base64"},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/me/encryption-keys", strings.NewReader(encryptionKeysBody(tc.field, tc.value)))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.HandleEncryptionKeys(rec, req)
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), tc.want)
+	}
+
+	// The user has no keys yet, so there is nothing to rotate
+	req := httptest.NewRequest(http.MethodPut, "/me/encryption-keys", strings.NewReader(encryptionKeysBody("", "")))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	handler.HandleEncryptionKeys(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	mockStore.AssertNotCalled(t, "SetUserEncryptionKeys", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestHandleEncryptionKeys_RotateKEKWithoutKeysIsBadRequest(t *testing.T) {
+	handler, mockStore, _ := setupHandler(t)
+	token := authenticate(t, handler, mockStore)
+
+	req := httptest.NewRequest(http.MethodPatch, "/me/encryption-keys", strings.NewReader(encryptionKeysBody("", "")))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	handler.HandleEncryptionKeys(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "no existing keys")
+	mockStore.AssertNotCalled(t, "SetUserEncryptionKeys", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestHandleEncryptionKeys_RotateKEKStaleVersionIsConflict(t *testing.T) {
+	handler, mockStore, _ := setupHandler(t)
+	user := models.User{Id: "user1", Provider: "github", ProviderId: "123", KeyVersion: 2, SaltKEK: "salt"}
+	token, err := handler.Service.CreateJWT(user.Id, user.Provider, user.ProviderId)
+	assert.NoError(t, err)
+	mockStore.On("GetUser", mock.Anything, user.Provider, user.ProviderId).Return(user, nil)
+	mockStore.On("RotateUserKEK", mock.Anything, mock.Anything, 2).Return(store.ErrConditionFailed)
+
+	// The client still holds version 1
+	body := strings.Replace(encryptionKeysBody("", ""), "{", `{"keyVersion":1,`, 1)
+	req := httptest.NewRequest(http.MethodPatch, "/me/encryption-keys", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	handler.HandleEncryptionKeys(rec, req)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	mockStore.AssertNotCalled(t, "RotateUserKEK", mock.Anything, mock.Anything, mock.Anything)
+
+	// The keys were replaced after the user was read
+	body = strings.Replace(encryptionKeysBody("", ""), "{", `{"keyVersion":2,`, 1)
+	req = httptest.NewRequest(http.MethodPatch, "/me/encryption-keys", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec = httptest.NewRecorder()
+	handler.HandleEncryptionKeys(rec, req)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+}
+
+func TestHandleEncryptionKeys_StoreFailureIsInternalError(t *testing.T) {
+	handler, mockStore, _ := setupHandler(t)
+	token := authenticate(t, handler, mockStore)
+	mockStore.On("SetUserEncryptionKeys", mock.Anything, mock.Anything, true).Return(0, errors.New("dynamodb unavailable"))
+
+	req := httptest.NewRequest(http.MethodPost, "/me/encryption-keys", strings.NewReader(encryptionKeysBody("", "")))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	handler.HandleEncryptionKeys(rec, req)
+
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Equal(t, "failed to store encryption keys\n", rec.Body.String())
+}
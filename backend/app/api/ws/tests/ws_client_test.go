@@ -0,0 +1,308 @@
+package ws_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/zlnvch/webverse/api/ws"
+	cachemocks "github.com/zlnvch/webverse/cache/mocks"
+	"github.com/zlnvch/webverse/models"
+)
+
+func TestConnectionTimeouts_Validate(t *testing.T) {
+	assert.NoError(t, ws.DefaultConnectionTimeouts().Validate())
+
+	timeouts := ws.DefaultConnectionTimeouts()
+	timeouts.PingPeriod = timeouts.PongWait
+	assert.EqualError(t, timeouts.Validate(), "ping period must be less than pong wait")
+
+	timeouts = ws.DefaultConnectionTimeouts()
+	timeouts.WriteWait = 0
+	assert.EqualError(t, timeouts.Validate(), "connection timeouts must be positive")
+}
+
+func TestLoadLimits_Validate(t *testing.T) {
+	assert.NoError(t, ws.DefaultLoadLimits().Validate())
+
+	limits := ws.DefaultLoadLimits()
+	limits.MaxPages = 0
+	assert.EqualError(t, limits.Validate(), "load limits must be positive")
+
+	limits = ws.DefaultLoadLimits()
+	limits.Window = 0
+	assert.EqualError(t, limits.Validate(), "load limits must be positive")
+}
+
+func TestClient_PingsWithHubTimeouts(t *testing.T) {
+	handler, _, _ := setupHandler(t)
+	handler.Hub.Timeouts = ws.ConnectionTimeouts{
+		WriteWait:  time.Second,
+		PongWait:   500 * time.Millisecond,
+		PingPeriod: 50 * time.Millisecond,
+	}
+	shutdownCtx, shutdown := context.WithCancel(context.Background())
+	defer shutdown()
+
+	upgrader := websocket.Upgrader{}
+	clients := make(chan *ws.Client, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := ws.NewClient(handler.Hub, conn, models.User{Id: "user1"}, handler.HandleWsMessage)
+		go client.WritePump(shutdownCtx)
+		go client.ReadPump()
+		clients <- client
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	client := <-clients
+
+	// Reading answers the pings, and every answered ping is reported back as a latency message
+	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	_, frame, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	msg := decodeFrame(t, frame)
+	assert.Equal(t, "latency", msg.Type)
+	assert.Contains(t, msg.Data, "rttMs")
+	assert.Positive(t, client.RTT())
+}
+
+// isTimeout reports whether a read failed on its deadline rather than a closed connection
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// dialRateLimited connects to a client with the given rate limit grace, whose handler passes every handled message on
+func dialRateLimited(t *testing.T, grace time.Duration) (*websocket.Conn, chan string) {
+	t.Helper()
+	handler, _, _ := setupHandler(t)
+	handler.Hub.RateLimitGrace = grace
+	shutdownCtx, shutdown := context.WithCancel(context.Background())
+	t.Cleanup(shutdown)
+
+	handled := make(chan string, 256)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := ws.NewClient(handler.Hub, conn, models.User{Id: "user1"}, func(client *ws.Client, messageType int, messageBytes []byte) {
+			handled <- string(messageBytes)
+		})
+		go client.WritePump(shutdownCtx)
+		go client.ReadPump()
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, handled
+}
+
+func TestClient_RateLimitWarnsThenCloses(t *testing.T) {
+	conn, handled := dialRateLimited(t, time.Second)
+
+	for range 40 {
+		assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"draw"}`)))
+	}
+	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	_, frame, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	msg := decodeFrame(t, frame)
+	assert.Equal(t, "rate_limited", msg.Type)
+	assert.Equal(t, float64(1000), msg.Data["graceMs"])
+
+	// Still exceeding the limit within the grace window
+	for range 100 {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"draw"}`)); err != nil {
+			break
+		}
+	}
+	_, _, err = conn.ReadMessage()
+	assert.Error(t, err)
+	assert.False(t, isTimeout(err), "connection should be closed before the deadline")
+	assert.Less(t, len(handled), 140)
+}
+
+func TestClient_RateLimitWarnsThenRecovers(t *testing.T) {
+	conn, handled := dialRateLimited(t, 100*time.Millisecond)
+
+	// A short burst past the limit, well below what closes the connection
+	for range 40 {
+		assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"draw"}`)))
+	}
+	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	_, frame, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "rate_limited", decodeFrame(t, frame).Type)
+
+	// After the grace window, messages are handled again on the same connection
+	time.Sleep(200 * time.Millisecond)
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"after"}`)))
+	deadline := time.After(1 * time.Second)
+	for {
+		select {
+		case message := <-handled:
+			if message == `{"type":"after"}` {
+				return
+			}
+		case <-deadline:
+			assert.Fail(t, "timed out waiting for the message after the grace window")
+			return
+		}
+	}
+}
+
+func TestClient_RateLimitClosesWithFullSendBuffer(t *testing.T) {
+	handler, _, _ := setupHandler(t)
+	handler.Hub.RateLimitGrace = time.Second
+	handler.Hub.SendBufferSize = 1
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := ws.NewClient(handler.Hub, conn, models.User{Id: "user1"}, func(client *ws.Client, messageType int, messageBytes []byte) {})
+		// No WritePump, so Send stays full and the warning can't be queued behind it
+		client.Send <- []byte("queued")
+		go client.ReadPump()
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	// ReadPump keeps reading after the warning and closes the connection once it keeps exceeding the limit
+	for range 200 {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"draw"}`)); err != nil {
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	_, _, err = conn.ReadMessage()
+	assert.Error(t, err)
+	assert.False(t, isTimeout(err), "connection should be closed before the deadline")
+}
+
+// subscribeCapturingBroadcast subscribes the client to example.com and returns the function the hub
+// broadcasts the page's messages with
+func subscribeCapturingBroadcast(t *testing.T, handler *ws.Handler, mockCache *cachemocks.MockCache, client *ws.Client) func([]byte) {
+	t.Helper()
+	broadcasts := make(chan func([]byte), 1)
+	mockCache.On("Subscribe", mock.Anything, "page:example.com", mock.Anything).Run(func(args mock.Arguments) {
+		broadcasts <- args.Get(2).(func([]byte))
+	}).Return(nil)
+
+	resp := sendMessage(t, handler, client, "subscribe", map[string]any{"pageKey": "example.com", "layer": models.LayerPublic})
+	assert.Equal(t, true, resp.Data["success"])
+	return <-broadcasts
+}
+
+func TestClient_SendOverflowBlocksByDefault(t *testing.T) {
+	handler, _, mockCache := setupHandler(t)
+	handler.Hub.SendBufferSize = 2
+	client := ws.NewClient(handler.Hub, nil, models.User{Id: "user1"}, handler.HandleWsMessage)
+	broadcast := subscribeCapturingBroadcast(t, handler, mockCache, client)
+
+	// Nothing drains the buffer, the third broadcast waits for room instead of replacing the first
+	for i := range 3 {
+		broadcast(fmt.Appendf(nil, "message %d", i))
+	}
+	assert.Eventually(t, func() bool { return len(client.Send) == 2 }, time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+
+	// Draining makes room, and no message is lost
+	for i := range 3 {
+		select {
+		case msg := <-client.Send:
+			assert.Equal(t, fmt.Sprintf("message %d", i), string(msg))
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for message %d", i)
+		}
+	}
+}
+
+func TestClient_SendOverflowDropsOldest(t *testing.T) {
+	handler, _, mockCache := setupHandler(t)
+	handler.Hub.SendBufferSize = 2
+	handler.Hub.SendOverflow = ws.SendOverflowDropOldest
+	client := ws.NewClient(handler.Hub, nil, models.User{Id: "user1"}, handler.HandleWsMessage)
+	broadcast := subscribeCapturingBroadcast(t, handler, mockCache, client)
+
+	// Nothing drains the buffer, yet the hub never blocks on it
+	for i := range 5 {
+		broadcast(fmt.Appendf(nil, "message %d", i))
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	assert.Len(t, client.Send, 2)
+	assert.Equal(t, "message 3", string(<-client.Send))
+	assert.Equal(t, "message 4", string(<-client.Send))
+}
+
+func TestClient_SendOverflowDisconnects(t *testing.T) {
+	handler, _, mockCache := setupHandler(t)
+	handler.Hub.SendBufferSize = 2
+	handler.Hub.SendOverflow = ws.SendOverflowDisconnect
+
+	upgrader := websocket.Upgrader{}
+	clients := make(chan *ws.Client, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := ws.NewClient(handler.Hub, conn, models.User{Id: "user1"}, handler.HandleWsMessage)
+		// No WritePump, so the send buffer fills up
+		go client.ReadPump()
+		clients <- client
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	client := <-clients
+	// Saved again when the closed connection unregisters
+	mockCache.On("SetReconnectState", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil).Maybe()
+	broadcast := subscribeCapturingBroadcast(t, handler, mockCache, client)
+
+	// The subscribe response takes one slot, the second broadcast overflows
+	for i := range 5 {
+		broadcast(fmt.Appendf(nil, "message %d", i))
+	}
+
+	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	_, _, err = conn.ReadMessage()
+	assert.Error(t, err)
+	assert.False(t, isTimeout(err), "connection should be closed before the deadline")
+}
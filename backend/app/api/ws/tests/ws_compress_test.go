@@ -0,0 +1,154 @@
+package ws_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/zlnvch/webverse/api/ws"
+	"github.com/zlnvch/webverse/models"
+)
+
+// Header byte of gzip-compressed binary frames
+const frameHeaderGzip = 0x01
+
+func largePage(n int) ([]models.Stroke, [][]byte) {
+	strokes := make([]models.Stroke, 0, n)
+	raw := make([][]byte, 0, n)
+	for i := range n {
+		stroke := models.Stroke{
+			Id:      fmt.Sprintf("018e38d7-%04x-7000-8000-000000000000", i),
+			UserId:  "user2",
+			Content: bytes.Repeat([]byte{byte(i)}, 200),
+		}
+		strokeBytes, _ := json.Marshal(stroke)
+		strokes = append(strokes, stroke)
+		raw = append(raw, strokeBytes)
+	}
+	return strokes, raw
+}
+
+func decodeFrame(t *testing.T, frame []byte) wsResponse {
+	t.Helper()
+	var resp wsResponse
+	if assert.NotEmpty(t, frame) && frame[0] == frameHeaderGzip {
+		zr, err := gzip.NewReader(bytes.NewReader(frame[1:]))
+		assert.NoError(t, err)
+		frame, err = io.ReadAll(zr)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, json.Unmarshal(frame, &resp))
+	return resp
+}
+
+func TestLoad_CompressedAfterCompressSubscribe(t *testing.T) {
+	handler, _, mockCache := setupHandler(t)
+	client := ws.NewClient(handler.Hub, nil, models.User{Id: "user1"}, handler.HandleWsMessage)
+	pageKey := "example.com"
+
+	strokes, raw := largePage(1000)
+	mockCache.On("GetStrokes", context.Background(), pageKey).Return(raw, nil)
+	mockCache.On("IsPageComplete", context.Background(), pageKey).Return(true, nil)
+	mockCache.On("Subscribe", mock.Anything, "page:"+pageKey, mock.Anything).Return(nil)
+
+	// The subscribe response itself is never compressed
+	resp := sendMessage(t, handler, client, "subscribe", map[string]any{"pageKey": pageKey, "layer": models.LayerPublic, "compress": true})
+	assert.Equal(t, true, resp.Data["success"])
+
+	handler.HandleWsMessage(client, 1, []byte(`{"type":"load","data":{"pageKey":"example.com","layer":0}}`))
+	var frame []byte
+	select {
+	case frame = <-client.Send:
+	case <-time.After(1 * time.Second):
+		t.Fatal("timed out waiting for load response")
+	}
+
+	assert.Equal(t, byte(frameHeaderGzip), frame[0])
+	uncompressedLen := 0
+	for _, b := range raw {
+		uncompressedLen += len(b)
+	}
+	assert.Less(t, len(frame), uncompressedLen/2)
+
+	resp = decodeFrame(t, frame)
+	assert.Equal(t, "load_response", resp.Type)
+	assert.Equal(t, true, resp.Data["success"])
+
+	strokesBytes, _ := json.Marshal(resp.Data["strokes"])
+	var loaded []models.Stroke
+	assert.NoError(t, json.Unmarshal(strokesBytes, &loaded))
+	assert.Equal(t, strokes, loaded)
+}
+
+func TestLoad_UncompressedByDefault(t *testing.T) {
+	handler, _, mockCache := setupHandler(t)
+	client := ws.NewClient(handler.Hub, nil, models.User{Id: "user1"}, handler.HandleWsMessage)
+	pageKey := "example.com"
+
+	_, raw := largePage(10)
+	mockCache.On("GetStrokes", context.Background(), pageKey).Return(raw, nil)
+	mockCache.On("IsPageComplete", context.Background(), pageKey).Return(true, nil)
+
+	resp := sendMessage(t, handler, client, "load", map[string]any{"pageKey": pageKey, "layer": models.LayerPublic})
+
+	assert.Equal(t, "load_response", resp.Type)
+	assert.Equal(t, true, resp.Data["success"])
+	assert.Len(t, resp.Data["strokes"], 10)
+}
+
+func TestWritePump_CompressedFramesAreBinary(t *testing.T) {
+	handler, _, _ := setupHandler(t)
+	shutdownCtx, shutdown := context.WithCancel(context.Background())
+	defer shutdown()
+
+	upgrader := websocket.Upgrader{}
+	clients := make(chan *ws.Client, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := ws.NewClient(handler.Hub, conn, models.User{Id: "user1"}, handler.HandleWsMessage)
+		go client.WritePump(shutdownCtx)
+		clients <- client
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	client := <-clients
+
+	var compressed bytes.Buffer
+	compressed.WriteByte(frameHeaderGzip)
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(`{"type":"load_response","data":{"success":true}}`))
+	zw.Close()
+
+	client.Send <- []byte(`{"type":"pong"}`)
+	client.Send <- compressed.Bytes()
+
+	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	frameType, frame, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, websocket.TextMessage, frameType)
+	assert.Equal(t, "pong", decodeFrame(t, frame).Type)
+
+	frameType, frame, err = conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, websocket.BinaryMessage, frameType)
+	assert.Equal(t, "load_response", decodeFrame(t, frame).Type)
+}
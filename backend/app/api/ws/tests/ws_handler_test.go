@@ -0,0 +1,399 @@
+package ws_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/zlnvch/webverse/api/ws"
+	"github.com/zlnvch/webverse/cache"
+	cachemocks "github.com/zlnvch/webverse/cache/mocks"
+	"github.com/zlnvch/webverse/models"
+	mqmocks "github.com/zlnvch/webverse/mq/mocks"
+	"github.com/zlnvch/webverse/service"
+	storemocks "github.com/zlnvch/webverse/store/mocks"
+	"github.com/zlnvch/webverse/worker"
+)
+
+func setupHandler(t *testing.T) (*ws.Handler, *storemocks.MockStore, *cachemocks.MockCache) {
+	mockStore := new(storemocks.MockStore)
+	mockCache := new(cachemocks.MockCache)
+
+	counterBatcher := worker.NewCounterBatcher(mockStore, 1000, worker.DefaultCounterFlushUsers)
+	strokeBatcher := worker.NewStrokeBatcher(mockStore, 1000, worker.DefaultStrokeBufferSize, counterBatcher, nil)
+
+	svc, err := service.NewService(
+		mockStore,
+		mockCache,
+		new(mqmocks.MockMQ),
+		strokeBatcher,
+		counterBatcher,
+		nil,
+		[][]byte{[]byte("secret")},
+		service.DefaultConfig(),
+	)
+	assert.NoError(t, err)
+
+	hub := ws.NewHub(mockCache)
+	go hub.Run()
+	return ws.NewHandler(svc, hub), mockStore, mockCache
+}
+
+type wsResponse struct {
+	Type string         `json:"type"`
+	Data map[string]any `json:"data"`
+}
+
+// Helper that sends a message through the handler and returns the response sent to the client
+func sendMessage(t *testing.T, handler *ws.Handler, client *ws.Client, msgType string, data any) wsResponse {
+	t.Helper()
+	dataBytes, _ := json.Marshal(data)
+	msgBytes, _ := json.Marshal(map[string]any{"type": msgType, "data": json.RawMessage(dataBytes)})
+	handler.HandleWsMessage(client, 1, msgBytes)
+
+	select {
+	case respBytes := <-client.Send:
+		var resp wsResponse
+		assert.NoError(t, json.Unmarshal(respBytes, &resp))
+		return resp
+	case <-time.After(1 * time.Second):
+		t.Fatal("timed out waiting for response")
+		return wsResponse{}
+	}
+}
+
+func TestSubscribe_WithoutLoad(t *testing.T) {
+	handler, mockStore, mockCache := setupHandler(t)
+	client := ws.NewClient(handler.Hub, nil, models.User{Id: "user1"}, handler.HandleWsMessage)
+	mockCache.On("Subscribe", mock.Anything, "page:example.com", mock.Anything).Return(nil)
+
+	resp := sendMessage(t, handler, client, "subscribe", map[string]any{"pageKey": "example.com", "layer": models.LayerPublic})
+
+	assert.Equal(t, "subscribe_response", resp.Type)
+	assert.Equal(t, true, resp.Data["success"])
+	assert.NotContains(t, resp.Data, "strokes")
+	mockCache.AssertNumberOfCalls(t, "Subscribe", 1)
+	mockCache.AssertNotCalled(t, "GetStrokes", mock.Anything, mock.Anything)
+	mockStore.AssertNotCalled(t, "GetVisibleStrokeRecords", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestHandleWsMessage_DoesNotBlockOnFullSendBuffer(t *testing.T) {
+	handler, _, mockCache := setupHandler(t)
+	handler.Hub.SendBufferSize = 1
+	client := ws.NewClient(handler.Hub, nil, models.User{Id: "user1"}, handler.HandleWsMessage)
+	mockCache.On("Subscribe", mock.Anything, "page:example.com", mock.Anything).Return(nil)
+	// Nothing reads Send, so it stays full
+	client.Send <- []byte("queued")
+
+	done := make(chan struct{})
+	go func() {
+		handler.HandleWsMessage(client, 1, []byte(`{"type":"subscribe","data":{"pageKey":"example.com","layer":0}}`))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(1 * time.Second):
+		t.Fatal("handler blocked on the full send buffer")
+	}
+	assert.Equal(t, "queued", string(<-client.Send))
+}
+
+func TestSubscribe_LoadOnSubscribe(t *testing.T) {
+	handler, _, mockCache := setupHandler(t)
+	client := ws.NewClient(handler.Hub, nil, models.User{Id: "user1"}, handler.HandleWsMessage)
+	pageKey := "example.com"
+
+	stroke := models.Stroke{Id: "018e38d7-0000-7000-8000-000000000000", UserId: "user2", Content: []byte("data")}
+	strokeBytes, _ := json.Marshal(stroke)
+	mockCache.On("GetStrokes", context.Background(), pageKey).Return([][]byte{strokeBytes}, nil)
+	mockCache.On("IsPageComplete", context.Background(), pageKey).Return(true, nil)
+	mockCache.On("Subscribe", mock.Anything, "page:"+pageKey, mock.Anything).Return(nil)
+
+	resp := sendMessage(t, handler, client, "subscribe", map[string]any{"pageKey": pageKey, "layer": models.LayerPublic, "loadOnSubscribe": true})
+
+	assert.Equal(t, "subscribe_response", resp.Type)
+	assert.Equal(t, true, resp.Data["success"])
+	assert.Equal(t, true, resp.Data["loaded"])
+	assert.Equal(t, pageKey, resp.Data["pageKey"])
+
+	strokesBytes, _ := json.Marshal(resp.Data["strokes"])
+	var strokes []models.Stroke
+	assert.NoError(t, json.Unmarshal(strokesBytes, &strokes))
+	assert.Equal(t, []models.Stroke{stroke}, strokes)
+
+	// Subscribed before loading
+	mockCache.AssertExpectations(t)
+}
+
+func TestSubscribe_LoadOnSubscribe_LoadFails(t *testing.T) {
+	handler, mockStore, mockCache := setupHandler(t)
+	client := ws.NewClient(handler.Hub, nil, models.User{Id: "user1"}, handler.HandleWsMessage)
+	pageKey := "example.com"
+
+	mockCache.On("GetStrokes", context.Background(), pageKey).Return([][]byte{}, nil)
+	mockCache.On("IsPageComplete", context.Background(), pageKey).Return(false, nil)
+	mockStore.On("GetVisibleStrokeRecords", context.Background(), pageKey, mock.Anything).Return([]models.Stroke(nil), assert.AnError)
+	mockCache.On("Subscribe", mock.Anything, "page:"+pageKey, mock.Anything).Return(nil)
+
+	resp := sendMessage(t, handler, client, "subscribe", map[string]any{"pageKey": pageKey, "layer": models.LayerPublic, "loadOnSubscribe": true})
+
+	// The subscription itself succeeded
+	assert.Equal(t, true, resp.Data["success"])
+	assert.Equal(t, false, resp.Data["loaded"])
+	assert.Equal(t, []any{}, resp.Data["strokes"])
+	mockCache.AssertNumberOfCalls(t, "Subscribe", 1)
+}
+
+func TestSubscribe_RedisSubscribeFails(t *testing.T) {
+	handler, _, mockCache := setupHandler(t)
+	client := ws.NewClient(handler.Hub, nil, models.User{Id: "user1"}, handler.HandleWsMessage)
+	mockCache.On("Subscribe", mock.Anything, "page:example.com", mock.Anything).Return(assert.AnError).Once()
+
+	resp := sendMessage(t, handler, client, "subscribe", map[string]any{"pageKey": "example.com", "layer": models.LayerPublic, "loadOnSubscribe": true})
+
+	assert.Equal(t, "subscribe_response", resp.Type)
+	assert.Equal(t, false, resp.Data["success"])
+	// Nothing is loaded for a page the client would not get updates for
+	assert.NotContains(t, resp.Data, "strokes")
+	mockCache.AssertNotCalled(t, "GetStrokes", mock.Anything, mock.Anything)
+
+	// The failed page is not left half-subscribed, so a retry subscribes again
+	mockCache.On("Subscribe", mock.Anything, "page:example.com", mock.Anything).Return(nil).Once()
+	resp = sendMessage(t, handler, client, "subscribe", map[string]any{"pageKey": "example.com", "layer": models.LayerPublic})
+	assert.Equal(t, true, resp.Data["success"])
+	mockCache.AssertNumberOfCalls(t, "Subscribe", 2)
+}
+
+func TestResubscribe_SkipsFailedPages(t *testing.T) {
+	handler, _, mockCache := setupHandler(t)
+	client := ws.NewClient(handler.Hub, nil, models.User{Id: "user1"}, handler.HandleWsMessage)
+
+	state := cache.ReconnectState{UserId: "user1", PageKeys: []string{"example.com", "example.org"}}
+	mockCache.On("GetReconnectState", mock.Anything, "token1").Return(state, nil)
+	mockCache.On("Subscribe", mock.Anything, "page:example.com", mock.Anything).Return(assert.AnError)
+	mockCache.On("Subscribe", mock.Anything, "page:example.org", mock.Anything).Return(nil)
+
+	resp := sendMessage(t, handler, client, "resubscribe", map[string]any{"token": "token1"})
+
+	assert.Equal(t, true, resp.Data["success"])
+	assert.Equal(t, []any{"example.org"}, resp.Data["pageKeys"])
+}
+
+func TestResubscribe_RestoresSubscriptions(t *testing.T) {
+	handler, _, mockCache := setupHandler(t)
+	client := ws.NewClient(handler.Hub, nil, models.User{Id: "user1"}, handler.HandleWsMessage)
+
+	state := cache.ReconnectState{UserId: "user1", PageKeys: []string{"example.com", "example.org"}}
+	mockCache.On("GetReconnectState", mock.Anything, "token1").Return(state, nil)
+	mockCache.On("Subscribe", mock.Anything, "page:example.com", mock.Anything).Return(nil)
+	mockCache.On("Subscribe", mock.Anything, "page:example.org", mock.Anything).Return(nil)
+
+	resp := sendMessage(t, handler, client, "resubscribe", map[string]any{"token": "token1"})
+
+	assert.Equal(t, "resubscribe_response", resp.Type)
+	assert.Equal(t, true, resp.Data["success"])
+	assert.Equal(t, []any{"example.com", "example.org"}, resp.Data["pageKeys"])
+	// Both pages are subscribed in one shot
+	mockCache.AssertNumberOfCalls(t, "Subscribe", 2)
+}
+
+func TestResubscribe_OtherUsersToken(t *testing.T) {
+	handler, _, mockCache := setupHandler(t)
+	client := ws.NewClient(handler.Hub, nil, models.User{Id: "user1"}, handler.HandleWsMessage)
+
+	state := cache.ReconnectState{UserId: "user2", PageKeys: []string{"example.com"}}
+	mockCache.On("GetReconnectState", mock.Anything, "token1").Return(state, nil)
+
+	resp := sendMessage(t, handler, client, "resubscribe", map[string]any{"token": "token1"})
+
+	assert.Equal(t, false, resp.Data["success"])
+	mockCache.AssertNotCalled(t, "Subscribe", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestResubscribe_ExpiredToken(t *testing.T) {
+	handler, _, mockCache := setupHandler(t)
+	client := ws.NewClient(handler.Hub, nil, models.User{Id: "user1"}, handler.HandleWsMessage)
+
+	mockCache.On("GetReconnectState", mock.Anything, "token1").Return(cache.ReconnectState{}, nil)
+
+	resp := sendMessage(t, handler, client, "resubscribe", map[string]any{"token": "token1"})
+
+	assert.Equal(t, false, resp.Data["success"])
+	mockCache.AssertNotCalled(t, "Subscribe", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestSyncSeq_ReturnsMissedStrokes(t *testing.T) {
+	handler, _, mockCache := setupHandler(t)
+	client := ws.NewClient(handler.Hub, nil, models.User{Id: "user1"}, handler.HandleWsMessage)
+	pageKey := "example.com"
+
+	stroke := models.Stroke{Id: "00000000-0000-7000-8000-000000000001", Content: []byte("data")}
+	strokeBytes, _ := json.Marshal(stroke)
+	// Seq 43 undid a stroke the client already had
+	mockCache.On("GetStrokesAfterSeq", context.Background(), pageKey, int64(41)).Return(cache.StrokesAfterSeq{
+		Strokes:    []cache.SequencedStroke{{Seq: 42, Data: strokeBytes}},
+		RemovedIds: []string{"00000000-0000-7000-8000-000000000000"},
+		LastSeq:    43,
+	}, nil)
+
+	resp := sendMessage(t, handler, client, "sync_seq", map[string]any{"pageKey": pageKey, "layer": models.LayerPublic, "seq": 41})
+
+	assert.Equal(t, "sync_seq_response", resp.Type)
+	assert.Equal(t, true, resp.Data["success"])
+	assert.Equal(t, float64(43), resp.Data["seq"])
+	assert.Equal(t, []any{"00000000-0000-7000-8000-000000000000"}, resp.Data["removedIds"])
+	strokes, _ := resp.Data["strokes"].([]any)
+	if assert.Len(t, strokes, 1) {
+		synced := strokes[0].(map[string]any)
+		assert.Equal(t, float64(42), synced["seq"])
+		assert.Equal(t, stroke.Id, synced["stroke"].(map[string]any)["id"])
+	}
+}
+
+func TestSyncSeq_GapTellsClientToLoad(t *testing.T) {
+	handler, _, mockCache := setupHandler(t)
+	client := ws.NewClient(handler.Hub, nil, models.User{Id: "user1"}, handler.HandleWsMessage)
+
+	mockCache.On("GetStrokesAfterSeq", context.Background(), "example.com", int64(3)).Return(cache.StrokesAfterSeq{}, cache.ErrSequenceGap)
+
+	resp := sendMessage(t, handler, client, "sync_seq", map[string]any{"pageKey": "example.com", "layer": models.LayerPublic, "seq": 3})
+
+	assert.Equal(t, "sync_seq_response", resp.Type)
+	assert.Equal(t, false, resp.Data["success"])
+	assert.Equal(t, cache.ErrSequenceGap.Error(), resp.Data["reason"])
+}
+
+func TestLoad_DistinctPagesCappedPerConnection(t *testing.T) {
+	handler, _, mockCache := setupHandler(t)
+	handler.Hub.LoadLimits = ws.LoadLimits{MaxPages: 3, Window: time.Minute}
+	client := ws.NewClient(handler.Hub, nil, models.User{Id: "user1"}, handler.HandleWsMessage)
+
+	mockCache.On("GetStrokes", context.Background(), mock.Anything).Return([][]byte{}, nil)
+	mockCache.On("IsPageComplete", context.Background(), mock.Anything).Return(true, nil)
+
+	for i := 0; i < 3; i++ {
+		resp := sendMessage(t, handler, client, "load", map[string]any{"pageKey": fmt.Sprintf("page%d.com", i), "layer": models.LayerPublic})
+		assert.Equal(t, true, resp.Data["success"])
+	}
+
+	resp := sendMessage(t, handler, client, "load", map[string]any{"pageKey": "page3.com", "layer": models.LayerPublic})
+	assert.Equal(t, "load_response", resp.Type)
+	assert.Equal(t, false, resp.Data["success"])
+	assert.Equal(t, "too many page loads", resp.Data["error"])
+	mockCache.AssertNotCalled(t, "GetStrokes", context.Background(), "page3.com")
+
+	// Reloading an already loaded page is not capped
+	resp = sendMessage(t, handler, client, "load", map[string]any{"pageKey": "page0.com", "layer": models.LayerPublic})
+	assert.Equal(t, true, resp.Data["success"])
+
+	// The cap is per connection
+	other := ws.NewClient(handler.Hub, nil, models.User{Id: "user1"}, handler.HandleWsMessage)
+	resp = sendMessage(t, handler, other, "load", map[string]any{"pageKey": "page3.com", "layer": models.LayerPublic})
+	assert.Equal(t, true, resp.Data["success"])
+}
+
+func TestLoad_IncludesDisplaySeeds(t *testing.T) {
+	handler, _, mockCache := setupHandler(t)
+	client := ws.NewClient(handler.Hub, nil, models.User{Id: "user1"}, handler.HandleWsMessage)
+
+	stroke := models.Stroke{Id: "00000000-0000-7000-8000-000000000001", UserId: "user2", Content: []byte("data")}
+	strokeBytes, _ := json.Marshal(stroke)
+	mockCache.On("GetStrokes", context.Background(), "example.com").Return([][]byte{strokeBytes}, nil)
+	mockCache.On("IsPageComplete", context.Background(), "example.com").Return(true, nil)
+
+	resp := sendMessage(t, handler, client, "load", map[string]any{"pageKey": "example.com", "layer": models.LayerPublic})
+	assert.Equal(t, true, resp.Data["success"])
+	assert.Equal(t, map[string]any{"user2": float64(service.UserDisplaySeed("user2"))}, resp.Data["displaySeeds"])
+}
+
+func TestLoad_CapResetsAfterWindow(t *testing.T) {
+	handler, _, mockCache := setupHandler(t)
+	handler.Hub.LoadLimits = ws.LoadLimits{MaxPages: 1, Window: 50 * time.Millisecond}
+	client := ws.NewClient(handler.Hub, nil, models.User{Id: "user1"}, handler.HandleWsMessage)
+
+	mockCache.On("GetStrokes", context.Background(), mock.Anything).Return([][]byte{}, nil)
+	mockCache.On("IsPageComplete", context.Background(), mock.Anything).Return(true, nil)
+
+	resp := sendMessage(t, handler, client, "load", map[string]any{"pageKey": "a.com", "layer": models.LayerPublic})
+	assert.Equal(t, true, resp.Data["success"])
+	resp = sendMessage(t, handler, client, "load", map[string]any{"pageKey": "b.com", "layer": models.LayerPublic})
+	assert.Equal(t, false, resp.Data["success"])
+
+	time.Sleep(60 * time.Millisecond)
+	resp = sendMessage(t, handler, client, "load", map[string]any{"pageKey": "b.com", "layer": models.LayerPublic})
+	assert.Equal(t, true, resp.Data["success"])
+}
+
+// Helper that connects through ServeWS with the token and returns the close frame it is rejected with
+func dialWithToken(t *testing.T, handler *ws.Handler, token string) *websocket.CloseError {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeWS(websocket.Upgrader{}, w, r, context.Background())
+	}))
+	defer server.Close()
+
+	header := http.Header{}
+	header.Set("Sec-WebSocket-Protocol", "webverse-v1, "+token)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), header)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	assert.ErrorAs(t, err, &closeErr)
+	return closeErr
+}
+
+func TestServeWS_OversizedTokenRejectedBeforeVerify(t *testing.T) {
+	handler, mockStore, _ := setupHandler(t)
+
+	// Correctly signed, so only the length check keeps it from reaching the store
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"id":         "user1",
+		"provider":   "github",
+		"providerId": "1",
+		"exp":        time.Now().Add(time.Hour).Unix(),
+		"padding":    strings.Repeat("a", 4096),
+	}).SignedString([]byte("secret"))
+	assert.NoError(t, err)
+
+	closeErr := dialWithToken(t, handler, token)
+	if assert.NotNil(t, closeErr) {
+		assert.Equal(t, websocket.ClosePolicyViolation, closeErr.Code)
+		assert.Equal(t, "Unauthenticated", closeErr.Text)
+	}
+	mockStore.AssertNotCalled(t, "GetUser", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestServeWS_MalformedTokenRejected(t *testing.T) {
+	handler, mockStore, _ := setupHandler(t)
+
+	tokens := []string{
+		"not-a-jwt",
+		"a.b",
+		"a..c",
+		"a.b.c.d",
+		"a.b+c.d",
+		"eyJhbGciOiJIUzI1NiJ9.e30=.c2ln",
+	}
+	for _, token := range tokens {
+		closeErr := dialWithToken(t, handler, token)
+		if assert.NotNil(t, closeErr, token) {
+			assert.Equal(t, websocket.ClosePolicyViolation, closeErr.Code, token)
+		}
+	}
+	mockStore.AssertNotCalled(t, "GetUser", mock.Anything, mock.Anything, mock.Anything)
+}
@@ -0,0 +1,481 @@
+package ws_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/zlnvch/webverse/api/ws"
+	"github.com/zlnvch/webverse/cache"
+	"github.com/zlnvch/webverse/models"
+	"github.com/zlnvch/webverse/service"
+)
+
+func TestHub_SubscribeIssuesReconnectToken(t *testing.T) {
+	handler, _, mockCache := setupHandler(t)
+	hub := handler.Hub
+
+	client := ws.NewClient(hub, nil, models.User{Id: "user1"}, nil)
+	go client.StatePump()
+
+	saved := make(chan cache.ReconnectState, 1)
+	mockCache.On("Subscribe", mock.Anything, "page:example.com", mock.Anything).Return(nil)
+	mockCache.On("SetReconnectState", mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			saved <- args.Get(2).(cache.ReconnectState)
+		}).Return(nil).Once()
+
+	hub.OpenCh <- client
+	handler.HandleWsMessage(client, 1, []byte(`{"type":"subscribe","data":{"pageKey":"example.com","layer":0}}`))
+
+	select {
+	case state := <-saved:
+		assert.Equal(t, cache.ReconnectState{UserId: "user1", PageKeys: []string{"example.com"}}, state)
+	case <-time.After(1 * time.Second):
+		t.Fatal("reconnect state was not saved")
+	}
+
+	// The token can arrive before or after the subscribe response
+	var msg struct {
+		Type string `json:"type"`
+		Data struct {
+			Token string `json:"token"`
+		} `json:"data"`
+	}
+	for range 2 {
+		select {
+		case msgBytes := <-client.Send:
+			assert.NoError(t, json.Unmarshal(msgBytes, &msg))
+		case <-time.After(1 * time.Second):
+			t.Fatal("reconnect token was not sent")
+		}
+		if msg.Type == "reconnect_token" {
+			break
+		}
+	}
+	assert.Equal(t, "reconnect_token", msg.Type)
+	assert.NotEmpty(t, msg.Data.Token)
+	mockCache.AssertCalled(t, "SetReconnectState", mock.Anything, msg.Data.Token, mock.Anything, mock.Anything)
+}
+
+func TestHub_ReconnectTokenDoesNotBlockOnFullSendBuffer(t *testing.T) {
+	handler, _, mockCache := setupHandler(t)
+	hub := handler.Hub
+	hub.SendBufferSize = 1
+
+	client := ws.NewClient(hub, nil, models.User{Id: "user1"}, nil)
+	go client.StatePump()
+	// Nothing reads Send, so it stays full
+	client.Send <- []byte("queued")
+
+	saved := make(chan cache.ReconnectState, 2)
+	mockCache.On("Subscribe", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockCache.On("SetReconnectState", mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			saved <- args.Get(2).(cache.ReconnectState)
+		}).Return(nil)
+
+	hub.OpenCh <- client
+	// The handlers run in the background, so a handler stuck on the full Send fails the test below instead of hanging it
+	handlersDone := make(chan struct{}, 2)
+	subscribe := func(pageKey string) {
+		go func() {
+			handler.HandleWsMessage(client, 1, []byte(`{"type":"subscribe","data":{"pageKey":"`+pageKey+`","layer":0}}`))
+			handlersDone <- struct{}{}
+		}()
+	}
+
+	subscribe("example.com")
+	select {
+	case state := <-saved:
+		assert.Equal(t, []string{"example.com"}, state.PageKeys)
+	case <-time.After(1 * time.Second):
+		t.Fatal("reconnect state was not saved")
+	}
+
+	// StatePump must not be stuck sending the first token
+	subscribe("example.org")
+	select {
+	case state := <-saved:
+		assert.ElementsMatch(t, []string{"example.com", "example.org"}, state.PageKeys)
+	case <-time.After(1 * time.Second):
+		t.Fatal("reconnect state was not saved after the send buffer filled up")
+	}
+
+	for finished := 0; finished < 2; {
+		select {
+		case <-client.Send:
+		case <-handlersDone:
+			finished++
+		case <-time.After(1 * time.Second):
+			t.Fatal("subscribe handlers did not finish")
+		}
+	}
+}
+
+func TestHub_ReconnectTokenOutlivesLastSubscribeAfterClose(t *testing.T) {
+	handler, _, mockCache := setupHandler(t)
+	hub := handler.Hub
+	hub.ReconnectTokenTTL = 100 * time.Millisecond
+
+	client := ws.NewClient(hub, nil, models.User{Id: "user1"}, nil)
+	go client.StatePump()
+
+	// Stands in for Redis, which drops the state once its TTL is up
+	type savedState struct {
+		token     string
+		state     cache.ReconnectState
+		expiresAt time.Time
+	}
+	saved := make(chan savedState, 2)
+	mockCache.On("Subscribe", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockCache.On("SetReconnectState", mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			saved <- savedState{args.String(1), args.Get(2).(cache.ReconnectState), time.Now().Add(args.Get(3).(time.Duration))}
+		}).Return(nil)
+
+	hub.OpenCh <- client
+	handler.HandleWsMessage(client, 1, []byte(`{"type":"subscribe","data":{"pageKey":"example.com","layer":0}}`))
+	select {
+	case <-saved:
+	case <-time.After(1 * time.Second):
+		t.Fatal("reconnect state was not saved on subscribe")
+	}
+
+	// The connection stays up past the TTL without changing its subscriptions, then drops
+	time.Sleep(2 * hub.ReconnectTokenTTL)
+	hub.CloseCh <- client
+
+	var last savedState
+	select {
+	case last = <-saved:
+	case <-time.After(1 * time.Second):
+		t.Fatal("reconnect state was not refreshed on close")
+	}
+	assert.True(t, time.Now().Before(last.expiresAt), "reconnect state expired right after the drop")
+
+	reconnected := ws.NewClient(hub, nil, models.User{Id: "user1"}, handler.HandleWsMessage)
+	mockCache.On("GetReconnectState", mock.Anything, last.token).Return(last.state, nil)
+	resp := sendMessage(t, handler, reconnected, "resubscribe", map[string]any{"token": last.token})
+	assert.Equal(t, true, resp.Data["success"])
+	assert.Equal(t, []any{"example.com"}, resp.Data["pageKeys"])
+}
+
+func TestHub_KeysUpdatedForwardsKeyMaterial(t *testing.T) {
+	handler, _, _ := setupHandler(t)
+	hub := handler.Hub
+
+	client := ws.NewClient(hub, nil, models.User{Id: "user1"}, nil)
+	go client.StatePump()
+	hub.OpenCh <- client
+
+	// The hub may take the update before the open, so wait until the client gets one
+	assert.Eventually(t, func() bool {
+		hub.UserKeysUpdatedCh <- service.UserKeysUpdatedMessage{UserId: "user1", KeyVersion: 1}
+		select {
+		case <-client.Send:
+			return true
+		case <-time.After(10 * time.Millisecond):
+			return false
+		}
+	}, time.Second, 10*time.Millisecond)
+
+	keys := service.EncryptionKeys{SaltKEK: "salt", EncryptedDEK1: "dek1", NonceDEK1: "nonce1", EncryptedDEK2: "dek2", NonceDEK2: "nonce2"}
+	hub.UserKeysUpdatedCh <- service.UserKeysUpdatedMessage{UserId: "user1", KeyVersion: 2}
+	hub.UserKeysUpdatedCh <- service.UserKeysUpdatedMessage{UserId: "user1", KeyVersion: 3, Keys: &keys}
+
+	var data []map[string]any
+	for len(data) < 2 {
+		select {
+		case msgBytes := <-client.Send:
+			var msg struct {
+				Type string         `json:"type"`
+				Data map[string]any `json:"data"`
+			}
+			assert.NoError(t, json.Unmarshal(msgBytes, &msg))
+			assert.Equal(t, "keys_updated", msg.Type)
+			// Skip any late reply to the wait above
+			if msg.Data["keyVersion"] != float64(1) {
+				data = append(data, msg.Data)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatal("keys_updated was not sent")
+		}
+	}
+
+	// Without key material only the version is sent
+	assert.Equal(t, map[string]any{"keyVersion": float64(2), "keysDeleted": false}, data[0])
+	assert.Equal(t, map[string]any{
+		"keyVersion":    float64(3),
+		"keysDeleted":   false,
+		"saltKEK":       "salt",
+		"encryptedDEK1": "dek1",
+		"nonceDEK1":     "nonce1",
+		"encryptedDEK2": "dek2",
+		"nonceDEK2":     "nonce2",
+	}, data[1])
+}
+
+func TestHub_KeysUpdatesDoNotBlockOnStalledStatePump(t *testing.T) {
+	handler, _, _ := setupHandler(t)
+	hub := handler.Hub
+
+	// StatePump is not running, so nothing takes the updates handed to it
+	client := ws.NewClient(hub, nil, models.User{Id: "user1"}, nil)
+	hub.OpenCh <- client
+
+	// The hub may take the update before the open, so wait until the client gets one
+	assert.Eventually(t, func() bool {
+		hub.UserKeysUpdatedCh <- service.UserKeysUpdatedMessage{UserId: "user1", KeyVersion: 1}
+		select {
+		case <-client.Send:
+			return true
+		case <-time.After(10 * time.Millisecond):
+			return false
+		}
+	}, time.Second, 10*time.Millisecond)
+
+	for version := 2; version <= 6; version++ {
+		hub.UserKeysUpdatedCh <- service.UserKeysUpdatedMessage{UserId: "user1", KeyVersion: version}
+	}
+
+	// Every update still reaches the client, the hub is not stuck on the ones StatePump hasn't taken
+	received := 0
+	for received < 5 {
+		select {
+		case <-client.Send:
+			received++
+		case <-time.After(1 * time.Second):
+			t.Fatalf("only %d of 5 keys_updated messages were sent", received)
+		}
+	}
+}
+
+func TestHub_StrokePersistedSentToUsersConnections(t *testing.T) {
+	handler, _, _ := setupHandler(t)
+	hub := handler.Hub
+
+	client := ws.NewClient(hub, nil, models.User{Id: "user1"}, nil)
+	other := ws.NewClient(hub, nil, models.User{Id: "user2"}, nil)
+	hub.OpenCh <- client
+	hub.OpenCh <- other
+
+	// The hub may take the ack before the opens, so wait until the client gets one
+	assert.Eventually(t, func() bool {
+		hub.StrokesPersistedCh <- service.StrokesPersistedMessage{UserId: "user1", StrokeIds: []string{"stroke0"}}
+		select {
+		case <-client.Send:
+			return true
+		case <-time.After(10 * time.Millisecond):
+			return false
+		}
+	}, time.Second, 10*time.Millisecond)
+
+	hub.StrokesPersistedCh <- service.StrokesPersistedMessage{UserId: "user1", StrokeIds: []string{"stroke1", "stroke2"}}
+
+	var strokeIds []string
+	for len(strokeIds) < 2 {
+		select {
+		case msgBytes := <-client.Send:
+			var msg struct {
+				Type string `json:"type"`
+				Data struct {
+					StrokeId string `json:"strokeId"`
+				} `json:"data"`
+			}
+			assert.NoError(t, json.Unmarshal(msgBytes, &msg))
+			assert.Equal(t, "stroke_persisted", msg.Type)
+			// Skip any late reply to the wait above
+			if msg.Data.StrokeId != "stroke0" {
+				strokeIds = append(strokeIds, msg.Data.StrokeId)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatal("stroke_persisted was not sent")
+		}
+	}
+	assert.Equal(t, []string{"stroke1", "stroke2"}, strokeIds)
+	// Only the user's own connections are told
+	assert.Empty(t, other.Send)
+}
+
+func TestHub_SubscribeRejectedWhenPageAtCapacity(t *testing.T) {
+	setup, _, mockCache := setupHandler(t)
+	hub := ws.NewHub(mockCache)
+	hub.MaxSubscribersPerPage = 1
+	go hub.Run()
+	handler := ws.NewHandler(setup.Service, hub)
+
+	mockCache.On("Subscribe", mock.Anything, "page:example.com", mock.Anything).Return(nil).Once()
+
+	first := ws.NewClient(hub, nil, models.User{Id: "user1"}, nil)
+	second := ws.NewClient(hub, nil, models.User{Id: "user2"}, nil)
+	data := map[string]any{"pageKey": "example.com", "layer": 0}
+
+	resp := sendMessage(t, handler, first, "subscribe", data)
+	assert.Equal(t, "subscribe_response", resp.Type)
+	assert.Equal(t, true, resp.Data["success"])
+
+	resp = sendMessage(t, handler, second, "subscribe", data)
+	assert.Equal(t, "subscribe_response", resp.Type)
+	assert.Equal(t, false, resp.Data["success"])
+	assert.Equal(t, "page at capacity", resp.Data["reason"])
+
+	// Existing subscribers are unaffected
+	resp = sendMessage(t, handler, first, "subscribe", data)
+	assert.Equal(t, true, resp.Data["success"])
+	mockCache.AssertNumberOfCalls(t, "Subscribe", 1)
+}
+
+func TestHub_DuplicateSubscribeCountedOnce(t *testing.T) {
+	setup, _, mockCache := setupHandler(t)
+	hub := ws.NewHub(mockCache)
+	hub.MaxSubscribersPerPage = 1
+	go hub.Run()
+	handler := ws.NewHandler(setup.Service, hub)
+
+	mockCache.On("Subscribe", mock.Anything, "page:example.com", mock.Anything).Return(nil)
+
+	first := ws.NewClient(hub, nil, models.User{Id: "user1"}, nil)
+	second := ws.NewClient(hub, nil, models.User{Id: "user2"}, nil)
+	data := map[string]any{"pageKey": "example.com", "layer": 0}
+
+	resp := sendMessage(t, handler, first, "subscribe", data)
+	assert.Equal(t, true, resp.Data["success"])
+	assert.Nil(t, resp.Data["alreadySubscribed"])
+
+	resp = sendMessage(t, handler, first, "subscribe", data)
+	assert.Equal(t, true, resp.Data["success"])
+	assert.Equal(t, true, resp.Data["alreadySubscribed"])
+
+	// A single unsubscribe frees the page's only place
+	resp = sendMessage(t, handler, first, "unsubscribe", data)
+	assert.Equal(t, true, resp.Data["success"])
+	// The unsubscribe isn't acknowledged by the hub, so retry until it was processed
+	assert.Eventually(t, func() bool {
+		return sendMessage(t, handler, second, "subscribe", data).Data["success"] == true
+	}, time.Second, 10*time.Millisecond)
+
+	// The page's redis subscription was created once per subscriber, not per subscribe message
+	mockCache.AssertNumberOfCalls(t, "Subscribe", 2)
+}
+
+func TestHub_ForwardsNewStrokesUnchanged(t *testing.T) {
+	handler, _, mockCache := setupHandler(t)
+	hub := handler.Hub
+
+	var onMessage func([]byte)
+	mockCache.On("Subscribe", mock.Anything, "page:example.com", mock.Anything).Run(func(args mock.Arguments) {
+		onMessage = args.Get(2).(func([]byte))
+	}).Return(nil).Once()
+
+	client := ws.NewClient(hub, nil, models.User{Id: "user1"}, nil)
+	resp := sendMessage(t, handler, client, "subscribe", map[string]any{"pageKey": "example.com", "layer": 0})
+	assert.Equal(t, true, resp.Data["success"])
+
+	batch, err := json.Marshal(service.NewStrokesMessage{
+		Type: "new_strokes",
+		Data: service.NewStrokesData{
+			PageKey: "example.com",
+			Layer:   models.LayerPublic,
+			Strokes: []service.SequencedStroke{
+				{Seq: 1, Stroke: models.Stroke{Id: "stroke1", UserId: "user2", Content: []byte("data1")}},
+				{Seq: 2, Stroke: models.Stroke{Id: "stroke2", UserId: "user3", Content: []byte("data2")}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	onMessage(batch)
+
+	for {
+		select {
+		case msgBytes := <-client.Send:
+			var msg struct {
+				Type string `json:"type"`
+			}
+			assert.NoError(t, json.Unmarshal(msgBytes, &msg))
+			if msg.Type != "new_strokes" {
+				continue
+			}
+			assert.Equal(t, batch, msgBytes)
+			return
+		case <-time.After(1 * time.Second):
+			t.Fatal("new_strokes was not forwarded")
+		}
+	}
+}
+
+func TestHub_LogoutThenBroadcastDoesNotPanic(t *testing.T) {
+	handler, _, mockCache := setupHandler(t)
+	hub := handler.Hub
+	shutdownCtx, shutdown := context.WithCancel(context.Background())
+	defer shutdown()
+
+	var onMessage func([]byte)
+	mockCache.On("Subscribe", mock.Anything, "page:example.com", mock.Anything).Run(func(args mock.Arguments) {
+		onMessage = args.Get(2).(func([]byte))
+	}).Return(nil).Once()
+	// Saved again when the logged out connection unregisters
+	mockCache.On("SetReconnectState", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil).Maybe()
+
+	upgrader := websocket.Upgrader{}
+	clients := make(chan *ws.Client, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := ws.NewClient(hub, conn, models.User{Id: "user1"}, handler.HandleWsMessage)
+		hub.OpenCh <- client
+		go client.WritePump(shutdownCtx)
+		go client.ReadPump()
+		clients <- client
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	<-clients
+
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"subscribe","data":{"pageKey":"example.com","layer":0}}`)))
+	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	for {
+		_, frame, err := conn.ReadMessage()
+		if !assert.NoError(t, err) {
+			return
+		}
+		if decodeFrame(t, frame).Type == "subscribe_response" {
+			break
+		}
+	}
+
+	// Broadcasts arriving right after the logout, before the client is unregistered, must not panic the hub
+	hub.UserLogoutCh <- "user1"
+	for range 10 {
+		onMessage([]byte(`{"type":"new_stroke"}`))
+	}
+
+	// The connection is closed by the server
+	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			var netErr net.Error
+			assert.False(t, errors.As(err, &netErr) && netErr.Timeout(), "connection was not closed")
+			break
+		}
+	}
+
+	// The hub keeps running
+	hub.UserLogoutCh <- "user2"
+}
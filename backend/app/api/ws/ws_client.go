@@ -1,31 +1,133 @@
 package ws
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/zlnvch/webverse/cache"
 	"github.com/zlnvch/webverse/models"
+	"github.com/zlnvch/webverse/service"
 	"golang.org/x/time/rate"
 )
 
-const (
+// ConnectionTimeouts are the keepalive and write deadlines of every connection
+type ConnectionTimeouts struct {
 	// Time allowed to write a message to the peer.
-	writeWait = 10 * time.Second
-
+	WriteWait time.Duration
 	// Time allowed to read the next pong message from the peer.
-	pongWait = 60 * time.Second
+	PongWait time.Duration
+	// Send pings to peer with this period. Must be less than PongWait.
+	PingPeriod time.Duration
+}
+
+func DefaultConnectionTimeouts() ConnectionTimeouts {
+	return ConnectionTimeouts{
+		WriteWait:  10 * time.Second,
+		PongWait:   60 * time.Second,
+		PingPeriod: (60 * time.Second * 9) / 10,
+	}
+}
+
+func (timeouts ConnectionTimeouts) Validate() error {
+	if timeouts.WriteWait <= 0 || timeouts.PongWait <= 0 || timeouts.PingPeriod <= 0 {
+		return errors.New("connection timeouts must be positive")
+	}
+	// Otherwise the read deadline passes before the next ping is even sent
+	if timeouts.PingPeriod >= timeouts.PongWait {
+		return errors.New("ping period must be less than pong wait")
+	}
+	return nil
+}
+
+// LoadLimits caps the distinct pages a connection can load, each of which may cost a store query and cache backfill
+type LoadLimits struct {
+	// Distinct pages a connection can load within Window, reloading a page is free
+	MaxPages int
+	Window   time.Duration
+}
+
+func DefaultLoadLimits() LoadLimits {
+	return LoadLimits{
+		MaxPages: 100,
+		Window:   time.Minute,
+	}
+}
+
+func (limits LoadLimits) Validate() error {
+	if limits.MaxPages <= 0 || limits.Window <= 0 {
+		return errors.New("load limits must be positive")
+	}
+	return nil
+}
+
+var errTooManyLoads = errors.New("too many page loads")
+
+// SendOverflowPolicy is what happens to a broadcast when a connection's send buffer is full
+type SendOverflowPolicy int
+
+const (
+	// Wait for room, holding up the broadcast to every other subscriber until the connection catches up
+	SendOverflowBlock SendOverflowPolicy = iota
+	// Drop the oldest queued message to make room, the client detects the gap from the page's seq
+	SendOverflowDropOldest
+	// Close the connection, the client reconnects and reloads its pages
+	SendOverflowDisconnect
+)
+
+// ParseSendOverflowPolicy parses "block", "drop_oldest" or "disconnect"
+func ParseSendOverflowPolicy(s string) (SendOverflowPolicy, error) {
+	switch s {
+	case "block":
+		return SendOverflowBlock, nil
+	case "drop_oldest":
+		return SendOverflowDropOldest, nil
+	case "disconnect":
+		return SendOverflowDisconnect, nil
+	}
+	return 0, fmt.Errorf("unknown send overflow policy %q", s)
+}
+
+// rateLimitState is where a connection stands with the message rate limit
+type rateLimitState int
+
+const (
+	rateLimitOK rateLimitState = iota
+	// Warned about a breach, further breaches within the grace window are counted
+	rateLimitWarned
+)
 
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
+// What ReadPump does with a message after the rate limit check
+type rateDecision int
 
+const (
+	rateHandle rateDecision = iota
+	rateDrop
+	rateClose
+)
+
+const (
 	// Maximum message size allowed from peer.
 	maxMessageSize = 1024 * 16
 
 	// Rate limiting: 20 messages per second with a burst of 30
 	messagesPerSecond = 20
 	burstLimit        = 30
+	// Messages dropped during the grace window before the connection is closed. Some were sent
+	// before the client got the warning, so a full burst of them is tolerated
+	maxGraceBreaches = burstLimit
+
+	// Binary frames start with a header byte telling how the rest is encoded
+	// Text frames are always JSON objects, so no text message starts with one
+	frameHeaderGzip byte = 0x01
 )
 
 type MessageHandler func(client *Client, messageType int, messageBytes []byte)
@@ -38,11 +140,20 @@ func NewClient(hub *Hub, conn *websocket.Conn, user models.User, handler Message
 		user:            user,
 		handler:         handler,
 		subscribedPages: make(map[string]struct{}),
-		Send:            make(chan []byte, 128),
-		updateKeys:      make(chan keysUpdatedData, 2),
+		Send:            make(chan []byte, hub.SendBufferSize),
+		updateKeys:      make(chan service.UserKeysUpdatedMessage, 2),
+		keysDeleted:     user.KeyVersion > 0 && user.SaltKEK == "",
+		reconnectToken:  rand.Text(),
+		reconnectPages:  make(chan []string, 1),
 		ctx:             ctx,
 		cancel:          cancel,
 		limiter:         rate.NewLimiter(rate.Limit(messagesPerSecond), burstLimit),
+		timeouts:        hub.Timeouts,
+		loadLimits:      hub.LoadLimits,
+		loadedPages:     make(map[string]time.Time),
+		rateLimitGrace:  hub.RateLimitGrace,
+		sendOverflow:    hub.SendOverflow,
+		reconnectTTL:    hub.ReconnectTokenTTL,
 	}
 }
 
@@ -54,10 +165,32 @@ type Client struct {
 	handler         MessageHandler
 	subscribedPages map[string]struct{}
 	Send            chan []byte // Buffered channel of outbound messages.
-	updateKeys      chan keysUpdatedData
+	updateKeys      chan service.UserKeysUpdatedMessage
+	keysDeleted     bool
+	reconnectToken  string
+	reconnectPages  chan []string
+	reconnectTTL    time.Duration
+	compress        bool // Only accessed from ReadPump
 	ctx             context.Context
 	cancel          context.CancelFunc
 	limiter         *rate.Limiter
+	timeouts        ConnectionTimeouts
+	loadLimits      LoadLimits
+	// When each page was first loaded in the current window. Only accessed from ReadPump
+	loadedPages map[string]time.Time
+	// How long a rate limited connection has to slow down, 0 closes it on the first breach
+	rateLimitGrace time.Duration
+	// Rate limit state machine, only accessed from ReadPump
+	rateState     rateLimitState
+	graceUntil    time.Time
+	graceBreaches int
+	sendOverflow  SendOverflowPolicy
+	// Set once the connection is being closed for a full send buffer
+	overflowed atomic.Bool
+	// Unix nanoseconds of the unanswered ping, 0 if there is none. Set by WritePump, cleared by ReadPump
+	pingSent atomic.Int64
+	// Round-trip time of the last answered ping
+	rtt atomic.Int64
 }
 
 func (c *Client) ReadPump() {
@@ -67,8 +200,12 @@ func (c *Client) ReadPump() {
 	}()
 
 	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	c.conn.SetReadDeadline(time.Now().Add(c.timeouts.PongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(c.timeouts.PongWait))
+		c.recordPong()
+		return nil
+	})
 
 	for {
 		messageType, messageBytes, err := c.conn.ReadMessage()
@@ -79,9 +216,12 @@ func (c *Client) ReadPump() {
 			break
 		}
 
-		if !c.limiter.Allow() {
+		switch c.checkRateLimit(time.Now()) {
+		case rateDrop:
+			continue
+		case rateClose:
 			log.Printf("Closing connection for user %s: message rate limit exceeded", c.user.Id)
-			break
+			return
 		}
 
 		c.handler(c, messageType, messageBytes)
@@ -89,7 +229,7 @@ func (c *Client) ReadPump() {
 }
 
 func (c *Client) WritePump(shutdownCtx context.Context) {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(c.timeouts.PingPeriod)
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
@@ -98,19 +238,24 @@ func (c *Client) WritePump(shutdownCtx context.Context) {
 	for {
 		select {
 		case message, ok := <-c.Send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.SetWriteDeadline(time.Now().Add(c.timeouts.WriteWait))
 			if !ok {
 				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 
-			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+			frameType := websocket.TextMessage
+			if len(message) > 0 && message[0] == frameHeaderGzip {
+				frameType = websocket.BinaryMessage
+			}
+			if err := c.conn.WriteMessage(frameType, message); err != nil {
 				log.Printf("WS send error: %v", err)
 				return
 			}
 
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.SetWriteDeadline(time.Now().Add(c.timeouts.WriteWait))
+			c.pingSent.Store(time.Now().UnixNano())
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
@@ -128,19 +273,271 @@ func (c *Client) WritePump(shutdownCtx context.Context) {
 func (c *Client) StatePump() {
 	for {
 		select {
-		case keysUpdatedData := <-c.updateKeys:
-			if keysUpdatedData.KeyVersion >= c.user.KeyVersion {
-				c.user.KeyVersion = keysUpdatedData.KeyVersion
-				if keysUpdatedData.KeysDeleted {
+		case keysUpdatedMsg := <-c.updateKeys:
+			if keysUpdatedMsg.Supersedes(c.user.KeyVersion, c.keysDeleted) {
+				c.user.KeyVersion = keysUpdatedMsg.KeyVersion
+				c.keysDeleted = keysUpdatedMsg.KeysDeleted
+				if keysUpdatedMsg.KeysDeleted {
+					c.user.SaltKEK = ""
 					c.user.EncryptedDEK1 = ""
 					c.user.NonceDEK1 = ""
 					c.user.EncryptedDEK2 = ""
 					c.user.NonceDEK2 = ""
+				} else if keys := keysUpdatedMsg.Keys; keys != nil {
+					c.user.SaltKEK = keys.SaltKEK
+					c.user.EncryptedDEK1 = keys.EncryptedDEK1
+					c.user.NonceDEK1 = keys.NonceDEK1
+					c.user.EncryptedDEK2 = keys.EncryptedDEK2
+					c.user.NonceDEK2 = keys.NonceDEK2
 				}
 			}
 
+		case pageKeys := <-c.reconnectPages:
+			c.saveReconnectState(pageKeys)
+
 		case <-c.ctx.Done():
 			return
 		}
 	}
 }
+
+// allowLoad reports whether the connection may load the page, must be called from ReadPump
+func (c *Client) allowLoad(pageKey string) bool {
+	now := time.Now()
+	for loadedKey, loadedAt := range c.loadedPages {
+		if now.Sub(loadedAt) >= c.loadLimits.Window {
+			delete(c.loadedPages, loadedKey)
+		}
+	}
+
+	if _, ok := c.loadedPages[pageKey]; ok {
+		return true
+	}
+	if len(c.loadedPages) >= c.loadLimits.MaxPages {
+		return false
+	}
+	c.loadedPages[pageKey] = now
+	return true
+}
+
+type rateLimitedMessage struct {
+	Type string          `json:"type"`
+	Data rateLimitedData `json:"data"`
+}
+
+type rateLimitedData struct {
+	GraceMs int64 `json:"graceMs"`
+}
+
+// checkRateLimit decides what happens to a message under the rate limit, must be called from ReadPump
+// The first breach only warns the client and drops the message, the connection is closed if it keeps
+// exceeding the limit until the grace window ends
+func (c *Client) checkRateLimit(now time.Time) rateDecision {
+	allowed := c.limiter.AllowN(now, 1)
+	if c.rateState == rateLimitWarned && !now.Before(c.graceUntil) {
+		c.rateState = rateLimitOK
+	}
+	if allowed {
+		return rateHandle
+	}
+	if c.rateLimitGrace <= 0 {
+		return rateClose
+	}
+
+	switch c.rateState {
+	case rateLimitOK:
+		c.rateState = rateLimitWarned
+		c.graceUntil = now.Add(c.rateLimitGrace)
+		c.graceBreaches = 0
+		log.Printf("User %s exceeded the message rate limit, grace window started", c.user.Id)
+
+		msg := rateLimitedMessage{Type: "rate_limited", Data: rateLimitedData{GraceMs: c.rateLimitGrace.Milliseconds()}}
+		if msgBytes, err := json.Marshal(msg); err == nil {
+			c.queue(msgBytes)
+		}
+		return rateDrop
+
+	default:
+		c.graceBreaches++
+		if c.graceBreaches > maxGraceBreaches {
+			return rateClose
+		}
+		return rateDrop
+	}
+}
+
+// broadcast hands a hub message to WritePump, applying the overflow policy if Send is full
+// Must be called from the hub's Run
+func (c *Client) broadcast(message []byte) {
+	if c.sendOverflow != SendOverflowBlock {
+		c.queue(message)
+		return
+	}
+	select {
+	case c.Send <- message:
+	// WritePump is gone, nothing will make room
+	case <-c.ctx.Done():
+	}
+}
+
+// queue hands a message to WritePump without blocking, applying the overflow policy if Send is full
+// Replies the connection sends itself are dropped when full with SendOverflowBlock, rather than blocking their pump
+// Returns whether the message was queued
+func (c *Client) queue(message []byte) bool {
+	if c.overflowed.Load() {
+		return false
+	}
+	select {
+	case c.Send <- message:
+		return true
+	default:
+	}
+
+	switch c.sendOverflow {
+	case SendOverflowDisconnect:
+		if c.overflowed.CompareAndSwap(false, true) {
+			log.Printf("Closing connection for user %s: send buffer full", c.user.Id)
+			// ReadPump fails on the closed connection and unregisters the client
+			c.conn.Close()
+		}
+		return false
+
+	case SendOverflowBlock:
+		return false
+
+	default:
+		select {
+		case <-c.Send:
+		default:
+		}
+		// Another broadcast may have taken the freed slot, then this one is dropped instead
+		select {
+		case c.Send <- message:
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+// RTT returns the round-trip time of the connection's last answered ping, 0 before the first one
+func (c *Client) RTT() time.Duration {
+	return time.Duration(c.rtt.Load())
+}
+
+type latencyMessage struct {
+	Type string      `json:"type"`
+	Data latencyData `json:"data"`
+}
+
+type latencyData struct {
+	RttMs int64 `json:"rttMs"`
+}
+
+// recordPong measures the round trip of the last ping and tells the client about it
+// Pongs without a ping in flight (browsers may send them unsolicited) are ignored
+func (c *Client) recordPong() {
+	sent := c.pingSent.Swap(0)
+	if sent == 0 {
+		return
+	}
+	rtt := time.Since(time.Unix(0, sent))
+	c.rtt.Store(int64(rtt))
+
+	msg := latencyMessage{Type: "latency", Data: latencyData{RttMs: rtt.Milliseconds()}}
+	if msgBytes, err := json.Marshal(msg); err == nil {
+		c.queue(msgBytes)
+	}
+}
+
+// gzipFrame compresses a JSON message into a binary frame: frameHeaderGzip followed by the gzip stream
+func gzipFrame(message []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(frameHeaderGzip)
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(message); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type reconnectTokenMessage struct {
+	Type string             `json:"type"`
+	Data reconnectTokenData `json:"data"`
+}
+
+type reconnectTokenData struct {
+	Token string `json:"token"`
+}
+
+// queueKeysUpdate hands a key update to StatePump without blocking the hub, must be called from the hub's Run
+// If StatePump is behind, the oldest pending update is dropped: StatePump only keeps the latest one anyway
+func (c *Client) queueKeysUpdate(msg service.UserKeysUpdatedMessage) {
+	select {
+	case c.updateKeys <- msg:
+		return
+	default:
+	}
+	select {
+	case <-c.updateKeys:
+	default:
+	}
+	c.updateKeys <- msg
+}
+
+// queueReconnectState hands the connection's current pages to StatePump, must be called from the hub's Run
+// Only the latest page set matters, so a pending one is replaced
+func (c *Client) queueReconnectState() {
+	pageKeys := c.subscribedPageKeys()
+
+	select {
+	case <-c.reconnectPages:
+	default:
+	}
+	c.reconnectPages <- pageKeys
+}
+
+// refreshReconnectState saves the connection's pages again once it has closed, must be called from the hub's Run
+// The state is otherwise only saved on subscription changes, so the token would expire reconnectTTL
+// after the last one rather than after the drop. c.ctx is cancelled by now, so the save gets its own deadline
+func (c *Client) refreshReconnectState() {
+	if len(c.subscribedPages) == 0 {
+		return
+	}
+	state := cache.ReconnectState{UserId: c.user.Id, PageKeys: c.subscribedPageKeys()}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := c.hub.webverseCache.SetReconnectState(ctx, c.reconnectToken, state, c.reconnectTTL); err != nil {
+			log.Printf("Failed to refresh reconnect state for user %s: %v", c.user.Id, err)
+		}
+	}()
+}
+
+// subscribedPageKeys must be called from the hub's Run
+func (c *Client) subscribedPageKeys() []string {
+	pageKeys := make([]string, 0, len(c.subscribedPages))
+	for pageKey := range c.subscribedPages {
+		pageKeys = append(pageKeys, pageKey)
+	}
+	return pageKeys
+}
+
+// saveReconnectState stores the page set under the connection's reconnect token and sends the token to the client
+// After a dropped connection, the client sends the token in a resubscribe message to restore its pages
+func (c *Client) saveReconnectState(pageKeys []string) {
+	state := cache.ReconnectState{UserId: c.user.Id, PageKeys: pageKeys}
+	if err := c.hub.webverseCache.SetReconnectState(c.ctx, c.reconnectToken, state, c.reconnectTTL); err != nil {
+		log.Printf("Failed to save reconnect state for user %s: %v", c.user.Id, err)
+		return
+	}
+
+	msg := reconnectTokenMessage{Type: "reconnect_token", Data: reconnectTokenData{Token: c.reconnectToken}}
+	if msgBytes, err := json.Marshal(msg); err == nil {
+		c.queue(msgBytes)
+	}
+}
@@ -3,11 +3,13 @@ package ws
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"strings"
 
 	"github.com/gorilla/websocket"
+	"github.com/zlnvch/webverse/cache"
 	"github.com/zlnvch/webverse/models"
 	"github.com/zlnvch/webverse/service"
 )
@@ -34,6 +36,34 @@ func (h *Handler) NewWsUpgrader(requiredOrigin string) websocket.Upgrader {
 	}
 }
 
+// Our JWTs are far shorter, the claims are just the user's ids and timestamps
+const maxTokenLength = 2048
+
+var errMalformedToken = errors.New("malformed token")
+
+// wellFormedToken cheaply checks that the token has the header.payload.signature shape of a JWT,
+// with three non-empty base64url segments, before it gets parsed and verified
+func wellFormedToken(token string) bool {
+	if len(token) == 0 || len(token) > maxTokenLength {
+		return false
+	}
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return false
+	}
+	for _, segment := range segments {
+		if len(segment) == 0 {
+			return false
+		}
+		for _, c := range segment {
+			if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 // ServeWS handles websocket requests from the peer.
 func (h *Handler) ServeWS(wsUpgrader websocket.Upgrader, w http.ResponseWriter, r *http.Request, shutdownCtx context.Context) {
 	protocols := r.Header.Get("Sec-WebSocket-Protocol")
@@ -46,7 +76,12 @@ func (h *Handler) ServeWS(wsUpgrader websocket.Upgrader, w http.ResponseWriter,
 
 	token := strings.TrimSpace(protocolsSplit[1])
 
-	user, authErr := h.Service.AuthenticateToken(r.Context(), token)
+	// Only tokens shaped like one of our JWTs are worth verifying
+	var user models.User
+	authErr := errMalformedToken
+	if wellFormedToken(token) {
+		user, authErr = h.Service.AuthenticateToken(r.Context(), token)
+	}
 
 	conn, err := wsUpgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -109,6 +144,12 @@ type pageMessage struct {
 	PageKey string           `json:"pageKey"`
 	Layer   models.LayerType `json:"layer"`
 	LayerId string           `json:"layerId"`
+	// Subscribe only: also load the page's strokes into the subscribe response
+	LoadOnSubscribe bool `json:"loadOnSubscribe"`
+	// Subscribe only: the client accepts gzip-compressed load responses for the rest of the connection
+	Compress bool `json:"compress"`
+	// Sync_seq only: the sequence number of the last new_stroke the client received for the page
+	Seq int64 `json:"seq"`
 }
 
 type drawMessage struct {
@@ -126,6 +167,17 @@ type undoMessage struct {
 	StrokeId string           `json:"strokeId"`
 }
 
+// Only public strokes can be reported, so there is no layer
+type reportMessage struct {
+	PageKey  string `json:"pageKey"`
+	StrokeId string `json:"strokeId"`
+	Reason   string `json:"reason"`
+}
+
+type resubscribeMessage struct {
+	Token string `json:"token"`
+}
+
 type responseMessage struct {
 	Type string      `json:"type"`
 	Data interface{} `json:"data"`
@@ -157,6 +209,14 @@ func (h *Handler) HandleWsMessage(client *Client, messageType int, messageBytes
 		}
 		resp = h.handleSubscribe(client, pageMsg)
 
+	case "resubscribe":
+		var resubscribeMsg resubscribeMessage
+		if err := json.Unmarshal(msg.Data, &resubscribeMsg); err != nil {
+			log.Printf("Invalid resubscribe data: %v", err)
+			return
+		}
+		resp = h.handleResubscribe(client, resubscribeMsg)
+
 	case "unsubscribe":
 		var pageMsg pageMessage
 		if err := json.Unmarshal(msg.Data, &pageMsg); err != nil {
@@ -189,6 +249,38 @@ func (h *Handler) HandleWsMessage(client *Client, messageType int, messageBytes
 		}
 		resp = h.handleDraw(client, redoMsg, true)
 
+	case "sync_seq":
+		var pageMsg pageMessage
+		if err := json.Unmarshal(msg.Data, &pageMsg); err != nil {
+			log.Printf("Invalid sync_seq data: %v", err)
+			return
+		}
+		resp = h.handleSyncSeq(pageMsg)
+
+	case "page_status":
+		var pageMsg pageMessage
+		if err := json.Unmarshal(msg.Data, &pageMsg); err != nil {
+			log.Printf("Invalid page_status data: %v", err)
+			return
+		}
+		resp = h.handlePageStatus(pageMsg)
+
+	case "validate":
+		var validateMsg drawMessage
+		if err := json.Unmarshal(msg.Data, &validateMsg); err != nil {
+			log.Printf("Invalid validate data: %v", err)
+			return
+		}
+		resp = h.handleValidate(validateMsg)
+
+	case "report":
+		var reportMsg reportMessage
+		if err := json.Unmarshal(msg.Data, &reportMsg); err != nil {
+			log.Printf("Invalid report data: %v", err)
+			return
+		}
+		resp = h.handleReport(client, reportMsg)
+
 	default:
 		log.Printf("Unknown message type: %v", msg.Type)
 	}
@@ -199,14 +291,35 @@ func (h *Handler) HandleWsMessage(client *Client, messageType int, messageBytes
 			log.Printf("Error marshaling response JSON: %v", err)
 			return
 		}
-		client.Send <- respBytes
+		// Loads are by far the largest responses
+		if resp.Type == "load_response" && client.compress {
+			if compressed, err := gzipFrame(respBytes); err == nil {
+				respBytes = compressed
+			} else {
+				log.Printf("Error compressing load response: %v", err)
+			}
+		}
+		// Runs on ReadPump, which must keep reading even if the client stops draining its responses
+		client.queue(respBytes)
 	}
 }
 
+// normalizePageKey maps variants of the message's page key to the one its strokes are stored and broadcast under
+func (h *Handler) normalizePageKey(pageMsg pageMessage) string {
+	return h.Service.Config.PageKeyPolicy.NormalizePageKey(pageMsg.PageKey, pageMsg.Layer == models.LayerPrivate)
+}
+
 func (h *Handler) handleLoad(client *Client, pageMsg pageMessage) responseMessage {
 	resp := responseMessage{
 		Type: "load_response",
 	}
+	pageMsg.PageKey = h.normalizePageKey(pageMsg)
+
+	if !client.allowLoad(pageMsg.PageKey) {
+		log.Printf("Rejecting load of page %s by user %s: %v", pageMsg.PageKey, client.user.Id, errTooManyLoads)
+		resp.Data = map[string]any{"success": false, "error": errTooManyLoads.Error(), "pageKey": pageMsg.PageKey, "layer": pageMsg.Layer, "layerId": pageMsg.LayerId, "strokes": []models.Stroke{}}
+		return resp
+	}
 
 	strokes, err := h.Service.LoadPage(context.Background(), pageMsg.PageKey, pageMsg.Layer)
 	if err != nil {
@@ -215,7 +328,7 @@ func (h *Handler) handleLoad(client *Client, pageMsg pageMessage) responseMessag
 		return resp
 	}
 
-	resp.Data = map[string]any{"success": true, "pageKey": pageMsg.PageKey, "layer": pageMsg.Layer, "layerId": pageMsg.LayerId, "strokes": strokes}
+	resp.Data = map[string]any{"success": true, "pageKey": pageMsg.PageKey, "layer": pageMsg.Layer, "layerId": pageMsg.LayerId, "strokes": strokes, "displaySeeds": service.UserDisplaySeeds(strokes)}
 	return resp
 }
 
@@ -223,16 +336,94 @@ func (h *Handler) handleSubscribe(client *Client, pageMsg pageMessage) responseM
 	resp := responseMessage{
 		Type: "subscribe_response",
 	}
+	pageMsg.PageKey = h.normalizePageKey(pageMsg)
 
-	if err := service.ValidatePageKey(pageMsg.PageKey, pageMsg.Layer == models.LayerPrivate); err != nil {
+	if err := h.Service.CheckPageKey(pageMsg.PageKey, pageMsg.Layer == models.LayerPrivate); err != nil {
 		log.Printf("Subscribe page key validation failed: %v", err)
 		resp.Data = map[string]any{"success": false, "pageKey": pageMsg.PageKey, "layer": pageMsg.Layer, "layerId": pageMsg.LayerId}
 		return resp
 	}
 
-	sub := subscription{client: client, pageKey: pageMsg.PageKey}
-	h.Hub.SubscribeCh <- sub
-	resp.Data = map[string]any{"success": true, "pageKey": pageMsg.PageKey, "layer": pageMsg.Layer, "layerId": pageMsg.LayerId}
+	if pageMsg.Compress {
+		client.compress = true
+	}
+
+	err := h.Hub.subscribe(client, pageMsg.PageKey)
+	if errors.Is(err, errAlreadySubscribed) {
+		// Nothing to redo, the client already has the page from its first subscribe
+		resp.Data = map[string]any{"success": true, "alreadySubscribed": true, "pageKey": pageMsg.PageKey, "layer": pageMsg.Layer, "layerId": pageMsg.LayerId}
+		return resp
+	}
+	if err != nil {
+		log.Printf("Subscribe to page %s failed: %v", pageMsg.PageKey, err)
+		data := map[string]any{"success": false, "pageKey": pageMsg.PageKey, "layer": pageMsg.Layer, "layerId": pageMsg.LayerId}
+		if errors.Is(err, errPageAtCapacity) {
+			data["reason"] = err.Error()
+		}
+		resp.Data = data
+		return resp
+	}
+	data := map[string]any{"success": true, "pageKey": pageMsg.PageKey, "layer": pageMsg.Layer, "layerId": pageMsg.LayerId}
+
+	// Load after subscribing, so strokes drawn in between are either loaded or broadcast to the client
+	if pageMsg.LoadOnSubscribe && !client.allowLoad(pageMsg.PageKey) {
+		// Still subscribed, the client can load the page once the window passes
+		log.Printf("Not loading page %s on subscribe for user %s: %v", pageMsg.PageKey, client.user.Id, errTooManyLoads)
+		data["loaded"] = false
+		data["error"] = errTooManyLoads.Error()
+		data["strokes"] = []models.Stroke{}
+	} else if pageMsg.LoadOnSubscribe {
+		strokes, err := h.Service.LoadPage(context.Background(), pageMsg.PageKey, pageMsg.Layer)
+		if err != nil {
+			// Still subscribed, the client can retry with a separate load
+			log.Printf("LoadPage on subscribe failed: %v", err)
+			data["loaded"] = false
+			data["strokes"] = []models.Stroke{}
+		} else {
+			data["loaded"] = true
+			data["strokes"] = strokes
+		}
+	}
+
+	resp.Data = data
+	return resp
+}
+
+// handleResubscribe restores the subscriptions of a previous connection from its reconnect token
+// The pages were validated when first subscribed, and the token is only valid for the same user
+func (h *Handler) handleResubscribe(client *Client, resubscribeMsg resubscribeMessage) responseMessage {
+	resp := responseMessage{
+		Type: "resubscribe_response",
+	}
+
+	if resubscribeMsg.Token == "" {
+		resp.Data = map[string]any{"success": false, "pageKeys": []string{}}
+		return resp
+	}
+
+	state, err := h.Service.Cache.GetReconnectState(context.Background(), resubscribeMsg.Token)
+	if err != nil {
+		log.Printf("Failed to get reconnect state: %v", err)
+		resp.Data = map[string]any{"success": false, "pageKeys": []string{}}
+		return resp
+	}
+
+	// Unknown or expired tokens have no user
+	if state.UserId != client.user.Id {
+		resp.Data = map[string]any{"success": false, "pageKeys": []string{}}
+		return resp
+	}
+
+	// Only report the pages that were actually resubscribed, the client subscribes to the rest itself
+	pageKeys := make([]string, 0, len(state.PageKeys))
+	for _, pageKey := range state.PageKeys {
+		if err := h.Hub.subscribe(client, pageKey); err != nil && !errors.Is(err, errAlreadySubscribed) {
+			log.Printf("Resubscribe to page %s failed: %v", pageKey, err)
+			continue
+		}
+		pageKeys = append(pageKeys, pageKey)
+	}
+	resp.Data = map[string]any{"success": true, "pageKeys": pageKeys}
 
 	return resp
 }
@@ -241,8 +432,9 @@ func (h *Handler) handleUnsubscribe(client *Client, pageMsg pageMessage) respons
 	resp := responseMessage{
 		Type: "unsubscribe_response",
 	}
+	pageMsg.PageKey = h.normalizePageKey(pageMsg)
 
-	if err := service.ValidatePageKey(pageMsg.PageKey, pageMsg.Layer == models.LayerPrivate); err != nil {
+	if err := h.Service.Config.PageKeyPolicy.ValidatePageKey(pageMsg.PageKey, pageMsg.Layer == models.LayerPrivate); err != nil {
 		log.Printf("Unsubscribe page key validation failed: %v", err)
 		resp.Data = map[string]any{"success": false, "pageKey": pageMsg.PageKey, "layer": pageMsg.Layer, "layerId": pageMsg.LayerId}
 		return resp
@@ -334,3 +526,109 @@ func (h *Handler) handleUndo(client *Client, undoMsg undoMessage) responseMessag
 
 	return resp
 }
+
+func (h *Handler) handleSyncSeq(pageMsg pageMessage) responseMessage {
+	resp := responseMessage{
+		Type: "sync_seq_response",
+	}
+
+	missed, err := h.Service.SyncPageSeq(context.Background(), pageMsg.PageKey, pageMsg.Layer, pageMsg.Seq)
+	if err != nil {
+		log.Printf("SyncPageSeq failed: %v", err)
+		data := map[string]any{"success": false, "pageKey": pageMsg.PageKey, "layer": pageMsg.Layer, "layerId": pageMsg.LayerId}
+		// Tells the client to load the page instead
+		if errors.Is(err, cache.ErrSequenceGap) {
+			data["reason"] = err.Error()
+		}
+		resp.Data = data
+		return resp
+	}
+
+	resp.Data = map[string]any{
+		"success":    true,
+		"pageKey":    pageMsg.PageKey,
+		"layer":      pageMsg.Layer,
+		"layerId":    pageMsg.LayerId,
+		"seq":        missed.Seq,
+		"strokes":    missed.Strokes,
+		"removedIds": missed.RemovedIds,
+	}
+	return resp
+}
+
+func (h *Handler) handlePageStatus(pageMsg pageMessage) responseMessage {
+	resp := responseMessage{
+		Type: "page_status_response",
+	}
+
+	status, err := h.Service.GetPageStatus(context.Background(), pageMsg.PageKey, pageMsg.Layer)
+	if err != nil {
+		log.Printf("GetPageStatus failed: %v", err)
+		resp.Data = map[string]any{
+			"success": false,
+			"error":   err.Error(),
+			"pageKey": pageMsg.PageKey,
+			"layer":   pageMsg.Layer,
+			"layerId": pageMsg.LayerId,
+		}
+		return resp
+	}
+
+	resp.Data = map[string]any{
+		"success":     true,
+		"pageKey":     pageMsg.PageKey,
+		"layer":       pageMsg.Layer,
+		"layerId":     pageMsg.LayerId,
+		"strokeCount": status.StrokeCount,
+		"maxStrokes":  status.MaxStrokes,
+		"full":        status.Full,
+		"complete":    status.Complete,
+	}
+	return resp
+}
+
+func (h *Handler) handleValidate(validateMsg drawMessage) responseMessage {
+	resp := responseMessage{
+		Type: "validate_response",
+	}
+
+	data := map[string]any{
+		"success":      true,
+		"pageKey":      validateMsg.PageKey,
+		"layer":        validateMsg.Layer,
+		"layerId":      validateMsg.LayerId,
+		"userStrokeId": validateMsg.UserStrokeId,
+	}
+	if err := h.Service.ValidateStroke(validateMsg.PageKey, validateMsg.Layer, validateMsg.Stroke.Content); err != nil {
+		data["success"] = false
+		data["error"] = err.Error()
+	}
+
+	resp.Data = data
+	return resp
+}
+
+func (h *Handler) handleReport(client *Client, reportMsg reportMessage) responseMessage {
+	resp := responseMessage{
+		Type: "report_response",
+	}
+
+	err := h.Service.ReportStroke(context.Background(), client.user, reportMsg.PageKey, reportMsg.StrokeId, reportMsg.Reason)
+	if err != nil {
+		log.Printf("ReportStroke failed: %v", err)
+		resp.Data = map[string]any{
+			"success":  false,
+			"error":    err.Error(),
+			"pageKey":  reportMsg.PageKey,
+			"strokeId": reportMsg.StrokeId,
+		}
+		return resp
+	}
+
+	resp.Data = map[string]any{
+		"success":  true,
+		"pageKey":  reportMsg.PageKey,
+		"strokeId": reportMsg.StrokeId,
+	}
+	return resp
+}
@@ -3,7 +3,9 @@ package ws
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
+	"time"
 
 	"github.com/zlnvch/webverse/cache"
 	"github.com/zlnvch/webverse/service"
@@ -12,11 +14,32 @@ import (
 type subscription struct {
 	client  *Client
 	pageKey string
+	// Receives the outcome of a subscribe, must be buffered
+	result chan error
 }
 
+// broadcast is a message published to a page, fanned out to its subscribers by Run
+type broadcast struct {
+	pageKey string
+	message []byte
+}
+
+var (
+	errMaxSubscriptions = errors.New("max subscriptions per connection reached")
+	errPageAtCapacity   = errors.New("page at capacity")
+	// Not a failure: the client already receives the page's messages
+	errAlreadySubscribed = errors.New("already subscribed")
+)
+
 type keysUpdatedData struct {
 	KeyVersion  int  `json:"keyVersion"`
 	KeysDeleted bool `json:"keysDeleted"`
+	// Same fields as GET /me, only sent if the service publishes key material
+	SaltKEK       string `json:"saltKEK,omitempty"`
+	EncryptedDEK1 string `json:"encryptedDEK1,omitempty"`
+	NonceDEK1     string `json:"nonceDEK1,omitempty"`
+	EncryptedDEK2 string `json:"encryptedDEK2,omitempty"`
+	NonceDEK2     string `json:"nonceDEK2,omitempty"`
 }
 
 type keysUpdatedMessage struct {
@@ -24,16 +47,43 @@ type keysUpdatedMessage struct {
 	Data keysUpdatedData `json:"data"`
 }
 
+type strokePersistedData struct {
+	StrokeId string `json:"strokeId"`
+}
+
+type strokePersistedMessage struct {
+	Type string              `json:"type"`
+	Data strokePersistedData `json:"data"`
+}
+
 // Hub maintains the set of active clients and broadcasts messages to the
 // clients.
 type Hub struct {
+	// Given to every new client, set before Run
+	Timeouts   ConnectionTimeouts
+	LoadLimits LoadLimits
+	// Every draw on a page is sent to all of its subscribers, so viral pages are capped. Set before Run
+	MaxSubscribersPerPage int
+	// Given to every new client: how long a connection exceeding the message rate limit has to
+	// slow down before it is closed, 0 closes it right away. Set before Run
+	RateLimitGrace time.Duration
+	// Given to every new client: how long after its last subscription change, or after it closes,
+	// a connection's reconnect token can restore its pages. Set before Run
+	ReconnectTokenTTL time.Duration
+	// Given to every new client: messages queued for a connection, and what happens to broadcasts
+	// once the queue is full. Set before Run
+	SendBufferSize         int
+	SendOverflow           SendOverflowPolicy
 	webverseCache          cache.WebverseCache
 	OpenCh                 chan *Client
 	CloseCh                chan *Client
 	SubscribeCh            chan subscription
 	UnsubscribeCh          chan subscription
 	UserDeletedCh          chan string
+	UserLogoutCh           chan string
 	UserKeysUpdatedCh      chan service.UserKeysUpdatedMessage
+	StrokesPersistedCh     chan service.StrokesPersistedMessage
+	broadcastCh            chan broadcast
 	userToClients          map[string]map[*Client]struct{}
 	pageToClients          map[string]map[*Client]struct{}
 	pageToSubscriberCancel map[string]context.CancelFunc
@@ -41,13 +91,22 @@ type Hub struct {
 
 func NewHub(webverseCache cache.WebverseCache) *Hub {
 	return &Hub{
+		Timeouts:               DefaultConnectionTimeouts(),
+		MaxSubscribersPerPage:  DefaultMaxSubscribersPerPage,
+		RateLimitGrace:         DefaultRateLimitGrace,
+		SendBufferSize:         DefaultSendBufferSize,
+		ReconnectTokenTTL:      DefaultReconnectTokenTTL,
+		LoadLimits:             DefaultLoadLimits(),
 		webverseCache:          webverseCache,
 		OpenCh:                 make(chan *Client, 256),
 		CloseCh:                make(chan *Client, 256),
 		SubscribeCh:            make(chan subscription, 1024),
 		UnsubscribeCh:          make(chan subscription, 1024),
 		UserDeletedCh:          make(chan string, 64),
+		UserLogoutCh:           make(chan string, 64),
 		UserKeysUpdatedCh:      make(chan service.UserKeysUpdatedMessage, 64),
+		StrokesPersistedCh:     make(chan service.StrokesPersistedMessage, 1024),
+		broadcastCh:            make(chan broadcast, 1024),
 		userToClients:          make(map[string]map[*Client]struct{}),
 		pageToClients:          make(map[string]map[*Client]struct{}),
 		pageToSubscriberCancel: make(map[string]context.CancelFunc),
@@ -57,6 +116,11 @@ func NewHub(webverseCache cache.WebverseCache) *Hub {
 const (
 	maxConnectionsPerUser         = 3
 	maxSubscriptionsPerConnection = 50
+
+	DefaultMaxSubscribersPerPage = 5000
+	DefaultRateLimitGrace        = 2 * time.Second
+	DefaultSendBufferSize        = 128
+	DefaultReconnectTokenTTL     = 2 * time.Minute
 )
 
 func (h *Hub) Run() {
@@ -76,6 +140,7 @@ func (h *Hub) Run() {
 			h.userToClients[client.user.Id][client] = struct{}{}
 
 		case client := <-h.CloseCh:
+			client.refreshReconnectState()
 			for page := range client.subscribedPages {
 				delete(h.pageToClients[page], client)
 				if len(h.pageToClients[page]) == 0 {
@@ -92,8 +157,19 @@ func (h *Hub) Run() {
 			}
 
 		case sub := <-h.SubscribeCh:
+			// Checked first, so a repeated subscribe neither counts toward the limits nor saves the reconnect state again
+			if _, subscribed := sub.client.subscribedPages[sub.pageKey]; subscribed {
+				sub.result <- errAlreadySubscribed
+				continue
+			}
 			if len(sub.client.subscribedPages) >= maxSubscriptionsPerConnection {
 				log.Printf("Connection by user %s reached max subscriptions (%d)", sub.client.user.Id, maxSubscriptionsPerConnection)
+				sub.result <- errMaxSubscriptions
+				continue
+			}
+			if len(h.pageToClients[sub.pageKey]) >= h.MaxSubscribersPerPage {
+				log.Printf("Page %s reached max subscribers (%d)", sub.pageKey, h.MaxSubscribersPerPage)
+				sub.result <- errPageAtCapacity
 				continue
 			}
 			if h.pageToClients[sub.pageKey] == nil {
@@ -103,13 +179,14 @@ func (h *Hub) Run() {
 				pageKey := sub.pageKey
 				channel := "page:" + pageKey
 
+				// Fanned out by Run, the only goroutine touching the subscriber maps
 				err := h.webverseCache.Subscribe(ctx, channel, func(messageBytes []byte) {
-					for client := range h.pageToClients[pageKey] {
-						client.Send <- messageBytes
-					}
+					h.broadcastCh <- broadcast{pageKey: pageKey, message: messageBytes}
 				})
 				if err != nil {
 					log.Printf("Failed to create redis sub for channel %s: %v", channel, err)
+					cancel()
+					sub.result <- err
 					continue
 				}
 
@@ -118,10 +195,13 @@ func (h *Hub) Run() {
 			}
 			h.pageToClients[sub.pageKey][sub.client] = struct{}{}
 			sub.client.subscribedPages[sub.pageKey] = struct{}{}
+			sub.client.queueReconnectState()
+			sub.result <- nil
 
 		case unsub := <-h.UnsubscribeCh:
 			delete(h.pageToClients[unsub.pageKey], unsub.client)
 			delete(unsub.client.subscribedPages, unsub.pageKey)
+			unsub.client.queueReconnectState()
 			if len(h.pageToClients[unsub.pageKey]) == 0 {
 				if cancel, ok := h.pageToSubscriberCancel[unsub.pageKey]; ok {
 					cancel()
@@ -130,33 +210,75 @@ func (h *Hub) Run() {
 				delete(h.pageToClients, unsub.pageKey)
 			}
 
-		case userId := <-h.UserDeletedCh:
-			if clients, ok := h.userToClients[userId]; ok {
-				for client := range clients {
-					close(client.Send)
-					delete(h.userToClients[userId], client)
-				}
-				delete(h.userToClients, userId)
+		case msg := <-h.broadcastCh:
+			// Only blocks with SendOverflowBlock, then a slow client holds up every other page
+			for client := range h.pageToClients[msg.pageKey] {
+				client.broadcast(msg.message)
 			}
 
+		case userId := <-h.UserDeletedCh:
+			h.disconnectUser(userId)
+
+		case userId := <-h.UserLogoutCh:
+			h.disconnectUser(userId)
+
 		case userKeysUpdatedMsg := <-h.UserKeysUpdatedCh:
 			if clients, ok := h.userToClients[userKeysUpdatedMsg.UserId]; ok {
 				data := keysUpdatedData{KeyVersion: userKeysUpdatedMsg.KeyVersion, KeysDeleted: userKeysUpdatedMsg.KeysDeleted}
+				if keys := userKeysUpdatedMsg.Keys; keys != nil {
+					data.SaltKEK = keys.SaltKEK
+					data.EncryptedDEK1 = keys.EncryptedDEK1
+					data.NonceDEK1 = keys.NonceDEK1
+					data.EncryptedDEK2 = keys.EncryptedDEK2
+					data.NonceDEK2 = keys.NonceDEK2
+				}
 				message := keysUpdatedMessage{Type: "keys_updated", Data: data}
 				keysUpdatedBytes, err := json.Marshal(message)
 				if err == nil {
 					for client := range clients {
-						client.Send <- keysUpdatedBytes
-						client.updateKeys <- data
+						client.broadcast(keysUpdatedBytes)
+						client.queueKeysUpdate(userKeysUpdatedMsg)
 					}
 				}
 
 			}
 
+		case persistedMsg := <-h.StrokesPersistedCh:
+			// Every connection of the user, the stroke id tells the one that drew it
+			clients := h.userToClients[persistedMsg.UserId]
+			if len(clients) == 0 {
+				continue
+			}
+			for _, strokeId := range persistedMsg.StrokeIds {
+				message := strokePersistedMessage{Type: "stroke_persisted", Data: strokePersistedData{StrokeId: strokeId}}
+				if msgBytes, err := json.Marshal(message); err == nil {
+					for client := range clients {
+						client.broadcast(msgBytes)
+					}
+				}
+			}
+
 		}
 	}
 }
 
+// subscribe adds the client to the page's subscribers and waits until the hub has done so,
+// so the client is only told it is subscribed once it will actually receive the page's messages
+func (h *Hub) subscribe(client *Client, pageKey string) error {
+	sub := subscription{client: client, pageKey: pageKey, result: make(chan error, 1)}
+	h.SubscribeCh <- sub
+	return <-sub.result
+}
+
+// disconnectUser closes all of the user's connections, must be called from Run
+// Send is left open: broadcasts and responses may still be queued to the clients until ReadPump
+// fails on the closed connection and unregisters them through CloseCh
+func (h *Hub) disconnectUser(userId string) {
+	for client := range h.userToClients[userId] {
+		client.conn.Close()
+	}
+}
+
 func (h *Hub) InitSubscriptions(shutdownCtx context.Context) error {
 	err := h.webverseCache.Subscribe(shutdownCtx, "user-deleted", func(message []byte) {
 		var userDeletedMsg service.UserDeletedMessage
@@ -169,6 +291,17 @@ func (h *Hub) InitSubscriptions(shutdownCtx context.Context) error {
 		return err
 	}
 
+	err = h.webverseCache.Subscribe(shutdownCtx, "user-logout", func(message []byte) {
+		var userLogoutMsg service.UserLogoutMessage
+		if err := json.Unmarshal(message, &userLogoutMsg); err == nil {
+			h.UserLogoutCh <- userLogoutMsg.UserId
+		}
+	})
+	if err != nil {
+		log.Printf("WS hub failed to subscribe to user-logout: %v", err)
+		return err
+	}
+
 	err = h.webverseCache.Subscribe(shutdownCtx, "user-keys-updated", func(message []byte) {
 		var userKeysUpdatedMsg service.UserKeysUpdatedMessage
 		if err := json.Unmarshal(message, &userKeysUpdatedMsg); err == nil {
@@ -182,5 +315,18 @@ func (h *Hub) InitSubscriptions(shutdownCtx context.Context) error {
 		return err
 	}
 
+	err = h.webverseCache.Subscribe(shutdownCtx, "user-strokes-persisted", func(message []byte) {
+		var strokesPersistedMsg service.StrokesPersistedMessage
+		if err := json.Unmarshal(message, &strokesPersistedMsg); err == nil {
+			h.StrokesPersistedCh <- strokesPersistedMsg
+		} else {
+			log.Printf("Failed to unmarshal user-strokes-persisted message: %v", err)
+		}
+	})
+	if err != nil {
+		log.Printf("WS hub failed to subscribe to user-strokes-persisted: %v", err)
+		return err
+	}
+
 	return nil
 }
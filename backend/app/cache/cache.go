@@ -1,6 +1,12 @@
 package cache
 
-import "context"
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/zlnvch/webverse/models"
+)
 
 type StrokeCacheItem struct {
 	StrokeId string
@@ -8,22 +14,120 @@ type StrokeCacheItem struct {
 	Data     []byte
 }
 
+// SequencedStroke is a cached stroke with the sequence number its page assigned it when it was drawn
+type SequencedStroke struct {
+	Seq  int64
+	Data []byte
+}
+
+// StrokesAfterSeq is what changed on a page after a sequence number
+type StrokesAfterSeq struct {
+	Strokes []SequencedStroke
+	// Strokes removed after the sequence, e.g. undone, including strokes drawn before it
+	RemovedIds []string
+	// The page's last sequence number, removals take one too
+	LastSeq int64
+}
+
+// ErrSequenceGap means the cache no longer holds every stroke after the sequence, e.g. because the
+// page expired or was evicted, so the page has to be loaded instead
+var ErrSequenceGap = errors.New("strokes after sequence are not cached")
+
+type RecentPage struct {
+	PageKey string
+	// Unix milliseconds of the user's last draw on the page
+	LastDrawn int64
+}
+
+// ReconnectState is the set of pages a connection was subscribed to, restored with a reconnect token
+type ReconnectState struct {
+	UserId   string   `json:"userId"`
+	PageKeys []string `json:"pageKeys"`
+}
+
+// UserUsage is a computed estimate of a user's stored data, cached to avoid recounting on every request
+type UserUsage struct {
+	StrokeCount    int   `json:"strokeCount"`
+	PageCount      int   `json:"pageCount"`
+	EstimatedBytes int64 `json:"estimatedBytes"`
+	// Unix milliseconds of when the estimate was computed, 0 if there is none
+	Computed int64 `json:"computed"`
+}
+
 type WebverseCache interface {
 	Publish(ctx context.Context, channel string, message []byte) error
 	Subscribe(ctx context.Context, channel string, handler func(message []byte)) error
 
-	AddStroke(ctx context.Context, pageKey string, strokeId string, score int64, strokeData []byte) error
+	AddStroke(ctx context.Context, pageKey string, strokeId string, score int64, strokeData []byte) (int64, error)
 	AddStrokesBatch(ctx context.Context, pageKey string, strokes []StrokeCacheItem) error
 	RemoveStroke(ctx context.Context, pageKey string, strokeId string) error
 	GetStrokes(ctx context.Context, pageKey string) ([][]byte, error)
+	GetStrokesAfterSeq(ctx context.Context, pageKey string, seq int64) (StrokesAfterSeq, error)
 	GetPageStrokeCountFromZCard(ctx context.Context, pageKey string) (int64, error)
 
 	SetPageComplete(ctx context.Context, pageKey string) error
 	IsPageComplete(ctx context.Context, pageKey string) (bool, error)
 	InvalidatePages(ctx context.Context, pageKeys []string) error
+	GetPageVersionTag(ctx context.Context, pageKey string) (string, error)
+	TouchPage(ctx context.Context, pageKey string, touchedAt time.Time) (int64, error)
+	EvictOldestPages(ctx context.Context, maxPages int) ([]string, error)
+	GetTouchedPages(ctx context.Context, since time.Time, limit int) ([]string, error)
+
+	SetPagePaused(ctx context.Context, pageKey string, ttl time.Duration) error
+	ClearPagePaused(ctx context.Context, pageKey string) error
+	IsPagePaused(ctx context.Context, pageKey string) (bool, error)
+
+	AddUserDeletionPages(ctx context.Context, userId string, pageKeys []string) error
+	GetUserDeletionPages(ctx context.Context, userId string) ([]string, error)
+	ClearUserDeletionPages(ctx context.Context, userId string) error
+	SetUserDeletionCount(ctx context.Context, userId string, layer string, count int) (int, error)
+	ClearUserDeletionCount(ctx context.Context, userId string, layer string) error
+
+	AddRecentPage(ctx context.Context, userId string, pageKey string, drawnAt time.Time, maxSize int) error
+	GetRecentPages(ctx context.Context, userId string, limit int) ([]RecentPage, error)
+	ClearRecentPages(ctx context.Context, userId string) error
+
+	SetReconnectState(ctx context.Context, token string, state ReconnectState, ttl time.Duration) error
+	GetReconnectState(ctx context.Context, token string) (ReconnectState, error)
+
+	SetUserUsage(ctx context.Context, userId string, usage UserUsage, ttl time.Duration) error
+	GetUserUsage(ctx context.Context, userId string) (UserUsage, error)
+
+	SetUserPages(ctx context.Context, userId string, pageKeys []string, ttl time.Duration) error
+	// GetUserPages also reports whether the cached pages are complete, pages drawn on while they
+	// were not cached are kept without the rest until they are cached again
+	GetUserPages(ctx context.Context, userId string) ([]string, bool, error)
+	InvalidateUserPages(ctx context.Context, userId string, pageKey string) error
+	AddUserPage(ctx context.Context, userId string, pageKey string) error
+
+	SetPageSettings(ctx context.Context, pageKey string, settings models.PageSettings, ttl time.Duration) error
+	// GetPageSettings also reports whether the page's settings are cached, pages without settings are cached as zero settings
+	GetPageSettings(ctx context.Context, pageKey string) (models.PageSettings, bool, error)
+
+	ClaimDrawHash(ctx context.Context, hash string, strokeId string, ttl time.Duration) (string, error)
+	// ReleaseDrawHash frees the hash claimed for strokeId, so the same content can be drawn again
+	ReleaseDrawHash(ctx context.Context, strokeId string) error
+
+	MarkMessageProcessed(ctx context.Context, messageId string, ttl time.Duration) error
+	IsMessageProcessed(ctx context.Context, messageId string) (bool, error)
+
+	BanUser(ctx context.Context, userId string, until time.Time) error
+	IsUserBanned(ctx context.Context, userId string) (bool, error)
+
+	AddPendingStrokeCount(ctx context.Context, userKey string, delta int) error
+	TakePendingStrokeCount(ctx context.Context, userKey string) (int, error)
+	GetPendingStrokeCountUsers(ctx context.Context) ([]string, error)
+
+	// AddDroppedStrokes adds to the total of strokes the stroke batcher failed to persist and returns the new total
+	AddDroppedStrokes(ctx context.Context, count int) (int64, error)
+	GetDroppedStrokes(ctx context.Context) (int64, error)
 
 	IncrementUserStrokeCount(ctx context.Context, userId string) (int64, error)
 	DecrementUserStrokeCount(ctx context.Context, userId string) error
+	// AddUserStrokeCount adjusts a cached count by delta, a count that isn't cached is left to be seeded from the store
+	AddUserStrokeCount(ctx context.Context, userId string, delta int) error
 	SeedUserStrokeCount(ctx context.Context, userId string, count int) error
 	GetUserStrokeCount(ctx context.Context, userId string) (int, error)
+
+	Close() error
 }
@@ -0,0 +1,311 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/zlnvch/webverse/metrics"
+	"github.com/zlnvch/webverse/models"
+)
+
+// InstrumentedCache records the latency of every cache operation as "cache.<operation>", and counts its
+// failures as "cache.<operation>.errors". ErrSequenceGap is an expected outcome and not counted
+// Page lookups also count "cache.<operation>.hits" and ".misses": GetStrokes hits when the page has
+// cached strokes, IsPageComplete when the cache holds the whole page so the store can be skipped
+type InstrumentedCache struct {
+	inner   WebverseCache
+	metrics metrics.Metrics
+}
+
+// NewInstrumentedCache wraps inner, returning its results unchanged
+func NewInstrumentedCache(inner WebverseCache, m metrics.Metrics) *InstrumentedCache {
+	return &InstrumentedCache{inner: inner, metrics: metrics.OrNoop(m)}
+}
+
+func (c *InstrumentedCache) observe(operation string, start time.Time, err *error) {
+	c.metrics.Observe("cache."+operation, time.Since(start))
+	if *err != nil && !errors.Is(*err, ErrSequenceGap) {
+		c.metrics.Inc("cache."+operation+".errors", 1)
+	}
+}
+
+func (c *InstrumentedCache) recordLookup(operation string, hit bool) {
+	if hit {
+		c.metrics.Inc("cache."+operation+".hits", 1)
+	} else {
+		c.metrics.Inc("cache."+operation+".misses", 1)
+	}
+}
+
+func (c *InstrumentedCache) Publish(ctx context.Context, channel string, message []byte) (err error) {
+	defer c.observe("publish", time.Now(), &err)
+	return c.inner.Publish(ctx, channel, message)
+}
+
+func (c *InstrumentedCache) Subscribe(ctx context.Context, channel string, handler func(message []byte)) (err error) {
+	defer c.observe("subscribe", time.Now(), &err)
+	return c.inner.Subscribe(ctx, channel, handler)
+}
+
+func (c *InstrumentedCache) AddStroke(ctx context.Context, pageKey string, strokeId string, score int64, strokeData []byte) (seq int64, err error) {
+	defer c.observe("add_stroke", time.Now(), &err)
+	return c.inner.AddStroke(ctx, pageKey, strokeId, score, strokeData)
+}
+
+func (c *InstrumentedCache) AddStrokesBatch(ctx context.Context, pageKey string, strokes []StrokeCacheItem) (err error) {
+	defer c.observe("add_strokes_batch", time.Now(), &err)
+	return c.inner.AddStrokesBatch(ctx, pageKey, strokes)
+}
+
+func (c *InstrumentedCache) RemoveStroke(ctx context.Context, pageKey string, strokeId string) (err error) {
+	defer c.observe("remove_stroke", time.Now(), &err)
+	return c.inner.RemoveStroke(ctx, pageKey, strokeId)
+}
+
+func (c *InstrumentedCache) GetStrokes(ctx context.Context, pageKey string) (strokes [][]byte, err error) {
+	defer c.observe("get_strokes", time.Now(), &err)
+	strokes, err = c.inner.GetStrokes(ctx, pageKey)
+	if err == nil {
+		c.recordLookup("get_strokes", len(strokes) > 0)
+	}
+	return strokes, err
+}
+
+func (c *InstrumentedCache) GetStrokesAfterSeq(ctx context.Context, pageKey string, seq int64) (strokes StrokesAfterSeq, err error) {
+	defer c.observe("get_strokes_after_seq", time.Now(), &err)
+	return c.inner.GetStrokesAfterSeq(ctx, pageKey, seq)
+}
+
+func (c *InstrumentedCache) GetPageStrokeCountFromZCard(ctx context.Context, pageKey string) (count int64, err error) {
+	defer c.observe("get_page_stroke_count_from_zcard", time.Now(), &err)
+	return c.inner.GetPageStrokeCountFromZCard(ctx, pageKey)
+}
+
+func (c *InstrumentedCache) SetPageComplete(ctx context.Context, pageKey string) (err error) {
+	defer c.observe("set_page_complete", time.Now(), &err)
+	return c.inner.SetPageComplete(ctx, pageKey)
+}
+
+func (c *InstrumentedCache) IsPageComplete(ctx context.Context, pageKey string) (complete bool, err error) {
+	defer c.observe("is_page_complete", time.Now(), &err)
+	complete, err = c.inner.IsPageComplete(ctx, pageKey)
+	if err == nil {
+		c.recordLookup("is_page_complete", complete)
+	}
+	return complete, err
+}
+
+func (c *InstrumentedCache) InvalidatePages(ctx context.Context, pageKeys []string) (err error) {
+	defer c.observe("invalidate_pages", time.Now(), &err)
+	return c.inner.InvalidatePages(ctx, pageKeys)
+}
+
+func (c *InstrumentedCache) GetPageVersionTag(ctx context.Context, pageKey string) (tag string, err error) {
+	defer c.observe("get_page_version_tag", time.Now(), &err)
+	return c.inner.GetPageVersionTag(ctx, pageKey)
+}
+
+func (c *InstrumentedCache) TouchPage(ctx context.Context, pageKey string, touchedAt time.Time) (tracked int64, err error) {
+	defer c.observe("touch_page", time.Now(), &err)
+	return c.inner.TouchPage(ctx, pageKey, touchedAt)
+}
+
+func (c *InstrumentedCache) EvictOldestPages(ctx context.Context, maxPages int) (evicted []string, err error) {
+	defer c.observe("evict_oldest_pages", time.Now(), &err)
+	return c.inner.EvictOldestPages(ctx, maxPages)
+}
+
+func (c *InstrumentedCache) GetTouchedPages(ctx context.Context, since time.Time, limit int) (pageKeys []string, err error) {
+	defer c.observe("get_touched_pages", time.Now(), &err)
+	return c.inner.GetTouchedPages(ctx, since, limit)
+}
+
+func (c *InstrumentedCache) SetPagePaused(ctx context.Context, pageKey string, ttl time.Duration) (err error) {
+	defer c.observe("set_page_paused", time.Now(), &err)
+	return c.inner.SetPagePaused(ctx, pageKey, ttl)
+}
+
+func (c *InstrumentedCache) ClearPagePaused(ctx context.Context, pageKey string) (err error) {
+	defer c.observe("clear_page_paused", time.Now(), &err)
+	return c.inner.ClearPagePaused(ctx, pageKey)
+}
+
+func (c *InstrumentedCache) IsPagePaused(ctx context.Context, pageKey string) (paused bool, err error) {
+	defer c.observe("is_page_paused", time.Now(), &err)
+	return c.inner.IsPagePaused(ctx, pageKey)
+}
+
+func (c *InstrumentedCache) AddUserDeletionPages(ctx context.Context, userId string, pageKeys []string) (err error) {
+	defer c.observe("add_user_deletion_pages", time.Now(), &err)
+	return c.inner.AddUserDeletionPages(ctx, userId, pageKeys)
+}
+
+func (c *InstrumentedCache) GetUserDeletionPages(ctx context.Context, userId string) (pageKeys []string, err error) {
+	defer c.observe("get_user_deletion_pages", time.Now(), &err)
+	return c.inner.GetUserDeletionPages(ctx, userId)
+}
+
+func (c *InstrumentedCache) ClearUserDeletionPages(ctx context.Context, userId string) (err error) {
+	defer c.observe("clear_user_deletion_pages", time.Now(), &err)
+	return c.inner.ClearUserDeletionPages(ctx, userId)
+}
+
+func (c *InstrumentedCache) SetUserDeletionCount(ctx context.Context, userId string, layer string, count int) (stored int, err error) {
+	defer c.observe("set_user_deletion_count", time.Now(), &err)
+	return c.inner.SetUserDeletionCount(ctx, userId, layer, count)
+}
+
+func (c *InstrumentedCache) ClearUserDeletionCount(ctx context.Context, userId string, layer string) (err error) {
+	defer c.observe("clear_user_deletion_count", time.Now(), &err)
+	return c.inner.ClearUserDeletionCount(ctx, userId, layer)
+}
+
+func (c *InstrumentedCache) AddRecentPage(ctx context.Context, userId string, pageKey string, drawnAt time.Time, maxSize int) (err error) {
+	defer c.observe("add_recent_page", time.Now(), &err)
+	return c.inner.AddRecentPage(ctx, userId, pageKey, drawnAt, maxSize)
+}
+
+func (c *InstrumentedCache) GetRecentPages(ctx context.Context, userId string, limit int) (pages []RecentPage, err error) {
+	defer c.observe("get_recent_pages", time.Now(), &err)
+	return c.inner.GetRecentPages(ctx, userId, limit)
+}
+
+func (c *InstrumentedCache) ClearRecentPages(ctx context.Context, userId string) (err error) {
+	defer c.observe("clear_recent_pages", time.Now(), &err)
+	return c.inner.ClearRecentPages(ctx, userId)
+}
+
+func (c *InstrumentedCache) SetReconnectState(ctx context.Context, token string, state ReconnectState, ttl time.Duration) (err error) {
+	defer c.observe("set_reconnect_state", time.Now(), &err)
+	return c.inner.SetReconnectState(ctx, token, state, ttl)
+}
+
+func (c *InstrumentedCache) GetReconnectState(ctx context.Context, token string) (state ReconnectState, err error) {
+	defer c.observe("get_reconnect_state", time.Now(), &err)
+	return c.inner.GetReconnectState(ctx, token)
+}
+
+func (c *InstrumentedCache) SetUserUsage(ctx context.Context, userId string, usage UserUsage, ttl time.Duration) (err error) {
+	defer c.observe("set_user_usage", time.Now(), &err)
+	return c.inner.SetUserUsage(ctx, userId, usage, ttl)
+}
+
+func (c *InstrumentedCache) GetUserUsage(ctx context.Context, userId string) (usage UserUsage, err error) {
+	defer c.observe("get_user_usage", time.Now(), &err)
+	return c.inner.GetUserUsage(ctx, userId)
+}
+
+func (c *InstrumentedCache) SetPageSettings(ctx context.Context, pageKey string, settings models.PageSettings, ttl time.Duration) (err error) {
+	defer c.observe("set_page_settings", time.Now(), &err)
+	return c.inner.SetPageSettings(ctx, pageKey, settings, ttl)
+}
+
+func (c *InstrumentedCache) GetPageSettings(ctx context.Context, pageKey string) (settings models.PageSettings, cached bool, err error) {
+	defer c.observe("get_page_settings", time.Now(), &err)
+	return c.inner.GetPageSettings(ctx, pageKey)
+}
+
+func (c *InstrumentedCache) SetUserPages(ctx context.Context, userId string, pageKeys []string, ttl time.Duration) (err error) {
+	defer c.observe("set_user_pages", time.Now(), &err)
+	return c.inner.SetUserPages(ctx, userId, pageKeys, ttl)
+}
+
+func (c *InstrumentedCache) GetUserPages(ctx context.Context, userId string) (pageKeys []string, found bool, err error) {
+	defer c.observe("get_user_pages", time.Now(), &err)
+	return c.inner.GetUserPages(ctx, userId)
+}
+
+func (c *InstrumentedCache) InvalidateUserPages(ctx context.Context, userId string, pageKey string) (err error) {
+	defer c.observe("invalidate_user_pages", time.Now(), &err)
+	return c.inner.InvalidateUserPages(ctx, userId, pageKey)
+}
+
+func (c *InstrumentedCache) AddUserPage(ctx context.Context, userId string, pageKey string) (err error) {
+	defer c.observe("add_user_page", time.Now(), &err)
+	return c.inner.AddUserPage(ctx, userId, pageKey)
+}
+
+func (c *InstrumentedCache) ClaimDrawHash(ctx context.Context, hash string, strokeId string, ttl time.Duration) (existing string, err error) {
+	defer c.observe("claim_draw_hash", time.Now(), &err)
+	return c.inner.ClaimDrawHash(ctx, hash, strokeId, ttl)
+}
+
+func (c *InstrumentedCache) ReleaseDrawHash(ctx context.Context, strokeId string) (err error) {
+	defer c.observe("release_draw_hash", time.Now(), &err)
+	return c.inner.ReleaseDrawHash(ctx, strokeId)
+}
+
+func (c *InstrumentedCache) MarkMessageProcessed(ctx context.Context, messageId string, ttl time.Duration) (err error) {
+	defer c.observe("mark_message_processed", time.Now(), &err)
+	return c.inner.MarkMessageProcessed(ctx, messageId, ttl)
+}
+
+func (c *InstrumentedCache) IsMessageProcessed(ctx context.Context, messageId string) (processed bool, err error) {
+	defer c.observe("is_message_processed", time.Now(), &err)
+	return c.inner.IsMessageProcessed(ctx, messageId)
+}
+
+func (c *InstrumentedCache) BanUser(ctx context.Context, userId string, until time.Time) (err error) {
+	defer c.observe("ban_user", time.Now(), &err)
+	return c.inner.BanUser(ctx, userId, until)
+}
+
+func (c *InstrumentedCache) IsUserBanned(ctx context.Context, userId string) (banned bool, err error) {
+	defer c.observe("is_user_banned", time.Now(), &err)
+	return c.inner.IsUserBanned(ctx, userId)
+}
+
+func (c *InstrumentedCache) AddPendingStrokeCount(ctx context.Context, userKey string, delta int) (err error) {
+	defer c.observe("add_pending_stroke_count", time.Now(), &err)
+	return c.inner.AddPendingStrokeCount(ctx, userKey, delta)
+}
+
+func (c *InstrumentedCache) TakePendingStrokeCount(ctx context.Context, userKey string) (count int, err error) {
+	defer c.observe("take_pending_stroke_count", time.Now(), &err)
+	return c.inner.TakePendingStrokeCount(ctx, userKey)
+}
+
+func (c *InstrumentedCache) GetPendingStrokeCountUsers(ctx context.Context) (userKeys []string, err error) {
+	defer c.observe("get_pending_stroke_count_users", time.Now(), &err)
+	return c.inner.GetPendingStrokeCountUsers(ctx)
+}
+
+func (c *InstrumentedCache) AddDroppedStrokes(ctx context.Context, count int) (total int64, err error) {
+	defer c.observe("add_dropped_strokes", time.Now(), &err)
+	return c.inner.AddDroppedStrokes(ctx, count)
+}
+
+func (c *InstrumentedCache) GetDroppedStrokes(ctx context.Context) (total int64, err error) {
+	defer c.observe("get_dropped_strokes", time.Now(), &err)
+	return c.inner.GetDroppedStrokes(ctx)
+}
+
+func (c *InstrumentedCache) IncrementUserStrokeCount(ctx context.Context, userId string) (count int64, err error) {
+	defer c.observe("increment_user_stroke_count", time.Now(), &err)
+	return c.inner.IncrementUserStrokeCount(ctx, userId)
+}
+
+func (c *InstrumentedCache) DecrementUserStrokeCount(ctx context.Context, userId string) (err error) {
+	defer c.observe("decrement_user_stroke_count", time.Now(), &err)
+	return c.inner.DecrementUserStrokeCount(ctx, userId)
+}
+
+func (c *InstrumentedCache) AddUserStrokeCount(ctx context.Context, userId string, delta int) (err error) {
+	defer c.observe("add_user_stroke_count", time.Now(), &err)
+	return c.inner.AddUserStrokeCount(ctx, userId, delta)
+}
+
+func (c *InstrumentedCache) SeedUserStrokeCount(ctx context.Context, userId string, count int) (err error) {
+	defer c.observe("seed_user_stroke_count", time.Now(), &err)
+	return c.inner.SeedUserStrokeCount(ctx, userId, count)
+}
+
+func (c *InstrumentedCache) GetUserStrokeCount(ctx context.Context, userId string) (count int, err error) {
+	defer c.observe("get_user_stroke_count", time.Now(), &err)
+	return c.inner.GetUserStrokeCount(ctx, userId)
+}
+
+func (c *InstrumentedCache) Close() error {
+	return c.inner.Close()
+}
@@ -0,0 +1,144 @@
+package mempubsub
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/zlnvch/webverse/cache"
+)
+
+// Per-subscriber buffer, same as the go-redis PubSub channel default
+const subscriberBufferSize = 100
+
+// MemPubSub is an in-process implementation of the Publish/Subscribe portion of
+// cache.WebverseCache. Messages only reach subscribers in the same process, so it is
+// only suitable for single-instance deployments
+type MemPubSub struct {
+	mu          sync.RWMutex
+	subscribers map[string]map[*subscriber]struct{}
+	closed      bool
+}
+
+type subscriber struct {
+	messages chan []byte
+	done     chan struct{}
+	once     sync.Once
+}
+
+func (sub *subscriber) stop() {
+	sub.once.Do(func() { close(sub.done) })
+}
+
+func NewMemPubSub() *MemPubSub {
+	return &MemPubSub{subscribers: make(map[string]map[*subscriber]struct{})}
+}
+
+// Publish delivers the message to every current subscriber of the channel without
+// blocking. Like Redis pub/sub, delivery is at-most-once: a subscriber whose buffer
+// is full misses the message
+func (ps *MemPubSub) Publish(ctx context.Context, channel string, message []byte) error {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	for sub := range ps.subscribers[channel] {
+		// Each subscriber gets its own copy, as if it came off the wire
+		msg := make([]byte, len(message))
+		copy(msg, message)
+
+		select {
+		case sub.messages <- msg:
+		default:
+			log.Printf("Pubsub subscriber buffer full, dropping message on channel: %s", channel)
+		}
+	}
+	return nil
+}
+
+// Subscribe calls handler for every message published on channel until ctx is done
+// or the MemPubSub is closed. Handlers for one subscription run sequentially
+func (ps *MemPubSub) Subscribe(ctx context.Context, channel string, handler func(message []byte)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	sub := &subscriber{
+		messages: make(chan []byte, subscriberBufferSize),
+		done:     make(chan struct{}),
+	}
+
+	ps.mu.Lock()
+	if ps.closed {
+		ps.mu.Unlock()
+		return context.Canceled
+	}
+	if ps.subscribers[channel] == nil {
+		ps.subscribers[channel] = make(map[*subscriber]struct{})
+	}
+	ps.subscribers[channel][sub] = struct{}{}
+	ps.mu.Unlock()
+
+	go func() {
+		defer func() {
+			ps.mu.Lock()
+			delete(ps.subscribers[channel], sub)
+			if len(ps.subscribers[channel]) == 0 {
+				delete(ps.subscribers, channel)
+			}
+			ps.mu.Unlock()
+		}()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sub.done:
+				return
+			case msg := <-sub.messages:
+				handler(msg)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Close ends all subscriptions, later subscribes fail
+func (ps *MemPubSub) Close() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.closed = true
+	for _, subs := range ps.subscribers {
+		for sub := range subs {
+			sub.stop()
+		}
+	}
+	return nil
+}
+
+// pubSubCache serves Publish and Subscribe in-process and everything else from the
+// wrapped cache
+type pubSubCache struct {
+	cache.WebverseCache
+	pubsub *MemPubSub
+}
+
+// Wrap returns webverseCache with its pub/sub replaced by a MemPubSub, so a single
+// instance doesn't depend on Redis pub/sub for same-process fan-out
+func Wrap(webverseCache cache.WebverseCache) cache.WebverseCache {
+	return &pubSubCache{WebverseCache: webverseCache, pubsub: NewMemPubSub()}
+}
+
+func (c *pubSubCache) Publish(ctx context.Context, channel string, message []byte) error {
+	return c.pubsub.Publish(ctx, channel, message)
+}
+
+func (c *pubSubCache) Subscribe(ctx context.Context, channel string, handler func(message []byte)) error {
+	return c.pubsub.Subscribe(ctx, channel, handler)
+}
+
+func (c *pubSubCache) Close() error {
+	c.pubsub.Close()
+	return c.WebverseCache.Close()
+}
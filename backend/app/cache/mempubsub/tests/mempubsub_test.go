@@ -0,0 +1,125 @@
+package mempubsub_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zlnvch/webverse/cache/mempubsub"
+	cachemocks "github.com/zlnvch/webverse/cache/mocks"
+)
+
+func receive(t *testing.T, ch chan string) string {
+	t.Helper()
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(1 * time.Second):
+		t.Fatal("timed out waiting for message")
+		return ""
+	}
+}
+
+func assertNothingReceived(t *testing.T, ch chan string) {
+	t.Helper()
+	select {
+	case msg := <-ch:
+		t.Fatalf("unexpected message: %s", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func subscribe(t *testing.T, ps *mempubsub.MemPubSub, ctx context.Context, channel string) chan string {
+	t.Helper()
+	received := make(chan string, 10)
+	assert.NoError(t, ps.Subscribe(ctx, channel, func(message []byte) {
+		received <- string(message)
+	}))
+	return received
+}
+
+func TestMemPubSub_FanOut(t *testing.T) {
+	ps := mempubsub.NewMemPubSub()
+	defer ps.Close()
+	ctx := context.Background()
+
+	first := subscribe(t, ps, ctx, "page:example.com")
+	second := subscribe(t, ps, ctx, "page:example.com")
+	other := subscribe(t, ps, ctx, "page:other.com")
+
+	assert.NoError(t, ps.Publish(ctx, "page:example.com", []byte("hello")))
+
+	assert.Equal(t, "hello", receive(t, first))
+	assert.Equal(t, "hello", receive(t, second))
+	assertNothingReceived(t, other)
+}
+
+func TestMemPubSub_PreservesOrder(t *testing.T) {
+	ps := mempubsub.NewMemPubSub()
+	defer ps.Close()
+	ctx := context.Background()
+
+	received := subscribe(t, ps, ctx, "user-deleted")
+	for _, msg := range []string{"1", "2", "3"} {
+		assert.NoError(t, ps.Publish(ctx, "user-deleted", []byte(msg)))
+	}
+
+	assert.Equal(t, "1", receive(t, received))
+	assert.Equal(t, "2", receive(t, received))
+	assert.Equal(t, "3", receive(t, received))
+}
+
+func TestMemPubSub_CancelUnsubscribes(t *testing.T) {
+	ps := mempubsub.NewMemPubSub()
+	defer ps.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := subscribe(t, ps, ctx, "page:example.com")
+	remaining := subscribe(t, ps, context.Background(), "page:example.com")
+
+	cancel()
+	// Give the subscriber goroutine time to observe the cancellation
+	time.Sleep(20 * time.Millisecond)
+
+	assert.NoError(t, ps.Publish(context.Background(), "page:example.com", []byte("after")))
+	assert.Equal(t, "after", receive(t, remaining))
+	assertNothingReceived(t, cancelled)
+}
+
+func TestMemPubSub_Close(t *testing.T) {
+	ps := mempubsub.NewMemPubSub()
+	received := subscribe(t, ps, context.Background(), "page:example.com")
+
+	assert.NoError(t, ps.Close())
+	time.Sleep(20 * time.Millisecond)
+
+	assert.NoError(t, ps.Publish(context.Background(), "page:example.com", []byte("after")))
+	assertNothingReceived(t, received)
+
+	err := ps.Subscribe(context.Background(), "page:example.com", func([]byte) {})
+	assert.Error(t, err)
+}
+
+func TestWrap_PubSubIsInProcess(t *testing.T) {
+	mockCache := new(cachemocks.MockCache)
+	mockCache.On("GetStrokes", context.Background(), "example.com").Return([][]byte{}, nil)
+	mockCache.On("Close").Return(nil)
+
+	wrapped := mempubsub.Wrap(mockCache)
+
+	received := make(chan string, 1)
+	assert.NoError(t, wrapped.Subscribe(context.Background(), "page:example.com", func(message []byte) {
+		received <- string(message)
+	}))
+	assert.NoError(t, wrapped.Publish(context.Background(), "page:example.com", []byte("hello")))
+	assert.Equal(t, "hello", receive(t, received))
+
+	// Everything else still goes to the wrapped cache
+	_, err := wrapped.GetStrokes(context.Background(), "example.com")
+	assert.NoError(t, err)
+	assert.NoError(t, wrapped.Close())
+
+	// The mock has no Publish/Subscribe expectations, so reaching it would have panicked
+	mockCache.AssertExpectations(t)
+}
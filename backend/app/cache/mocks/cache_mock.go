@@ -2,9 +2,11 @@ package mocks
 
 import (
 	"context"
+	"time"
 
 	"github.com/stretchr/testify/mock"
 	"github.com/zlnvch/webverse/cache"
+	"github.com/zlnvch/webverse/models"
 )
 
 type MockCache struct {
@@ -21,9 +23,9 @@ func (m *MockCache) Subscribe(ctx context.Context, channel string, handler func(
 	return args.Error(0)
 }
 
-func (m *MockCache) AddStroke(ctx context.Context, pageKey string, strokeId string, score int64, strokeData []byte) error {
+func (m *MockCache) AddStroke(ctx context.Context, pageKey string, strokeId string, score int64, strokeData []byte) (int64, error) {
 	args := m.Called(ctx, pageKey, strokeId, score, strokeData)
-	return args.Error(0)
+	return args.Get(0).(int64), args.Error(1)
 }
 
 func (m *MockCache) AddStrokesBatch(ctx context.Context, pageKey string, strokes []cache.StrokeCacheItem) error {
@@ -41,6 +43,11 @@ func (m *MockCache) GetStrokes(ctx context.Context, pageKey string) ([][]byte, e
 	return args.Get(0).([][]byte), args.Error(1)
 }
 
+func (m *MockCache) GetStrokesAfterSeq(ctx context.Context, pageKey string, seq int64) (cache.StrokesAfterSeq, error) {
+	args := m.Called(ctx, pageKey, seq)
+	return args.Get(0).(cache.StrokesAfterSeq), args.Error(1)
+}
+
 func (m *MockCache) SetPageComplete(ctx context.Context, pageKey string) error {
 	args := m.Called(ctx, pageKey)
 	return args.Error(0)
@@ -56,6 +63,201 @@ func (m *MockCache) InvalidatePages(ctx context.Context, pageKeys []string) erro
 	return args.Error(0)
 }
 
+func (m *MockCache) TouchPage(ctx context.Context, pageKey string, touchedAt time.Time) (int64, error) {
+	args := m.Called(ctx, pageKey, touchedAt)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *MockCache) GetTouchedPages(ctx context.Context, since time.Time, limit int) ([]string, error) {
+	args := m.Called(ctx, since, limit)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *MockCache) EvictOldestPages(ctx context.Context, maxPages int) ([]string, error) {
+	args := m.Called(ctx, maxPages)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *MockCache) GetPageVersionTag(ctx context.Context, pageKey string) (string, error) {
+	args := m.Called(ctx, pageKey)
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockCache) SetPagePaused(ctx context.Context, pageKey string, ttl time.Duration) error {
+	args := m.Called(ctx, pageKey, ttl)
+	return args.Error(0)
+}
+
+func (m *MockCache) ClearPagePaused(ctx context.Context, pageKey string) error {
+	args := m.Called(ctx, pageKey)
+	return args.Error(0)
+}
+
+func (m *MockCache) IsPagePaused(ctx context.Context, pageKey string) (bool, error) {
+	args := m.Called(ctx, pageKey)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockCache) AddUserDeletionPages(ctx context.Context, userId string, pageKeys []string) error {
+	args := m.Called(ctx, userId, pageKeys)
+	return args.Error(0)
+}
+
+func (m *MockCache) GetUserDeletionPages(ctx context.Context, userId string) ([]string, error) {
+	args := m.Called(ctx, userId)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *MockCache) ClearUserDeletionPages(ctx context.Context, userId string) error {
+	args := m.Called(ctx, userId)
+	return args.Error(0)
+}
+
+func (m *MockCache) SetUserDeletionCount(ctx context.Context, userId string, layer string, count int) (int, error) {
+	args := m.Called(ctx, userId, layer, count)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockCache) ClearUserDeletionCount(ctx context.Context, userId string, layer string) error {
+	args := m.Called(ctx, userId, layer)
+	return args.Error(0)
+}
+
+func (m *MockCache) AddRecentPage(ctx context.Context, userId string, pageKey string, drawnAt time.Time, maxSize int) error {
+	args := m.Called(ctx, userId, pageKey, drawnAt, maxSize)
+	return args.Error(0)
+}
+
+func (m *MockCache) GetRecentPages(ctx context.Context, userId string, limit int) ([]cache.RecentPage, error) {
+	args := m.Called(ctx, userId, limit)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]cache.RecentPage), args.Error(1)
+}
+
+func (m *MockCache) ClearRecentPages(ctx context.Context, userId string) error {
+	args := m.Called(ctx, userId)
+	return args.Error(0)
+}
+
+func (m *MockCache) SetReconnectState(ctx context.Context, token string, state cache.ReconnectState, ttl time.Duration) error {
+	args := m.Called(ctx, token, state, ttl)
+	return args.Error(0)
+}
+
+func (m *MockCache) GetReconnectState(ctx context.Context, token string) (cache.ReconnectState, error) {
+	args := m.Called(ctx, token)
+	return args.Get(0).(cache.ReconnectState), args.Error(1)
+}
+
+func (m *MockCache) SetUserUsage(ctx context.Context, userId string, usage cache.UserUsage, ttl time.Duration) error {
+	args := m.Called(ctx, userId, usage, ttl)
+	return args.Error(0)
+}
+
+func (m *MockCache) GetUserUsage(ctx context.Context, userId string) (cache.UserUsage, error) {
+	args := m.Called(ctx, userId)
+	return args.Get(0).(cache.UserUsage), args.Error(1)
+}
+
+func (m *MockCache) SetPageSettings(ctx context.Context, pageKey string, settings models.PageSettings, ttl time.Duration) error {
+	args := m.Called(ctx, pageKey, settings, ttl)
+	return args.Error(0)
+}
+
+func (m *MockCache) GetPageSettings(ctx context.Context, pageKey string) (models.PageSettings, bool, error) {
+	args := m.Called(ctx, pageKey)
+	return args.Get(0).(models.PageSettings), args.Bool(1), args.Error(2)
+}
+
+func (m *MockCache) SetUserPages(ctx context.Context, userId string, pageKeys []string, ttl time.Duration) error {
+	args := m.Called(ctx, userId, pageKeys, ttl)
+	return args.Error(0)
+}
+
+func (m *MockCache) GetUserPages(ctx context.Context, userId string) ([]string, bool, error) {
+	args := m.Called(ctx, userId)
+	return args.Get(0).([]string), args.Bool(1), args.Error(2)
+}
+
+func (m *MockCache) InvalidateUserPages(ctx context.Context, userId string, pageKey string) error {
+	args := m.Called(ctx, userId, pageKey)
+	return args.Error(0)
+}
+
+func (m *MockCache) AddUserPage(ctx context.Context, userId string, pageKey string) error {
+	args := m.Called(ctx, userId, pageKey)
+	return args.Error(0)
+}
+
+func (m *MockCache) ClaimDrawHash(ctx context.Context, hash string, strokeId string, ttl time.Duration) (string, error) {
+	args := m.Called(ctx, hash, strokeId, ttl)
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockCache) ReleaseDrawHash(ctx context.Context, strokeId string) error {
+	args := m.Called(ctx, strokeId)
+	return args.Error(0)
+}
+
+func (m *MockCache) BanUser(ctx context.Context, userId string, until time.Time) error {
+	args := m.Called(ctx, userId, until)
+	return args.Error(0)
+}
+
+func (m *MockCache) IsUserBanned(ctx context.Context, userId string) (bool, error) {
+	args := m.Called(ctx, userId)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockCache) MarkMessageProcessed(ctx context.Context, messageId string, ttl time.Duration) error {
+	args := m.Called(ctx, messageId, ttl)
+	return args.Error(0)
+}
+
+func (m *MockCache) IsMessageProcessed(ctx context.Context, messageId string) (bool, error) {
+	args := m.Called(ctx, messageId)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockCache) AddPendingStrokeCount(ctx context.Context, userKey string, delta int) error {
+	args := m.Called(ctx, userKey, delta)
+	return args.Error(0)
+}
+
+func (m *MockCache) TakePendingStrokeCount(ctx context.Context, userKey string) (int, error) {
+	args := m.Called(ctx, userKey)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockCache) GetPendingStrokeCountUsers(ctx context.Context) ([]string, error) {
+	args := m.Called(ctx)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *MockCache) AddDroppedStrokes(ctx context.Context, count int) (int64, error) {
+	args := m.Called(ctx, count)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *MockCache) GetDroppedStrokes(ctx context.Context) (int64, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(int64), args.Error(1)
+}
+
 func (m *MockCache) IncrementUserStrokeCount(ctx context.Context, userId string) (int64, error) {
 	args := m.Called(ctx, userId)
 	return args.Get(0).(int64), args.Error(1)
@@ -66,6 +268,11 @@ func (m *MockCache) DecrementUserStrokeCount(ctx context.Context, userId string)
 	return args.Error(0)
 }
 
+func (m *MockCache) AddUserStrokeCount(ctx context.Context, userId string, delta int) error {
+	args := m.Called(ctx, userId, delta)
+	return args.Error(0)
+}
+
 func (m *MockCache) SeedUserStrokeCount(ctx context.Context, userId string, count int) error {
 	args := m.Called(ctx, userId, count)
 	return args.Error(0)
@@ -80,3 +287,8 @@ func (m *MockCache) GetPageStrokeCountFromZCard(ctx context.Context, pageKey str
 	args := m.Called(ctx, pageKey)
 	return args.Get(0).(int64), args.Error(1)
 }
+
+func (m *MockCache) Close() error {
+	args := m.Called()
+	return args.Error(0)
+}
@@ -2,16 +2,27 @@ package redis
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
 	"log"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 	"github.com/zlnvch/webverse/cache"
+	"github.com/zlnvch/webverse/models"
 )
 
 type RedisWebverseCache struct {
 	client redis.UniversalClient
+
+	// Open pubsubs, tracked so Close can tear down their goroutines deterministically
+	pubsubsMu sync.Mutex
+	pubsubs   map[*redis.PubSub]struct{}
 }
 
 func NewRedisWebverseCache(ctx context.Context, devMode bool, redis_endpoint string) (*RedisWebverseCache, error) {
@@ -33,7 +44,19 @@ func NewRedisWebverseCache(ctx context.Context, devMode bool, redis_endpoint str
 		return nil, err
 	}
 
-	return &RedisWebverseCache{client: client}, nil
+	return &RedisWebverseCache{client: client, pubsubs: make(map[*redis.PubSub]struct{})}, nil
+}
+
+// Close closes all open pubsubs, which ends their handler goroutines, then the client
+func (redisCache *RedisWebverseCache) Close() error {
+	redisCache.pubsubsMu.Lock()
+	for pubsub := range redisCache.pubsubs {
+		pubsub.Close()
+	}
+	clear(redisCache.pubsubs)
+	redisCache.pubsubsMu.Unlock()
+
+	return redisCache.client.Close()
 }
 
 func (redisCache *RedisWebverseCache) Publish(ctx context.Context, channel string, message []byte) error {
@@ -54,8 +77,17 @@ func (redisCache *RedisWebverseCache) Subscribe(ctx context.Context, channel str
 
 	ch := pubsub.Channel()
 
+	redisCache.pubsubsMu.Lock()
+	redisCache.pubsubs[pubsub] = struct{}{}
+	redisCache.pubsubsMu.Unlock()
+
 	go func() {
-		defer pubsub.Close()
+		defer func() {
+			redisCache.pubsubsMu.Lock()
+			delete(redisCache.pubsubs, pubsub)
+			redisCache.pubsubsMu.Unlock()
+			pubsub.Close()
+		}()
 
 		for {
 			select {
@@ -86,8 +118,27 @@ func buildPageCompleteKey(pageKey string) string {
 	return "page:{" + pageKey + "}:complete"
 }
 
+func buildPagePausedKey(pageKey string) string {
+	return "page:{" + pageKey + "}:paused"
+}
+
+func buildPageSeqKey(pageKey string) string {
+	return "page:{" + pageKey + "}:seq"
+}
+
+func buildPageSeqIndexKey(pageKey string) string {
+	return "page:{" + pageKey + "}:seqs"
+}
+
 const cacheTTL = 10 * time.Minute
 
+// The sequence counter outlives the page's strokes, so a page that expires and is drawn on again keeps
+// counting up and clients holding an old sequence see the gap instead of new strokes reusing their numbers
+const seqTTL = 24 * time.Hour
+
+// Syncing further behind than this many strokes costs more than loading the page
+const maxStrokesAfterSeq = 1000
+
 // Design Choice: Split Index/Data Pattern
 // We use two Redis structures to store page strokes efficiently:
 // 1. ZSet ("page:{key}"): Stores only StrokeIDs, ordered by Timestamp (Score).
@@ -97,19 +148,37 @@ const cacheTTL = 10 * time.Minute
 //
 // 2. Hash ("page:{key}:data"): Stores StrokeID -> JSON Blob.
 //   - Purpose: fast O(1) data retrieval (HMGET) after getting IDs from the ZSet.
-func (redisCache *RedisWebverseCache) AddStroke(ctx context.Context, pageKey string, strokeId string, score int64, strokeData []byte) error {
+//
+// Drawn strokes are also numbered per page ("page:{key}:seq"), with a second ZSet ("page:{key}:seqs")
+// of StrokeID by sequence, so reconnecting clients can fetch just the strokes after the last one they saw.
+// Removing a stroke takes the next sequence number too, indexed as removedSeqPrefix + StrokeID.
+// AddStroke returns the stroke's sequence number
+func (redisCache *RedisWebverseCache) AddStroke(ctx context.Context, pageKey string, strokeId string, score int64, strokeData []byte) (int64, error) {
 	key := buildPageKey(pageKey)
 	dataKey := buildPageDataKey(pageKey)
 	completeKey := buildPageCompleteKey(pageKey)
+	seqKey := buildPageSeqKey(pageKey)
+	seqIndexKey := buildPageSeqIndexKey(pageKey)
 
+	seq, err := redisCache.client.Incr(ctx, seqKey).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	// Data before index, so an id in the ZSet without data is an orphan and not a stroke being added
 	pipe := redisCache.client.Pipeline()
-	pipe.ZAdd(ctx, key, redis.Z{Score: float64(score), Member: strokeId})
 	pipe.HSet(ctx, dataKey, strokeId, strokeData)
+	pipe.ZAdd(ctx, key, redis.Z{Score: float64(score), Member: strokeId})
+	pipe.ZAdd(ctx, seqIndexKey, redis.Z{Score: float64(seq), Member: strokeId})
 	pipe.Expire(ctx, completeKey, cacheTTL)
 	pipe.Expire(ctx, key, cacheTTL)
 	pipe.Expire(ctx, dataKey, cacheTTL)
-	_, err := pipe.Exec(ctx)
-	return err
+	pipe.Expire(ctx, seqIndexKey, cacheTTL)
+	pipe.Expire(ctx, seqKey, seqTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return seq, nil
 }
 
 func (redisCache *RedisWebverseCache) AddStrokesBatch(ctx context.Context, pageKey string, strokes []cache.StrokeCacheItem) error {
@@ -135,9 +204,10 @@ func (redisCache *RedisWebverseCache) AddStrokesBatch(ctx context.Context, pageK
 		hValues[i*2+1] = s.Data
 	}
 
+	// Data before index, like AddStroke
 	pipe := redisCache.client.Pipeline()
-	pipe.ZAdd(ctx, key, zMembers...)
 	pipe.HSet(ctx, dataKey, hValues...)
+	pipe.ZAdd(ctx, key, zMembers...)
 	pipe.Expire(ctx, completeKey, cacheTTL)
 	pipe.Expire(ctx, key, cacheTTL)
 	pipe.Expire(ctx, dataKey, cacheTTL)
@@ -145,18 +215,32 @@ func (redisCache *RedisWebverseCache) AddStrokesBatch(ctx context.Context, pageK
 	return err
 }
 
+// removedSeqPrefix marks a removal in the sequence index, stroke ids never start with it
+const removedSeqPrefix = "removed:"
+
 func (redisCache *RedisWebverseCache) RemoveStroke(ctx context.Context, pageKey string, strokeId string) error {
 	key := buildPageKey(pageKey)
 	dataKey := buildPageDataKey(pageKey)
 	completeKey := buildPageCompleteKey(pageKey)
+	seqKey := buildPageSeqKey(pageKey)
+	seqIndexKey := buildPageSeqIndexKey(pageKey)
+
+	// Numbered like a draw, so clients syncing from before the removal are told about it
+	seq, err := redisCache.client.Incr(ctx, seqKey).Result()
+	if err != nil {
+		return err
+	}
 
 	pipe := redisCache.client.Pipeline()
 	pipe.ZRem(ctx, key, strokeId)
 	pipe.HDel(ctx, dataKey, strokeId)
+	pipe.ZAdd(ctx, seqIndexKey, redis.Z{Score: float64(seq), Member: removedSeqPrefix + strokeId})
 	pipe.Expire(ctx, completeKey, cacheTTL)
 	pipe.Expire(ctx, key, cacheTTL)
 	pipe.Expire(ctx, dataKey, cacheTTL)
-	_, err := pipe.Exec(ctx)
+	pipe.Expire(ctx, seqIndexKey, cacheTTL)
+	pipe.Expire(ctx, seqKey, seqTTL)
+	_, err = pipe.Exec(ctx)
 	return err
 }
 
@@ -194,14 +278,19 @@ func (redisCache *RedisWebverseCache) GetStrokes(ctx context.Context, pageKey st
 
 	// 3. Assemble result
 	strokes := make([][]byte, 0, len(ids))
-	for _, item := range dataMap {
+	var orphanIds []string
+	for i, item := range dataMap {
 		if item == nil {
-			continue // Should not happen if consistency is maintained
+			orphanIds = append(orphanIds, ids[i])
+			continue
 		}
 		if s, ok := item.(string); ok {
 			strokes = append(strokes, []byte(s))
 		}
 	}
+	if len(orphanIds) > 0 {
+		redisCache.removeOrphanIds(ctx, pageKey, orphanIds)
+	}
 
 	// Refresh TTL
 	pipe := redisCache.client.Pipeline()
@@ -213,6 +302,83 @@ func (redisCache *RedisWebverseCache) GetStrokes(ctx context.Context, pageKey st
 	return strokes, nil
 }
 
+// removeOrphanIds removes ids without data from the page's ZSet, where they would count toward the page
+// quota forever. Strokes are added data first and removed index first, so the ids can't belong to a
+// stroke being added. They are left by a failed pipeline or an evicted hash
+func (redisCache *RedisWebverseCache) removeOrphanIds(ctx context.Context, pageKey string, ids []string) {
+	members := make([]interface{}, len(ids))
+	for i, id := range ids {
+		members[i] = id
+	}
+	if err := redisCache.client.ZRem(ctx, buildPageKey(pageKey), members...).Err(); err != nil {
+		log.Printf("Failed to remove %d stroke ids without data from page %s: %v", len(ids), pageKey, err)
+		return
+	}
+	log.Printf("Removed %d stroke ids without data from page %s", len(ids), pageKey)
+}
+
+// GetStrokesAfterSeq returns the strokes drawn on the page after the given sequence number, oldest first,
+// and the ids of the strokes removed since. Returns cache.ErrSequenceGap if any of them may be missing from the cache
+// Removed strokes are left out of the drawn ones, but keep their place in the sequence
+func (redisCache *RedisWebverseCache) GetStrokesAfterSeq(ctx context.Context, pageKey string, seq int64) (cache.StrokesAfterSeq, error) {
+	dataKey := buildPageDataKey(pageKey)
+	seqKey := buildPageSeqKey(pageKey)
+	seqIndexKey := buildPageSeqIndexKey(pageKey)
+
+	lastSeq, err := redisCache.client.Get(ctx, seqKey).Int64()
+	if err == redis.Nil {
+		lastSeq = 0
+	} else if err != nil {
+		return cache.StrokesAfterSeq{}, err
+	}
+	if seq == lastSeq {
+		return cache.StrokesAfterSeq{Strokes: []cache.SequencedStroke{}, RemovedIds: []string{}, LastSeq: lastSeq}, nil
+	}
+	// Ahead of the counter means it expired since, too far behind is better served by a load
+	if seq > lastSeq || lastSeq-seq > maxStrokesAfterSeq {
+		return cache.StrokesAfterSeq{}, cache.ErrSequenceGap
+	}
+
+	entries, err := redisCache.client.ZRangeByScoreWithScores(ctx, seqIndexKey, &redis.ZRangeBy{
+		Min: "(" + strconv.FormatInt(seq, 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return cache.StrokesAfterSeq{}, err
+	}
+	// Sequence numbers stay in the index after an undo, so a complete index starts right after seq
+	if len(entries) == 0 || int64(entries[0].Score) != seq+1 {
+		return cache.StrokesAfterSeq{}, cache.ErrSequenceGap
+	}
+
+	result := cache.StrokesAfterSeq{Strokes: []cache.SequencedStroke{}, RemovedIds: []string{}, LastSeq: lastSeq}
+	var ids []string
+	var seqs []int64
+	for _, entry := range entries {
+		member := entry.Member.(string)
+		if removedId, ok := strings.CutPrefix(member, removedSeqPrefix); ok {
+			result.RemovedIds = append(result.RemovedIds, removedId)
+			continue
+		}
+		ids = append(ids, member)
+		seqs = append(seqs, int64(entry.Score))
+	}
+	if len(ids) == 0 {
+		return result, nil
+	}
+
+	dataMap, err := redisCache.client.HMGet(ctx, dataKey, ids...).Result()
+	if err != nil {
+		return cache.StrokesAfterSeq{}, err
+	}
+	for i, item := range dataMap {
+		if s, ok := item.(string); ok {
+			result.Strokes = append(result.Strokes, cache.SequencedStroke{Seq: seqs[i], Data: []byte(s)})
+		}
+	}
+	return result, nil
+}
+
 func (redisCache *RedisWebverseCache) SetPageComplete(ctx context.Context, pageKey string) error {
 	completeKey := buildPageCompleteKey(pageKey)
 	return redisCache.client.Set(ctx, completeKey, "true", cacheTTL).Err()
@@ -233,19 +399,477 @@ func (redisCache *RedisWebverseCache) InvalidatePages(ctx context.Context, pageK
 	}
 
 	// In Redis Cluster, keys with different hash tags hash to different slots.
-	// We must delete each page separately, but we can pipeline the 3 keys within each page.
+	// We must delete each page separately, but we can pipeline the keys within each page.
 	for _, pageKey := range pageKeys {
 		key := buildPageKey(pageKey)
 		dataKey := buildPageDataKey(pageKey)
 		completeKey := buildPageCompleteKey(pageKey)
+		// The sequence counter is kept, see seqTTL
+		seqIndexKey := buildPageSeqIndexKey(pageKey)
 
-		// All 3 keys for this page have the same hash tag, so they hash to the same slot
-		if err := redisCache.client.Del(ctx, key, dataKey, completeKey).Err(); err != nil {
+		// All 4 keys for this page have the same hash tag, so they hash to the same slot
+		if err := redisCache.client.Del(ctx, key, dataKey, completeKey, seqIndexKey).Err(); err != nil {
 			return err
 		}
 	}
 
-	return nil
+	members := make([]any, len(pageKeys))
+	for i, pageKey := range pageKeys {
+		members[i] = pageKey
+	}
+	return redisCache.client.ZRem(ctx, cachedPagesKey, members...).Err()
+}
+
+// Cached pages
+// Sorted set of the cached pages, scored by the time they were last loaded, so the least recently
+// loaded pages can be evicted before Redis runs out of memory rather than waiting for their TTL
+const cachedPagesKey = "cached_pages"
+
+// TouchPage marks the page as just loaded and returns the number of tracked pages
+func (redisCache *RedisWebverseCache) TouchPage(ctx context.Context, pageKey string, touchedAt time.Time) (int64, error) {
+	pipe := redisCache.client.Pipeline()
+	pipe.ZAdd(ctx, cachedPagesKey, redis.Z{Score: float64(touchedAt.UnixMilli()), Member: pageKey})
+	card := pipe.ZCard(ctx, cachedPagesKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return card.Val(), nil
+}
+
+// GetTouchedPages returns up to limit pages loaded since the given time, most recently loaded first
+func (redisCache *RedisWebverseCache) GetTouchedPages(ctx context.Context, since time.Time, limit int) ([]string, error) {
+	return redisCache.client.ZRevRangeByScore(ctx, cachedPagesKey, &redis.ZRangeBy{
+		Min:   strconv.FormatInt(since.UnixMilli(), 10),
+		Max:   "+inf",
+		Count: int64(limit),
+	}).Result()
+}
+
+// EvictOldestPages removes the least recently loaded pages past maxPages from the tracked set and returns them
+// Their strokes are still cached, the caller invalidates them
+func (redisCache *RedisWebverseCache) EvictOldestPages(ctx context.Context, maxPages int) ([]string, error) {
+	count, err := redisCache.client.ZCard(ctx, cachedPagesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	if count <= int64(maxPages) {
+		return nil, nil
+	}
+
+	results, err := redisCache.client.ZPopMin(ctx, cachedPagesKey, count-int64(maxPages)).Result()
+	if err != nil {
+		return nil, err
+	}
+	pageKeys := make([]string, 0, len(results))
+	for _, z := range results {
+		if pageKey, ok := z.Member.(string); ok {
+			pageKeys = append(pageKeys, pageKey)
+		}
+	}
+	return pageKeys, nil
+}
+
+// GetPageVersionTag hashes the stroke ids in the page's ZSet, so the tag changes whenever a stroke is added or removed
+// Stroke content is immutable, so the ids are enough to identify a version of the page
+func (redisCache *RedisWebverseCache) GetPageVersionTag(ctx context.Context, pageKey string) (string, error) {
+	key := buildPageKey(pageKey)
+	strokeIds, err := redisCache.client.ZRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write([]byte(strconv.Itoa(len(strokeIds))))
+	for _, strokeId := range strokeIds {
+		h.Write([]byte{0})
+		h.Write([]byte(strokeId))
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16]), nil
+}
+
+// Paused pages
+// The flag is independent of the page's stroke cache, so InvalidatePages does not resume a page
+func (redisCache *RedisWebverseCache) SetPagePaused(ctx context.Context, pageKey string, ttl time.Duration) error {
+	return redisCache.client.Set(ctx, buildPagePausedKey(pageKey), "true", ttl).Err()
+}
+
+func (redisCache *RedisWebverseCache) ClearPagePaused(ctx context.Context, pageKey string) error {
+	return redisCache.client.Del(ctx, buildPagePausedKey(pageKey)).Err()
+}
+
+func (redisCache *RedisWebverseCache) IsPagePaused(ctx context.Context, pageKey string) (bool, error) {
+	val, err := redisCache.client.Exists(ctx, buildPagePausedKey(pageKey)).Result()
+	if err != nil {
+		return false, err
+	}
+	return val > 0, nil
+}
+
+// Account deletion checkpoint
+// Pages affected by an in-progress account deletion, so a redelivered deletion still
+// invalidates pages whose strokes were already deleted by an interrupted attempt
+const deletionPagesTTL = 24 * time.Hour
+
+func (redisCache *RedisWebverseCache) AddUserDeletionPages(ctx context.Context, userId string, pageKeys []string) error {
+	if len(pageKeys) == 0 {
+		return nil
+	}
+	key := "user:" + userId + ":deletion_pages"
+	members := make([]any, len(pageKeys))
+	for i, pageKey := range pageKeys {
+		members[i] = pageKey
+	}
+
+	pipe := redisCache.client.Pipeline()
+	pipe.SAdd(ctx, key, members...)
+	pipe.Expire(ctx, key, deletionPagesTTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (redisCache *RedisWebverseCache) GetUserDeletionPages(ctx context.Context, userId string) ([]string, error) {
+	key := "user:" + userId + ":deletion_pages"
+	return redisCache.client.SMembers(ctx, key).Result()
+}
+
+func (redisCache *RedisWebverseCache) ClearUserDeletionPages(ctx context.Context, userId string) error {
+	key := "user:" + userId + ":deletion_pages"
+	return redisCache.client.Del(ctx, key).Err()
+}
+
+// Stroke count of an in-progress layer deletion, so a redelivered deletion still
+// decrements the strokes already deleted by an interrupted attempt
+// Only the first count is kept, the stored count is returned
+func (redisCache *RedisWebverseCache) SetUserDeletionCount(ctx context.Context, userId string, layer string, count int) (int, error) {
+	key := "user:" + userId + ":deletion_count:" + layer
+
+	pipe := redisCache.client.Pipeline()
+	pipe.SetNX(ctx, key, count, deletionPagesTTL)
+	get := pipe.Get(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return get.Int()
+}
+
+func (redisCache *RedisWebverseCache) ClearUserDeletionCount(ctx context.Context, userId string, layer string) error {
+	key := "user:" + userId + ":deletion_count:" + layer
+	return redisCache.client.Del(ctx, key).Err()
+}
+
+// Recent pages
+// Sorted set of the pages a user drew on, scored by the time of their last draw
+const recentPagesTTL = 30 * 24 * time.Hour
+
+func (redisCache *RedisWebverseCache) AddRecentPage(ctx context.Context, userId string, pageKey string, drawnAt time.Time, maxSize int) error {
+	key := "user:" + userId + ":recent_pages"
+
+	pipe := redisCache.client.Pipeline()
+	pipe.ZAdd(ctx, key, redis.Z{Score: float64(drawnAt.UnixMilli()), Member: pageKey})
+	// Keep only the maxSize most recent pages
+	pipe.ZRemRangeByRank(ctx, key, 0, int64(-maxSize-1))
+	pipe.Expire(ctx, key, recentPagesTTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (redisCache *RedisWebverseCache) GetRecentPages(ctx context.Context, userId string, limit int) ([]cache.RecentPage, error) {
+	key := "user:" + userId + ":recent_pages"
+	results, err := redisCache.client.ZRevRangeWithScores(ctx, key, 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	pages := make([]cache.RecentPage, 0, len(results))
+	for _, z := range results {
+		if pageKey, ok := z.Member.(string); ok {
+			pages = append(pages, cache.RecentPage{PageKey: pageKey, LastDrawn: int64(z.Score)})
+		}
+	}
+	return pages, nil
+}
+
+func (redisCache *RedisWebverseCache) ClearRecentPages(ctx context.Context, userId string) error {
+	key := "user:" + userId + ":recent_pages"
+	return redisCache.client.Del(ctx, key).Err()
+}
+
+// Reconnect state
+// JSON blob per reconnect token, the client only ever holds the token
+func (redisCache *RedisWebverseCache) SetReconnectState(ctx context.Context, token string, state cache.ReconnectState, ttl time.Duration) error {
+	key := "reconnect:" + token
+	stateBytes, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return redisCache.client.Set(ctx, key, stateBytes, ttl).Err()
+}
+
+// GetReconnectState returns an empty state if the token is unknown or expired
+func (redisCache *RedisWebverseCache) GetReconnectState(ctx context.Context, token string) (cache.ReconnectState, error) {
+	key := "reconnect:" + token
+	stateBytes, err := redisCache.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return cache.ReconnectState{}, nil
+	}
+	if err != nil {
+		return cache.ReconnectState{}, err
+	}
+
+	var state cache.ReconnectState
+	if err := json.Unmarshal(stateBytes, &state); err != nil {
+		return cache.ReconnectState{}, err
+	}
+	return state, nil
+}
+
+// User usage
+func (redisCache *RedisWebverseCache) SetUserUsage(ctx context.Context, userId string, usage cache.UserUsage, ttl time.Duration) error {
+	key := "usage:" + userId
+	usageBytes, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	return redisCache.client.Set(ctx, key, usageBytes, ttl).Err()
+}
+
+// GetUserUsage returns an empty usage (Computed 0) if none is cached
+func (redisCache *RedisWebverseCache) GetUserUsage(ctx context.Context, userId string) (cache.UserUsage, error) {
+	key := "usage:" + userId
+	usageBytes, err := redisCache.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return cache.UserUsage{}, nil
+	}
+	if err != nil {
+		return cache.UserUsage{}, err
+	}
+
+	var usage cache.UserUsage
+	if err := json.Unmarshal(usageBytes, &usage); err != nil {
+		return cache.UserUsage{}, err
+	}
+	return usage, nil
+}
+
+// Marks a user's pages set as computed from the store, page keys are never empty
+const userPagesComplete = ""
+
+// User pages
+// Set of the pages a user has strokes on, computed from the store and cached for a short time
+// A set computed from the store also holds userPagesComplete, so users without pages are cached as well
+// Pages drawn on while the set is not cached go in a set without it, which is merged into the next computed one
+func (redisCache *RedisWebverseCache) SetUserPages(ctx context.Context, userId string, pageKeys []string, ttl time.Duration) error {
+	key := "user:" + userId + ":pages"
+	members := make([]any, len(pageKeys))
+	for i, pageKey := range pageKeys {
+		members[i] = pageKey
+	}
+
+	pipe := redisCache.client.TxPipeline()
+	pipe.Del(ctx, key)
+	pipe.SAdd(ctx, key, append([]any{userPagesComplete}, members...)...)
+	pipe.Expire(ctx, key, ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// GetUserPages returns the user's cached pages, and whether they are all of the user's pages
+// If they are not, they are the pages drawn on since the cached set expired or was dropped
+func (redisCache *RedisWebverseCache) GetUserPages(ctx context.Context, userId string) ([]string, bool, error) {
+	key := "user:" + userId + ":pages"
+	members, err := redisCache.client.SMembers(ctx, key).Result()
+	if err != nil {
+		return nil, false, err
+	}
+
+	complete := false
+	pageKeys := make([]string, 0, len(members))
+	for _, member := range members {
+		if member == userPagesComplete {
+			complete = true
+		} else {
+			pageKeys = append(pageKeys, member)
+		}
+	}
+	return pageKeys, complete, nil
+}
+
+// InvalidateUserPages drops the user's cached pages unless pageKey is already one of them
+func (redisCache *RedisWebverseCache) InvalidateUserPages(ctx context.Context, userId string, pageKey string) error {
+	key := "user:" + userId + ":pages"
+	isMember, err := redisCache.client.SIsMember(ctx, key, pageKey).Result()
+	if err != nil || isMember {
+		return err
+	}
+	return redisCache.client.Del(ctx, key).Err()
+}
+
+// Keeps the expiry of an existing set, a new one can only be incomplete
+var addUserPageScript = redis.NewScript(`
+redis.call("SADD", KEYS[1], ARGV[1])
+if redis.call("TTL", KEYS[1]) < 0 then
+	redis.call("EXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// AddUserPage adds pageKey to the user's cached pages, creating an incomplete set if they are not cached
+func (redisCache *RedisWebverseCache) AddUserPage(ctx context.Context, userId string, pageKey string) error {
+	key := "user:" + userId + ":pages"
+	return addUserPageScript.Run(ctx, redisCache.client, []string{key}, pageKey, int(cacheTTL/time.Second)).Err()
+}
+
+// Page settings
+// Read on every public draw when page settings are enabled, so they are cached rather than read from the store
+func (redisCache *RedisWebverseCache) SetPageSettings(ctx context.Context, pageKey string, settings models.PageSettings, ttl time.Duration) error {
+	key := "page:{" + pageKey + "}:settings"
+	settingsBytes, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	return redisCache.client.Set(ctx, key, settingsBytes, ttl).Err()
+}
+
+// GetPageSettings reports false if the page's settings are not cached
+func (redisCache *RedisWebverseCache) GetPageSettings(ctx context.Context, pageKey string) (models.PageSettings, bool, error) {
+	key := "page:{" + pageKey + "}:settings"
+	settingsBytes, err := redisCache.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return models.PageSettings{}, false, nil
+	}
+	if err != nil {
+		return models.PageSettings{}, false, err
+	}
+
+	var settings models.PageSettings
+	if err := json.Unmarshal(settingsBytes, &settings); err != nil {
+		return models.PageSettings{}, false, err
+	}
+	return settings, true, nil
+}
+
+// Draw idempotency
+// ClaimDrawHash maps a draw's content hash to its stroke id unless the hash is already mapped
+// Returns the existing stroke id if it was, or "" if the hash was claimed for strokeId
+func (redisCache *RedisWebverseCache) ClaimDrawHash(ctx context.Context, hash string, strokeId string, ttl time.Duration) (string, error) {
+	key := "draw:" + hash
+	claimed, err := redisCache.client.SetNX(ctx, key, strokeId, ttl).Result()
+	if err != nil {
+		return "", err
+	}
+	if claimed {
+		// Lets an undo of the stroke find its hash, the two keys may live on different cluster nodes
+		return "", redisCache.client.Set(ctx, "draw_stroke:"+strokeId, hash, ttl).Err()
+	}
+
+	existing, err := redisCache.client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		// Expired in between, the draw is not a duplicate anymore
+		return "", nil
+	}
+	return existing, err
+}
+
+// Only deletes the hash while it still maps to the stroke, a later draw may have claimed it since
+var releaseDrawHashScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+func (redisCache *RedisWebverseCache) ReleaseDrawHash(ctx context.Context, strokeId string) error {
+	strokeKey := "draw_stroke:" + strokeId
+	hash, err := redisCache.client.Get(ctx, strokeKey).Result()
+	if err == redis.Nil {
+		// Never claimed, or its window is over
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := releaseDrawHashScript.Run(ctx, redisCache.client, []string{"draw:" + hash}, strokeId).Err(); err != nil {
+		return err
+	}
+	return redisCache.client.Del(ctx, strokeKey).Err()
+}
+
+// Banned users
+// One key per user expiring when the ban ends, so checking a ban is a single EXISTS
+func (redisCache *RedisWebverseCache) BanUser(ctx context.Context, userId string, until time.Time) error {
+	key := "user:" + userId + ":banned"
+	return redisCache.client.SetArgs(ctx, key, "true", redis.SetArgs{ExpireAt: until}).Err()
+}
+
+func (redisCache *RedisWebverseCache) IsUserBanned(ctx context.Context, userId string) (bool, error) {
+	key := "user:" + userId + ":banned"
+	val, err := redisCache.client.Exists(ctx, key).Result()
+	if err != nil {
+		return false, err
+	}
+	return val > 0, nil
+}
+
+// Processed queue messages
+// Markers of the queue messages already handled, so a message redelivered after it was processed is skipped
+func (redisCache *RedisWebverseCache) MarkMessageProcessed(ctx context.Context, messageId string, ttl time.Duration) error {
+	return redisCache.client.Set(ctx, "mq:processed:"+messageId, "1", ttl).Err()
+}
+
+func (redisCache *RedisWebverseCache) IsMessageProcessed(ctx context.Context, messageId string) (bool, error) {
+	val, err := redisCache.client.Exists(ctx, "mq:processed:"+messageId).Result()
+	if err != nil {
+		return false, err
+	}
+	return val > 0, nil
+}
+
+// Pending stroke counts
+// Hash of user ("provider#providerId") -> stroke count change not yet written to the store,
+// shared by all servers so a restarted server can write the changes a crashed one held in memory
+const pendingStrokeCountsKey = "counter:pending"
+
+func (redisCache *RedisWebverseCache) AddPendingStrokeCount(ctx context.Context, userKey string, delta int) error {
+	return redisCache.client.HIncrBy(ctx, pendingStrokeCountsKey, userKey, int64(delta)).Err()
+}
+
+// TakePendingStrokeCount removes the user's pending change and returns it, 0 if there is none
+// Get and delete run in one transaction, so a change is only ever taken by one server
+func (redisCache *RedisWebverseCache) TakePendingStrokeCount(ctx context.Context, userKey string) (int, error) {
+	var get *redis.StringCmd
+	_, err := redisCache.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.HGet(ctx, pendingStrokeCountsKey, userKey)
+		pipe.HDel(ctx, pendingStrokeCountsKey, userKey)
+		return nil
+	})
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return get.Int()
+}
+
+func (redisCache *RedisWebverseCache) GetPendingStrokeCountUsers(ctx context.Context) ([]string, error) {
+	return redisCache.client.HKeys(ctx, pendingStrokeCountsKey).Result()
+}
+
+// Dropped strokes
+// Total of acknowledged strokes that were never persisted, across all servers and restarts
+const droppedStrokesKey = "stroke_batcher:dropped"
+
+func (redisCache *RedisWebverseCache) AddDroppedStrokes(ctx context.Context, count int) (int64, error) {
+	return redisCache.client.IncrBy(ctx, droppedStrokesKey, int64(count)).Result()
+}
+
+// GetDroppedStrokes returns 0 if no stroke was ever dropped
+func (redisCache *RedisWebverseCache) GetDroppedStrokes(ctx context.Context) (int64, error) {
+	count, err := redisCache.client.Get(ctx, droppedStrokesKey).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return count, err
 }
 
 // User Stroke Count
@@ -269,6 +893,19 @@ func (redisCache *RedisWebverseCache) DecrementUserStrokeCount(ctx context.Conte
 	return nil
 }
 
+// Only adjusts an existing count, creating one here would hide the strokes already in the store
+var addUserStrokeCountScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	redis.call("INCRBY", KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+func (redisCache *RedisWebverseCache) AddUserStrokeCount(ctx context.Context, userId string, delta int) error {
+	key := "user:" + userId + ":stroke_count"
+	return addUserStrokeCountScript.Run(ctx, redisCache.client, []string{key}, delta).Err()
+}
+
 func (redisCache *RedisWebverseCache) SeedUserStrokeCount(ctx context.Context, userId string, count int) error {
 	key := "user:" + userId + ":stroke_count"
 	return redisCache.client.SetNX(ctx, key, count, cacheTTL).Err()
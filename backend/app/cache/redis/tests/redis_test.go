@@ -0,0 +1,243 @@
+package redis_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zlnvch/webverse/cache/redis"
+)
+
+// fakeRedis speaks just enough RESP2 to serve GetStrokes, GetUserPages and the dropped stroke total:
+// sorted sets, hashes, sets and strings
+type fakeRedis struct {
+	mu     sync.Mutex
+	zsets  map[string][]string
+	hashes map[string]map[string]string
+	sets   map[string][]string
+	values map[string]string
+}
+
+func newFakeRedis(t *testing.T) (*fakeRedis, string) {
+	fake := &fakeRedis{zsets: make(map[string][]string), hashes: make(map[string]map[string]string), sets: make(map[string][]string), values: make(map[string]string)}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fake.serve(conn)
+		}
+	}()
+	return fake, listener.Addr().String()
+}
+
+func (fake *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		fake.mu.Lock()
+		reply := fake.handle(args)
+		fake.mu.Unlock()
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(line)[1:])
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, count)
+	for i := range args {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		length, err := strconv.Atoi(strings.TrimSpace(header)[1:])
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:length])
+	}
+	return args, nil
+}
+
+func (fake *fakeRedis) handle(args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "EXPIRE":
+		return ":1\r\n"
+	case "ZRANGE":
+		// Only the negative ranges GetStrokes uses
+		members := fake.zsets[args[1]]
+		start, _ := strconv.Atoi(args[2])
+		start = max(len(members)+start, 0)
+		reply := fmt.Sprintf("*%d\r\n", len(members)-start)
+		for _, member := range members[start:] {
+			reply += bulk(member)
+		}
+		return reply
+	case "HMGET":
+		reply := fmt.Sprintf("*%d\r\n", len(args)-2)
+		for _, field := range args[2:] {
+			if value, ok := fake.hashes[args[1]][field]; ok {
+				reply += bulk(value)
+			} else {
+				reply += "$-1\r\n"
+			}
+		}
+		return reply
+	case "SMEMBERS":
+		members := fake.sets[args[1]]
+		reply := fmt.Sprintf("*%d\r\n", len(members))
+		for _, member := range members {
+			reply += bulk(member)
+		}
+		return reply
+	case "INCRBY":
+		count, _ := strconv.Atoi(fake.values[args[1]])
+		delta, _ := strconv.Atoi(args[2])
+		fake.values[args[1]] = strconv.Itoa(count + delta)
+		return ":" + fake.values[args[1]] + "\r\n"
+	case "GET":
+		value, ok := fake.values[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulk(value)
+	case "ZREM":
+		removed := 0
+		for _, member := range args[2:] {
+			if i := slices.Index(fake.zsets[args[1]], member); i >= 0 {
+				fake.zsets[args[1]] = slices.Delete(fake.zsets[args[1]], i, i+1)
+				removed++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", removed)
+	default:
+		// Includes the HELLO and CLIENT handshake, which the client falls back from
+		return "-ERR unknown command '" + args[0] + "'\r\n"
+	}
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func TestGetStrokes_RemovesOrphanedIds(t *testing.T) {
+	fake, addr := newFakeRedis(t)
+	ctx := context.Background()
+	redisCache, err := redis.NewRedisWebverseCache(ctx, true, addr)
+	assert.NoError(t, err)
+	defer redisCache.Close()
+
+	// "orphan" is in the ZSet, but its data is gone
+	fake.zsets["page:{example.com}"] = []string{"stroke1", "orphan", "stroke2"}
+	fake.hashes["page:{example.com}:data"] = map[string]string{"stroke1": "data1", "stroke2": "data2"}
+
+	strokes, err := redisCache.GetStrokes(ctx, "example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("data1"), []byte("data2")}, strokes)
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	assert.Equal(t, []string{"stroke1", "stroke2"}, fake.zsets["page:{example.com}"])
+}
+
+func TestGetStrokes_ConsistentPageUntouched(t *testing.T) {
+	fake, addr := newFakeRedis(t)
+	ctx := context.Background()
+	redisCache, err := redis.NewRedisWebverseCache(ctx, true, addr)
+	assert.NoError(t, err)
+	defer redisCache.Close()
+
+	fake.zsets["page:{example.com}"] = []string{"stroke1"}
+	fake.hashes["page:{example.com}:data"] = map[string]string{"stroke1": "data1"}
+
+	strokes, err := redisCache.GetStrokes(ctx, "example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("data1")}, strokes)
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	assert.Equal(t, []string{"stroke1"}, fake.zsets["page:{example.com}"])
+}
+
+func TestGetUserPages_CompleteOnlyWithMarker(t *testing.T) {
+	fake, addr := newFakeRedis(t)
+	ctx := context.Background()
+	redisCache, err := redis.NewRedisWebverseCache(ctx, true, addr)
+	assert.NoError(t, err)
+	defer redisCache.Close()
+
+	fake.mu.Lock()
+	// Computed from the store for a user without pages: only the empty marker
+	fake.sets["user:user1:pages"] = []string{""}
+	// Only added to by draws while not cached
+	fake.sets["user:user2:pages"] = []string{"example.com"}
+	fake.mu.Unlock()
+
+	pageKeys, complete, err := redisCache.GetUserPages(ctx, "user1")
+	assert.NoError(t, err)
+	assert.True(t, complete)
+	assert.Empty(t, pageKeys)
+
+	pageKeys, complete, err = redisCache.GetUserPages(ctx, "user2")
+	assert.NoError(t, err)
+	assert.False(t, complete)
+	assert.Equal(t, []string{"example.com"}, pageKeys)
+
+	_, complete, err = redisCache.GetUserPages(ctx, "user3")
+	assert.NoError(t, err)
+	assert.False(t, complete)
+}
+
+func TestDroppedStrokes_ReadBack(t *testing.T) {
+	_, addr := newFakeRedis(t)
+	ctx := context.Background()
+	redisCache, err := redis.NewRedisWebverseCache(ctx, true, addr)
+	assert.NoError(t, err)
+	defer redisCache.Close()
+
+	total, err := redisCache.GetDroppedStrokes(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), total)
+
+	total, err = redisCache.AddDroppedStrokes(ctx, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), total)
+	_, err = redisCache.AddDroppedStrokes(ctx, 2)
+	assert.NoError(t, err)
+
+	total, err = redisCache.GetDroppedStrokes(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), total)
+}
@@ -0,0 +1,80 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zlnvch/webverse/cache"
+	cachemocks "github.com/zlnvch/webverse/cache/mocks"
+	"github.com/zlnvch/webverse/metrics"
+)
+
+func TestInstrumentedCache_DelegatesAndRecords(t *testing.T) {
+	mockCache := new(cachemocks.MockCache)
+	registry := metrics.NewRegistry()
+	instrumented := cache.NewInstrumentedCache(mockCache, registry)
+	ctx := context.Background()
+
+	mockCache.On("AddStroke", ctx, "example.com", "s1", int64(1), []byte("data")).Return(int64(7), nil)
+	mockCache.On("Publish", ctx, "page:example.com", []byte("msg")).Return(errors.New("connection refused"))
+
+	seq, err := instrumented.AddStroke(ctx, "example.com", "s1", 1, []byte("data"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), seq)
+	assert.Equal(t, int64(1), registry.Duration("cache.add_stroke").Count)
+	assert.Equal(t, int64(0), registry.Counter("cache.add_stroke.errors"))
+
+	err = instrumented.Publish(ctx, "page:example.com", []byte("msg"))
+	assert.EqualError(t, err, "connection refused")
+	assert.Equal(t, int64(1), registry.Duration("cache.publish").Count)
+	assert.Equal(t, int64(1), registry.Counter("cache.publish.errors"))
+
+	mockCache.AssertExpectations(t)
+}
+
+func TestInstrumentedCache_CountsHitsAndMisses(t *testing.T) {
+	mockCache := new(cachemocks.MockCache)
+	registry := metrics.NewRegistry()
+	instrumented := cache.NewInstrumentedCache(mockCache, registry)
+	ctx := context.Background()
+
+	mockCache.On("GetStrokes", ctx, "cached.com").Return([][]byte{[]byte("stroke")}, nil)
+	mockCache.On("GetStrokes", ctx, "uncached.com").Return([][]byte{}, nil)
+	mockCache.On("GetStrokes", ctx, "down.com").Return([][]byte(nil), errors.New("connection refused"))
+	mockCache.On("IsPageComplete", ctx, "cached.com").Return(true, nil)
+	mockCache.On("IsPageComplete", ctx, "uncached.com").Return(false, nil)
+
+	strokes, err := instrumented.GetStrokes(ctx, "cached.com")
+	assert.NoError(t, err)
+	assert.Len(t, strokes, 1)
+	_, _ = instrumented.GetStrokes(ctx, "uncached.com")
+	_, _ = instrumented.GetStrokes(ctx, "down.com")
+
+	complete, err := instrumented.IsPageComplete(ctx, "cached.com")
+	assert.NoError(t, err)
+	assert.True(t, complete)
+	_, _ = instrumented.IsPageComplete(ctx, "uncached.com")
+
+	assert.Equal(t, int64(1), registry.Counter("cache.get_strokes.hits"))
+	assert.Equal(t, int64(1), registry.Counter("cache.get_strokes.misses"))
+	// Failed lookups are errors, neither hits nor misses
+	assert.Equal(t, int64(1), registry.Counter("cache.get_strokes.errors"))
+	assert.Equal(t, int64(3), registry.Duration("cache.get_strokes").Count)
+	assert.Equal(t, int64(1), registry.Counter("cache.is_page_complete.hits"))
+	assert.Equal(t, int64(1), registry.Counter("cache.is_page_complete.misses"))
+}
+
+func TestInstrumentedCache_SequenceGapIsNotAnError(t *testing.T) {
+	mockCache := new(cachemocks.MockCache)
+	registry := metrics.NewRegistry()
+	instrumented := cache.NewInstrumentedCache(mockCache, registry)
+	ctx := context.Background()
+
+	mockCache.On("GetStrokesAfterSeq", ctx, "example.com", int64(3)).Return(cache.StrokesAfterSeq{}, cache.ErrSequenceGap)
+
+	_, err := instrumented.GetStrokesAfterSeq(ctx, "example.com", 3)
+	assert.ErrorIs(t, err, cache.ErrSequenceGap)
+	assert.Equal(t, int64(0), registry.Counter("cache.get_strokes_after_seq.errors"))
+}
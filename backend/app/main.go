@@ -8,12 +8,20 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/zlnvch/webverse/api"
+	"github.com/zlnvch/webverse/api/ws"
+	"github.com/zlnvch/webverse/cache"
+	"github.com/zlnvch/webverse/cache/mempubsub"
 	"github.com/zlnvch/webverse/cache/redis"
 	"github.com/zlnvch/webverse/mq/sqsmq"
+	"github.com/zlnvch/webverse/store"
 	"github.com/zlnvch/webverse/store/dynamo"
+	"github.com/zlnvch/webverse/store/memstore"
 	"golang.org/x/oauth2"
 )
 
@@ -26,9 +34,19 @@ func main() {
 	ctx := context.Background()
 	devMode := os.Getenv("DEV_MODE") == "true"
 
-	webverseStore, err := dynamo.NewDynamoWebverseStore(ctx, devMode, os.Getenv("DYNAMODB_ENDPOINT"), DynamoDBTable)
-	if err != nil {
-		log.Fatalf("Failed to create dynamodb store: %v", err)
+	var webverseStore store.WebverseStore
+	if devMode && os.Getenv("MEMORY_STORE") == "true" {
+		// Local dev without DynamoDB: all data is lost on restart
+		log.Printf("Using in-memory store")
+		webverseStore = memstore.NewMemWebverseStore()
+	} else {
+		dynamoConfig := dynamo.DefaultDynamoConfig()
+		dynamoConfig.DeleteThrottle = time.Duration(getEnvInt("DYNAMO_DELETE_THROTTLE_MS", int(dynamoConfig.DeleteThrottle/time.Millisecond))) * time.Millisecond
+		dynamoStore, err := dynamo.NewDynamoWebverseStore(ctx, devMode, os.Getenv("DYNAMODB_ENDPOINT"), DynamoDBTable, dynamoConfig)
+		if err != nil {
+			log.Fatalf("Failed to create dynamodb store: %v", err)
+		}
+		webverseStore = dynamoStore
 	}
 
 	deleteUserStrokesQueue, err := sqsmq.NewSQSMessageQueue(ctx, devMode, os.Getenv("SQS_ENDPOINT"), SQSDeleteUserStrokesQueue)
@@ -36,10 +54,17 @@ func main() {
 		log.Fatalf("Failed to create SQS MQ: %v", err)
 	}
 
-	webverseCache, err := redis.NewRedisWebverseCache(ctx, devMode, os.Getenv("REDIS_ENDPOINT"))
+	var webverseCache cache.WebverseCache
+	redisCache, err := redis.NewRedisWebverseCache(ctx, devMode, os.Getenv("REDIS_ENDPOINT"))
 	if err != nil {
 		log.Fatalf("Failed to create redis cache: %v", err)
 	}
+	webverseCache = redisCache
+	if os.Getenv("MEMORY_PUBSUB") == "true" {
+		// Single-instance deployments: fan-out happens in-process instead of through Redis
+		log.Printf("Using in-memory pub/sub")
+		webverseCache = mempubsub.Wrap(redisCache)
+	}
 
 	extensionId := os.Getenv("EXTENSION_ID")
 
@@ -60,6 +85,14 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to decode base64 jwtSecret: %v", err)
 	}
+	jwtSecrets := [][]byte{jwtSecret}
+	for _, previous := range getEnvList("JWT_PREVIOUS_SECRETS") {
+		previousSecret, err := base64.StdEncoding.DecodeString(previous)
+		if err != nil {
+			log.Fatalf("Failed to decode base64 previous jwtSecret: %v", err)
+		}
+		jwtSecrets = append(jwtSecrets, previousSecret)
+	}
 
 	shutdownCtx, stop := signal.NotifyContext(
 		context.Background(),
@@ -68,7 +101,71 @@ func main() {
 	)
 	defer stop()
 
-	webverseApi, err := api.NewWebverseAPI(webverseStore, deleteUserStrokesQueue, webverseCache, oauthConfigs, jwtSecret, shutdownCtx)
+	config := api.DefaultConfig()
+	config.Service.JWTIssuer = os.Getenv("JWT_ISSUER")
+	config.Service.JWTAudience = os.Getenv("JWT_AUDIENCE")
+	config.Service.AdminUserIds = getEnvList("ADMIN_USER_IDS")
+	config.Service.PageKeyPolicy.Blocklist = getEnvList("BLOCKED_PAGE_KEYS")
+	config.Service.PageKeyPolicy.Allowlist = getEnvList("ALLOWED_PAGE_KEYS")
+	config.Service.StrokeLimits.AllowedColors = getEnvList("ALLOWED_COLORS")
+	config.Service.StrokeLimits.MinPoints = getEnvInt("MIN_STROKE_POINTS", 0)
+	config.Service.PageSettings = os.Getenv("PAGE_SETTINGS") == "true"
+	config.Service.ReportHideThreshold = getEnvInt("REPORT_HIDE_THRESHOLD", 0)
+	config.Service.DrawDedupeWindow = time.Duration(getEnvInt("DRAW_DEDUPE_WINDOW_MS", 0)) * time.Millisecond
+	config.Service.DrawCoalesceWindow = time.Duration(getEnvInt("DRAW_COALESCE_WINDOW_MS", 0)) * time.Millisecond
+	config.Service.UndoPrecheck = os.Getenv("UNDO_PRECHECK") == "true"
+	config.Service.OAuthTimeout = time.Duration(getEnvInt("OAUTH_TIMEOUT_MS", int(config.Service.OAuthTimeout/time.Millisecond))) * time.Millisecond
+	config.Service.RejectPlaintextPrivate = os.Getenv("REJECT_PLAINTEXT_PRIVATE") == "true"
+	config.Service.NonceBits = getEnvInt("NONCE_BITS", config.Service.NonceBits)
+	config.Service.PublishKeyMaterial = os.Getenv("PUBLISH_KEY_MATERIAL") == "true"
+	config.Service.PublishStrokePersisted = os.Getenv("PUBLISH_STROKE_PERSISTED") == "true"
+	config.Service.MaxPageStrokesReturned = getEnvInt("MAX_PAGE_STROKES_RETURNED", config.Service.MaxPageStrokesReturned)
+	config.Service.MaxCachedPages = getEnvInt("MAX_CACHED_PAGES", config.Service.MaxCachedPages)
+	config.Service.MaxUserPages = getEnvInt("MAX_USER_PAGES", 0)
+	config.Service.ReconcileInterval = time.Duration(getEnvInt("RECONCILE_INTERVAL_MS", 0)) * time.Millisecond
+	config.Service.ReconcileMaxPages = getEnvInt("RECONCILE_MAX_PAGES", config.Service.ReconcileMaxPages)
+	config.Service.ReconcileThreshold = getEnvInt("RECONCILE_THRESHOLD", config.Service.ReconcileThreshold)
+	config.Service.InactiveUserCleanupInterval = time.Duration(getEnvInt("INACTIVE_USER_CLEANUP_INTERVAL_MS", 0)) * time.Millisecond
+	config.Service.InactiveUserMinAge = time.Duration(getEnvInt("INACTIVE_USER_MIN_AGE_DAYS", 0)) * 24 * time.Hour
+	config.Service.InactiveUserIdle = time.Duration(getEnvInt("INACTIVE_USER_IDLE_DAYS", 0)) * 24 * time.Hour
+	config.Service.PageKeyPolicy.DisablePrivate = os.Getenv("DISABLE_PRIVATE_PAGES") == "true"
+	config.Service.PageKeyPolicy.AllowPrivateHosts = os.Getenv("ALLOW_PRIVATE_HOSTS") == "true"
+	config.Service.PageKeyPolicy.NormalizePaths = os.Getenv("NORMALIZE_PAGE_PATHS") == "true"
+	config.ExposeMetrics = os.Getenv("EXPOSE_METRICS") == "true"
+	config.TrustedProxyCount = getEnvInt("TRUSTED_PROXY_COUNT", 0)
+	config.LoginRateLimit.PerMinute = getEnvInt("LOGIN_RATE_LIMIT_PER_MIN", 0)
+	config.LoginRateLimit.Burst = getEnvInt("LOGIN_RATE_LIMIT_BURST", config.LoginRateLimit.PerMinute)
+	config.WSConnectRateLimit.PerMinute = getEnvInt("WS_CONNECT_RATE_LIMIT_PER_MIN", 0)
+	config.WSConnectRateLimit.Burst = getEnvInt("WS_CONNECT_RATE_LIMIT_BURST", config.WSConnectRateLimit.PerMinute)
+	config.RequestTimeout = time.Duration(getEnvInt("REQUEST_TIMEOUT_MS", int(config.RequestTimeout/time.Millisecond))) * time.Millisecond
+	config.WSTimeouts.WriteWait = time.Duration(getEnvInt("WS_WRITE_WAIT_MS", int(config.WSTimeouts.WriteWait/time.Millisecond))) * time.Millisecond
+	config.WSTimeouts.PongWait = time.Duration(getEnvInt("WS_PONG_WAIT_MS", int(config.WSTimeouts.PongWait/time.Millisecond))) * time.Millisecond
+	// Pings follow the pong wait unless set explicitly
+	config.WSTimeouts.PingPeriod = time.Duration(getEnvInt("WS_PING_PERIOD_MS", int(config.WSTimeouts.PongWait*9/10/time.Millisecond))) * time.Millisecond
+	config.MaxSubscribersPerPage = getEnvInt("MAX_SUBSCRIBERS_PER_PAGE", config.MaxSubscribersPerPage)
+	config.WSLoadLimits.MaxPages = getEnvInt("WS_MAX_PAGE_LOADS", config.WSLoadLimits.MaxPages)
+	config.WSLoadLimits.Window = time.Duration(getEnvInt("WS_PAGE_LOAD_WINDOW_MS", int(config.WSLoadLimits.Window/time.Millisecond))) * time.Millisecond
+	config.WSRateLimitGrace = time.Duration(getEnvInt("WS_RATE_LIMIT_GRACE_MS", int(config.WSRateLimitGrace/time.Millisecond))) * time.Millisecond
+	config.WSSendBufferSize = getEnvInt("WS_SEND_BUFFER_SIZE", config.WSSendBufferSize)
+	if v := os.Getenv("WS_SEND_OVERFLOW"); v != "" {
+		config.WSSendOverflow, err = ws.ParseSendOverflowPolicy(v)
+		if err != nil {
+			log.Fatalf("Invalid WS_SEND_OVERFLOW: %v", err)
+		}
+	}
+	config.CounterFlushInterval = time.Duration(getEnvInt("COUNTER_FLUSH_INTERVAL_MS", int(config.CounterFlushInterval/time.Millisecond))) * time.Millisecond
+	config.CounterFlushUsers = getEnvInt("COUNTER_FLUSH_USERS", config.CounterFlushUsers)
+	config.CounterWAL = os.Getenv("COUNTER_WAL") == "true"
+	config.StrokeBufferSize = getEnvInt("STROKE_BUFFER_SIZE", config.StrokeBufferSize)
+	config.StrokeShedWhenFull = os.Getenv("STROKE_SHED_WHEN_FULL") == "true"
+	config.StrokeTransactionalFlushSize = getEnvInt("STROKE_TRANSACTIONAL_FLUSH_SIZE", config.StrokeTransactionalFlushSize)
+	config.StrokeGracePeriod = time.Duration(getEnvInt("STROKE_GRACE_PERIOD_MS", 0)) * time.Millisecond
+	config.MQConsumers = getEnvInt("MQ_CONSUMERS", config.MQConsumers)
+	config.MQVisibilityTimeout = time.Duration(getEnvInt("MQ_VISIBILITY_TIMEOUT_S", int(config.MQVisibilityTimeout/time.Second))) * time.Second
+	config.WebhookURLs = getEnvList("WEBHOOK_URLS")
+	config.WebhookSecret = []byte(os.Getenv("WEBHOOK_SECRET"))
+
+	webverseApi, err := api.NewWebverseAPI(webverseStore, deleteUserStrokesQueue, webverseCache, oauthConfigs, jwtSecrets, config, shutdownCtx)
 	if err != nil {
 		log.Fatalf("Failed to create webverse api: %v", err)
 	}
@@ -80,8 +177,63 @@ func main() {
 	if p := os.Getenv("HOST_PORT"); p != "" {
 		hostPort = p
 	}
-	log.Printf("Starting server on host port: %s\n", hostPort)
-	log.Fatal(http.ListenAndServe(":8080", mux))
+	server := &http.Server{Addr: ":8080", Handler: mux}
+	go func() {
+		log.Printf("Starting server on host port: %s\n", hostPort)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server failed: %v", err)
+		}
+	}()
 
+	<-shutdownCtx.Done()
 	log.Printf("Server shutting down...")
+
+	// Websocket connections are hijacked and not tracked by Shutdown,
+	// they close themselves when shutdownCtx is done
+	serverCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(serverCtx); err != nil {
+		log.Printf("Failed to shut down http server: %v", err)
+	}
+
+	// Pending strokes and counters are written before the store and cache are closed
+	workersCtx, cancelWorkers := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelWorkers()
+	if !webverseApi.WaitForWorkers(workersCtx) {
+		log.Printf("Timed out waiting for workers to finish, pending writes may be lost")
+	}
+
+	if err := webverseCache.Close(); err != nil {
+		log.Printf("Failed to close cache: %v", err)
+	}
+	if err := deleteUserStrokesQueue.Close(); err != nil {
+		log.Printf("Failed to close MQ: %v", err)
+	}
+	if err := webverseStore.Close(); err != nil {
+		log.Printf("Failed to close store: %v", err)
+	}
+}
+
+// getEnvList splits a comma-separated environment variable, ignoring empty entries
+func getEnvList(key string) []string {
+	var values []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// getEnvInt parses an integer environment variable, using def if it is unset
+func getEnvInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
+	}
+	return n
 }
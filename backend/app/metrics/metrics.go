@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Metrics is the sink components report counters and timings to
+type Metrics interface {
+	Inc(name string, delta int64)
+	Observe(name string, d time.Duration)
+}
+
+// Noop discards everything, used when a component is created without a sink
+type Noop struct{}
+
+func (Noop) Inc(name string, delta int64)         {}
+func (Noop) Observe(name string, d time.Duration) {}
+
+// OrNoop returns m, or a Noop sink if m is nil
+func OrNoop(m Metrics) Metrics {
+	if m == nil {
+		return Noop{}
+	}
+	return m
+}
+
+type DurationStats struct {
+	Count int64         `json:"count"`
+	Total time.Duration `json:"totalNs"`
+	Max   time.Duration `json:"maxNs"`
+}
+
+type Snapshot struct {
+	Counters  map[string]int64         `json:"counters"`
+	Durations map[string]DurationStats `json:"durations"`
+}
+
+// Registry is an in-process Metrics implementation keeping running totals since startup
+type Registry struct {
+	mu        sync.Mutex
+	counters  map[string]int64
+	durations map[string]DurationStats
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		counters:  make(map[string]int64),
+		durations: make(map[string]DurationStats),
+	}
+}
+
+func (r *Registry) Inc(name string, delta int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counters[name] += delta
+}
+
+func (r *Registry) Observe(name string, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := r.durations[name]
+	stats.Count++
+	stats.Total += d
+	stats.Max = max(stats.Max, d)
+	r.durations[name] = stats
+}
+
+func (r *Registry) Counter(name string) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counters[name]
+}
+
+func (r *Registry) Duration(name string) DurationStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.durations[name]
+}
+
+func (r *Registry) Snapshot() Snapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	snapshot := Snapshot{
+		Counters:  make(map[string]int64, len(r.counters)),
+		Durations: make(map[string]DurationStats, len(r.durations)),
+	}
+	for k, v := range r.counters {
+		snapshot.Counters[k] = v
+	}
+	for k, v := range r.durations {
+		snapshot.Durations[k] = v
+	}
+	return snapshot
+}
+
+// ServeHTTP writes the current snapshot as JSON
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.Snapshot())
+}
@@ -1,5 +1,11 @@
 package models
 
+import (
+	"errors"
+
+	"github.com/gofrs/uuid/v5"
+)
+
 type User struct {
 	Id            string
 	Username      string
@@ -13,6 +19,8 @@ type User struct {
 	NonceDEK1     string
 	EncryptedDEK2 string
 	NonceDEK2     string
+	// Unix seconds of the user's last draw, written at most hourly. 0 if they haven't drawn since it was tracked
+	LastActive int64
 }
 
 type Stroke struct {
@@ -20,6 +28,20 @@ type Stroke struct {
 	UserId  string `json:"userId"`
 	Nonce   string `json:"nonce"`
 	Content []byte `json:"content"`
+	// Hidden by moderation pending review. Hidden strokes are only returned to admins
+	Hidden bool `json:"hidden,omitempty"`
+}
+
+// Validate checks the fields every persisted stroke has, to catch corrupt cache entries
+func (s Stroke) Validate() error {
+	id, err := uuid.FromString(s.Id)
+	if err != nil || id.Version() != uuid.V7 {
+		return errors.New("invalid stroke id")
+	}
+	if len(s.Content) == 0 {
+		return errors.New("empty stroke content")
+	}
+	return nil
 }
 
 type LayerType int
@@ -35,3 +57,19 @@ type StrokeRecord struct {
 	LayerId string
 	Stroke  Stroke
 }
+
+// PageSettings overrides the global stroke limits on a single page, e.g. a "fine detail" page
+// Zero fields keep the global limit
+type PageSettings struct {
+	MaxWidth  uint8 `json:"maxWidth"`
+	MaxPoints int   `json:"maxPoints"`
+}
+
+// StrokeReport is a user's report of another user's public stroke, for moderation
+type StrokeReport struct {
+	PageKey    string
+	StrokeId   string
+	ReporterId string
+	Reason     string
+	Created    int64
+}
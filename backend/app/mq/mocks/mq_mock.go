@@ -28,3 +28,8 @@ func (m *MockMQ) Delete(ctx context.Context, msg *mq.Message) error {
 	args := m.Called(ctx, msg)
 	return args.Error(0)
 }
+
+func (m *MockMQ) Close() error {
+	args := m.Called()
+	return args.Error(0)
+}
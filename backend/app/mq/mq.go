@@ -6,9 +6,13 @@ type MessageQueue interface {
 	Send(ctx context.Context, body string) error
 	Receive(ctx context.Context, visibilityTimeout int32) (*Message, error)
 	Delete(ctx context.Context, msg *Message) error
+	Close() error
 }
 
 type Message struct {
-	Id   string
-	Body string
+	// Identifies this delivery of the message, used to delete it. Changes every time the message is redelivered
+	Id string
+	// Identifies the message itself, the same across its deliveries
+	MessageId string
+	Body      string
 }
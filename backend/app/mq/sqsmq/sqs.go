@@ -52,3 +52,8 @@ func (sqsmq *SQSMessageQueue) Receive(ctx context.Context, visibilityTimeout int
 func (sqsmq *SQSMessageQueue) Delete(ctx context.Context, msg *mq.Message) error {
 	return deleteMessage(sqsmq, ctx, msg)
 }
+
+// Close is a no-op: the AWS SDK client holds no resources that need releasing
+func (sqsmq *SQSMessageQueue) Close() error {
+	return nil
+}
@@ -82,8 +82,9 @@ func receiveMessage(sqsmq *SQSMessageQueue, ctx context.Context, visibilityTimeo
 
 	msg := resp.Messages[0]
 	return &mq.Message{
-		Id:   aws.ToString(msg.ReceiptHandle),
-		Body: aws.ToString(msg.Body),
+		Id:        aws.ToString(msg.ReceiptHandle),
+		MessageId: aws.ToString(msg.MessageId),
+		Body:      aws.ToString(msg.Body),
 	}, nil
 }
 
@@ -0,0 +1,248 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/zlnvch/webverse/models"
+	"github.com/zlnvch/webverse/store"
+)
+
+var (
+	ErrNotAdmin   = errors.New("admin privileges required")
+	ErrUserBanned = errors.New("user is banned")
+)
+
+// IsAdmin reports whether the user is one of the configured admins (moderators)
+func (s *Service) IsAdmin(user models.User) bool {
+	return user.Id != "" && slices.Contains(s.Config.AdminUserIds, user.Id)
+}
+
+type UserLogoutMessage struct {
+	UserId string
+}
+
+// BanUser blocks a user from drawing and undoing until the given time
+// Their open connections are closed; they can reconnect, but every draw is rejected
+func (s *Service) BanUser(ctx context.Context, adminUser models.User, userId string, until time.Time) error {
+	if !s.IsAdmin(adminUser) {
+		return ErrNotAdmin
+	}
+	if userId == "" {
+		return errors.New("user id is required")
+	}
+	if !until.After(time.Now()) {
+		return errors.New("ban must end in the future")
+	}
+
+	if err := s.Cache.BanUser(ctx, userId, until); err != nil {
+		return err
+	}
+
+	// Async side-effects - return to caller as soon as as cache operation is done
+	go func() {
+		ctx, cancel := asyncContext()
+		defer cancel()
+
+		userLogoutMsg := UserLogoutMessage{UserId: userId}
+		userLogoutMsgBytes, err := json.Marshal(userLogoutMsg)
+		if err == nil {
+			if err := s.Cache.Publish(ctx, "user-logout", userLogoutMsgBytes); err != nil {
+				log.Printf("Failed to publish user-logout for user %s: %v", userId, err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// UserIdentity identifies a user by their OAuth account, like the store's user records
+type UserIdentity struct {
+	Provider   string
+	ProviderId string
+}
+
+type UserDeletionResult struct {
+	UserIdentity
+	// Empty if the user was deleted
+	Error string
+}
+
+const (
+	maxBulkDeleteUsers    = 100
+	bulkDeleteConcurrency = 5
+)
+
+// DeleteUsers deletes many users at once, e.g. for GDPR requests or cleanups
+// Each user goes through DeleteUser, so their strokes are deleted by the MQ consumer
+// A failed user does not stop the others: the results, in input order, report each user's outcome
+func (s *Service) DeleteUsers(ctx context.Context, adminUser models.User, identities []UserIdentity) ([]UserDeletionResult, error) {
+	if !s.IsAdmin(adminUser) {
+		return nil, ErrNotAdmin
+	}
+	if len(identities) == 0 {
+		return nil, errors.New("no users to delete")
+	}
+	if len(identities) > maxBulkDeleteUsers {
+		return nil, fmt.Errorf("at most %d users can be deleted at once", maxBulkDeleteUsers)
+	}
+
+	results := make([]UserDeletionResult, len(identities))
+	sem := make(chan struct{}, bulkDeleteConcurrency)
+	var wg sync.WaitGroup
+	for i, identity := range identities {
+		results[i].UserIdentity = identity
+		wg.Go(func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			if err := s.deleteUserByIdentity(ctx, identity); err != nil {
+				results[i].Error = err.Error()
+			}
+		})
+	}
+	wg.Wait()
+
+	deleted := 0
+	for _, result := range results {
+		if result.Error == "" {
+			deleted++
+		}
+	}
+	log.Printf("Admin %s deleted %d of %d users", adminUser.Id, deleted, len(identities))
+
+	return results, nil
+}
+
+func (s *Service) deleteUserByIdentity(ctx context.Context, identity UserIdentity) error {
+	if identity.Provider == "" || identity.ProviderId == "" {
+		return errors.New("provider and provider id are required")
+	}
+	// The user id is needed to delete their strokes and close their connections
+	user, err := s.Store.GetUser(ctx, identity.Provider, identity.ProviderId)
+	if err != nil {
+		return err
+	}
+	return s.DeleteUser(ctx, user)
+}
+
+// checkNotBanned fails open if the cache is unavailable, like the other draw path guards
+func (s *Service) checkNotBanned(ctx context.Context, userId string) error {
+	banned, err := s.Cache.IsUserBanned(ctx, userId)
+	if err != nil {
+		log.Printf("Failed to check if user %s is banned: %v", userId, err)
+		return nil
+	}
+	if banned {
+		return ErrUserBanned
+	}
+	return nil
+}
+
+// Largest page of users returned by ListUsersCreatedBetween
+const maxUsersPageSize = 100
+
+// ListUsersCreatedBetween pages through the users created between from and to (Unix seconds, inclusive), oldest first
+// Meant for growth analytics, the users only carry their public fields
+func (s *Service) ListUsersCreatedBetween(ctx context.Context, adminUser models.User, from int64, to int64, limit int, cursor string) ([]models.User, string, error) {
+	if !s.IsAdmin(adminUser) {
+		return nil, "", ErrNotAdmin
+	}
+	if from > to {
+		return nil, "", errors.New("from must not be after to")
+	}
+	if limit <= 0 || limit > maxUsersPageSize {
+		limit = maxUsersPageSize
+	}
+
+	return s.Store.GetUsersCreatedBetween(ctx, from, to, limit, cursor)
+}
+
+// GetStrokeOwner returns a stroke and the user who drew it, so moderators can act on abusive strokes
+// The user is nil if their account has since been deleted, the stroke is still returned
+func (s *Service) GetStrokeOwner(ctx context.Context, adminUser models.User, pageKey string, strokeId string) (models.Stroke, *models.User, error) {
+	if !s.IsAdmin(adminUser) {
+		return models.Stroke{}, nil, ErrNotAdmin
+	}
+	if pageKey == "" || strokeId == "" {
+		return models.Stroke{}, nil, errors.New("page and stroke id are required")
+	}
+	pageKey = s.Config.PageKeyPolicy.NormalizePageKey(pageKey, false)
+	if err := s.Config.PageKeyPolicy.ValidatePageKey(pageKey, false); err != nil {
+		return models.Stroke{}, nil, err
+	}
+
+	stroke, err := s.Store.GetStroke(ctx, pageKey, strokeId)
+	if errors.Is(err, store.ErrItemNotFound) {
+		return models.Stroke{}, nil, ErrStrokeNotFound
+	}
+	if err != nil {
+		return models.Stroke{}, nil, err
+	}
+
+	owner, err := s.Store.GetUserById(ctx, stroke.UserId)
+	if errors.Is(err, store.ErrItemNotFound) {
+		return stroke, nil, nil
+	}
+	if err != nil {
+		return models.Stroke{}, nil, err
+	}
+	return stroke, &owner, nil
+}
+
+// SetStrokeHidden hides a public stroke pending review, or restores it. It stays in the store either way
+// Hiding removes it like an undo, restoring invalidates the page so live clients reload it
+func (s *Service) SetStrokeHidden(ctx context.Context, adminUser models.User, pageKey string, strokeId string, hidden bool) error {
+	if !s.IsAdmin(adminUser) {
+		return ErrNotAdmin
+	}
+	pageKey = s.Config.PageKeyPolicy.NormalizePageKey(pageKey, false)
+	if err := s.Config.PageKeyPolicy.ValidatePageKey(pageKey, false); err != nil {
+		return err
+	}
+
+	stroke, err := s.Store.GetStroke(ctx, pageKey, strokeId)
+	if errors.Is(err, store.ErrItemNotFound) {
+		return ErrStrokeNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.Store.SetStrokeHidden(ctx, pageKey, strokeId, hidden); err != nil {
+		if errors.Is(err, store.ErrItemNotFound) {
+			return ErrStrokeNotFound
+		}
+		return err
+	}
+
+	if hidden {
+		// Async side-effects - return to caller as soon as the store operation is done
+		go s.removeHiddenStroke(pageKey, stroke)
+	} else {
+		if err := s.EvictPage(ctx, pageKey); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Admin %s set stroke %s on page %s hidden=%t", adminUser.Id, strokeId, pageKey, hidden)
+	return nil
+}
+
+// LoadPageAdmin returns the newest strokes of a public page from the store, including the hidden ones
+// Strokes drawn in the last moments may still be waiting to be written and missing
+func (s *Service) LoadPageAdmin(ctx context.Context, adminUser models.User, pageKey string) ([]models.Stroke, error) {
+	if !s.IsAdmin(adminUser) {
+		return nil, ErrNotAdmin
+	}
+	pageKey = s.Config.PageKeyPolicy.NormalizePageKey(pageKey, false)
+	if err := s.Config.PageKeyPolicy.ValidatePageKey(pageKey, false); err != nil {
+		return nil, err
+	}
+	return s.getStrokeRecordsWithRetry(ctx, pageKey, int32(s.Config.MaxPageStrokesReturned), true)
+}
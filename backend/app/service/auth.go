@@ -2,6 +2,8 @@ package service
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -24,10 +26,23 @@ type gitHubUser struct {
 }
 
 type googleUser struct {
-	Email string `json:"email"`
-	Sub   string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Sub           string `json:"sub"`
 }
 
+// Google emails are used as usernames, so unverified ones could impersonate other people
+var ErrEmailNotVerified = errors.New("email address is not verified")
+
+var ErrUnsupportedProvider = errors.New("unsupported provider")
+
+// Login failures, each wraps the error that caused it
+var (
+	ErrOAuthFailed      = errors.New("oauth failed")
+	ErrCreateUserFailed = errors.New("create user failed")
+	ErrTokenFailed      = errors.New("token generation failed")
+)
+
 var oauthAPIs = map[string]struct {
 	URL     string
 	Headers map[string]string
@@ -61,25 +76,37 @@ var oauthConfigsTemplate = map[string]*oauth2.Config{
 	},
 }
 
-func addOauthEndpointsAndScopes(oauthConfigs map[string]*oauth2.Config) (map[string]*oauth2.Config, error) {
-	for provider := range oauthConfigs {
+// OAuthConfig is a provider's OAuth client config and the endpoint the signed in user is read from
+type OAuthConfig struct {
+	*oauth2.Config
+	UserInfoURL string
+}
+
+func addOauthEndpointsAndScopes(oauthConfigs map[string]*oauth2.Config) (map[string]OAuthConfig, error) {
+	configs := make(map[string]OAuthConfig, len(oauthConfigs))
+	for provider, conf := range oauthConfigs {
 		template, ok := oauthConfigsTemplate[provider]
 		if !ok {
-			return nil, fmt.Errorf("unsupported provider: %s", provider)
+			return nil, fmt.Errorf("%w: %s", ErrUnsupportedProvider, provider)
 		}
-		oauthConfigs[provider].Endpoint = template.Endpoint
-		oauthConfigs[provider].Scopes = template.Scopes
+		conf.Endpoint = template.Endpoint
+		conf.Scopes = template.Scopes
+		configs[provider] = OAuthConfig{Config: conf, UserInfoURL: oauthAPIs[provider].URL}
 	}
 
-	return oauthConfigs, nil
+	return configs, nil
 }
 
 func (s *Service) HandleOauth(ctx context.Context, provider string, code string) (models.User, error) {
 	conf, ok := s.OAuthConfigs[provider]
 	if !ok {
-		return models.User{}, fmt.Errorf("unsupported provider: %s", provider)
+		return models.User{}, fmt.Errorf("%w: %s", ErrUnsupportedProvider, provider)
 	}
 
+	// The token exchange uses the context's client, the user info request a client derived from it
+	httpClient := &http.Client{Timeout: s.Config.OAuthTimeout}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, httpClient)
+
 	tok, err := conf.Exchange(ctx, code)
 	if err != nil {
 		log.Println("Error:", err)
@@ -87,12 +114,14 @@ func (s *Service) HandleOauth(ctx context.Context, provider string, code string)
 	}
 
 	client := conf.Client(ctx, tok)
+	// Only the transport is taken from the context's client
+	client.Timeout = s.Config.OAuthTimeout
 	api, ok := oauthAPIs[provider]
 	if !ok {
-		return models.User{}, fmt.Errorf("unsupported provider: %s", provider)
+		return models.User{}, fmt.Errorf("%w: %s", ErrUnsupportedProvider, provider)
 	}
 
-	req, err := http.NewRequest("GET", api.URL, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", conf.UserInfoURL, nil)
 	if err != nil {
 		log.Println("Error:", err)
 		return models.User{}, err
@@ -135,10 +164,13 @@ func parseUser(jsonData []byte, provider string) (models.User, error) {
 		if err := json.Unmarshal(jsonData, &g); err != nil {
 			return models.User{}, err
 		}
+		if !g.EmailVerified {
+			return models.User{}, ErrEmailNotVerified
+		}
 		u.Username = g.Email
 		u.ProviderId = g.Sub
 	default:
-		return models.User{}, fmt.Errorf("unsupported provider: %s", provider)
+		return models.User{}, fmt.Errorf("%w: %s", ErrUnsupportedProvider, provider)
 	}
 
 	return u, nil
@@ -152,9 +184,16 @@ func (s *Service) CreateJWT(id string, provider string, providerId string) (stri
 		"exp":        time.Now().Add(24 * time.Hour).Unix(),
 		"iat":        time.Now().Unix(),
 	}
+	if s.Config.JWTIssuer != "" {
+		claims["iss"] = s.Config.JWTIssuer
+	}
+	if s.Config.JWTAudience != "" {
+		claims["aud"] = s.Config.JWTAudience
+	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	signedToken, err := token.SignedString(s.JWTSecret)
+	token.Header["kid"] = jwtKeyId(s.JWTSecrets[0])
+	signedToken, err := token.SignedString(s.JWTSecrets[0])
 	if err != nil {
 		return "", err
 	}
@@ -162,10 +201,61 @@ func (s *Service) CreateJWT(id string, provider string, providerId string) (stri
 	return signedToken, nil
 }
 
+var (
+	errMissingKeyId = errors.New("missing kid header")
+	errUnknownKeyId = errors.New("unknown kid")
+)
+
+// jwtKeyId identifies a secret in the kid header of the tokens it signs, without revealing it
+func jwtKeyId(secret []byte) string {
+	sum := sha256.Sum256(secret)
+	return hex.EncodeToString(sum[:8])
+}
+
+// parseJWT verifies the token with the secret its kid names
+func (s *Service) parseJWT(tokenString string) (*jwt.Token, error) {
+	options := []jwt.ParserOption{jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()})}
+	if s.Config.JWTIssuer != "" {
+		options = append(options, jwt.WithIssuer(s.Config.JWTIssuer))
+	}
+	if s.Config.JWTAudience != "" {
+		options = append(options, jwt.WithAudience(s.Config.JWTAudience))
+	}
+	parse := func(keyFunc jwt.Keyfunc) (*jwt.Token, error) {
+		return jwt.Parse(tokenString, keyFunc, options...)
+	}
+
+	token, err := parse(func(token *jwt.Token) (any, error) {
+		kid, ok := token.Header["kid"].(string)
+		if !ok {
+			return nil, errMissingKeyId
+		}
+		for _, secret := range s.JWTSecrets {
+			if jwtKeyId(secret) == kid {
+				return secret, nil
+			}
+		}
+		return nil, errUnknownKeyId
+	})
+	if !errors.Is(err, errMissingKeyId) {
+		return token, err
+	}
+
+	// Tokens issued before kids were added are tried against every secret until they expire
+	for _, secret := range s.JWTSecrets {
+		token, err = parse(func(token *jwt.Token) (any, error) {
+			return secret, nil
+		})
+		// Any other failure (expired, malformed) is the same whichever secret signed the token
+		if !errors.Is(err, jwt.ErrSignatureInvalid) {
+			break
+		}
+	}
+	return token, err
+}
+
 func (s *Service) VerifyJWT(tokenString string) (string, string, string, time.Time, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (any, error) {
-		return s.JWTSecret, nil
-	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	token, err := s.parseJWT(tokenString)
 	if err != nil {
 		return "", "", "", time.Time{}, err
 	}
@@ -223,18 +313,38 @@ func (s *Service) AuthenticateToken(ctx context.Context, token string) (models.U
 
 func (s *Service) Login(ctx context.Context, provider, code string) (models.User, string, error) {
 	user, err := s.HandleOauth(ctx, provider, code)
+	if errors.Is(err, ErrEmailNotVerified) {
+		// Not an OAuth failure: the user has to verify their email with the provider first
+		return models.User{}, "", err
+	}
 	if err != nil {
-		return models.User{}, "", fmt.Errorf("oauth failed: %w", err)
+		return models.User{}, "", fmt.Errorf("%w: %w", ErrOAuthFailed, err)
 	}
 
+	return s.LoginProviderUser(ctx, user)
+}
+
+// LoginProviderUser signs in the account returned by the OAuth provider, creating the user on first login
+// Users are identified by the stable ProviderId, while usernames can change on the provider's side
+// (e.g. GitHub logins), so the stored username is refreshed on every login
+func (s *Service) LoginProviderUser(ctx context.Context, user models.User) (models.User, string, error) {
 	createdUser, err := s.Store.CreateUser(ctx, user)
 	if err != nil {
-		return models.User{}, "", fmt.Errorf("create user failed: %w", err)
+		return models.User{}, "", fmt.Errorf("%w: %w", ErrCreateUserFailed, err)
+	}
+
+	if user.Username != "" && createdUser.Username != user.Username {
+		if err := s.Store.UpdateUsername(ctx, createdUser.Provider, createdUser.ProviderId, user.Username); err != nil {
+			// A stale username is not worth failing the login over, the next login retries
+			log.Printf("Failed to update username for user %s: %v", createdUser.Id, err)
+		} else {
+			createdUser.Username = user.Username
+		}
 	}
 
 	token, err := s.CreateJWT(createdUser.Id, createdUser.Provider, createdUser.ProviderId)
 	if err != nil {
-		return models.User{}, "", fmt.Errorf("token generation failed: %w", err)
+		return models.User{}, "", fmt.Errorf("%w: %w", ErrTokenFailed, err)
 	}
 
 	return createdUser, token, nil
@@ -251,9 +361,17 @@ func (s *Service) DeleteUser(ctx context.Context, user models.User) error {
 
 	// Async side-effects - return to caller as soon as as store operation is done
 	go func() {
+		ctx, cancel := asyncContext()
+		defer cancel()
+
+		// Would otherwise be kept for its TTL after the account is gone
+		if err := s.Cache.ClearRecentPages(ctx, user.Id); err != nil {
+			log.Printf("Failed to clear recent pages of deleted user %s: %v", user.Id, err)
+		}
+
 		userDeletedMsg := UserDeletedMessage{UserId: user.Id}
 		if userDeletedMsgBytes, err := json.Marshal(userDeletedMsg); err == nil {
-			s.Cache.Publish(context.Background(), "user-deleted", userDeletedMsgBytes)
+			s.Cache.Publish(ctx, "user-deleted", userDeletedMsgBytes)
 		}
 
 		msg := worker.DeleteUserStrokesMessage{
@@ -263,7 +381,7 @@ func (s *Service) DeleteUser(ctx context.Context, user models.User) error {
 			DeleteAll:      true,
 		}
 		if msgBytes, err := json.Marshal(msg); err == nil {
-			s.MQ.Send(context.Background(), string(msgBytes))
+			s.MQ.Send(ctx, string(msgBytes))
 		}
 	}()
 
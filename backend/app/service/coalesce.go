@@ -0,0 +1,117 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/zlnvch/webverse/models"
+)
+
+// A page layer's pending broadcast is published early once it holds this many strokes, bounding the message size
+const maxCoalescedStrokes = 100
+
+type coalesceKey struct {
+	pageKey string
+	layer   models.LayerType
+	layerId string
+}
+
+// drawCoalescer buffers the new strokes of each page layer for DrawCoalesceWindow and publishes them
+// as one new_strokes message, so subscribers of a busy page get one message per window instead of one per draw
+type drawCoalescer struct {
+	mu      sync.Mutex
+	pending map[coalesceKey][]SequencedStroke
+}
+
+func newDrawCoalescer() *drawCoalescer {
+	return &drawCoalescer{pending: make(map[coalesceKey][]SequencedStroke)}
+}
+
+// publishNewStroke broadcasts a drawn stroke to the page's subscribers, right away or batched with the
+// page layer's other strokes when coalescing is enabled
+func (s *Service) publishNewStroke(ctx context.Context, data NewStrokeData) {
+	if s.Config.DrawCoalesceWindow <= 0 {
+		// TODO: the service layer is broadcasting the message in the format the WS client expects
+		// This is a bit of leaking of responsibilities
+		// Ideally, we should just send the delete data, and the hub should format it the way the client expects
+		// In which case, we would need to separate the pub-sub into two separate channels, one for draw and one for delete
+		// or create a message format for between the service layer and the hub, and the hub switches on message type
+		msgBytes, _ := json.Marshal(NewStrokeMessage{Type: "new_stroke", Data: data})
+		s.Cache.Publish(ctx, "page:"+data.PageKey, msgBytes)
+		return
+	}
+
+	key := coalesceKey{pageKey: data.PageKey, layer: data.Layer, layerId: data.LayerId}
+	stroke := SequencedStroke{Seq: data.Seq, Stroke: data.Stroke}
+
+	s.coalescer.mu.Lock()
+	strokes, scheduled := s.coalescer.pending[key]
+	strokes = append(strokes, stroke)
+	if len(strokes) >= maxCoalescedStrokes {
+		// The scheduled flush finds nothing pending, or the strokes drawn since
+		delete(s.coalescer.pending, key)
+		s.coalescer.mu.Unlock()
+		s.publishNewStrokes(key, strokes)
+		return
+	}
+	s.coalescer.pending[key] = strokes
+	s.coalescer.mu.Unlock()
+
+	if !scheduled {
+		time.AfterFunc(s.Config.DrawCoalesceWindow, func() {
+			s.flushNewStrokes(key)
+		})
+	}
+}
+
+// flushNewStrokes publishes the strokes pending for the page layer, if any
+func (s *Service) flushNewStrokes(key coalesceKey) {
+	s.coalescer.mu.Lock()
+	strokes := s.coalescer.pending[key]
+	delete(s.coalescer.pending, key)
+	s.coalescer.mu.Unlock()
+
+	if len(strokes) > 0 {
+		s.publishNewStrokes(key, strokes)
+	}
+}
+
+// dropPendingStroke removes an undone stroke from the page's pending broadcast, so subscribers don't get
+// it after its delete_stroke message. The undo's layer id may not be normalized like the draw's, so every
+// pending layer of the page is checked
+func (s *Service) dropPendingStroke(pageKey string, layer models.LayerType, strokeId string) {
+	s.coalescer.mu.Lock()
+	defer s.coalescer.mu.Unlock()
+
+	for key, strokes := range s.coalescer.pending {
+		if key.pageKey != pageKey || key.layer != layer {
+			continue
+		}
+		for i, stroke := range strokes {
+			if stroke.Stroke.Id == strokeId {
+				// The scheduled flush still runs and skips an emptied layer
+				s.coalescer.pending[key] = append(strokes[:i], strokes[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (s *Service) publishNewStrokes(key coalesceKey, strokes []SequencedStroke) {
+	msg := NewStrokesMessage{
+		Type: "new_strokes",
+		Data: NewStrokesData{
+			PageKey: key.pageKey,
+			Layer:   key.layer,
+			LayerId: key.layerId,
+			Strokes: strokes,
+		},
+	}
+	msgBytes, _ := json.Marshal(msg)
+	// The draws that added the strokes have long returned
+	ctx, cancel := asyncContext()
+	defer cancel()
+	s.Cache.Publish(ctx, "page:"+key.pageKey, msgBytes)
+}
@@ -0,0 +1,87 @@
+package service
+
+import "time"
+
+// Config holds the tunable limits and policies of the service
+// Start from DefaultConfig and override individual fields
+type Config struct {
+	StrokeLimits  StrokeLimits
+	PageKeyPolicy PageKeyPolicy
+	// Apply the per-page overrides of the stroke limits set with SetPageSettings to public draws
+	// Costs a store read per public draw
+	PageSettings bool
+	// Number of users reporting a public stroke that hides it pending review. Zero only records reports
+	ReportHideThreshold int
+	// iss and aud claims of the JWTs the service issues, which VerifyJWT then requires, so a token minted
+	// by another deployment sharing the secret is rejected. Empty leaves the claim out and unchecked
+	// Setting either logs out users whose tokens were issued without it
+	JWTIssuer   string
+	JWTAudience string
+	// Internal user ids allowed to run admin/moderation operations
+	AdminUserIds []string
+	// Number of pages kept in each user's recent pages feed
+	MaxRecentPages int
+	// Identical draws from the same user on the same page within this window return the
+	// first draw's stroke id, so clients can safely retry. Costs a Redis round trip per draw
+	// Zero disables deduplication
+	DrawDedupeWindow time.Duration
+	// Buffer the strokes drawn on each page layer for this long and broadcast them as one new_strokes
+	// message, so a page with many active users isn't flooded with a message per draw per subscriber
+	// Clients must handle new_strokes. Zero broadcasts each stroke right away as new_stroke
+	DrawCoalesceWindow time.Duration
+	// Look up the stroke before an undo, so a stroke that does not exist (e.g. a client bug)
+	// is reported as not found instead of counting as an attempt to delete someone else's stroke
+	UndoPrecheck bool
+	// Length of the nonces clients send with encrypted data keys and private strokes
+	// Must match the client's AEAD cipher: 192 for XChaCha20-Poly1305 (what the extension uses),
+	// 96 for standard AES-GCM or ChaCha20-Poly1305
+	NonceBits int
+	// Include the new encrypted key material in key update notifications, so the user's other
+	// devices can switch keys without fetching /me. Makes every notification a few hundred bytes larger
+	PublishKeyMaterial bool
+	// Tell the drawing user's connections once their strokes are written to the store, so clients know
+	// when a draw is durable. Costs a pub/sub message per user with strokes in each write
+	PublishStrokePersisted bool
+	// Newest strokes of a page returned by LoadPage and read from the store
+	// A full page holds 1000, the default leaves room for strokes drawn while the page is trimmed
+	MaxPageStrokesReturned int
+	// Most pages kept in the cache at once, the least recently loaded pages past it are invalidated
+	// Bounds Redis memory when many distinct pages are loaded within the cache TTL. Zero disables the cap
+	MaxCachedPages int
+	// Reject private strokes whose content parses as public stroke JSON, so a buggy client can't
+	// store plaintext where other devices expect ciphertext. A heuristic: it can't tell ciphertext from other garbage
+	RejectPlaintextPrivate bool
+	// Deadline of each request to the OAuth providers during login, so a slow provider can't hang it
+	// Zero disables it, leaving only the login request's own deadline
+	OAuthTimeout time.Duration
+	// Most distinct pages a user can draw on, across both layers, so one account can't spread strokes
+	// over millions of pages. Drawing on a new page past it fails with ErrPageCreationLimit
+	// Checked against the user's cached page list, which is recomputed from the store when it expires
+	// Zero disables it
+	MaxUserPages int
+	// Every ReconcileInterval, compare the cached stroke count of up to ReconcileMaxPages pages loaded
+	// within the interval with the store's count, and reload the pages whose counts differ by more than
+	// ReconcileThreshold. Strokes waiting in the stroke batcher are only cached, so small differences
+	// are expected. Each page checked costs a store count query. Zero disables it
+	ReconcileInterval  time.Duration
+	ReconcileMaxPages  int
+	ReconcileThreshold int
+	// Every InactiveUserCleanupInterval, delete the users created over InactiveUserMinAge ago that have no
+	// strokes, or whose last draw is over InactiveUserIdle ago. Deleting a user deletes their strokes
+	// Zero interval disables the cleanup, zero idle only deletes users without strokes
+	InactiveUserCleanupInterval time.Duration
+	InactiveUserMinAge          time.Duration
+	InactiveUserIdle            time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		StrokeLimits:           DefaultStrokeLimits(),
+		MaxRecentPages:         20,
+		NonceBits:              192,
+		MaxPageStrokesReturned: 1100,
+		OAuthTimeout:           10 * time.Second,
+		ReconcileMaxPages:      50,
+		ReconcileThreshold:     25,
+	}
+}
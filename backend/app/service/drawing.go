@@ -2,15 +2,19 @@ package service
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"log"
+	"slices"
 	"strconv"
 	"time"
 
 	"github.com/gofrs/uuid/v5"
 	"github.com/zlnvch/webverse/models"
 	"github.com/zlnvch/webverse/store"
+	"github.com/zlnvch/webverse/webhook"
 	"github.com/zlnvch/webverse/worker"
 )
 
@@ -44,13 +48,44 @@ func (s *Service) enforceUserAndPageQuota(ctx context.Context, user models.User,
 	}
 
 	// Check Page Quota using ZCard
-	// If page is not in cache, load it first
+	pageStrokeCount, _ := s.pageStrokeCount(ctx, pageKey, layer)
+	if pageStrokeCount >= maxPageStrokes {
+		log.Printf("Page %s exceeded stroke quota (%d)", pageKey, pageStrokeCount)
+		return errors.New("page stroke quota exceeded")
+	}
+	return nil
+}
+
+var ErrPageCreationLimit = errors.New("page creation limit reached")
+
+// enforcePageCreationLimit rejects a draw on a page new to the user once they have MaxUserPages pages
+func (s *Service) enforcePageCreationLimit(ctx context.Context, user models.User, pageKey string) error {
+	if s.Config.MaxUserPages <= 0 {
+		return nil
+	}
+
+	pageKeys, err := s.userPageKeys(ctx, user.Id)
+	if err != nil {
+		return err
+	}
+	if len(pageKeys) < s.Config.MaxUserPages || slices.Contains(pageKeys, pageKey) {
+		return nil
+	}
+	log.Printf("User %s reached the page creation limit (%d)", user.Id, len(pageKeys))
+	return ErrPageCreationLimit
+}
+
+// pageStrokeCount returns the page's stroke count from ZCard, and whether the cache holds the complete page
+// If page is not in cache, load it first
+func (s *Service) pageStrokeCount(ctx context.Context, pageKey string, layer models.LayerType) (int64, bool) {
 	isComplete, _ := s.Cache.IsPageComplete(ctx, pageKey)
 	if !isComplete {
 		_, err := s.LoadPage(ctx, pageKey, layer)
 		if err != nil {
 			log.Printf("Failed to load page %s for quota check: %v", pageKey, err)
 			// Continue anyway - if we can't load, assume 0 strokes
+		} else {
+			isComplete = true
 		}
 	}
 
@@ -59,11 +94,7 @@ func (s *Service) enforceUserAndPageQuota(ctx context.Context, user models.User,
 		// If ZCard fails, assume 0 strokes
 		pageStrokeCount = 0
 	}
-	if pageStrokeCount >= maxPageStrokes {
-		log.Printf("Page %s exceeded stroke quota (%d)", pageKey, pageStrokeCount)
-		return errors.New("page stroke quota exceeded")
-	}
-	return nil
+	return pageStrokeCount, isComplete
 }
 
 type DrawParams struct {
@@ -85,32 +116,99 @@ type NewStrokeData struct {
 	Layer   models.LayerType `json:"layer"`
 	LayerId string           `json:"layerId"`
 	Stroke  models.Stroke    `json:"stroke"`
+	// The stroke's sequence number on the page, clients pass the last one they saw to SyncPageSeq
+	// 0 if the cache failed to assign one
+	Seq int64 `json:"seq,omitempty"`
+}
+
+// NewStrokesMessage broadcasts the strokes drawn on a page layer within DrawCoalesceWindow at once
+type NewStrokesMessage struct {
+	Type string         `json:"type"`
+	Data NewStrokesData `json:"data"`
+}
+
+type NewStrokesData struct {
+	PageKey string           `json:"pageKey"`
+	Layer   models.LayerType `json:"layer"`
+	LayerId string           `json:"layerId"`
+	// In the order they were drawn, each with its sequence number on the page
+	Strokes []SequencedStroke `json:"strokes"`
+}
+
+// ValidateStroke runs the stateless draw validation without touching the store, cache or quota
+// Used by DrawStroke and by clients that want to pre-check a stroke
+func (s *Service) ValidateStroke(pageKey string, layer models.LayerType, content []byte) error {
+	pageKey = s.Config.PageKeyPolicy.NormalizePageKey(pageKey, layer == models.LayerPrivate)
+	return s.validateStroke(pageKey, layer, content, s.Config.StrokeLimits)
+}
+
+func (s *Service) validateStroke(pageKey string, layer models.LayerType, content []byte, limits StrokeLimits) error {
+	if layer != models.LayerPublic && layer != models.LayerPrivate {
+		return errors.New("invalid layer")
+	}
+
+	isPrivate := layer == models.LayerPrivate
+	if err := s.CheckPageKey(pageKey, isPrivate); err != nil {
+		return err
+	}
+
+	if !isPrivate {
+		// Stroke content can only be validated for public (unencrypted) strokes
+		if err := limits.ValidateStrokeContent(content); err != nil {
+			return err
+		}
+	} else if s.Config.RejectPlaintextPrivate && looksLikePlaintextStroke(content) {
+		return errors.New("private stroke content appears unencrypted")
+	}
+
+	return nil
 }
 
 func (s *Service) DrawStroke(ctx context.Context, params DrawParams) (string, error) {
+	if err := s.checkNotBanned(ctx, params.User.Id); err != nil {
+		return "", err
+	}
+
 	// 1. Validation
-	isPrivate := params.Layer == models.LayerPrivate
-	if err := ValidatePageKey(params.PageKey, isPrivate); err != nil {
+	params.PageKey = s.Config.PageKeyPolicy.NormalizePageKey(params.PageKey, params.Layer == models.LayerPrivate)
+	limits := s.strokeLimitsForPage(ctx, params.PageKey, params.Layer)
+	if err := s.validateStroke(params.PageKey, params.Layer, params.Stroke.Content, limits); err != nil {
 		return "", err
 	}
 
-	if !isPrivate {
-		// Stroke content can only be validated for public (unencrypted) strokes
-		if err := ValidateStrokeContent(params.Stroke.Content); err != nil {
-			return "", err
+	// Paused pages reject draws until resumed or the pause expires
+	if paused, err := s.Cache.IsPagePaused(ctx, params.PageKey); err != nil {
+		log.Printf("Failed to check if page %s is paused: %v", params.PageKey, err)
+	} else if paused {
+		return "", ErrPagePaused
+	}
+
+	// Normalize the layer id, it is stored and broadcast with the stroke
+	switch params.Layer {
+	case models.LayerPublic:
+		// Public strokes have no layer id, whatever the client sent
+		params.LayerId = ""
+	case models.LayerPrivate:
+		if _, err := strconv.Atoi(params.LayerId); err != nil {
+			return "", errors.New("invalid layer id")
 		}
-	} else {
 		// Ensure the frontend has the user's latest encryption keys
 		// Otherwise, it will write strokes that they will be unable to decrypt later
 		if params.LayerId != strconv.Itoa(params.User.KeyVersion) {
 			return "", errors.New("stroke was encrypted with an older encryption key")
 		}
+		if err := validateStrokeNonce(params.Stroke.Nonce, s.Config.NonceBits); err != nil {
+			return "", err
+		}
 	}
 
 	// 2. Quota Enforcement
 	if err := s.enforceUserAndPageQuota(ctx, params.User, params.PageKey, params.Layer); err != nil {
 		return "", err
 	}
+	if err := s.enforcePageCreationLimit(ctx, params.User, params.PageKey); err != nil {
+		return "", err
+	}
 
 	// 3. ID Generation
 	var (
@@ -125,9 +223,9 @@ func (s *Service) DrawStroke(ctx context.Context, params DrawParams) (string, er
 		}
 
 		if t.After(time.Now()) {
-			return "", errors.New("redo stroke uuidv7 has time greater than current time")
 			// This means they maliciously sent a redo message with a uuidv7 with a timestamp in the future
-			// TODO: ban user?
+			s.AbuseReporter.ReportFutureUUID(params.User.Id, params.Stroke.Id)
+			return "", errors.New("redo stroke uuidv7 has time greater than current time")
 		}
 		strokeUUID, err = uuid.NewV7AtTime(t)
 	} else {
@@ -139,17 +237,35 @@ func (s *Service) DrawStroke(ctx context.Context, params DrawParams) (string, er
 	}
 
 	strokeId := strokeUUID.String()
+
+	// Deduplicate retried draws, redos are exempt as they redraw the content of an undone stroke
+	if !params.IsRedo && s.Config.DrawDedupeWindow > 0 {
+		hash := drawHash(params.User.Id, params.PageKey, params.Stroke.Content)
+		existingId, err := s.Cache.ClaimDrawHash(ctx, hash, strokeId, s.Config.DrawDedupeWindow)
+		if err != nil {
+			log.Printf("Failed to check draw idempotency for user %s: %v", params.User.Id, err)
+		} else if existingId != "" {
+			return existingId, nil
+		}
+	}
+
 	params.Stroke.Id = strokeId
 	params.Stroke.UserId = params.User.Id
+	// Only moderation hides strokes
+	params.Stroke.Hidden = false
 
 	// Async side-effects - return to caller as soon as as strokeId is generated
 	go func() {
+		// The caller's ctx may be cancelled by now, e.g. once the websocket handler returned
+		ctx, cancel := asyncContext()
+		defer cancel()
+
 		// 4. Increment User Counter
-		s.Cache.IncrementUserStrokeCount(context.Background(), params.User.Id)
+		s.Cache.IncrementUserStrokeCount(ctx, params.User.Id)
 		// Note: Page counter comes from ZCard, no separate increment needed
 
 		// 5. Add to Stroke Batcher
-		s.StrokeBatcher.WriteCh <- worker.BatchedStroke{
+		s.StrokeBatcher.Enqueue(worker.BatchedStroke{
 			Record: models.StrokeRecord{
 				PageKey: params.PageKey,
 				Stroke:  params.Stroke,
@@ -158,13 +274,14 @@ func (s *Service) DrawStroke(ctx context.Context, params DrawParams) (string, er
 			},
 			UserProvider:   params.User.Provider,
 			UserProviderId: params.User.ProviderId,
-		}
+		})
 
 		// 6. Add to Cache
+		var seq int64
 		strokeBytes, err := json.Marshal(params.Stroke)
 		if err == nil {
 			t, _ := getTimeFromUUIDv7(strokeId)
-			s.Cache.AddStroke(ctx, params.PageKey, strokeId, t.UnixMilli(), strokeBytes)
+			seq, _ = s.Cache.AddStroke(ctx, params.PageKey, strokeId, t.UnixMilli(), strokeBytes)
 		}
 
 		// 7. Broadcast New Stroke
@@ -173,23 +290,71 @@ func (s *Service) DrawStroke(ctx context.Context, params DrawParams) (string, er
 			Layer:   params.Layer,
 			LayerId: params.LayerId,
 			Stroke:  params.Stroke,
+			Seq:     seq,
 		}
-		msg := NewStrokeMessage{
-			Type: "new_stroke",
-			Data: newStrokeData,
+		s.publishNewStroke(ctx, newStrokeData)
+
+		// 8. Add the page to the user's cached page list, recomputing it from the store would miss
+		// the stroke until the batcher writes it
+		if err := s.Cache.AddUserPage(ctx, params.User.Id, params.PageKey); err != nil {
+			log.Printf("Failed to add page to cached pages for user %s: %v", params.User.Id, err)
 		}
-		// TODO: the service layer is broadcasting the message in the format the WS client expects
-		// This is a bit of leaking of responsibilities
-		// Ideally, we should just send the delete data, and the hub should format it the way the client expects
-		// In which case, we would need to separate the pub-sub into two separate channels, one for draw and one for delete
-		// or create a message format for between the service layer and the hub, and the hub switches on message type
-		msgBytes, _ := json.Marshal(msg)
-		s.Cache.Publish(ctx, "page:"+params.PageKey, msgBytes)
+
+		// 9. Track Recent Page
+		// Public pages only: private keys are HMACs the user can't navigate back to
+		if params.Layer == models.LayerPublic && s.Config.MaxRecentPages > 0 {
+			t, _ := getTimeFromUUIDv7(strokeId)
+			if err := s.Cache.AddRecentPage(ctx, params.User.Id, params.PageKey, t, s.Config.MaxRecentPages); err != nil {
+				log.Printf("Failed to add recent page for user %s: %v", params.User.Id, err)
+			}
+		}
+
+		// 10. Track Activity, for the inactive user cleanup
+		s.touchLastActive(ctx, params.User)
+
+		// 11. Notify Webhooks
+		t, _ := getTimeFromUUIDv7(strokeId)
+		s.Webhook.Notify(webhook.Event{
+			Type:     "draw",
+			PageKey:  params.PageKey,
+			Layer:    params.Layer,
+			StrokeId: strokeId,
+			UserId:   params.User.Id,
+			Time:     t.UnixMilli(),
+		})
 	}()
 
 	return strokeId, nil
 }
 
+// StrokesPersistedMessage lists strokes of a user that were written to the store
+type StrokesPersistedMessage struct {
+	UserId    string
+	StrokeIds []string
+}
+
+// PublishStrokesPersisted tells the users their strokes are durable, meant for StrokeBatcher.OnPersisted
+func (s *Service) PublishStrokesPersisted(items []worker.BatchedStroke) {
+	userStrokeIds := make(map[string][]string)
+	for _, item := range items {
+		userId := item.Record.Stroke.UserId
+		userStrokeIds[userId] = append(userStrokeIds[userId], item.Record.Stroke.Id)
+	}
+
+	// Async, the batcher must not wait on the cache
+	go func() {
+		ctx, cancel := asyncContext()
+		defer cancel()
+
+		for userId, strokeIds := range userStrokeIds {
+			msg := StrokesPersistedMessage{UserId: userId, StrokeIds: strokeIds}
+			if msgBytes, err := json.Marshal(msg); err == nil {
+				s.Cache.Publish(ctx, "user-strokes-persisted", msgBytes)
+			}
+		}
+	}()
+}
+
 type UndoParams struct {
 	User     models.User
 	PageKey  string
@@ -212,30 +377,62 @@ type DeleteStrokeData struct {
 }
 
 func (s *Service) UndoStroke(ctx context.Context, params UndoParams) error {
+	if err := s.checkNotBanned(ctx, params.User.Id); err != nil {
+		return err
+	}
+
 	// 1. Validate page key
 	isPrivate := params.Layer == models.LayerPrivate
-	if err := ValidatePageKey(params.PageKey, isPrivate); err != nil {
+	params.PageKey = s.Config.PageKeyPolicy.NormalizePageKey(params.PageKey, isPrivate)
+	if err := s.Config.PageKeyPolicy.ValidatePageKey(params.PageKey, isPrivate); err != nil {
 		return err
 	}
 
 	// 2. Remove from Stroke Batcher (if pending)
+	cancelled := make(chan bool, 1)
 	s.StrokeBatcher.DeleteCh <- worker.DeleteStrokeRequest{
-		StrokeId: params.StrokeId,
-		UserId:   params.User.Id,
+		StrokeId:  params.StrokeId,
+		UserId:    params.User.Id,
+		Cancelled: cancelled,
 	}
 
 	// 3. Delete from Store
-	err := s.Store.DeleteStroke(ctx, params.PageKey, params.StrokeId, params.User.Id)
-	if err != nil && err == store.ErrConditionFailed {
-		// This means they maliciously sent a delete message with a different user's strokeId
-		// TODO: ban user?
+	var err error
+	if s.Config.UndoPrecheck {
+		err = s.checkUndoStroke(ctx, params)
+	}
+	if err == nil {
+		err = s.Store.DeleteStroke(ctx, params.PageKey, params.StrokeId, params.User.Id)
+		if err != nil && err == store.ErrConditionFailed {
+			// This means they maliciously sent a delete message with a different user's strokeId
+			s.AbuseReporter.ReportNotOwnerDelete(params.User.Id, params.StrokeId)
+		}
+	}
+
+	// A stroke that is not found in the store may still have been pending in the batcher, then it was undone
+	// Otherwise nothing was removed, and the counters and clients are left alone
+	if err == ErrStrokeNotFound && waitCancelled(ctx, cancelled) {
+		err = nil
 	}
 
-	if err != store.ErrConditionFailed {
+	if err != store.ErrConditionFailed && err != ErrNotStrokeOwner && err != ErrStrokeNotFound {
+		// Before the delete is broadcast, a stroke still waiting to be broadcast must not follow it
+		s.dropPendingStroke(params.PageKey, params.Layer, params.StrokeId)
+
+		// Before returning, so redrawing the same content right after the undo isn't taken for a retry
+		if s.Config.DrawDedupeWindow > 0 {
+			if err := s.Cache.ReleaseDrawHash(ctx, params.StrokeId); err != nil {
+				log.Printf("Failed to release draw hash of stroke %s: %v", params.StrokeId, err)
+			}
+		}
+
 		// Async side-effects - return to caller as soon as as store operation is done
 		go func() {
+			ctx, cancel := asyncContext()
+			defer cancel()
+
 			// 4. Remove from Cache
-			s.Cache.RemoveStroke(context.Background(), params.PageKey, params.StrokeId)
+			s.Cache.RemoveStroke(ctx, params.PageKey, params.StrokeId)
 
 			// 5. Broadcast Delete Stroke
 			deleteStrokeData := DeleteStrokeData{
@@ -251,17 +448,70 @@ func (s *Service) UndoStroke(ctx context.Context, params UndoParams) error {
 			}
 			// TODO: same as new stroke broadcast above
 			msgBytes, _ := json.Marshal(msg)
-			s.Cache.Publish(context.Background(), "page:"+params.PageKey, msgBytes)
+			s.Cache.Publish(ctx, "page:"+params.PageKey, msgBytes)
 
 			// 6. Decrement User Counter
-			s.Cache.DecrementUserStrokeCount(context.Background(), params.User.Id)
+			s.Cache.DecrementUserStrokeCount(ctx, params.User.Id)
 			// Note: Page counter comes from ZCard, no separate decrement needed
 		}()
 	}
 
+	// 7. Notify Webhooks, only of strokes that were actually deleted
+	if err == nil {
+		s.Webhook.Notify(webhook.Event{
+			Type:     "undo",
+			PageKey:  params.PageKey,
+			Layer:    params.Layer,
+			StrokeId: params.StrokeId,
+			UserId:   params.User.Id,
+			Time:     time.Now().UnixMilli(),
+		})
+	}
+
 	return err
 }
 
+var (
+	ErrStrokeNotFound = errors.New("stroke_not_found")
+	ErrNotStrokeOwner = errors.New("not_stroke_owner")
+)
+
+// waitCancelled returns whether the stroke batcher cancelled a pending write, false if ctx ends first
+func waitCancelled(ctx context.Context, cancelled <-chan bool) bool {
+	select {
+	case ok := <-cancelled:
+		return ok
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// checkUndoStroke tells apart undoing a stroke that does not exist on the page, which is harmless,
+// from undoing another user's stroke, which is reported. Lookup errors are left to the conditional delete
+func (s *Service) checkUndoStroke(ctx context.Context, params UndoParams) error {
+	stroke, err := s.Store.GetStroke(ctx, params.PageKey, params.StrokeId)
+	if err == store.ErrItemNotFound {
+		return ErrStrokeNotFound
+	}
+	if err != nil {
+		log.Printf("Undo precheck for stroke %s failed: %v", params.StrokeId, err)
+		return nil
+	}
+	if stroke.UserId != params.User.Id {
+		s.AbuseReporter.ReportNotOwnerDelete(params.User.Id, params.StrokeId)
+		return ErrNotStrokeOwner
+	}
+	return nil
+}
+
+// drawHash identifies identical draw content from the same user on the same page
+func drawHash(userId string, pageKey string, content []byte) string {
+	h := sha256.New()
+	h.Write([]byte(userId + "|" + pageKey + "|"))
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
 func getTimeFromUUIDv7(strokeId string) (time.Time, error) {
 	id, err := uuid.FromString(strokeId)
 	if err != nil || id.Version() != uuid.V7 {
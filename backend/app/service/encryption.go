@@ -8,6 +8,7 @@ import (
 	"fmt"
 
 	"github.com/zlnvch/webverse/models"
+	"github.com/zlnvch/webverse/store"
 	"github.com/zlnvch/webverse/worker"
 )
 
@@ -19,14 +20,51 @@ type EncryptionKeys struct {
 	NonceDEK2     string
 }
 
+// WrappedDEKs are the user's data encryption keys, encrypted with their key encryption key
+type WrappedDEKs struct {
+	EncryptedDEK1 string
+	NonceDEK1     string
+	EncryptedDEK2 string
+	NonceDEK2     string
+}
+
+// InvalidKeyError reports an encryption key field the client sent in the wrong format
+type InvalidKeyError struct {
+	Field  string
+	Reason string
+}
+
+func (e *InvalidKeyError) Error() string {
+	return e.Field + ": " + e.Reason
+}
+
+var ErrNoKeysToRotate = errors.New("cannot rotate keys: user has no existing keys")
+
+// ErrKeyVersionMismatch is returned when the keys were replaced or deleted since the client last read them
+var ErrKeyVersionMismatch = errors.New("encryption keys changed since they were read")
+
 type UserKeysUpdatedMessage struct {
 	UserId      string
 	KeyVersion  int
 	KeysDeleted bool
+	// The new keys, only set if Config.PublishKeyMaterial is enabled
+	Keys *EncryptionKeys `json:",omitempty"`
+}
+
+// Supersedes reports whether the message is newer than the key state a connection holds
+// Messages are published asynchronously, so they can arrive out of order. New keys always get a
+// new version (rotations keep it), and deleting keys keeps the version, so within a version keys are
+// only ever deleted last: once a connection saw a version's deletion, any other message for that
+// version is stale, while a deletion supersedes the version's keys
+func (msg UserKeysUpdatedMessage) Supersedes(keyVersion int, keysDeleted bool) bool {
+	if msg.KeyVersion != keyVersion {
+		return msg.KeyVersion > keyVersion
+	}
+	return !keysDeleted
 }
 
 func (s *Service) SetEncryptionKeys(ctx context.Context, user models.User, keys EncryptionKeys, isNew bool) (int, error) {
-	if err := validateEncryptionKeys(keys); err != nil {
+	if err := validateEncryptionKeys(keys, s.Config.NonceBits); err != nil {
 		return 0, err
 	}
 
@@ -34,7 +72,7 @@ func (s *Service) SetEncryptionKeys(ctx context.Context, user models.User, keys
 
 	// Cannot rotate keys that don't exist
 	if !isNew && !hadEncryptionKeys {
-		return 0, errors.New("cannot rotate keys: user has no existing keys")
+		return 0, ErrNoKeysToRotate
 	}
 
 	prevKeyVersion := user.KeyVersion
@@ -52,10 +90,10 @@ func (s *Service) SetEncryptionKeys(ctx context.Context, user models.User, keys
 
 	// Async side-effects - return to caller as soon as as store operation is done
 	go func() {
-		userKeysUpdatedMsg := UserKeysUpdatedMessage{UserId: user.Id, KeyVersion: keyVersion, KeysDeleted: false}
-		if msgBytes, err := json.Marshal(userKeysUpdatedMsg); err == nil {
-			s.Cache.Publish(context.Background(), "user-keys-updated", msgBytes)
-		}
+		ctx, cancel := asyncContext()
+		defer cancel()
+
+		s.publishUserKeysUpdated(ctx, user.Id, keyVersion, keys)
 
 		if isNew && hadEncryptionKeys {
 			// Keys were overwritten (reset via POST on existing keys)
@@ -68,7 +106,7 @@ func (s *Service) SetEncryptionKeys(ctx context.Context, user models.User, keys
 				Layer:          "Private#" + fmt.Sprint(prevKeyVersion),
 			}
 			if msgBytes, err := json.Marshal(msg); err == nil {
-				s.MQ.Send(context.Background(), string(msgBytes))
+				s.MQ.Send(ctx, string(msgBytes))
 			}
 		}
 	}()
@@ -76,6 +114,65 @@ func (s *Service) SetEncryptionKeys(ctx context.Context, user models.User, keys
 	return keyVersion, nil
 }
 
+// RotateKEK replaces the user's KEK salt and their data keys, re-wrapped client-side with the new KEK
+// The data keys themselves are unchanged, so the key version is kept and no strokes are deleted
+// expectedKeyVersion is the version the client unwrapped, so keys replaced meanwhile are never overwritten
+func (s *Service) RotateKEK(ctx context.Context, user models.User, expectedKeyVersion int, saltKEK string, rewrappedDEKs WrappedDEKs) (int, error) {
+	if saltKEK == "" {
+		return 0, &InvalidKeyError{Field: "SaltKEK", Reason: "missing"}
+	}
+	if err := validateWrappedDEKs(rewrappedDEKs, s.Config.NonceBits); err != nil {
+		return 0, err
+	}
+	if len(user.SaltKEK) == 0 {
+		return 0, ErrNoKeysToRotate
+	}
+	if user.KeyVersion != expectedKeyVersion {
+		return 0, ErrKeyVersionMismatch
+	}
+
+	keys := EncryptionKeys{
+		SaltKEK:       saltKEK,
+		EncryptedDEK1: rewrappedDEKs.EncryptedDEK1,
+		NonceDEK1:     rewrappedDEKs.NonceDEK1,
+		EncryptedDEK2: rewrappedDEKs.EncryptedDEK2,
+		NonceDEK2:     rewrappedDEKs.NonceDEK2,
+	}
+	user.SaltKEK = keys.SaltKEK
+	user.EncryptedDEK1 = keys.EncryptedDEK1
+	user.NonceDEK1 = keys.NonceDEK1
+	user.EncryptedDEK2 = keys.EncryptedDEK2
+	user.NonceDEK2 = keys.NonceDEK2
+
+	// The user was read at the start of the request, so the store checks the version again
+	if err := s.Store.RotateUserKEK(ctx, user, expectedKeyVersion); err != nil {
+		if errors.Is(err, store.ErrConditionFailed) {
+			return 0, ErrKeyVersionMismatch
+		}
+		return 0, err
+	}
+
+	// Async side-effects - return to caller as soon as as store operation is done
+	go func() {
+		ctx, cancel := asyncContext()
+		defer cancel()
+
+		s.publishUserKeysUpdated(ctx, user.Id, expectedKeyVersion, keys)
+	}()
+
+	return expectedKeyVersion, nil
+}
+
+func (s *Service) publishUserKeysUpdated(ctx context.Context, userId string, keyVersion int, keys EncryptionKeys) {
+	userKeysUpdatedMsg := UserKeysUpdatedMessage{UserId: userId, KeyVersion: keyVersion, KeysDeleted: false}
+	if s.Config.PublishKeyMaterial {
+		userKeysUpdatedMsg.Keys = &keys
+	}
+	if msgBytes, err := json.Marshal(userKeysUpdatedMsg); err == nil {
+		s.Cache.Publish(ctx, "user-keys-updated", msgBytes)
+	}
+}
+
 func (s *Service) DeleteEncryptionKeys(ctx context.Context, user models.User) error {
 	hadEncryptionKeys := len(user.SaltKEK) > 0
 	prevKeyVersion := user.KeyVersion
@@ -92,6 +189,10 @@ func (s *Service) DeleteEncryptionKeys(ctx context.Context, user models.User) er
 
 	// Async side-effects - return to caller as soon as as store operation is done
 	go func() {
+		// The request's ctx is cancelled as soon as its handler returns
+		ctx, cancel := asyncContext()
+		defer cancel()
+
 		if hadEncryptionKeys {
 			userKeysUpdatedMsg := UserKeysUpdatedMessage{UserId: user.Id, KeyVersion: prevKeyVersion, KeysDeleted: true}
 			if userKeysUpdatedMsgBytes, err := json.Marshal(userKeysUpdatedMsg); err == nil {
@@ -114,11 +215,18 @@ func (s *Service) DeleteEncryptionKeys(ctx context.Context, user models.User) er
 	return nil
 }
 
-func validateEncryptionKeys(k EncryptionKeys) error {
-	const (
-		encryptedKeyBits = 256 + 128
-		nonceBits        = 192
-	)
+func validateEncryptionKeys(k EncryptionKeys, nonceBits int) error {
+	return validateWrappedDEKs(WrappedDEKs{
+		EncryptedDEK1: k.EncryptedDEK1,
+		NonceDEK1:     k.NonceDEK1,
+		EncryptedDEK2: k.EncryptedDEK2,
+		NonceDEK2:     k.NonceDEK2,
+	}, nonceBits)
+}
+
+func validateWrappedDEKs(k WrappedDEKs, nonceBits int) error {
+	// 256-bit data key plus the 128-bit authentication tag
+	const encryptedKeyBits = 256 + 128
 	fields := []struct {
 		name  string
 		value string
@@ -132,15 +240,27 @@ func validateEncryptionKeys(k EncryptionKeys) error {
 	for _, f := range fields {
 		bits, err := base64LengthBits(f.value)
 		if err != nil {
-			return fmt.Errorf("%s: invalid Base64: %w", f.name, err)
+			return &InvalidKeyError{Field: f.name, Reason: "invalid Base64: " + err.Error()}
 		}
 		if bits != f.want {
-			return fmt.Errorf("%s: invalid length, got %d bits, want %d bits", f.name, bits, f.want)
+			return &InvalidKeyError{Field: f.name, Reason: fmt.Sprintf("invalid length, got %d bits, want %d bits", bits, f.want)}
 		}
 	}
 	return nil
 }
 
+// validateStrokeNonce checks the nonce a private stroke was encrypted with
+func validateStrokeNonce(nonce string, nonceBits int) error {
+	bits, err := base64LengthBits(nonce)
+	if err != nil {
+		return fmt.Errorf("invalid nonce: invalid Base64: %w", err)
+	}
+	if bits != nonceBits {
+		return fmt.Errorf("invalid nonce length, got %d bits, want %d bits", bits, nonceBits)
+	}
+	return nil
+}
+
 func base64LengthBits(s string) (int, error) {
 	data, err := base64.StdEncoding.DecodeString(s)
 	if err != nil {
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/zlnvch/webverse/models"
+)
+
+// Users deleted by the inactive user cleanup
+const metricInactiveUsersDeleted = "service.inactive_users_deleted"
+
+const (
+	// A user's LastActive is written at most once per resolution by each server, so it can be this stale
+	lastActiveResolution = time.Hour
+	// Users read from the store per page of the inactive user scan
+	inactiveUserScanPageSize = 100
+	// Users deleted per cleanup run, so a first run on an old deployment doesn't flood the MQ with stroke deletions
+	maxInactiveUserDeletes = 1000
+)
+
+// lastActiveTracker remembers the users whose LastActive this server wrote in the current period,
+// so a user drawing all day costs one store write per period
+type lastActiveTracker struct {
+	mu      sync.Mutex
+	start   time.Time
+	written map[string]struct{}
+}
+
+func newLastActiveTracker() *lastActiveTracker {
+	return &lastActiveTracker{written: make(map[string]struct{})}
+}
+
+// claim reports whether the user's LastActive is due a write, forgetting the previous period's users
+func (t *lastActiveTracker) claim(userId string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if now.Sub(t.start) >= lastActiveResolution {
+		t.start = now
+		t.written = make(map[string]struct{})
+	}
+	if _, ok := t.written[userId]; ok {
+		return false
+	}
+	t.written[userId] = struct{}{}
+	return true
+}
+
+// touchLastActive records that the user drew, if their LastActive is older than lastActiveResolution
+func (s *Service) touchLastActive(ctx context.Context, user models.User) {
+	now := time.Now()
+	if now.Sub(time.Unix(user.LastActive, 0)) < lastActiveResolution || !s.lastActive.claim(user.Id, now) {
+		return
+	}
+	if err := s.Store.UpdateUserLastActive(ctx, user.Provider, user.ProviderId, now.Unix()); err != nil {
+		log.Printf("Failed to update last active time of user %s: %v", user.Id, err)
+	}
+}
+
+// RunInactiveUserCleanup deletes the inactive users every InactiveUserCleanupInterval until shutdown
+func (s *Service) RunInactiveUserCleanup(shutdownCtx context.Context) {
+	ticker := time.NewTicker(s.Config.InactiveUserCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := s.DeleteInactiveUsers(shutdownCtx); err != nil {
+				log.Printf("Failed to delete inactive users: %v", err)
+			}
+
+		case <-shutdownCtx.Done():
+			return
+		}
+	}
+}
+
+// DeleteInactiveUsers deletes up to maxInactiveUserDeletes users older than InactiveUserMinAge that are
+// inactive, see isInactiveUser. Each goes through DeleteUser, so their strokes are deleted by the MQ consumer
+// Returns the users deleted
+func (s *Service) DeleteInactiveUsers(ctx context.Context) (int, error) {
+	now := time.Now()
+	createdBefore := now.Add(-s.Config.InactiveUserMinAge).Unix()
+
+	deleted := 0
+	cursor := ""
+	for {
+		users, nextCursor, err := s.Store.GetUsersCreatedBetween(ctx, 0, createdBefore, inactiveUserScanPageSize, cursor)
+		if err != nil {
+			return deleted, err
+		}
+		for _, user := range users {
+			if !s.isInactiveUser(user, now) {
+				continue
+			}
+			if err := s.DeleteUser(ctx, user); err != nil {
+				log.Printf("Failed to delete inactive user %s: %v", user.Id, err)
+				continue
+			}
+			deleted++
+			if deleted >= maxInactiveUserDeletes {
+				break
+			}
+		}
+		if nextCursor == "" || deleted >= maxInactiveUserDeletes {
+			break
+		}
+		cursor = nextCursor
+	}
+
+	if deleted > 0 {
+		log.Printf("Deleted %d inactive users", deleted)
+		s.Metrics.Inc(metricInactiveUsersDeleted, int64(deleted))
+	}
+	return deleted, nil
+}
+
+// isInactiveUser reports whether the user was created over InactiveUserMinAge ago and either
+//   - has no strokes and hasn't drawn within InactiveUserMinAge, whose strokes may not be counted yet, or
+//   - hasn't drawn within InactiveUserIdle, if set
+//
+// Admins are never inactive, nor are users with strokes whose last draw predates LastActive tracking
+func (s *Service) isInactiveUser(user models.User, now time.Time) bool {
+	minAgeCutoff := now.Add(-s.Config.InactiveUserMinAge).Unix()
+	if user.Created > minAgeCutoff || s.IsAdmin(user) {
+		return false
+	}
+	if user.StrokeCount <= 0 {
+		return user.LastActive <= minAgeCutoff
+	}
+	if s.Config.InactiveUserIdle <= 0 || user.LastActive == 0 {
+		return false
+	}
+	return user.LastActive <= now.Add(-s.Config.InactiveUserIdle).Unix()
+}
@@ -1,26 +1,59 @@
 package service
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"time"
 
 	"github.com/zlnvch/webverse/cache"
 	"github.com/zlnvch/webverse/models"
+	"github.com/zlnvch/webverse/store"
+	"github.com/zlnvch/webverse/worker"
+)
+
+// Cached strokes that failed to decode or validate and were left out of a page load
+const metricCorruptCachedStrokes = "service.corrupt_cached_strokes"
+
+// Pages invalidated because the cache held more than MaxCachedPages
+const metricEvictedPages = "service.evicted_pages"
+
+// Throttled store reads of a page load are retried with exponential backoff, starting at loadRetryBackoff
+const (
+	loadAttempts     = 3
+	loadRetryBackoff = 50 * time.Millisecond
 )
 
 func (s *Service) LoadPage(ctx context.Context, pageKey string, layer models.LayerType) ([]models.Stroke, error) {
-	if err := ValidatePageKey(pageKey, layer == models.LayerPrivate); err != nil {
+	pageKey = s.Config.PageKeyPolicy.NormalizePageKey(pageKey, layer == models.LayerPrivate)
+	if err := s.CheckPageKey(pageKey, layer == models.LayerPrivate); err != nil {
 		return nil, err
 	}
+	s.touchCachedPage(ctx, pageKey)
 
 	redisStrokesRaw, err := s.Cache.GetStrokes(ctx, pageKey)
 	redisStrokes := []models.Stroke{}
 	if err == nil {
 		for _, b := range redisStrokesRaw {
 			var stroke models.Stroke
-			if err := json.Unmarshal(b, &stroke); err == nil {
-				redisStrokes = append(redisStrokes, stroke)
+			if err := json.Unmarshal(b, &stroke); err != nil {
+				log.Printf("Dropping corrupt cached stroke on page %s: %v", pageKey, err)
+				s.Metrics.Inc(metricCorruptCachedStrokes, 1)
+				continue
 			}
+			if err := stroke.Validate(); err != nil {
+				log.Printf("Dropping corrupt cached stroke %q on page %s: %v", stroke.Id, pageKey, err)
+				s.Metrics.Inc(metricCorruptCachedStrokes, 1)
+				continue
+			}
+			redisStrokes = append(redisStrokes, stroke)
 		}
 	}
 
@@ -30,18 +63,24 @@ func (s *Service) LoadPage(ctx context.Context, pageKey string, layer models.Lay
 	}
 
 	// Fallback to DynamoDB + Merge with Redis
-	dbStrokes, err := s.Store.GetStrokeRecords(ctx, pageKey)
+	return s.backfillPage(ctx, pageKey, redisStrokes)
+}
+
+// backfillPage reads the page's newest strokes from the store, merges them with the cached ones
+// and writes them to the cache, marking the page complete once the cache holds what a load returns
+func (s *Service) backfillPage(ctx context.Context, pageKey string, redisStrokes []models.Stroke) ([]models.Stroke, error) {
+	maxStrokes := s.Config.MaxPageStrokesReturned
+	// Hidden strokes are never cached, so they are left out of every load but an admin's
+	// The store skips them in the query, so they don't use up the limit
+	dbStrokes, err := s.getStrokeRecordsWithRetry(ctx, pageKey, int32(maxStrokes), false)
 	if err != nil {
 		return nil, err
 	}
 
-	finalStrokes := mergeStrokes(dbStrokes, redisStrokes)
-
-	// Fetch newest 1100 strokes
-	// There should be only 1000 or a little more, but just to be safe, we will enforce 1100 limit here
-	if len(finalStrokes) > 1100 {
-		finalStrokes = finalStrokes[len(finalStrokes)-1100:]
-	}
+	// Only the newest strokes of each source can end up in the result, so drop the rest before
+	// merging to bound the allocation however large either source grows
+	finalStrokes := mergeStrokes(newestStrokes(dbStrokes, maxStrokes), newestStrokes(redisStrokes, maxStrokes))
+	finalStrokes = newestStrokes(finalStrokes, maxStrokes)
 
 	batchItems := make([]cache.StrokeCacheItem, 0, len(dbStrokes))
 	for _, stroke := range dbStrokes {
@@ -56,6 +95,11 @@ func (s *Service) LoadPage(ctx context.Context, pageKey string, layer models.Lay
 
 	if len(batchItems) > 0 {
 		s.Cache.AddStrokesBatch(ctx, pageKey, batchItems)
+		// A full page takes no new strokes, so the cache now holds everything a load would return
+		// Marking it complete lets later loads and quota checks reject draws without a store round trip
+		if len(finalStrokes) >= maxPageStrokes {
+			s.Cache.SetPageComplete(ctx, pageKey)
+		}
 	} else {
 		// Mark as complete even if currently empty
 		s.Cache.SetPageComplete(ctx, pageKey)
@@ -64,6 +108,45 @@ func (s *Service) LoadPage(ctx context.Context, pageKey string, layer models.Lay
 	return finalStrokes, nil
 }
 
+// touchCachedPage tracks the page as recently loaded, for eviction and reconciliation, and evicts the
+// least recently loaded pages past MaxCachedPages. Failures only leave the pages to their TTL, so they don't fail the load
+func (s *Service) touchCachedPage(ctx context.Context, pageKey string) {
+	if s.Config.MaxCachedPages <= 0 && s.Config.ReconcileInterval <= 0 {
+		return
+	}
+
+	count, err := s.Cache.TouchPage(ctx, pageKey, time.Now())
+	if err != nil {
+		log.Printf("Failed to track cached page %s: %v", pageKey, err)
+		return
+	}
+	if s.Config.MaxCachedPages <= 0 || count <= int64(s.Config.MaxCachedPages) {
+		return
+	}
+
+	evicted, err := s.Cache.EvictOldestPages(ctx, s.Config.MaxCachedPages)
+	if err != nil {
+		log.Printf("Failed to evict cached pages: %v", err)
+		return
+	}
+	if len(evicted) == 0 {
+		return
+	}
+	if err := s.Cache.InvalidatePages(ctx, evicted); err != nil {
+		log.Printf("Failed to invalidate %d evicted pages: %v", len(evicted), err)
+		return
+	}
+	s.Metrics.Inc(metricEvictedPages, int64(len(evicted)))
+}
+
+// newestStrokes returns the last limit strokes of an id-ordered slice
+func newestStrokes(strokes []models.Stroke, limit int) []models.Stroke {
+	if len(strokes) > limit {
+		return strokes[len(strokes)-limit:]
+	}
+	return strokes
+}
+
 func mergeStrokes(dbStrokes []models.Stroke, redisStrokes []models.Stroke) []models.Stroke {
 	finalStrokes := make([]models.Stroke, 0, len(dbStrokes)+len(redisStrokes))
 	i, j := 0, 0
@@ -72,7 +155,7 @@ func mergeStrokes(dbStrokes []models.Stroke, redisStrokes []models.Stroke) []mod
 		redisId := redisStrokes[j].Id
 
 		if dbId == redisId {
-			finalStrokes = append(finalStrokes, redisStrokes[j])
+			finalStrokes = append(finalStrokes, preferredDuplicate(dbStrokes[i], redisStrokes[j]))
 			i++
 			j++
 		} else if dbId < redisId {
@@ -91,3 +174,550 @@ func mergeStrokes(dbStrokes []models.Stroke, redisStrokes []models.Stroke) []mod
 	}
 	return finalStrokes
 }
+
+// preferredDuplicate picks the copy of a stroke that is both in the store and in the cache
+// The cache copy always wins: it is written when the stroke is drawn and is what connected clients
+// received, while the store copy is written later from the same record by the stroke batcher
+// Strokes are never edited, so copies that differ mean a write went wrong somewhere and are logged
+func preferredDuplicate(dbStroke models.Stroke, redisStroke models.Stroke) models.Stroke {
+	if dbStroke.UserId != redisStroke.UserId || dbStroke.Nonce != redisStroke.Nonce || !bytes.Equal(dbStroke.Content, redisStroke.Content) {
+		log.Printf("Stroke %s differs between store and cache, using the cached copy", redisStroke.Id)
+	}
+	return redisStroke
+}
+
+// DynamoDB BatchWriteItem accepts at most 25 items per call
+const migrateBatchSize = 25
+
+// MigratePage copies the strokes of fromKey to toKey, e.g. when a site moves domains
+// Strokes keep their ids and authors, and strokes already present at the destination are skipped,
+// so a failed migration can simply be re-run. If deleteSource is set, the migrated strokes are
+// removed from fromKey. Returns the number of strokes written to toKey.
+func (s *Service) MigratePage(ctx context.Context, adminUser models.User, fromKey string, toKey string, layer models.LayerType, deleteSource bool) (int, error) {
+	if !s.IsAdmin(adminUser) {
+		return 0, ErrNotAdmin
+	}
+
+	// Private page keys are per-user HMACs of the URL, which the server cannot recompute
+	if layer != models.LayerPublic {
+		return 0, errors.New("only public pages can be migrated")
+	}
+	fromKey = s.Config.PageKeyPolicy.NormalizePageKey(fromKey, false)
+	if err := s.Config.PageKeyPolicy.ValidatePageKey(fromKey, false); err != nil {
+		return 0, err
+	}
+	toKey = s.Config.PageKeyPolicy.NormalizePageKey(toKey, false)
+	if err := s.Config.PageKeyPolicy.ValidatePageKey(toKey, false); err != nil {
+		return 0, err
+	}
+	if fromKey == toKey {
+		return 0, errors.New("source and destination page are the same")
+	}
+
+	sourceStrokes, err := s.Store.GetStrokeRecords(ctx, fromKey, int32(s.Config.MaxPageStrokesReturned))
+	if err != nil {
+		return 0, err
+	}
+	destStrokes, err := s.Store.GetStrokeRecords(ctx, toKey, int32(s.Config.MaxPageStrokesReturned))
+	if err != nil {
+		return 0, err
+	}
+
+	existing := make(map[string]struct{}, len(destStrokes))
+	for _, stroke := range destStrokes {
+		existing[stroke.Id] = struct{}{}
+	}
+
+	records := make([]models.StrokeRecord, 0, len(sourceStrokes))
+	for _, stroke := range sourceStrokes {
+		if _, ok := existing[stroke.Id]; ok {
+			continue
+		}
+		records = append(records, models.StrokeRecord{
+			PageKey: toKey,
+			Layer:   models.LayerPublic,
+			Stroke:  stroke,
+		})
+	}
+
+	// Stroke count changes per author, applied however far the migration got
+	// Their page list only stays valid if the strokes were copied to a page already on it
+	deltas := make(map[string]int)
+	keptPage := toKey
+	if deleteSource {
+		keptPage = ""
+	}
+	defer s.adjustAuthorCounts(ctx, fromKey, keptPage, deltas)
+
+	migrated := 0
+	for i := 0; i < len(records); i += migrateBatchSize {
+		end := min(i+migrateBatchSize, len(records))
+		unprocessed, err := s.Store.WriteStrokeBatch(ctx, records[i:end])
+		migrated += end - i - len(unprocessed)
+		unprocessedIds := make(map[string]struct{}, len(unprocessed))
+		for _, record := range unprocessed {
+			unprocessedIds[record.Stroke.Id] = struct{}{}
+		}
+		for _, record := range records[i:end] {
+			if _, ok := unprocessedIds[record.Stroke.Id]; !ok {
+				deltas[record.Stroke.UserId]++
+			}
+		}
+		if err != nil {
+			return migrated, err
+		}
+		if len(unprocessed) > 0 {
+			return migrated, fmt.Errorf("%d strokes were not written, retry the migration", len(unprocessed))
+		}
+	}
+
+	if deleteSource {
+		for _, stroke := range sourceStrokes {
+			// Conditional on the original author, so only the strokes we just read are removed
+			err := s.Store.DeleteStroke(ctx, fromKey, stroke.Id, stroke.UserId)
+			if err == nil {
+				deltas[stroke.UserId]--
+			} else if err != store.ErrItemNotFound {
+				return migrated, err
+			}
+		}
+	}
+
+	if err := s.Cache.InvalidatePages(ctx, []string{fromKey, toKey}); err != nil {
+		log.Printf("Failed to invalidate pages after migrating %s to %s: %v", fromKey, toKey, err)
+	}
+
+	log.Printf("Admin %s migrated %d strokes from %s to %s", adminUser.Id, migrated, fromKey, toKey)
+	return migrated, nil
+}
+
+// adjustAuthorCounts applies the stroke count changes of an admin page operation to the authors' counters
+// and drops their cached page lists, unless they are known to still hold keptPage
+func (s *Service) adjustAuthorCounts(ctx context.Context, pageKey string, keptPage string, deltas map[string]int) {
+	for userId, delta := range deltas {
+		if err := s.Cache.InvalidateUserPages(ctx, userId, keptPage); err != nil {
+			log.Printf("Failed to invalidate cached pages for user %s after changing %s: %v", userId, pageKey, err)
+		}
+
+		// A moved stroke is written once and deleted once, so it leaves its author's count as it was
+		if delta == 0 {
+			continue
+		}
+		if err := s.Cache.AddUserStrokeCount(ctx, userId, delta); err != nil {
+			log.Printf("Failed to adjust cached stroke count for user %s: %v", userId, err)
+		}
+		// The store's count is keyed by provider, like the batcher's writes
+		user, err := s.Store.GetUserById(ctx, userId)
+		if err != nil {
+			log.Printf("Failed to look up user %s to adjust their stroke count by %d: %v", userId, delta, err)
+			continue
+		}
+		s.CounterBatcher.UpdateCh <- worker.CounterUpdate{
+			UserId:         userId,
+			UserProvider:   user.Provider,
+			UserProviderId: user.ProviderId,
+			Delta:          delta,
+		}
+	}
+}
+
+// ClearPage deletes all public strokes of a page, e.g. after vandalism, and tells live clients to reload it
+// Private layer strokes on the same page key are left alone. Returns the number of strokes deleted
+// The deleted strokes no longer count toward their authors' quotas
+func (s *Service) ClearPage(ctx context.Context, adminUser models.User, pageKey string) (int, error) {
+	if !s.IsAdmin(adminUser) {
+		return 0, ErrNotAdmin
+	}
+	pageKey = s.Config.PageKeyPolicy.NormalizePageKey(pageKey, false)
+	if err := s.Config.PageKeyPolicy.ValidatePageKey(pageKey, false); err != nil {
+		return 0, err
+	}
+
+	deletedByUser, err := s.Store.DeletePageStrokesByLayer(ctx, pageKey, "Public")
+	// Applied however far the delete got
+	deltas := make(map[string]int, len(deletedByUser))
+	deleted := 0
+	for userId, count := range deletedByUser {
+		deltas[userId] = -count
+		deleted += count
+	}
+	s.adjustAuthorCounts(ctx, pageKey, "", deltas)
+	if err != nil {
+		return deleted, err
+	}
+
+	if err := s.EvictPage(ctx, pageKey); err != nil {
+		log.Printf("Failed to evict page %s after clearing it: %v", pageKey, err)
+	}
+
+	log.Printf("Admin %s cleared %d strokes from %s", adminUser.Id, deleted, pageKey)
+	return deleted, nil
+}
+
+var ErrPagePaused = errors.New("page_paused")
+
+const (
+	defaultPauseDuration = 10 * time.Minute
+	maxPauseDuration     = 24 * time.Hour
+)
+
+// PageEventMessage is broadcast to a page's subscribers when the page's state changes
+type PageEventMessage struct {
+	Type string        `json:"type"`
+	Data PageEventData `json:"data"`
+}
+
+type PageEventData struct {
+	PageKey string           `json:"pageKey"`
+	Layer   models.LayerType `json:"layer"`
+	// Unix milliseconds, only set for events that expire
+	Until int64 `json:"until,omitempty"`
+}
+
+func (s *Service) publishPageEvent(ctx context.Context, eventType string, data PageEventData) {
+	ctx, cancel := context.WithTimeout(ctx, asyncTimeout)
+	defer cancel()
+
+	msgBytes, err := json.Marshal(PageEventMessage{Type: eventType, Data: data})
+	if err != nil {
+		return
+	}
+	if err := s.Cache.Publish(ctx, "page:"+data.PageKey, msgBytes); err != nil {
+		log.Printf("Failed to publish %s for page %s: %v", eventType, data.PageKey, err)
+	}
+}
+
+// PausePage temporarily freezes drawing on a page, e.g. during a presentation
+// The pause expires on its own after duration (default 10 minutes, at most 24 hours)
+func (s *Service) PausePage(ctx context.Context, user models.User, pageKey string, layer models.LayerType, duration time.Duration) (time.Time, error) {
+	if !s.IsAdmin(user) {
+		return time.Time{}, ErrNotAdmin
+	}
+	pageKey = s.Config.PageKeyPolicy.NormalizePageKey(pageKey, layer == models.LayerPrivate)
+	if err := s.Config.PageKeyPolicy.ValidatePageKey(pageKey, layer == models.LayerPrivate); err != nil {
+		return time.Time{}, err
+	}
+
+	if duration <= 0 {
+		duration = defaultPauseDuration
+	}
+	duration = min(duration, maxPauseDuration)
+
+	if err := s.Cache.SetPagePaused(ctx, pageKey, duration); err != nil {
+		return time.Time{}, err
+	}
+	until := time.Now().Add(duration)
+
+	// Async side-effects - return to caller as soon as as cache operation is done
+	go s.publishPageEvent(context.Background(), "page_paused", PageEventData{PageKey: pageKey, Layer: layer, Until: until.UnixMilli()})
+
+	return until, nil
+}
+
+func (s *Service) ResumePage(ctx context.Context, user models.User, pageKey string, layer models.LayerType) error {
+	if !s.IsAdmin(user) {
+		return ErrNotAdmin
+	}
+	pageKey = s.Config.PageKeyPolicy.NormalizePageKey(pageKey, layer == models.LayerPrivate)
+	if err := s.Config.PageKeyPolicy.ValidatePageKey(pageKey, layer == models.LayerPrivate); err != nil {
+		return err
+	}
+
+	if err := s.Cache.ClearPagePaused(ctx, pageKey); err != nil {
+		return err
+	}
+
+	// Async side-effects - return to caller as soon as as cache operation is done
+	go s.publishPageEvent(context.Background(), "page_resumed", PageEventData{PageKey: pageKey, Layer: layer})
+
+	return nil
+}
+
+// GetPageVersionTag returns a tag identifying the page's current set of strokes, e.g. for HTTP ETags
+// The tag is derived from the cache, so the page is loaded into it first if needed
+func (s *Service) GetPageVersionTag(ctx context.Context, pageKey string, layer models.LayerType) (string, error) {
+	pageKey = s.Config.PageKeyPolicy.NormalizePageKey(pageKey, layer == models.LayerPrivate)
+	if err := s.CheckPageKey(pageKey, layer == models.LayerPrivate); err != nil {
+		return "", err
+	}
+
+	isComplete, _ := s.Cache.IsPageComplete(ctx, pageKey)
+	if !isComplete {
+		if _, err := s.LoadPage(ctx, pageKey, layer); err != nil {
+			return "", err
+		}
+	}
+
+	return s.Cache.GetPageVersionTag(ctx, pageKey)
+}
+
+// EvictPage drops a page from the cache and tells its live clients to reload it, e.g. after moderation
+// The next load repopulates the cache from the store. Callers are responsible for authorization
+func (s *Service) EvictPage(ctx context.Context, pageKey string) error {
+	if pageKey == "" {
+		return errors.New("missing page key")
+	}
+
+	if err := s.Cache.InvalidatePages(ctx, []string{pageKey}); err != nil {
+		return err
+	}
+
+	// Async side-effects - return to caller as soon as as cache operation is done
+	go s.publishPageEvent(context.Background(), "page_evicted", PageEventData{PageKey: pageKey})
+
+	return nil
+}
+
+// SetPageSettings overrides the stroke limits of a public page, zero fields restore the global limit
+// Only applied to draws when Config.PageSettings is enabled
+func (s *Service) SetPageSettings(ctx context.Context, adminUser models.User, pageKey string, settings models.PageSettings) error {
+	if !s.IsAdmin(adminUser) {
+		return ErrNotAdmin
+	}
+	pageKey = s.Config.PageKeyPolicy.NormalizePageKey(pageKey, false)
+	if err := s.Config.PageKeyPolicy.ValidatePageKey(pageKey, false); err != nil {
+		return err
+	}
+	if err := s.Config.StrokeLimits.ValidatePageSettings(settings); err != nil {
+		return err
+	}
+
+	if err := s.Store.SetPageSettings(ctx, pageKey, settings); err != nil {
+		return err
+	}
+	// Every instance reads the settings through the cache, so the new ones apply to draws right away
+	if err := s.Cache.SetPageSettings(ctx, pageKey, settings, pageSettingsTTL); err != nil {
+		log.Printf("Failed to cache page settings of %s: %v", pageKey, err)
+	}
+
+	log.Printf("Admin %s set page settings of %s to %+v", adminUser.Id, pageKey, settings)
+	return nil
+}
+
+// strokeLimitsForPage returns the stroke limits a draw on the page is validated against
+// Private strokes are encrypted, so only public draws read the page's settings
+func (s *Service) strokeLimitsForPage(ctx context.Context, pageKey string, layer models.LayerType) StrokeLimits {
+	if !s.Config.PageSettings || layer != models.LayerPublic {
+		return s.Config.StrokeLimits
+	}
+
+	settings, cached, err := s.Cache.GetPageSettings(ctx, pageKey)
+	if err != nil {
+		log.Printf("Failed to get cached page settings of %s: %v", pageKey, err)
+	}
+	if err == nil && cached {
+		return s.Config.StrokeLimits.WithPageSettings(settings)
+	}
+
+	settings, err = s.Store.GetPageSettings(ctx, pageKey)
+	if err != nil && !errors.Is(err, store.ErrItemNotFound) {
+		// A failed read shouldn't block drawing, the global limits still apply
+		log.Printf("Failed to get page settings of %s: %v", pageKey, err)
+		return s.Config.StrokeLimits
+	}
+	// Most pages have no settings, zero settings keep the global limits and are cached all the same
+	if errors.Is(err, store.ErrItemNotFound) {
+		settings = models.PageSettings{}
+	}
+	if err := s.Cache.SetPageSettings(ctx, pageKey, settings, pageSettingsTTL); err != nil {
+		log.Printf("Failed to cache page settings of %s: %v", pageKey, err)
+	}
+	return s.Config.StrokeLimits.WithPageSettings(settings)
+}
+
+// GetRecentPages returns the public pages the user drew on most recently, newest first
+func (s *Service) GetRecentPages(ctx context.Context, user models.User, limit int) ([]cache.RecentPage, error) {
+	if limit <= 0 || limit > s.Config.MaxRecentPages {
+		limit = s.Config.MaxRecentPages
+	}
+	if limit <= 0 {
+		return []cache.RecentPage{}, nil
+	}
+	return s.Cache.GetRecentPages(ctx, user.Id, limit)
+}
+
+// getStrokeRecordsWithRetry retries throttled reads, so a brief spike doesn't show users an empty page
+// Other errors are returned right away, retrying them would only delay the failure
+func (s *Service) getStrokeRecordsWithRetry(ctx context.Context, pageKey string, limit int32, includeHidden bool) ([]models.Stroke, error) {
+	backoff := loadRetryBackoff
+	for attempt := 1; ; attempt++ {
+		var strokes []models.Stroke
+		var err error
+		if includeHidden {
+			strokes, err = s.Store.GetStrokeRecords(ctx, pageKey, limit)
+		} else {
+			strokes, err = s.Store.GetVisibleStrokeRecords(ctx, pageKey, limit)
+		}
+		if err == nil || !errors.Is(err, store.ErrThrottled) || attempt == loadAttempts {
+			return strokes, err
+		}
+
+		log.Printf("Loading page %s throttled (attempt %d/%d), retrying in %v", pageKey, attempt, loadAttempts, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+const (
+	// How long a user's page list is served from the cache, drawing on a new page adds it to the list
+	// Short, as a new page's stroke may not be written to the store yet when the list is recomputed
+	userPagesTTL = time.Minute
+	// How long a page's settings are served from the cache, an admin changing them updates the cache right away
+	pageSettingsTTL = time.Minute
+
+	defaultUserPagesLimit = 50
+	maxUserPagesLimit     = 100
+)
+
+// GetUserPages lists the pages the user has strokes on across all layers, ordered by page key
+// Private pages are listed under their hashed keys
+// Pass the returned cursor to get the next page of results, it is empty after the last one
+func (s *Service) GetUserPages(ctx context.Context, user models.User, limit int, cursor string) ([]string, string, error) {
+	if limit <= 0 {
+		limit = defaultUserPagesLimit
+	}
+	limit = min(limit, maxUserPagesLimit)
+
+	pageKeys, err := s.userPageKeys(ctx, user.Id)
+	if err != nil {
+		return nil, "", err
+	}
+	sort.Strings(pageKeys)
+
+	// The cursor is the last page key of the previous results
+	start := sort.SearchStrings(pageKeys, cursor)
+	if start < len(pageKeys) && pageKeys[start] == cursor {
+		start++
+	}
+	pageKeys = pageKeys[start:]
+
+	nextCursor := ""
+	if len(pageKeys) > limit {
+		pageKeys = pageKeys[:limit]
+		nextCursor = pageKeys[limit-1]
+	}
+	return pageKeys, nextCursor, nil
+}
+
+// userPageKeys returns the pages the user has strokes on, from the cache or else the store
+// Pages the cache only knows were drawn on recently are kept, their strokes may not be in the store yet
+func (s *Service) userPageKeys(ctx context.Context, userId string) ([]string, error) {
+	cachedKeys, complete, err := s.Cache.GetUserPages(ctx, userId)
+	if err != nil {
+		log.Printf("Failed to get cached pages for user %s: %v", userId, err)
+	}
+	if err == nil && complete {
+		return cachedKeys, nil
+	}
+
+	// Scans the user's strokes in GSI_UserStrokes
+	pageKeys, err := s.Store.GetUserPages(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	for _, pageKey := range cachedKeys {
+		if !slices.Contains(pageKeys, pageKey) {
+			pageKeys = append(pageKeys, pageKey)
+		}
+	}
+	if err := s.Cache.SetUserPages(ctx, userId, pageKeys, userPagesTTL); err != nil {
+		log.Printf("Failed to cache pages for user %s: %v", userId, err)
+	}
+	return pageKeys, nil
+}
+
+// UserDisplaySeed derives a stable number from a user id, for clients to pick a color or identicon that tells
+// collaborators apart without showing usernames. It is a truncated hash, so it reveals nothing about the user
+func UserDisplaySeed(userId string) uint32 {
+	sum := sha256.Sum256([]byte("webverse-display-seed:" + userId))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// UserDisplaySeeds returns the display seed of each user with strokes among the given ones, by user id
+func UserDisplaySeeds(strokes []models.Stroke) map[string]uint32 {
+	seeds := make(map[string]uint32)
+	for _, stroke := range strokes {
+		if _, ok := seeds[stroke.UserId]; !ok {
+			seeds[stroke.UserId] = UserDisplaySeed(stroke.UserId)
+		}
+	}
+	return seeds
+}
+
+type SequencedStroke struct {
+	Seq    int64         `json:"seq"`
+	Stroke models.Stroke `json:"stroke"`
+}
+
+// PageSync is what a client missed on a page since a sequence number
+type PageSync struct {
+	Strokes []SequencedStroke
+	// Strokes undone or hidden since, the client removes them if it has them
+	RemovedIds []string
+	// The sequence number to sync from next time
+	Seq int64
+}
+
+// SyncPageSeq returns the strokes drawn and removed on the page after the sequence number of a
+// new_stroke message, so a client that lost its connection only fetches what it missed
+// Returns cache.ErrSequenceGap if they are no longer all cached, the client has to load the page instead
+func (s *Service) SyncPageSeq(ctx context.Context, pageKey string, layer models.LayerType, seq int64) (PageSync, error) {
+	pageKey = s.Config.PageKeyPolicy.NormalizePageKey(pageKey, layer == models.LayerPrivate)
+	if err := s.CheckPageKey(pageKey, layer == models.LayerPrivate); err != nil {
+		return PageSync{}, err
+	}
+	if seq < 0 {
+		return PageSync{}, errors.New("invalid sequence")
+	}
+
+	cached, err := s.Cache.GetStrokesAfterSeq(ctx, pageKey, seq)
+	if err != nil {
+		return PageSync{}, err
+	}
+
+	strokes := make([]SequencedStroke, 0, len(cached.Strokes))
+	for _, item := range cached.Strokes {
+		var stroke models.Stroke
+		if err := json.Unmarshal(item.Data, &stroke); err != nil {
+			log.Printf("Dropping corrupt cached stroke on page %s: %v", pageKey, err)
+			s.Metrics.Inc(metricCorruptCachedStrokes, 1)
+			continue
+		}
+		if err := stroke.Validate(); err != nil {
+			log.Printf("Dropping corrupt cached stroke %q on page %s: %v", stroke.Id, pageKey, err)
+			s.Metrics.Inc(metricCorruptCachedStrokes, 1)
+			continue
+		}
+		strokes = append(strokes, SequencedStroke{Seq: item.Seq, Stroke: stroke})
+	}
+	return PageSync{Strokes: strokes, RemovedIds: cached.RemovedIds, Seq: cached.LastSeq}, nil
+}
+
+type PageStatus struct {
+	StrokeCount int64
+	MaxStrokes  int
+	Full        bool
+	// Whether the cache holds the complete page, i.e. StrokeCount is exact
+	Complete bool
+}
+
+// GetPageStatus reports how full a page is, so clients can check before drawing
+// Uses the same counts as the draw quota check, loading the page into the cache if needed
+func (s *Service) GetPageStatus(ctx context.Context, pageKey string, layer models.LayerType) (PageStatus, error) {
+	pageKey = s.Config.PageKeyPolicy.NormalizePageKey(pageKey, layer == models.LayerPrivate)
+	if err := s.CheckPageKey(pageKey, layer == models.LayerPrivate); err != nil {
+		return PageStatus{}, err
+	}
+
+	strokeCount, complete := s.pageStrokeCount(ctx, pageKey, layer)
+	return PageStatus{
+		StrokeCount: strokeCount,
+		MaxStrokes:  maxPageStrokes,
+		Full:        strokeCount >= maxPageStrokes,
+		Complete:    complete,
+	}, nil
+}
@@ -0,0 +1,130 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/zlnvch/webverse/cache"
+	"github.com/zlnvch/webverse/models"
+)
+
+// Pages reloaded because their cached stroke count drifted from the store's
+const metricReconciledPages = "service.reconciled_pages"
+
+// Cached strokes drawn this recently may still be waiting in the stroke batcher, including its retries,
+// so they are kept when a drifted page is reloaded from the store
+const reconcileKeepRecent = time.Minute
+
+// RunPageReconciler reconciles the recently loaded pages every ReconcileInterval until shutdown
+func (s *Service) RunPageReconciler(shutdownCtx context.Context) {
+	ticker := time.NewTicker(s.Config.ReconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(shutdownCtx, s.Config.ReconcileInterval)
+			if _, err := s.ReconcilePages(ctx); err != nil {
+				log.Printf("Failed to reconcile pages: %v", err)
+			}
+			cancel()
+
+		case <-shutdownCtx.Done():
+			return
+		}
+	}
+}
+
+// ReconcilePages compares the cached stroke count of up to ReconcileMaxPages pages loaded within the last
+// ReconcileInterval with the store's count, and reloads the pages that drifted apart by more than
+// ReconcileThreshold. The cached count is what the page quota is checked against. Returns the pages reloaded
+func (s *Service) ReconcilePages(ctx context.Context) (int, error) {
+	pageKeys, err := s.Cache.GetTouchedPages(ctx, time.Now().Add(-s.Config.ReconcileInterval), s.Config.ReconcileMaxPages)
+	if err != nil {
+		return 0, err
+	}
+
+	reloaded := 0
+	for _, pageKey := range pageKeys {
+		drifted, err := s.reconcilePage(ctx, pageKey)
+		if err != nil {
+			log.Printf("Failed to reconcile page %s: %v", pageKey, err)
+			continue
+		}
+		if drifted {
+			reloaded++
+		}
+	}
+	if reloaded > 0 {
+		s.Metrics.Inc(metricReconciledPages, int64(reloaded))
+	}
+	return reloaded, nil
+}
+
+// reconcilePage reloads the page from the store if its cached count drifted, returns whether it did
+func (s *Service) reconcilePage(ctx context.Context, pageKey string) (bool, error) {
+	// An incomplete page only caches the strokes drawn since it was last loaded, and is loaded
+	// before its quota is checked anyway
+	isComplete, err := s.Cache.IsPageComplete(ctx, pageKey)
+	if err != nil || !isComplete {
+		return false, err
+	}
+
+	cachedCount, err := s.Cache.GetPageStrokeCountFromZCard(ctx, pageKey)
+	if err != nil {
+		return false, err
+	}
+	storedCount, err := s.Store.CountPageStrokes(ctx, pageKey)
+	if err != nil {
+		return false, err
+	}
+	// A load caches at most MaxPageStrokesReturned strokes, however many are stored
+	drift := cachedCount - int64(min(storedCount, s.Config.MaxPageStrokesReturned))
+	if drift < 0 {
+		drift = -drift
+	}
+	if drift <= int64(s.Config.ReconcileThreshold) {
+		return false, nil
+	}
+
+	log.Printf("Page %s has %d cached strokes but %d stored, reloading it", pageKey, cachedCount, storedCount)
+	recentStrokes, err := s.recentCachedStrokes(ctx, pageKey)
+	if err != nil {
+		return false, err
+	}
+	if err := s.Cache.InvalidatePages(ctx, []string{pageKey}); err != nil {
+		return false, err
+	}
+	if _, err := s.backfillPage(ctx, pageKey, nil); err != nil {
+		return false, err
+	}
+	if len(recentStrokes) > 0 {
+		if err := s.Cache.AddStrokesBatch(ctx, pageKey, recentStrokes); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// recentCachedStrokes returns the page's cached strokes drawn within reconcileKeepRecent
+func (s *Service) recentCachedStrokes(ctx context.Context, pageKey string) ([]cache.StrokeCacheItem, error) {
+	strokesRaw, err := s.Cache.GetStrokes(ctx, pageKey)
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-reconcileKeepRecent)
+	strokes := []cache.StrokeCacheItem{}
+	for _, b := range strokesRaw {
+		var stroke models.Stroke
+		if err := json.Unmarshal(b, &stroke); err != nil {
+			continue
+		}
+		if t, err := getTimeFromUUIDv7(stroke.Id); err == nil && t.After(cutoff) {
+			strokes = append(strokes, cache.StrokeCacheItem{StrokeId: stroke.Id, Score: t.UnixMilli(), Data: b})
+		}
+	}
+	return strokes, nil
+}
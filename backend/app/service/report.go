@@ -0,0 +1,107 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/zlnvch/webverse/models"
+	"github.com/zlnvch/webverse/store"
+)
+
+// Strokes hidden because they reached Config.ReportHideThreshold
+const metricHiddenStrokes = "service.hidden_strokes"
+
+const maxReportReasonLength = 200
+
+var ErrReportOwnStroke = errors.New("cannot report own stroke")
+
+// ReportStroke records a user's report of another user's public stroke, each user counts once per stroke
+// The report that brings the stroke to Config.ReportHideThreshold hides it pending review: it is
+// flagged in the store, dropped from the cache and deleted on live clients
+func (s *Service) ReportStroke(ctx context.Context, reporter models.User, pageKey string, strokeId string, reason string) error {
+	if err := s.checkNotBanned(ctx, reporter.Id); err != nil {
+		return err
+	}
+
+	// Private strokes are only ever seen by their owner
+	pageKey = s.Config.PageKeyPolicy.NormalizePageKey(pageKey, false)
+	if err := s.Config.PageKeyPolicy.ValidatePageKey(pageKey, false); err != nil {
+		return err
+	}
+	if id, err := uuid.FromString(strokeId); err != nil || id.Version() != uuid.V7 {
+		return errors.New("invalid stroke id")
+	}
+	reason = strings.TrimSpace(reason)
+	if utf8.RuneCountInString(reason) > maxReportReasonLength {
+		return errors.New("report reason too long")
+	}
+
+	// Strokes are only reportable once written, which also rules out reports of made up ids
+	stroke, err := s.Store.GetStroke(ctx, pageKey, strokeId)
+	if errors.Is(err, store.ErrItemNotFound) {
+		return ErrStrokeNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if stroke.UserId == reporter.Id {
+		return ErrReportOwnStroke
+	}
+
+	reports, err := s.Store.AddStrokeReport(ctx, models.StrokeReport{
+		PageKey:    pageKey,
+		StrokeId:   strokeId,
+		ReporterId: reporter.Id,
+		Reason:     reason,
+		Created:    time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Only the report reaching the threshold hides the stroke, so one a moderator restored stays visible
+	if s.Config.ReportHideThreshold > 0 && reports == s.Config.ReportHideThreshold {
+		s.hideReportedStroke(ctx, pageKey, stroke)
+	}
+	return nil
+}
+
+// hideReportedStroke flags the stroke in the store and removes it like an undo, without decrementing its
+// owner's counter. A failure is only logged, the report itself was recorded
+func (s *Service) hideReportedStroke(ctx context.Context, pageKey string, stroke models.Stroke) {
+	if err := s.Store.SetStrokeHidden(ctx, pageKey, stroke.Id, true); err != nil {
+		log.Printf("Failed to hide reported stroke %s: %v", stroke.Id, err)
+		return
+	}
+	s.Metrics.Inc(metricHiddenStrokes, 1)
+	log.Printf("Hid stroke %s on page %s pending review", stroke.Id, pageKey)
+
+	// Async side-effects - return to caller as soon as the store operation is done
+	go s.removeHiddenStroke(pageKey, stroke)
+}
+
+// removeHiddenStroke drops a stroke that was just hidden from the cache and from live clients
+func (s *Service) removeHiddenStroke(pageKey string, stroke models.Stroke) {
+	ctx, cancel := asyncContext()
+	defer cancel()
+
+	s.Cache.RemoveStroke(ctx, pageKey, stroke.Id)
+
+	msg := DeleteStrokeMessage{
+		Type: "delete_stroke",
+		Data: DeleteStrokeData{
+			PageKey:  pageKey,
+			Layer:    models.LayerPublic,
+			StrokeId: stroke.Id,
+			UserId:   stroke.UserId,
+		},
+	}
+	msgBytes, _ := json.Marshal(msg)
+	s.Cache.Publish(ctx, "page:"+pageKey, msgBytes)
+}
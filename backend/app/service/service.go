@@ -1,9 +1,16 @@
 package service
 
 import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/zlnvch/webverse/abuse"
 	"github.com/zlnvch/webverse/cache"
+	"github.com/zlnvch/webverse/metrics"
 	"github.com/zlnvch/webverse/mq"
 	"github.com/zlnvch/webverse/store"
+	"github.com/zlnvch/webverse/webhook"
 	"github.com/zlnvch/webverse/worker"
 	"golang.org/x/oauth2"
 )
@@ -14,8 +21,19 @@ type Service struct {
 	MQ             mq.MessageQueue
 	StrokeBatcher  *worker.StrokeBatcher
 	CounterBatcher *worker.CounterBatcher
-	OAuthConfigs   map[string]*oauth2.Config
-	JWTSecret      []byte
+	OAuthConfigs   map[string]OAuthConfig
+	// The first secret signs new tokens, the others verify the tokens whose kid header names them,
+	// so tokens signed before the secret was rotated stay valid while the old secret is kept after it
+	JWTSecrets    [][]byte
+	Config        Config
+	AbuseReporter abuse.Reporter
+	// Defaults to a no-op
+	Metrics metrics.Metrics
+	// Notified of successful draws and undos, defaults to a no-op
+	Webhook webhook.Webhook
+
+	coalescer  *drawCoalescer
+	lastActive *lastActiveTracker
 }
 
 func NewService(
@@ -25,20 +43,76 @@ func NewService(
 	strokeBatcher *worker.StrokeBatcher,
 	counterBatcher *worker.CounterBatcher,
 	oauthConfigs map[string]*oauth2.Config,
-	jwtSecret []byte,
+	jwtSecrets [][]byte,
+	config Config,
 ) (*Service, error) {
-	oauthConfigs, err := addOauthEndpointsAndScopes(oauthConfigs)
+	providerConfigs, err := addOauthEndpointsAndScopes(oauthConfigs)
 	if err != nil {
 		return nil, err
 	}
 
+	if len(jwtSecrets) == 0 {
+		return nil, errors.New("at least one jwt secret is required")
+	}
+	if err := config.PageKeyPolicy.Validate(); err != nil {
+		return nil, err
+	}
+	if config.StrokeLimits.MinPoints < 0 {
+		return nil, errors.New("min stroke points must not be negative")
+	}
+	if config.MaxPageStrokesReturned <= 0 {
+		return nil, errors.New("max page strokes returned must be positive")
+	}
+	if config.ReportHideThreshold < 0 {
+		return nil, errors.New("report hide threshold must not be negative")
+	}
+	if config.MaxUserPages < 0 {
+		return nil, errors.New("max user pages must not be negative")
+	}
+	if config.MaxCachedPages < 0 {
+		return nil, errors.New("max cached pages must not be negative")
+	}
+	if config.ReconcileInterval < 0 || config.ReconcileThreshold < 0 {
+		return nil, errors.New("reconcile interval and threshold must not be negative")
+	}
+	if config.ReconcileInterval > 0 && config.ReconcileMaxPages <= 0 {
+		return nil, errors.New("reconcile max pages must be positive")
+	}
+	if config.DrawCoalesceWindow < 0 {
+		return nil, errors.New("draw coalesce window must not be negative")
+	}
+	if config.InactiveUserCleanupInterval < 0 || config.InactiveUserIdle < 0 {
+		return nil, errors.New("inactive user cleanup interval and idle time must not be negative")
+	}
+	if config.InactiveUserCleanupInterval > 0 && config.InactiveUserMinAge <= 0 {
+		return nil, errors.New("inactive user min age must be positive")
+	}
+	if config.OAuthTimeout < 0 {
+		return nil, errors.New("oauth timeout must not be negative")
+	}
+
 	return &Service{
 		Store:          store,
 		Cache:          cache,
 		MQ:             mq,
 		StrokeBatcher:  strokeBatcher,
 		CounterBatcher: counterBatcher,
-		OAuthConfigs:   oauthConfigs,
-		JWTSecret:      jwtSecret,
+		OAuthConfigs:   providerConfigs,
+		JWTSecrets:     jwtSecrets,
+		Config:         config,
+		AbuseReporter:  abuse.Noop{},
+		Metrics:        metrics.Noop{},
+		Webhook:        webhook.Noop{},
+		coalescer:      newDrawCoalescer(),
+		lastActive:     newLastActiveTracker(),
 	}, nil
 }
+
+// asyncTimeout bounds the side-effects that run after a call has returned
+const asyncTimeout = 10 * time.Second
+
+// asyncContext returns a context for async side-effects. It is not derived from the caller's
+// context, which is usually cancelled as soon as the call returns, but is still bounded
+func asyncContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), asyncTimeout)
+}
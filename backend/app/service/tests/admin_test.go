@@ -0,0 +1,349 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/zlnvch/webverse/models"
+	"github.com/zlnvch/webverse/service"
+	"github.com/zlnvch/webverse/store"
+)
+
+func TestBanUser_NotAdmin(t *testing.T) {
+	svc, _, mockCache, _, _, _ := setupService(t)
+
+	err := svc.BanUser(context.Background(), models.User{Id: "user1"}, "user2", time.Now().Add(time.Hour))
+	assert.ErrorIs(t, err, service.ErrNotAdmin)
+	mockCache.AssertNotCalled(t, "BanUser", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestBanUser_PastUntilRejected(t *testing.T) {
+	svc, _, mockCache, _, _, _ := setupService(t)
+	svc.Config.AdminUserIds = []string{"admin1"}
+
+	err := svc.BanUser(context.Background(), models.User{Id: "admin1"}, "user2", time.Now().Add(-time.Hour))
+	assert.EqualError(t, err, "ban must end in the future")
+	mockCache.AssertNotCalled(t, "BanUser", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestBanUser_PublishesLogout(t *testing.T) {
+	svc, _, mockCache, _, _, _ := setupService(t)
+	svc.Config.AdminUserIds = []string{"admin1"}
+	ctx := context.Background()
+	until := time.Now().Add(time.Hour)
+
+	mockCache.On("BanUser", ctx, "user2", until).Return(nil)
+	publishDone := wrapMockWithSignal(mockCache.On("Publish", mock.Anything, "user-logout", mock.MatchedBy(func(msg []byte) bool {
+		return string(msg) == `{"UserId":"user2"}`
+	})).Return(nil))
+
+	err := svc.BanUser(ctx, models.User{Id: "admin1"}, "user2", until)
+	assert.NoError(t, err)
+
+	select {
+	case <-publishDone:
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "timed out waiting for user-logout publish")
+	}
+}
+
+func TestDeleteUsers_NotAdmin(t *testing.T) {
+	svc, mockStore, _, _, _, _ := setupService(t)
+
+	_, err := svc.DeleteUsers(context.Background(), models.User{Id: "user1"}, []service.UserIdentity{{Provider: "github", ProviderId: "1"}})
+	assert.ErrorIs(t, err, service.ErrNotAdmin)
+	mockStore.AssertNotCalled(t, "DeleteUser", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestDeleteUsers_AggregatesPartialFailures(t *testing.T) {
+	svc, mockStore, mockCache, mockMQ, _, _ := setupService(t)
+	svc.Config.AdminUserIds = []string{"admin1"}
+	ctx := context.Background()
+
+	mockStore.On("GetUser", ctx, "github", "1").Return(models.User{Id: "user1", Provider: "github", ProviderId: "1"}, nil)
+	mockStore.On("GetUser", ctx, "github", "2").Return(models.User{}, store.ErrItemNotFound)
+	mockStore.On("GetUser", ctx, "google", "3").Return(models.User{Id: "user3", Provider: "google", ProviderId: "3"}, nil)
+	mockStore.On("DeleteUser", ctx, "github", "1").Return(nil)
+	mockStore.On("DeleteUser", ctx, "google", "3").Return(errors.New("dynamodb unavailable"))
+
+	mockCache.On("ClearRecentPages", mock.Anything, "user1").Return(nil)
+	publishDone := wrapMockWithSignal(mockCache.On("Publish", mock.Anything, "user-deleted", mock.Anything).Return(nil))
+	mqSendDone := wrapMockWithSignal(mockMQ.On("Send", mock.Anything, mock.MatchedBy(func(body string) bool {
+		return strings.Contains(body, `"userId":"user1"`)
+	})).Return(nil))
+
+	identities := []service.UserIdentity{
+		{Provider: "github", ProviderId: "1"},
+		{Provider: "github", ProviderId: "2"},
+		{Provider: "google", ProviderId: "3"},
+		{Provider: "github"},
+	}
+	results, err := svc.DeleteUsers(ctx, models.User{Id: "admin1"}, identities)
+	assert.NoError(t, err)
+
+	// Results keep the input order, and one failure does not stop the others
+	assert.Equal(t, []service.UserDeletionResult{
+		{UserIdentity: identities[0]},
+		{UserIdentity: identities[1], Error: store.ErrItemNotFound.Error()},
+		{UserIdentity: identities[2], Error: "dynamodb unavailable"},
+		{UserIdentity: identities[3], Error: "provider and provider id are required"},
+	}, results)
+
+	// Only the deleted user's strokes are queued for deletion
+	select {
+	case <-mqSendDone:
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "timed out waiting for MQ Send")
+	}
+	select {
+	case <-publishDone:
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "timed out waiting for Publish")
+	}
+	mockMQ.AssertNumberOfCalls(t, "Send", 1)
+}
+
+func TestDeleteUsers_TooManyUsers(t *testing.T) {
+	svc, mockStore, _, _, _, _ := setupService(t)
+	svc.Config.AdminUserIds = []string{"admin1"}
+
+	identities := make([]service.UserIdentity, 101)
+	_, err := svc.DeleteUsers(context.Background(), models.User{Id: "admin1"}, identities)
+	assert.EqualError(t, err, "at most 100 users can be deleted at once")
+	mockStore.AssertNotCalled(t, "GetUser", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestListUsersCreatedBetween_NotAdmin(t *testing.T) {
+	svc, mockStore, _, _, _, _ := setupService(t)
+
+	_, _, err := svc.ListUsersCreatedBetween(context.Background(), models.User{Id: "user1"}, 0, 100, 10, "")
+	assert.ErrorIs(t, err, service.ErrNotAdmin)
+	mockStore.AssertNotCalled(t, "GetUsersCreatedBetween", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestListUsersCreatedBetween_ClampsLimit(t *testing.T) {
+	svc, mockStore, _, _, _, _ := setupService(t)
+	svc.Config.AdminUserIds = []string{"admin1"}
+	ctx := context.Background()
+	admin := models.User{Id: "admin1"}
+
+	users := []models.User{{Id: "user1", Created: 50}}
+	mockStore.On("GetUsersCreatedBetween", ctx, int64(0), int64(100), 100, "").Return(users, "next", nil)
+	mockStore.On("GetUsersCreatedBetween", ctx, int64(0), int64(100), 10, "next").Return([]models.User{}, "", nil)
+
+	// Missing and too large limits fall back to the largest page
+	got, cursor, err := svc.ListUsersCreatedBetween(ctx, admin, 0, 100, 0, "")
+	assert.NoError(t, err)
+	assert.Equal(t, users, got)
+	assert.Equal(t, "next", cursor)
+	_, _, err = svc.ListUsersCreatedBetween(ctx, admin, 0, 100, 1000, "")
+	assert.NoError(t, err)
+
+	got, cursor, err = svc.ListUsersCreatedBetween(ctx, admin, 0, 100, 10, "next")
+	assert.NoError(t, err)
+	assert.Empty(t, got)
+	assert.Empty(t, cursor)
+
+	_, _, err = svc.ListUsersCreatedBetween(ctx, admin, 100, 0, 10, "")
+	assert.EqualError(t, err, "from must not be after to")
+}
+
+func TestGetStrokeOwner_ResolvesAuthor(t *testing.T) {
+	svc, mockStore, _, _, _, _ := setupService(t)
+	svc.Config.AdminUserIds = []string{"admin1"}
+	ctx := context.Background()
+
+	stroke := models.Stroke{Id: "stroke1", UserId: "user1", Content: []byte("{}")}
+	author := models.User{Id: "user1", Username: "alice", Provider: "github", ProviderId: "42"}
+	mockStore.On("GetStroke", ctx, "example.com", "stroke1").Return(stroke, nil)
+	mockStore.On("GetUserById", ctx, "user1").Return(author, nil)
+
+	gotStroke, gotAuthor, err := svc.GetStrokeOwner(ctx, models.User{Id: "admin1"}, "example.com", "stroke1")
+	assert.NoError(t, err)
+	assert.Equal(t, stroke, gotStroke)
+	if assert.NotNil(t, gotAuthor) {
+		assert.Equal(t, author, *gotAuthor)
+	}
+}
+
+func TestGetStrokeOwner_AuthorDeleted(t *testing.T) {
+	svc, mockStore, _, _, _, _ := setupService(t)
+	svc.Config.AdminUserIds = []string{"admin1"}
+	ctx := context.Background()
+
+	stroke := models.Stroke{Id: "stroke1", UserId: "user1", Content: []byte("{}")}
+	mockStore.On("GetStroke", ctx, "example.com", "stroke1").Return(stroke, nil)
+	mockStore.On("GetUserById", ctx, "user1").Return(models.User{}, store.ErrItemNotFound)
+
+	// The stroke outlives its author until the MQ consumer deletes it, moderators can still see it
+	gotStroke, gotAuthor, err := svc.GetStrokeOwner(ctx, models.User{Id: "admin1"}, "example.com", "stroke1")
+	assert.NoError(t, err)
+	assert.Equal(t, stroke, gotStroke)
+	assert.Nil(t, gotAuthor)
+}
+
+func TestGetStrokeOwner_NotAdminOrMissingStroke(t *testing.T) {
+	svc, mockStore, _, _, _, _ := setupService(t)
+	svc.Config.AdminUserIds = []string{"admin1"}
+	ctx := context.Background()
+
+	_, _, err := svc.GetStrokeOwner(ctx, models.User{Id: "user1"}, "example.com", "stroke1")
+	assert.ErrorIs(t, err, service.ErrNotAdmin)
+	mockStore.AssertNotCalled(t, "GetStroke", mock.Anything, mock.Anything, mock.Anything)
+
+	mockStore.On("GetStroke", ctx, "example.com", "missing").Return(models.Stroke{}, store.ErrItemNotFound)
+	_, _, err = svc.GetStrokeOwner(ctx, models.User{Id: "admin1"}, "example.com", "missing")
+	assert.ErrorIs(t, err, service.ErrStrokeNotFound)
+	mockStore.AssertNotCalled(t, "GetUserById", mock.Anything, mock.Anything)
+}
+
+func TestGetStrokeOwner_NormalizesAndValidatesPageKey(t *testing.T) {
+	svc, mockStore, _, _, _, _ := setupService(t)
+	svc.Config.AdminUserIds = []string{"admin1"}
+	ctx := context.Background()
+
+	stroke := models.Stroke{Id: "stroke1", UserId: "user1", Content: []byte("{}")}
+	mockStore.On("GetStroke", ctx, "example.com", "stroke1").Return(stroke, nil).Once()
+	mockStore.On("GetUserById", ctx, "user1").Return(models.User{Id: "user1"}, nil).Once()
+
+	gotStroke, _, err := svc.GetStrokeOwner(ctx, models.User{Id: "admin1"}, "Example.COM", "stroke1")
+	assert.NoError(t, err)
+	assert.Equal(t, stroke, gotStroke)
+
+	_, _, err = svc.GetStrokeOwner(ctx, models.User{Id: "admin1"}, "https://example.com", "stroke1")
+	assert.Error(t, err)
+	mockStore.AssertNumberOfCalls(t, "GetStroke", 1)
+}
+
+func TestDrawStroke_UserBanned(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+
+	unsetDefault(&mockCache.Mock, "IsUserBanned")
+	mockCache.On("IsUserBanned", ctx, "user1").Return(true, nil)
+
+	params := service.DrawParams{
+		User:    models.User{Id: "user1"},
+		PageKey: "example.com",
+		Layer:   models.LayerPublic,
+		Stroke:  models.Stroke{Content: []byte(`{"tool":0,"color":"#000000","width":1,"startX":0,"startY":0,"dx":[],"dy":[]}`)},
+	}
+	_, err := svc.DrawStroke(ctx, params)
+	assert.ErrorIs(t, err, service.ErrUserBanned)
+
+	mockCache.AssertNotCalled(t, "GetUserStrokeCount", mock.Anything, mock.Anything)
+	mockStore.AssertNotCalled(t, "WriteStrokeBatch", mock.Anything, mock.Anything)
+}
+
+func TestUndoStroke_UserBanned(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+
+	unsetDefault(&mockCache.Mock, "IsUserBanned")
+	mockCache.On("IsUserBanned", ctx, "user1").Return(true, nil)
+
+	params := service.UndoParams{
+		User:     models.User{Id: "user1"},
+		PageKey:  "example.com",
+		Layer:    models.LayerPublic,
+		StrokeId: "stroke1",
+	}
+	err := svc.UndoStroke(ctx, params)
+	assert.ErrorIs(t, err, service.ErrUserBanned)
+	mockStore.AssertNotCalled(t, "DeleteStroke", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestDrawStroke_BanCheckFailsOpen(t *testing.T) {
+	svc, _, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+
+	unsetDefault(&mockCache.Mock, "IsUserBanned")
+	mockCache.On("IsUserBanned", ctx, "user1").Return(false, assert.AnError)
+	// Stop right after the ban check with a quota error
+	mockCache.On("GetUserStrokeCount", ctx, "user1").Return(100000, nil)
+
+	params := service.DrawParams{
+		User:    models.User{Id: "user1"},
+		PageKey: "example.com",
+		Layer:   models.LayerPublic,
+		Stroke:  models.Stroke{Content: []byte(`{"tool":0,"color":"#000000","width":1,"startX":0,"startY":0,"dx":[],"dy":[]}`)},
+	}
+	_, err := svc.DrawStroke(ctx, params)
+	assert.EqualError(t, err, "user stroke quota exceeded")
+}
+
+func TestSetStrokeHidden_Hide(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	svc.Config.AdminUserIds = []string{"admin"}
+	ctx := context.Background()
+	strokeId := "00000000-0000-7000-8000-000000000001"
+
+	mockStore.On("GetStroke", ctx, "example.com", strokeId).Return(models.Stroke{Id: strokeId, UserId: "user2"}, nil)
+	mockStore.On("SetStrokeHidden", ctx, "example.com", strokeId, true).Return(nil).Once()
+	removed := wrapMockWithSignal(mockCache.On("RemoveStroke", mock.Anything, "example.com", strokeId).Return(nil).Once())
+	mockCache.On("Publish", mock.Anything, "page:example.com", mock.Anything).Return(nil).Maybe()
+
+	assert.NoError(t, svc.SetStrokeHidden(ctx, models.User{Id: "admin"}, "example.com", strokeId, true))
+
+	select {
+	case <-removed:
+	case <-time.After(1 * time.Second):
+		t.Fatal("hidden stroke was not removed from the cache")
+	}
+	mockStore.AssertExpectations(t)
+}
+
+func TestSetStrokeHidden_Restore(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	svc.Config.AdminUserIds = []string{"admin"}
+	ctx := context.Background()
+	strokeId := "00000000-0000-7000-8000-000000000001"
+
+	mockStore.On("GetStroke", ctx, "example.com", strokeId).Return(models.Stroke{Id: strokeId, UserId: "user2", Hidden: true}, nil)
+	mockStore.On("SetStrokeHidden", ctx, "example.com", strokeId, false).Return(nil).Once()
+	mockCache.On("InvalidatePages", ctx, []string{"example.com"}).Return(nil).Once()
+	mockCache.On("Publish", mock.Anything, "page:example.com", mock.Anything).Return(nil).Maybe()
+
+	assert.NoError(t, svc.SetStrokeHidden(ctx, models.User{Id: "admin"}, "example.com", strokeId, false))
+	mockStore.AssertExpectations(t)
+	mockCache.AssertExpectations(t)
+	mockCache.AssertNotCalled(t, "RemoveStroke", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestSetStrokeHidden_Rejected(t *testing.T) {
+	svc, mockStore, _, _, _, _ := setupService(t)
+	svc.Config.AdminUserIds = []string{"admin"}
+	ctx := context.Background()
+
+	mockStore.On("GetStroke", ctx, "example.com", "missing").Return(models.Stroke{}, store.ErrItemNotFound)
+
+	assert.ErrorIs(t, svc.SetStrokeHidden(ctx, models.User{Id: "user1"}, "example.com", "stroke1", true), service.ErrNotAdmin)
+	assert.ErrorIs(t, svc.SetStrokeHidden(ctx, models.User{Id: "admin"}, "example.com", "missing", true), service.ErrStrokeNotFound)
+	mockStore.AssertNotCalled(t, "SetStrokeHidden", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestLoadPageAdmin_IncludesHiddenStrokes(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	svc.Config.AdminUserIds = []string{"admin"}
+	ctx := context.Background()
+
+	stored := []models.Stroke{
+		{Id: "00000000-0000-7000-8000-000000000001", Content: []byte("data1")},
+		{Id: "00000000-0000-7000-8000-000000000002", Content: []byte("data2"), Hidden: true},
+	}
+	mockStore.On("GetStrokeRecords", ctx, "example.com", mock.Anything).Return(stored, nil)
+
+	strokes, err := svc.LoadPageAdmin(ctx, models.User{Id: "admin"}, "example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, stored, strokes)
+	// Read straight from the store, so hidden strokes never reach the cache
+	mockCache.AssertNotCalled(t, "AddStrokesBatch", mock.Anything, mock.Anything, mock.Anything)
+
+	_, err = svc.LoadPageAdmin(ctx, models.User{Id: "user1"}, "example.com")
+	assert.ErrorIs(t, err, service.ErrNotAdmin)
+}
@@ -11,9 +11,11 @@ import (
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/zlnvch/webverse/models"
+	"github.com/zlnvch/webverse/service"
 	"golang.org/x/oauth2"
 )
 
@@ -45,6 +47,147 @@ func TestVerifyJWT_Invalid(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestVerifyJWT_PreviousSecretDuringRotation(t *testing.T) {
+	svc, _, _, _, _, _ := setupService(t)
+	oldToken, err := svc.CreateJWT("user123", "google", "p123")
+	assert.NoError(t, err)
+
+	// Rotated: the old secret is kept after the new one
+	svc.JWTSecrets = [][]byte{[]byte("new-secret"), []byte("secret")}
+	gotId, _, _, _, err := svc.VerifyJWT(oldToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "user123", gotId)
+
+	// New tokens are signed with the new secret only
+	newToken, err := svc.CreateJWT("user123", "google", "p123")
+	assert.NoError(t, err)
+	svc.JWTSecrets = [][]byte{[]byte("new-secret")}
+	_, _, _, _, err = svc.VerifyJWT(newToken)
+	assert.NoError(t, err)
+
+	// Once the old secret is dropped its tokens are rejected
+	_, _, _, _, err = svc.VerifyJWT(oldToken)
+	assert.Error(t, err)
+}
+
+func TestVerifyJWT_UnknownKeyId(t *testing.T) {
+	svc, _, _, _, _, _ := setupService(t)
+	claims := jwt.MapClaims{"id": "user123", "provider": "google", "providerId": "p123", "exp": time.Now().Add(time.Hour).Unix()}
+
+	// Signed with a secret in the keyring, but naming another one
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = "0123456789abcdef"
+	signed, err := token.SignedString([]byte("secret"))
+	assert.NoError(t, err)
+
+	_, _, _, _, err = svc.VerifyJWT(signed)
+	assert.ErrorContains(t, err, "unknown kid")
+}
+
+func TestVerifyJWT_SelectsSecretByKeyId(t *testing.T) {
+	svc, _, _, _, _, _ := setupService(t)
+	svc.JWTSecrets = [][]byte{[]byte("new-secret"), []byte("secret")}
+
+	signed, err := svc.CreateJWT("user123", "google", "p123")
+	assert.NoError(t, err)
+	parsed, _, err := jwt.NewParser().ParseUnverified(signed, jwt.MapClaims{})
+	assert.NoError(t, err)
+	kid := parsed.Header["kid"]
+	assert.NotEmpty(t, kid)
+
+	// Another keyring ordering still finds the signing secret by its kid
+	svc.JWTSecrets = [][]byte{[]byte("secret"), []byte("new-secret")}
+	_, _, _, _, err = svc.VerifyJWT(signed)
+	assert.NoError(t, err)
+
+	// The same kid can't pass for another secret
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, parsed.Claims)
+	token.Header["kid"] = kid
+	forged, err := token.SignedString([]byte("secret"))
+	assert.NoError(t, err)
+	_, _, _, _, err = svc.VerifyJWT(forged)
+	assert.ErrorIs(t, err, jwt.ErrSignatureInvalid)
+}
+
+func TestVerifyJWT_LegacyTokenWithoutKeyId(t *testing.T) {
+	svc, _, _, _, _, _ := setupService(t)
+	svc.JWTSecrets = [][]byte{[]byte("new-secret"), []byte("secret")}
+	claims := jwt.MapClaims{"id": "user123", "provider": "google", "providerId": "p123", "exp": time.Now().Add(time.Hour).Unix()}
+
+	// Issued before tokens carried a kid
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+	assert.NoError(t, err)
+
+	gotId, _, _, _, err := svc.VerifyJWT(signed)
+	assert.NoError(t, err)
+	assert.Equal(t, "user123", gotId)
+}
+
+func TestVerifyJWT_IssuerAndAudience(t *testing.T) {
+	svc, _, _, _, _, _ := setupService(t)
+	svc.Config.JWTIssuer = "https://api.webverse.example"
+	svc.Config.JWTAudience = "webverse-extension"
+
+	signed, err := svc.CreateJWT("user123", "google", "p123")
+	assert.NoError(t, err)
+	parsed, _, err := jwt.NewParser().ParseUnverified(signed, jwt.MapClaims{})
+	assert.NoError(t, err)
+	claims := parsed.Claims.(jwt.MapClaims)
+	assert.Equal(t, "https://api.webverse.example", claims["iss"])
+	assert.Equal(t, "webverse-extension", claims["aud"])
+
+	gotId, _, _, _, err := svc.VerifyJWT(signed)
+	assert.NoError(t, err)
+	assert.Equal(t, "user123", gotId)
+
+	// Another deployment sharing the secret
+	other := *svc
+	other.Config.JWTIssuer = "https://api.other.example"
+	otherIssuer, err := other.CreateJWT("user123", "google", "p123")
+	assert.NoError(t, err)
+	_, _, _, _, err = svc.VerifyJWT(otherIssuer)
+	assert.ErrorIs(t, err, jwt.ErrTokenInvalidIssuer)
+
+	other.Config.JWTIssuer = svc.Config.JWTIssuer
+	other.Config.JWTAudience = "other-client"
+	otherAudience, err := other.CreateJWT("user123", "google", "p123")
+	assert.NoError(t, err)
+	_, _, _, _, err = svc.VerifyJWT(otherAudience)
+	assert.ErrorIs(t, err, jwt.ErrTokenInvalidAudience)
+}
+
+func TestVerifyJWT_MissingIssuerAndAudience(t *testing.T) {
+	svc, _, _, _, _, _ := setupService(t)
+
+	// Issued before the claims were configured
+	signed, err := svc.CreateJWT("user123", "google", "p123")
+	assert.NoError(t, err)
+
+	svc.Config.JWTIssuer = "https://api.webverse.example"
+	_, _, _, _, err = svc.VerifyJWT(signed)
+	assert.ErrorIs(t, err, jwt.ErrTokenRequiredClaimMissing)
+
+	svc.Config.JWTIssuer = ""
+	svc.Config.JWTAudience = "webverse-extension"
+	_, _, _, _, err = svc.VerifyJWT(signed)
+	assert.ErrorIs(t, err, jwt.ErrTokenRequiredClaimMissing)
+}
+
+func TestNewService_RequiresJWTSecret(t *testing.T) {
+	_, err := service.NewService(nil, nil, nil, nil, nil, nil, nil, service.DefaultConfig())
+	assert.EqualError(t, err, "at least one jwt secret is required")
+}
+
+func TestNewService_FillsProviderEndpoints(t *testing.T) {
+	svc, err := service.NewService(nil, nil, nil, nil, nil, map[string]*oauth2.Config{"github": {ClientID: "id"}}, [][]byte{[]byte("secret")}, service.DefaultConfig())
+	assert.NoError(t, err)
+
+	conf := svc.OAuthConfigs["github"]
+	assert.Equal(t, "id", conf.ClientID)
+	assert.Equal(t, "https://github.com/login/oauth/access_token", conf.Endpoint.TokenURL)
+	assert.Equal(t, "https://api.github.com/user", conf.UserInfoURL)
+}
+
 func TestVerifyJWT_Empty(t *testing.T) {
 	svc, _, _, _, _, _ := setupService(t)
 
@@ -117,13 +260,16 @@ func TestHandleOauth_TokenExchangeFails(t *testing.T) {
 	}))
 	defer server.Close()
 
-	oauthConfigs := map[string]*oauth2.Config{
+	oauthConfigs := map[string]service.OAuthConfig{
 		"github": {
-			Endpoint: oauth2.Endpoint{
-				AuthURL:  server.URL + "/auth",
-				TokenURL: server.URL + "/token",
+			Config: &oauth2.Config{
+				Endpoint: oauth2.Endpoint{
+					AuthURL:  server.URL + "/auth",
+					TokenURL: server.URL + "/token",
+				},
+				RedirectURL: "http://localhost/callback",
 			},
-			RedirectURL: "http://localhost/callback",
+			UserInfoURL: server.URL + "/userinfo",
 		},
 	}
 
@@ -134,23 +280,200 @@ func TestHandleOauth_TokenExchangeFails(t *testing.T) {
 	assert.Error(t, err)
 }
 
-// Note: HandleOauth and TestLogin tests below cannot work properly because oauthAPIs uses hardcoded URLs
-// These would require either:
-// 1. Modifying the service code to inject oauthAPIs
-// 2. Using an HTTP proxy to intercept requests
-// 3. Integration tests with real OAuth providers
-// The existing TestHandleOauth_UnsupportedProvider and TestHandleOauth_TokenExchangeFails cover the testable error paths
+// Helper that points the provider's OAuth endpoints at the server
+func useOauthServer(svc *service.Service, provider string, server *httptest.Server) {
+	svc.OAuthConfigs = map[string]service.OAuthConfig{
+		provider: {
+			Config:      &oauth2.Config{Endpoint: oauth2.Endpoint{AuthURL: server.URL + "/auth", TokenURL: server.URL + "/token"}},
+			UserInfoURL: server.URL + "/userinfo",
+		},
+	}
+}
+
+func TestLogin_OAuthFails(t *testing.T) {
+	svc, mockStore, _, _, _, _ := setupService(t)
+
+	_, _, err := svc.Login(context.Background(), "unsupported", "code")
+	assert.ErrorIs(t, err, service.ErrOAuthFailed)
+	assert.ErrorIs(t, err, service.ErrUnsupportedProvider)
+	mockStore.AssertNotCalled(t, "CreateUser", mock.Anything, mock.Anything)
+}
 
 func TestLogin_CreateUserFails(t *testing.T) {
-	t.Skip("Cannot test without mocking HandleOauth properly")
+	server := newOauthServer(t, `{"login":"alice","id":42}`)
+	svc, mockStore, _, _, _, _ := setupService(t)
+	useOauthServer(svc, "github", server)
+
+	storeErr := errors.New("dynamodb unavailable")
+	mockStore.On("CreateUser", mock.Anything, mock.Anything).Return(models.User{}, storeErr)
+
+	_, _, err := svc.Login(context.Background(), "github", "code")
+	assert.ErrorIs(t, err, service.ErrCreateUserFailed)
+	assert.ErrorIs(t, err, storeErr)
 }
 
 func TestLogin_TokenGenerationFails(t *testing.T) {
-	t.Skip("Cannot test without mocking HandleOauth properly")
+	t.Skip("HS256 signing with a []byte secret cannot fail")
 }
 
 func TestLogin_Success(t *testing.T) {
-	t.Skip("Cannot test without mocking HandleOauth properly")
+	server := newOauthServer(t, `{"login":"alice","id":42}`)
+	svc, mockStore, _, _, _, _ := setupService(t)
+	useOauthServer(svc, "github", server)
+
+	providerUser := models.User{Provider: "github", ProviderId: "42", Username: "alice"}
+	mockStore.On("CreateUser", mock.Anything, providerUser).Return(models.User{Id: "user1", Provider: "github", ProviderId: "42", Username: "alice"}, nil)
+
+	user, token, err := svc.Login(context.Background(), "github", "code")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token)
+	assert.Equal(t, "user1", user.Id)
+}
+
+func TestLoginProviderUser_RefreshesRenamedUsername(t *testing.T) {
+	svc, mockStore, _, _, _, _ := setupService(t)
+	ctx := context.Background()
+
+	// Same GitHub account (stable id), renamed from alice to alice2
+	providerUser := models.User{Provider: "github", ProviderId: "42", Username: "alice2"}
+	stored := models.User{Id: "user1", Provider: "github", ProviderId: "42", Username: "alice"}
+	mockStore.On("CreateUser", ctx, providerUser).Return(stored, nil)
+	mockStore.On("UpdateUsername", ctx, "github", "42", "alice2").Return(nil)
+
+	user, token, err := svc.LoginProviderUser(ctx, providerUser)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token)
+	assert.Equal(t, "user1", user.Id)
+	assert.Equal(t, "alice2", user.Username)
+	mockStore.AssertExpectations(t)
+}
+
+func TestLoginProviderUser_UnchangedUsername(t *testing.T) {
+	svc, mockStore, _, _, _, _ := setupService(t)
+	ctx := context.Background()
+
+	providerUser := models.User{Provider: "github", ProviderId: "42", Username: "alice"}
+	mockStore.On("CreateUser", ctx, providerUser).Return(models.User{Id: "user1", Provider: "github", ProviderId: "42", Username: "alice"}, nil)
+
+	_, _, err := svc.LoginProviderUser(ctx, providerUser)
+	assert.NoError(t, err)
+	mockStore.AssertNotCalled(t, "UpdateUsername", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestLoginProviderUser_UsernameUpdateFails(t *testing.T) {
+	svc, mockStore, _, _, _, _ := setupService(t)
+	ctx := context.Background()
+
+	providerUser := models.User{Provider: "github", ProviderId: "42", Username: "alice2"}
+	mockStore.On("CreateUser", ctx, providerUser).Return(models.User{Id: "user1", Provider: "github", ProviderId: "42", Username: "alice"}, nil)
+	mockStore.On("UpdateUsername", ctx, "github", "42", "alice2").Return(errors.New("dynamodb unavailable"))
+
+	// Login still succeeds with the stored username
+	user, token, err := svc.LoginProviderUser(ctx, providerUser)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token)
+	assert.Equal(t, "alice", user.Username)
+}
+
+// Helper that serves a successful token exchange and the given user info payload
+func newOauthServer(t *testing.T, userInfo string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/token":
+			w.Write([]byte(`{"access_token":"access","token_type":"bearer"}`))
+		case "/userinfo":
+			w.Write([]byte(userInfo))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestLogin_GoogleEmailNotVerified(t *testing.T) {
+	server := newOauthServer(t, `{"sub":"123","email":"alice@example.com","email_verified":false}`)
+
+	svc, mockStore, _, _, _, _ := setupService(t)
+	svc.OAuthConfigs = map[string]service.OAuthConfig{
+		"google": {
+			Config:      &oauth2.Config{Endpoint: oauth2.Endpoint{AuthURL: server.URL + "/auth", TokenURL: server.URL + "/token"}},
+			UserInfoURL: server.URL + "/userinfo",
+		},
+	}
+
+	_, _, err := svc.Login(context.Background(), "google", "code")
+	assert.ErrorIs(t, err, service.ErrEmailNotVerified)
+	mockStore.AssertNotCalled(t, "CreateUser", mock.Anything, mock.Anything)
+}
+
+func TestLogin_GoogleEmailVerified(t *testing.T) {
+	server := newOauthServer(t, `{"sub":"123","email":"alice@example.com","email_verified":true}`)
+
+	svc, mockStore, _, _, _, _ := setupService(t)
+	svc.OAuthConfigs = map[string]service.OAuthConfig{
+		"google": {
+			Config:      &oauth2.Config{Endpoint: oauth2.Endpoint{AuthURL: server.URL + "/auth", TokenURL: server.URL + "/token"}},
+			UserInfoURL: server.URL + "/userinfo",
+		},
+	}
+
+	providerUser := models.User{Provider: "google", ProviderId: "123", Username: "alice@example.com"}
+	mockStore.On("CreateUser", mock.Anything, providerUser).Return(models.User{Id: "user1", Provider: "google", ProviderId: "123", Username: "alice@example.com"}, nil)
+
+	user, token, err := svc.Login(context.Background(), "google", "code")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token)
+	assert.Equal(t, "user1", user.Id)
+}
+
+// Helper that serves the OAuth endpoints, stalling on the given path until the test ends
+func newStallingOauthServer(t *testing.T, stallPath string) *httptest.Server {
+	stop := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == stallPath {
+			select {
+			case <-stop:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/token":
+			w.Write([]byte(`{"access_token":"access","token_type":"bearer"}`))
+		case "/userinfo":
+			w.Write([]byte(`{"login":"alice","id":42}`))
+		}
+	}))
+	t.Cleanup(func() {
+		close(stop)
+		server.Close()
+	})
+	return server
+}
+
+func TestHandleOauth_Timeout(t *testing.T) {
+	for _, stallPath := range []string{"/token", "/userinfo"} {
+		t.Run(stallPath, func(t *testing.T) {
+			server := newStallingOauthServer(t, stallPath)
+
+			svc, _, _, _, _, _ := setupService(t)
+			svc.Config.OAuthTimeout = 50 * time.Millisecond
+			svc.OAuthConfigs = map[string]service.OAuthConfig{
+				"github": {
+					Config:      &oauth2.Config{Endpoint: oauth2.Endpoint{AuthURL: server.URL + "/auth", TokenURL: server.URL + "/token"}},
+					UserInfoURL: server.URL + "/userinfo",
+				},
+			}
+
+			start := time.Now()
+			_, err := svc.HandleOauth(context.Background(), "github", "code")
+			assert.ErrorContains(t, err, "Client.Timeout exceeded")
+			assert.Less(t, time.Since(start), time.Second)
+		})
+	}
 }
 
 func TestHandleOauth_HTTPRequestFails(t *testing.T) {
@@ -215,6 +538,7 @@ func TestDeleteUser_Success(t *testing.T) {
 	mockStore.On("DeleteUser", ctx, user.Provider, user.ProviderId).Return(nil)
 
 	// 2. Async Expectations with channel synchronization
+	clearRecentDone := wrapMockWithSignal(mockCache.On("ClearRecentPages", mock.Anything, "user1").Return(nil))
 	publishDone := wrapMockWithSignal(mockCache.On("Publish", mock.Anything, "user-deleted", mock.MatchedBy(func(msg []byte) bool {
 		return string(msg) == `{"UserId":"user1"}`
 	})).Return(nil))
@@ -227,6 +551,12 @@ func TestDeleteUser_Success(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Wait for async operations to complete
+	select {
+	case <-clearRecentDone:
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "timed out waiting for ClearRecentPages")
+	}
+
 	select {
 	case <-publishDone:
 	case <-time.After(1 * time.Second):
@@ -253,6 +583,7 @@ func TestDeleteUser_AsyncPublishFails(t *testing.T) {
 	mockStore.On("DeleteUser", ctx, user.Provider, user.ProviderId).Return(nil)
 
 	// Publish fails in async goroutine
+	mockCache.On("ClearRecentPages", mock.Anything, mock.Anything).Return(nil)
 	mockCache.On("Publish", mock.Anything, "user-deleted", mock.Anything).Return(errors.New("pubsub failed"))
 	mockMQ.On("Send", mock.Anything, mock.Anything).Return(nil)
 
@@ -274,6 +605,7 @@ func TestDeleteUser_AsyncMQSendFails(t *testing.T) {
 
 	mockStore.On("DeleteUser", ctx, user.Provider, user.ProviderId).Return(nil)
 
+	mockCache.On("ClearRecentPages", mock.Anything, mock.Anything).Return(nil)
 	mockCache.On("Publish", mock.Anything, "user-deleted", mock.Anything).Return(nil)
 	// MQ send fails in async goroutine
 	mockMQ.On("Send", mock.Anything, mock.Anything).Return(errors.New("mq failed"))
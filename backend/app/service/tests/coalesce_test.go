@@ -0,0 +1,161 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	cachemocks "github.com/zlnvch/webverse/cache/mocks"
+	"github.com/zlnvch/webverse/models"
+	"github.com/zlnvch/webverse/service"
+)
+
+// Sets up the mocks of the draw path and returns the messages published to the pages' channels
+func mockCoalescedDraws(mockCache *cachemocks.MockCache) chan []byte {
+	mockCache.On("GetUserStrokeCount", mock.Anything, mock.Anything).Return(10, nil)
+	mockCache.On("IsPageComplete", mock.Anything, mock.Anything).Return(true, nil)
+	mockCache.On("GetPageStrokeCountFromZCard", mock.Anything, mock.Anything).Return(int64(100), nil)
+	mockCache.On("IncrementUserStrokeCount", mock.Anything, mock.Anything).Return(int64(11), nil)
+	mockCache.On("AddStroke", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(int64(7), nil)
+
+	published := make(chan []byte, 10)
+	mockCache.On("Publish", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		published <- args.Get(2).([]byte)
+	}).Return(nil)
+	return published
+}
+
+func coalescedDraw(t *testing.T, svc *service.Service, pageKey string, x int) string {
+	strokeId, err := svc.DrawStroke(context.Background(), service.DrawParams{
+		User:    models.User{Id: "user1", Provider: "google", ProviderId: "123"},
+		PageKey: pageKey,
+		Layer:   models.LayerPublic,
+		Stroke: models.Stroke{
+			Content: fmt.Appendf(nil, `{"tool":0,"color":"#000000","width":5,"startX":%d,"startY":0,"dx":[],"dy":[]}`, x),
+		},
+	})
+	assert.NoError(t, err)
+	return strokeId
+}
+
+func TestDrawStroke_CoalescesBroadcasts(t *testing.T) {
+	svc, _, mockCache, _, _, _ := setupService(t)
+	svc.Config.DrawCoalesceWindow = 50 * time.Millisecond
+	published := mockCoalescedDraws(mockCache)
+
+	var strokeIds []string
+	for x := range 3 {
+		strokeIds = append(strokeIds, coalescedDraw(t, svc, "example.com", x))
+	}
+
+	var msg service.NewStrokesMessage
+	select {
+	case msgBytes := <-published:
+		assert.NoError(t, json.Unmarshal(msgBytes, &msg))
+	case <-time.After(1 * time.Second):
+		t.Fatal("coalesced strokes were not published")
+	}
+	assert.Equal(t, "new_strokes", msg.Type)
+	assert.Equal(t, "example.com", msg.Data.PageKey)
+	assert.Equal(t, models.LayerPublic, msg.Data.Layer)
+	var gotIds []string
+	for _, stroke := range msg.Data.Strokes {
+		gotIds = append(gotIds, stroke.Stroke.Id)
+		assert.Equal(t, int64(7), stroke.Seq)
+	}
+	assert.ElementsMatch(t, strokeIds, gotIds)
+
+	// One message for the whole window
+	select {
+	case <-published:
+		t.Fatal("strokes were published more than once")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDrawStroke_CoalescesPerPage(t *testing.T) {
+	svc, _, mockCache, _, _, _ := setupService(t)
+	svc.Config.DrawCoalesceWindow = 50 * time.Millisecond
+	published := mockCoalescedDraws(mockCache)
+
+	coalescedDraw(t, svc, "example.com", 0)
+	coalescedDraw(t, svc, "other.com", 0)
+
+	var pageKeys []string
+	for range 2 {
+		select {
+		case msgBytes := <-published:
+			var msg service.NewStrokesMessage
+			assert.NoError(t, json.Unmarshal(msgBytes, &msg))
+			assert.Len(t, msg.Data.Strokes, 1)
+			pageKeys = append(pageKeys, msg.Data.PageKey)
+		case <-time.After(1 * time.Second):
+			t.Fatal("coalesced strokes were not published")
+		}
+	}
+	assert.ElementsMatch(t, []string{"example.com", "other.com"}, pageKeys)
+}
+
+func TestNewService_NegativeDrawCoalesceWindow(t *testing.T) {
+	config := service.DefaultConfig()
+	config.DrawCoalesceWindow = -time.Millisecond
+
+	_, err := service.NewService(nil, nil, nil, nil, nil, nil, [][]byte{[]byte("secret")}, config)
+	assert.EqualError(t, err, "draw coalesce window must not be negative")
+}
+
+func TestUndoStroke_DropsStrokeFromPendingBroadcast(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	svc.Config.DrawCoalesceWindow = 100 * time.Millisecond
+	published := mockCoalescedDraws(mockCache)
+	mockStore.On("DeleteStroke", mock.Anything, "example.com", mock.Anything, "user1").Return(nil)
+	mockCache.On("RemoveStroke", mock.Anything, "example.com", mock.Anything).Return(nil)
+	mockCache.On("DecrementUserStrokeCount", mock.Anything, "user1").Return(nil)
+
+	// Adding the page to the user's pages follows the broadcast, so it tells when a stroke is pending
+	unsetDefault(&mockCache.Mock, "AddUserPage")
+	drawsDone := make(chan struct{}, 2)
+	mockCache.On("AddUserPage", mock.Anything, "user1", "example.com").Run(func(args mock.Arguments) {
+		drawsDone <- struct{}{}
+	}).Return(nil)
+
+	undoneId := coalescedDraw(t, svc, "example.com", 0)
+	keptId := coalescedDraw(t, svc, "example.com", 1)
+	for range 2 {
+		select {
+		case <-drawsDone:
+		case <-time.After(1 * time.Second):
+			t.Fatal("draws did not finish")
+		}
+	}
+	err := svc.UndoStroke(context.Background(), service.UndoParams{
+		User:     models.User{Id: "user1", Provider: "google", ProviderId: "123"},
+		PageKey:  "example.com",
+		Layer:    models.LayerPublic,
+		LayerId:  "public",
+		StrokeId: undoneId,
+	})
+	assert.NoError(t, err)
+
+	// The delete is broadcast within the window, the new strokes when it ends without the undone one
+	var newStrokes *service.NewStrokesMessage
+	for newStrokes == nil {
+		select {
+		case msgBytes := <-published:
+			var msg service.NewStrokesMessage
+			assert.NoError(t, json.Unmarshal(msgBytes, &msg))
+			if msg.Type == "new_strokes" {
+				newStrokes = &msg
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatal("coalesced strokes were not published")
+		}
+	}
+	if assert.Len(t, newStrokes.Data.Strokes, 1) {
+		assert.Equal(t, keptId, newStrokes.Data.Strokes[0].Stroke.Id)
+	}
+}
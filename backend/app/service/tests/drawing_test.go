@@ -2,10 +2,12 @@ package service_test
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"testing"
 	"time"
 
+	"github.com/gofrs/uuid/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	cachemocks "github.com/zlnvch/webverse/cache/mocks"
@@ -13,6 +15,7 @@ import (
 	mqmocks "github.com/zlnvch/webverse/mq/mocks"
 	"github.com/zlnvch/webverse/service"
 	"github.com/zlnvch/webverse/store"
+	"github.com/zlnvch/webverse/store/memstore"
 	storemocks "github.com/zlnvch/webverse/store/mocks"
 	"github.com/zlnvch/webverse/worker"
 )
@@ -24,8 +27,8 @@ func setupService(t *testing.T) (*service.Service, *storemocks.MockStore, *cache
 	mockMQ := new(mqmocks.MockMQ)
 
 	// Real batchers are used; tests verify items are pushed to their channels
-	counterBatcher := worker.NewCounterBatcher(mockStore, 1000)
-	strokeBatcher := worker.NewStrokeBatcher(mockStore, 1000, counterBatcher)
+	counterBatcher := worker.NewCounterBatcher(mockStore, 1000, worker.DefaultCounterFlushUsers)
+	strokeBatcher := worker.NewStrokeBatcher(mockStore, 1000, worker.DefaultStrokeBufferSize, counterBatcher, nil)
 
 	svc, err := service.NewService(
 		mockStore,
@@ -34,13 +37,54 @@ func setupService(t *testing.T) (*service.Service, *storemocks.MockStore, *cache
 		strokeBatcher,
 		counterBatcher,
 		nil,
-		[]byte("secret"),
+		[][]byte{[]byte("secret")},
+		service.DefaultConfig(),
 	)
 	assert.NoError(t, err)
 
+	// Permissive defaults for guard checks on the draw path
+	// Tests that exercise a guard remove its default with unsetDefault first
+	mockCache.On("IsPagePaused", mock.Anything, mock.Anything).Return(false, nil).Maybe()
+	mockCache.On("IsUserBanned", mock.Anything, mock.Anything).Return(false, nil).Maybe()
+	mockCache.On("AddRecentPage", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil).Maybe()
+	mockCache.On("ClaimDrawHash", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return("", nil).Maybe()
+	mockCache.On("ReleaseDrawHash", mock.Anything, mock.Anything).Return(nil).Maybe()
+	mockCache.On("AddUserPage", mock.Anything, mock.Anything, mock.Anything).Return(nil).Maybe()
+	mockCache.On("GetPageSettings", mock.Anything, mock.Anything).Return(models.PageSettings{}, false, nil).Maybe()
+	mockCache.On("SetPageSettings", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil).Maybe()
+	mockStore.On("UpdateUserLastActive", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil).Maybe()
+
 	return svc, mockStore, mockCache, mockMQ, strokeBatcher, counterBatcher
 }
 
+// Helper that removes the default expectations registered by setupService for a method
+func unsetDefault(m *mock.Mock, method string) {
+	calls := m.ExpectedCalls[:0]
+	for _, call := range m.ExpectedCalls {
+		if call.Method != method {
+			calls = append(calls, call)
+		}
+	}
+	m.ExpectedCalls = calls
+}
+
+// Abuse reporter that records reports as "kind:userId:strokeId"
+type recordingReporter struct {
+	reports chan string
+}
+
+func newRecordingReporter() *recordingReporter {
+	return &recordingReporter{reports: make(chan string, 10)}
+}
+
+func (r *recordingReporter) ReportFutureUUID(userId string, strokeId string) {
+	r.reports <- "future_uuid:" + userId + ":" + strokeId
+}
+
+func (r *recordingReporter) ReportNotOwnerDelete(userId string, strokeId string) {
+	r.reports <- "not_owner_delete:" + userId + ":" + strokeId
+}
+
 // Helper that creates a channel and wraps a mock call to signal when it's called
 func wrapMockWithSignal(call *mock.Call) chan struct{} {
 	done := make(chan struct{})
@@ -82,8 +126,11 @@ func TestDrawStroke_Success(t *testing.T) {
 
 	// Mocks expectation for Async side effects - use channels for synchronization
 	incrementUserDone := wrapMockWithSignal(mockCache.On("IncrementUserStrokeCount", mock.Anything, user.Id).Return(int64(11), nil))
-	addStrokeDone := wrapMockWithSignal(mockCache.On("AddStroke", mock.Anything, pageKey, mock.Anything, mock.Anything, mock.Anything).Return(nil))
-	publishDone := wrapMockWithSignal(mockCache.On("Publish", mock.Anything, "page:"+pageKey, mock.Anything).Return(nil))
+	addStrokeDone := wrapMockWithSignal(mockCache.On("AddStroke", mock.Anything, pageKey, mock.Anything, mock.Anything, mock.Anything).Return(int64(7), nil))
+	published := make(chan []byte, 1)
+	mockCache.On("Publish", mock.Anything, "page:"+pageKey, mock.Anything).Run(func(args mock.Arguments) {
+		published <- args.Get(2).([]byte)
+	}).Return(nil)
 
 	strokeId, err := svc.DrawStroke(ctx, params)
 
@@ -113,8 +160,13 @@ func TestDrawStroke_Success(t *testing.T) {
 		assert.Fail(t, "timed out waiting for AddStroke")
 	}
 
+	// The broadcast carries the sequence number the cache assigned
 	select {
-	case <-publishDone:
+	case msgBytes := <-published:
+		var msg service.NewStrokeMessage
+		assert.NoError(t, json.Unmarshal(msgBytes, &msg))
+		assert.Equal(t, strokeId, msg.Data.Stroke.Id)
+		assert.Equal(t, int64(7), msg.Data.Seq)
 	case <-time.After(1 * time.Second):
 		assert.Fail(t, "timed out waiting for Publish")
 	}
@@ -147,7 +199,7 @@ func TestDrawStroke_AsyncAddStrokeFails(t *testing.T) {
 
 	// AddStroke fails in async goroutine
 	mockCache.On("IncrementUserStrokeCount", mock.Anything, user.Id).Return(int64(11), nil)
-	mockCache.On("AddStroke", mock.Anything, pageKey, mock.Anything, mock.Anything, mock.Anything).Return(errors.New("redis connection failed"))
+	mockCache.On("AddStroke", mock.Anything, pageKey, mock.Anything, mock.Anything, mock.Anything).Return(int64(0), errors.New("redis connection failed"))
 	mockCache.On("Publish", mock.Anything, "page:"+pageKey, mock.Anything).Return(nil)
 
 	strokeId, err := svc.DrawStroke(ctx, params)
@@ -192,7 +244,7 @@ func TestDrawStroke_AsyncPublishFails(t *testing.T) {
 
 	// Publish fails in async goroutine
 	mockCache.On("IncrementUserStrokeCount", mock.Anything, user.Id).Return(int64(11), nil)
-	mockCache.On("AddStroke", mock.Anything, pageKey, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockCache.On("AddStroke", mock.Anything, pageKey, mock.Anything, mock.Anything, mock.Anything).Return(int64(1), nil)
 	mockCache.On("Publish", mock.Anything, "page:"+pageKey, mock.Anything).Return(errors.New("pubsub failed"))
 
 	strokeId, err := svc.DrawStroke(ctx, params)
@@ -298,7 +350,7 @@ func TestDrawStroke_QuotaExceeded_Page_CacheMiss(t *testing.T) {
 
 	// 4. Store returns Max Limit
 	mockStore.On("GetPageStrokeCount", ctx, pageKey).Return(1000, nil)
-	mockStore.On("GetStrokeRecords", ctx, pageKey).Return([]models.Stroke{}, nil)
+	mockStore.On("GetVisibleStrokeRecords", ctx, pageKey, mock.Anything).Return([]models.Stroke{}, nil)
 
 	// 5. Service should update Cache with completion status
 	mockCache.On("SetPageComplete", ctx, pageKey).Return(nil)
@@ -315,6 +367,229 @@ func TestDrawStroke_QuotaExceeded_Page_CacheMiss(t *testing.T) {
 	mockCache.AssertNotCalled(t, "IncrementUserStrokeCount", mock.Anything, mock.Anything)
 }
 
+func TestDrawStroke_PagePaused(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+
+	params := service.DrawParams{
+		User:    models.User{Id: "user1"},
+		PageKey: "example.com",
+		Layer:   models.LayerPublic,
+		Stroke:  models.Stroke{Content: []byte(`{"tool":0,"color":"#000000","width":1,"startX":0,"startY":0,"dx":[],"dy":[]}`)},
+	}
+
+	unsetDefault(&mockCache.Mock, "IsPagePaused")
+	mockCache.On("IsPagePaused", ctx, "example.com").Return(true, nil)
+
+	_, err := svc.DrawStroke(ctx, params)
+	assert.ErrorIs(t, err, service.ErrPagePaused)
+
+	// Rejected before quota checks and before anything is persisted or broadcast
+	mockCache.AssertNotCalled(t, "GetUserStrokeCount", mock.Anything, mock.Anything)
+	mockCache.AssertNotCalled(t, "AddStroke", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	mockCache.AssertNotCalled(t, "Publish", mock.Anything, mock.Anything, mock.Anything)
+	mockStore.AssertNotCalled(t, "WriteStrokeBatch", mock.Anything, mock.Anything)
+}
+
+func TestDrawStroke_Redo_FutureUUIDReported(t *testing.T) {
+	svc, _, mockCache, _, _, _ := setupService(t)
+	reporter := newRecordingReporter()
+	svc.AbuseReporter = reporter
+	ctx := context.Background()
+
+	futureId, _ := uuid.NewV7AtTime(time.Now().Add(time.Hour))
+	user := models.User{Id: "user1"}
+	params := service.DrawParams{
+		User:    user,
+		PageKey: "example.com",
+		Layer:   models.LayerPublic,
+		IsRedo:  true,
+		Stroke:  models.Stroke{Id: futureId.String(), Content: []byte(`{"tool":0,"color":"#000000","width":1,"startX":0,"startY":0,"dx":[],"dy":[]}`)},
+	}
+
+	mockCache.On("GetUserStrokeCount", ctx, user.Id).Return(10, nil)
+	mockCache.On("IsPageComplete", ctx, "example.com").Return(true, nil)
+	mockCache.On("GetPageStrokeCountFromZCard", ctx, "example.com").Return(int64(100), nil)
+
+	_, err := svc.DrawStroke(ctx, params)
+	assert.EqualError(t, err, "redo stroke uuidv7 has time greater than current time")
+	assert.Equal(t, "future_uuid:user1:"+futureId.String(), <-reporter.reports)
+}
+
+func TestDrawStroke_PublicLayerIdNormalized(t *testing.T) {
+	svc, _, mockCache, _, strokeBatcher, _ := setupService(t)
+	ctx := context.Background()
+
+	user := models.User{Id: "user1"}
+	params := service.DrawParams{
+		User:    user,
+		PageKey: "example.com",
+		Layer:   models.LayerPublic,
+		LayerId: "bogus",
+		Stroke:  models.Stroke{Content: []byte(`{"tool":0,"color":"#000000","width":1,"startX":0,"startY":0,"dx":[],"dy":[]}`)},
+	}
+
+	mockCache.On("GetUserStrokeCount", ctx, user.Id).Return(10, nil)
+	mockCache.On("IsPageComplete", ctx, "example.com").Return(true, nil)
+	mockCache.On("GetPageStrokeCountFromZCard", ctx, "example.com").Return(int64(100), nil)
+	mockCache.On("IncrementUserStrokeCount", mock.Anything, user.Id).Return(int64(11), nil)
+	mockCache.On("AddStroke", mock.Anything, "example.com", mock.Anything, mock.Anything, mock.Anything).Return(int64(1), nil)
+	publishDone := wrapMockWithSignal(mockCache.On("Publish", mock.Anything, "page:example.com", mock.MatchedBy(func(msg []byte) bool {
+		var newStroke service.NewStrokeMessage
+		return json.Unmarshal(msg, &newStroke) == nil && newStroke.Data.LayerId == ""
+	})).Return(nil))
+
+	_, err := svc.DrawStroke(ctx, params)
+	assert.NoError(t, err)
+
+	select {
+	case item := <-strokeBatcher.WriteCh:
+		assert.Equal(t, "", item.Record.LayerId)
+	case <-time.After(100 * time.Millisecond):
+		assert.Fail(t, "timed out waiting for stroke batcher")
+	}
+
+	select {
+	case <-publishDone:
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "timed out waiting for Publish")
+	}
+}
+
+func TestDrawStroke_TracksRecentPage(t *testing.T) {
+	svc, _, mockCache, _, _, _ := setupService(t)
+	svc.Config.MaxRecentPages = 7
+	ctx := context.Background()
+
+	user := models.User{Id: "user1"}
+	params := service.DrawParams{
+		User:    user,
+		PageKey: "example.com",
+		Layer:   models.LayerPublic,
+		Stroke:  models.Stroke{Content: []byte(`{"tool":0,"color":"#000000","width":1,"startX":0,"startY":0,"dx":[],"dy":[]}`)},
+	}
+
+	mockCache.On("GetUserStrokeCount", ctx, user.Id).Return(10, nil)
+	mockCache.On("IsPageComplete", ctx, "example.com").Return(true, nil)
+	mockCache.On("GetPageStrokeCountFromZCard", ctx, "example.com").Return(int64(100), nil)
+	mockCache.On("IncrementUserStrokeCount", mock.Anything, user.Id).Return(int64(11), nil)
+	mockCache.On("AddStroke", mock.Anything, "example.com", mock.Anything, mock.Anything, mock.Anything).Return(int64(1), nil)
+	mockCache.On("Publish", mock.Anything, "page:example.com", mock.Anything).Return(nil)
+
+	unsetDefault(&mockCache.Mock, "AddRecentPage")
+	recentDone := wrapMockWithSignal(mockCache.On("AddRecentPage", mock.Anything, user.Id, "example.com", mock.Anything, 7).Return(nil))
+
+	_, err := svc.DrawStroke(ctx, params)
+	assert.NoError(t, err)
+
+	select {
+	case <-recentDone:
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "timed out waiting for AddRecentPage")
+	}
+}
+
+func TestDrawStroke_AddsPageToCachedUserPages(t *testing.T) {
+	svc, _, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+
+	user := models.User{Id: "user1"}
+	params := service.DrawParams{
+		User:    user,
+		PageKey: "example.com",
+		Layer:   models.LayerPublic,
+		Stroke:  models.Stroke{Content: []byte(`{"tool":0,"color":"#000000","width":1,"startX":0,"startY":0,"dx":[],"dy":[]}`)},
+	}
+
+	mockCache.On("GetUserStrokeCount", ctx, user.Id).Return(10, nil)
+	mockCache.On("IsPageComplete", ctx, "example.com").Return(true, nil)
+	mockCache.On("GetPageStrokeCountFromZCard", ctx, "example.com").Return(int64(100), nil)
+	mockCache.On("IncrementUserStrokeCount", mock.Anything, user.Id).Return(int64(11), nil)
+	mockCache.On("AddStroke", mock.Anything, "example.com", mock.Anything, mock.Anything, mock.Anything).Return(int64(1), nil)
+	mockCache.On("Publish", mock.Anything, "page:example.com", mock.Anything).Return(nil)
+
+	unsetDefault(&mockCache.Mock, "AddUserPage")
+	addDone := wrapMockWithSignal(mockCache.On("AddUserPage", mock.Anything, user.Id, "example.com").Return(nil))
+
+	_, err := svc.DrawStroke(ctx, params)
+	assert.NoError(t, err)
+
+	select {
+	case <-addDone:
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "timed out waiting for AddUserPage")
+	}
+}
+
+func TestDrawStroke_DuplicateReturnsSameId(t *testing.T) {
+	svc, _, mockCache, _, strokeBatcher, _ := setupService(t)
+	svc.Config.DrawDedupeWindow = 10 * time.Second
+	ctx := context.Background()
+
+	user := models.User{Id: "user1"}
+	params := service.DrawParams{
+		User:    user,
+		PageKey: "example.com",
+		Layer:   models.LayerPublic,
+		Stroke:  models.Stroke{Content: []byte(`{"tool":0,"color":"#000000","width":1,"startX":0,"startY":0,"dx":[],"dy":[]}`)},
+	}
+
+	mockCache.On("GetUserStrokeCount", ctx, user.Id).Return(10, nil)
+	mockCache.On("IsPageComplete", ctx, "example.com").Return(true, nil)
+	mockCache.On("GetPageStrokeCountFromZCard", ctx, "example.com").Return(int64(100), nil)
+	mockCache.On("IncrementUserStrokeCount", mock.Anything, user.Id).Return(int64(11), nil)
+	mockCache.On("AddStroke", mock.Anything, "example.com", mock.Anything, mock.Anything, mock.Anything).Return(int64(1), nil)
+	mockCache.On("Publish", mock.Anything, "page:example.com", mock.Anything).Return(nil)
+
+	// First draw claims the content hash, the retry finds the first draw's stroke id
+	var claimedHash, claimedId string
+	unsetDefault(&mockCache.Mock, "ClaimDrawHash")
+	mockCache.On("ClaimDrawHash", ctx, mock.Anything, mock.Anything, 10*time.Second).Run(func(args mock.Arguments) {
+		claimedHash = args.String(1)
+		claimedId = args.String(2)
+	}).Return("", nil).Once()
+
+	strokeId, err := svc.DrawStroke(ctx, params)
+	assert.NoError(t, err)
+	assert.Equal(t, claimedId, strokeId)
+
+	select {
+	case item := <-strokeBatcher.WriteCh:
+		assert.Equal(t, strokeId, item.Record.Stroke.Id)
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "timed out waiting for stroke batcher")
+	}
+
+	mockCache.On("ClaimDrawHash", ctx, claimedHash, mock.Anything, 10*time.Second).Return(strokeId, nil).Once()
+
+	retryId, err := svc.DrawStroke(ctx, params)
+	assert.NoError(t, err)
+	assert.Equal(t, strokeId, retryId)
+
+	// The duplicate never reaches the batcher
+	select {
+	case <-strokeBatcher.WriteCh:
+		assert.Fail(t, "duplicate draw was batched")
+	case <-time.After(100 * time.Millisecond):
+	}
+	mockCache.AssertNumberOfCalls(t, "IncrementUserStrokeCount", 1)
+}
+
+func TestDrawStroke_PrivateLayer_NonNumericLayerId(t *testing.T) {
+	svc, _, _, _, _, _ := setupService(t)
+
+	params := service.DrawParams{
+		User:    models.User{Id: "user1", KeyVersion: 1},
+		PageKey: "YWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWE=",
+		Layer:   models.LayerPrivate,
+		LayerId: "public",
+		Stroke:  models.Stroke{Content: []byte("ciphertext")},
+	}
+
+	_, err := svc.DrawStroke(context.Background(), params)
+	assert.EqualError(t, err, "invalid layer id")
+}
+
 func TestDrawStroke_PrivateLayer_KeyMismatch(t *testing.T) {
 	svc, _, _, _, _, _ := setupService(t)
 	ctx := context.Background()
@@ -350,7 +625,7 @@ func TestDrawStroke_PrivateLayer_KeyMatch(t *testing.T) {
 		PageKey: privateKey,
 		Layer:   models.LayerPrivate,
 		LayerId: "5", // Match!
-		Stroke:  models.Stroke{},
+		Stroke:  models.Stroke{Nonce: makeBase64(24)},
 	}
 
 	mockCache.On("GetUserStrokeCount", ctx, user.Id).Return(10, nil)
@@ -359,13 +634,38 @@ func TestDrawStroke_PrivateLayer_KeyMatch(t *testing.T) {
 
 	// Async expectations
 	mockCache.On("IncrementUserStrokeCount", mock.Anything, user.Id).Return(int64(11), nil)
-	mockCache.On("AddStroke", mock.Anything, privateKey, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockCache.On("AddStroke", mock.Anything, privateKey, mock.Anything, mock.Anything, mock.Anything).Return(int64(1), nil)
 	mockCache.On("Publish", mock.Anything, "page:"+privateKey, mock.Anything).Return(nil)
 
 	_, err := svc.DrawStroke(ctx, params)
 	assert.NoError(t, err)
 }
 
+func TestDrawStroke_PrivateLayer_InvalidNonce(t *testing.T) {
+	svc, _, _, _, _, _ := setupService(t)
+	ctx := context.Background()
+
+	params := service.DrawParams{
+		User:    models.User{Id: "user1", KeyVersion: 5},
+		PageKey: "YWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWE=",
+		Layer:   models.LayerPrivate,
+		LayerId: "5",
+	}
+
+	params.Stroke = models.Stroke{}
+	_, err := svc.DrawStroke(ctx, params)
+	assert.EqualError(t, err, "invalid nonce length, got 0 bits, want 192 bits")
+
+	// 96-bit AES-GCM nonce against the default XChaCha20 length
+	params.Stroke = models.Stroke{Nonce: makeBase64(12)}
+	_, err = svc.DrawStroke(ctx, params)
+	assert.EqualError(t, err, "invalid nonce length, got 96 bits, want 192 bits")
+
+	params.Stroke = models.Stroke{Nonce: "!!!"}
+	_, err = svc.DrawStroke(ctx, params)
+	assert.ErrorContains(t, err, "invalid nonce: invalid Base64")
+}
+
 // Extra check specifically for the variable shadowing bug
 func TestQuotaCheck_ShadowingRegression(t *testing.T) {
 	svc, mockStore, mockCache, _, _, _ := setupService(t)
@@ -378,7 +678,7 @@ func TestQuotaCheck_ShadowingRegression(t *testing.T) {
 	mockCache.On("IsPageComplete", ctx, pageKey).Return(false, nil)
 	mockCache.On("GetStrokes", ctx, pageKey).Return([][]byte{}, nil)
 	mockStore.On("GetPageStrokeCount", ctx, pageKey).Return(2000, nil)
-	mockStore.On("GetStrokeRecords", ctx, pageKey).Return([]models.Stroke{}, nil)
+	mockStore.On("GetVisibleStrokeRecords", ctx, pageKey, mock.Anything).Return([]models.Stroke{}, nil)
 	mockCache.On("SetPageComplete", ctx, pageKey).Return(nil)
 	mockCache.On("AddStrokesBatch", ctx, pageKey, mock.Anything).Return(nil)
 	mockCache.On("GetPageStrokeCountFromZCard", ctx, pageKey).Return(int64(2000), nil)
@@ -403,6 +703,7 @@ func TestQuotaCheck_ShadowingRegression(t *testing.T) {
 
 func TestUndoStroke_Success(t *testing.T) {
 	svc, mockStore, mockCache, _, strokeBatcher, _ := setupService(t)
+	svc.Config.DrawDedupeWindow = 10 * time.Second
 	ctx := context.Background()
 
 	user := models.User{Id: "user1"}
@@ -424,6 +725,8 @@ func TestUndoStroke_Success(t *testing.T) {
 
 	err := svc.UndoStroke(ctx, params)
 	assert.NoError(t, err)
+	// Released before returning, so a redraw right after the undo is not deduplicated
+	mockCache.AssertCalled(t, "ReleaseDrawHash", ctx, params.StrokeId)
 
 	// 3. Verify Batcher Delete Request
 	select {
@@ -490,6 +793,8 @@ func TestUndoStroke_AsyncCacheFails(t *testing.T) {
 
 func TestUndoStroke_NotOwner_Malicious(t *testing.T) {
 	svc, mockStore, mockCache, _, strokeBatcher, _ := setupService(t)
+	reporter := newRecordingReporter()
+	svc.AbuseReporter = reporter
 	ctx := context.Background()
 
 	user := models.User{Id: "malicious_user"}
@@ -509,6 +814,7 @@ func TestUndoStroke_NotOwner_Malicious(t *testing.T) {
 
 	// Should return error
 	assert.ErrorIs(t, err, store.ErrConditionFailed)
+	assert.Equal(t, "not_owner_delete:malicious_user:stroke_of_another_user", <-reporter.reports)
 
 	// 3. Verify Batcher Request still sent (optimistic delete)
 	select {
@@ -523,6 +829,109 @@ func TestUndoStroke_NotOwner_Malicious(t *testing.T) {
 	mockCache.AssertNotCalled(t, "RemoveStroke", mock.Anything, mock.Anything, mock.Anything)
 	mockCache.AssertNotCalled(t, "DecrementUserStrokeCount", mock.Anything, mock.Anything)
 	mockCache.AssertNotCalled(t, "Publish", mock.Anything, mock.Anything, mock.Anything)
+	mockCache.AssertNotCalled(t, "ReleaseDrawHash", mock.Anything, mock.Anything)
+}
+
+func TestUndoStroke_Precheck_NotFound(t *testing.T) {
+	svc, mockStore, mockCache, _, strokeBatcher, _ := setupService(t)
+	svc.Config.UndoPrecheck = true
+	reporter := newRecordingReporter()
+	svc.AbuseReporter = reporter
+	ctx := context.Background()
+
+	user := models.User{Id: "user1"}
+	params := service.UndoParams{
+		User:     user,
+		PageKey:  "example.com",
+		Layer:    models.LayerPublic,
+		StrokeId: "missing_stroke",
+	}
+
+	mockStore.On("GetStroke", ctx, params.PageKey, params.StrokeId).Return(models.Stroke{}, store.ErrItemNotFound)
+	// The stroke was still pending in the batcher, so it is undone like a stored one
+	removeStrokeDone := wrapMockWithSignal(mockCache.On("RemoveStroke", mock.Anything, params.PageKey, params.StrokeId).Return(nil))
+	mockCache.On("Publish", mock.Anything, "page:"+params.PageKey, mock.Anything).Return(nil)
+	decrementDone := wrapMockWithSignal(mockCache.On("DecrementUserStrokeCount", mock.Anything, user.Id).Return(nil))
+	go func() {
+		req := <-strokeBatcher.DeleteCh
+		assert.Equal(t, params.StrokeId, req.StrokeId)
+		req.Cancelled <- true
+	}()
+
+	err := svc.UndoStroke(ctx, params)
+	assert.NoError(t, err)
+
+	for _, done := range []chan struct{}{removeStrokeDone, decrementDone} {
+		select {
+		case <-done:
+		case <-time.After(1 * time.Second):
+			assert.Fail(t, "timed out waiting for undo side effects")
+		}
+	}
+
+	// Not a strike against the user
+	select {
+	case report := <-reporter.reports:
+		assert.Fail(t, "unexpected abuse report", report)
+	case <-time.After(50 * time.Millisecond):
+	}
+	mockStore.AssertNotCalled(t, "DeleteStroke", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestUndoStroke_Precheck_UnknownStrokesLeaveCountsAlone(t *testing.T) {
+	svc, mockStore, mockCache, _, strokeBatcher, _ := setupService(t)
+	svc.Config.UndoPrecheck = true
+	svc.Config.DrawDedupeWindow = 10 * time.Second
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go strokeBatcher.Run(ctx)
+
+	user := models.User{Id: "user1"}
+	mockStore.On("GetStroke", ctx, "example.com", mock.Anything).Return(models.Stroke{}, store.ErrItemNotFound)
+
+	// Neither in the store nor pending in the batcher, so nothing was removed
+	for _, strokeId := range []string{"unknown_stroke_1", "unknown_stroke_2", "unknown_stroke_1"} {
+		err := svc.UndoStroke(ctx, service.UndoParams{
+			User:     user,
+			PageKey:  "example.com",
+			Layer:    models.LayerPublic,
+			StrokeId: strokeId,
+		})
+		assert.ErrorIs(t, err, service.ErrStrokeNotFound)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	mockCache.AssertNotCalled(t, "DecrementUserStrokeCount", mock.Anything, mock.Anything)
+	mockCache.AssertNotCalled(t, "RemoveStroke", mock.Anything, mock.Anything, mock.Anything)
+	mockCache.AssertNotCalled(t, "Publish", mock.Anything, mock.Anything, mock.Anything)
+	mockCache.AssertNotCalled(t, "ReleaseDrawHash", mock.Anything, mock.Anything)
+}
+
+func TestUndoStroke_Precheck_NotOwner(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	svc.Config.UndoPrecheck = true
+	reporter := newRecordingReporter()
+	svc.AbuseReporter = reporter
+	ctx := context.Background()
+
+	user := models.User{Id: "malicious_user"}
+	params := service.UndoParams{
+		User:     user,
+		PageKey:  "example.com",
+		Layer:    models.LayerPublic,
+		StrokeId: "stroke_of_another_user",
+	}
+
+	mockStore.On("GetStroke", ctx, params.PageKey, params.StrokeId).Return(models.Stroke{Id: params.StrokeId, UserId: "user2"}, nil)
+
+	err := svc.UndoStroke(ctx, params)
+	assert.ErrorIs(t, err, service.ErrNotStrokeOwner)
+	assert.Equal(t, "not_owner_delete:malicious_user:stroke_of_another_user", <-reporter.reports)
+
+	time.Sleep(50 * time.Millisecond)
+	mockStore.AssertNotCalled(t, "DeleteStroke", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	mockCache.AssertNotCalled(t, "RemoveStroke", mock.Anything, mock.Anything, mock.Anything)
+	mockCache.AssertNotCalled(t, "Publish", mock.Anything, mock.Anything, mock.Anything)
 }
 
 func TestUndoStroke_PrivateLayer_InvalidKey(t *testing.T) {
@@ -600,7 +1009,7 @@ func TestEnforceUserAndPageQuota_UserCacheMiss_DBSeedsCache(t *testing.T) {
 
 	// Async expectations
 	mockCache.On("IncrementUserStrokeCount", mock.Anything, user.Id).Return(int64(501), nil)
-	mockCache.On("AddStroke", mock.Anything, "example.com", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockCache.On("AddStroke", mock.Anything, "example.com", mock.Anything, mock.Anything, mock.Anything).Return(int64(1), nil)
 	mockCache.On("Publish", mock.Anything, "page:example.com", mock.Anything).Return(nil)
 
 	params := service.DrawParams{
@@ -614,3 +1023,131 @@ func TestEnforceUserAndPageQuota_UserCacheMiss_DBSeedsCache(t *testing.T) {
 	_, err := svc.DrawStroke(ctx, params)
 	assert.NoError(t, err)
 }
+
+// End to end: the batcher's flush publishes the ack for the user's connections
+func TestPublishStrokesPersisted_AfterFlush(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	mockCache := new(cachemocks.MockCache)
+	counterBatcher := worker.NewCounterBatcher(memStore, 60000, worker.DefaultCounterFlushUsers)
+	strokeBatcher := worker.NewStrokeBatcher(memStore, 10, worker.DefaultStrokeBufferSize, counterBatcher, nil)
+	svc, err := service.NewService(memStore, mockCache, new(mqmocks.MockMQ), strokeBatcher, counterBatcher, nil, [][]byte{[]byte("secret")}, service.DefaultConfig())
+	assert.NoError(t, err)
+	strokeBatcher.OnPersisted = svc.PublishStrokesPersisted
+
+	strokeId := "018e38d7-0000-7000-8000-000000000001"
+	publishDone := wrapMockWithSignal(mockCache.On("Publish", mock.Anything, "user-strokes-persisted", mock.MatchedBy(func(msg []byte) bool {
+		return string(msg) == `{"UserId":"user1","StrokeIds":["`+strokeId+`"]}`
+	})).Return(nil).Once())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go strokeBatcher.Run(ctx)
+
+	strokeBatcher.Enqueue(worker.BatchedStroke{
+		Record: models.StrokeRecord{PageKey: "example.com", Stroke: models.Stroke{Id: strokeId, UserId: "user1"}},
+	})
+
+	select {
+	case <-publishDone:
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "timed out waiting for user-strokes-persisted publish")
+	}
+	strokes, _ := memStore.GetStrokeRecords(context.Background(), "example.com", 1100)
+	assert.Len(t, strokes, 1)
+}
+
+func TestDrawStroke_PageCreationLimit(t *testing.T) {
+	svc, _, mockCache, _, _, _ := setupService(t)
+	svc.Config.MaxUserPages = 2
+	ctx := context.Background()
+	user := models.User{Id: "user1"}
+	content := []byte(`{"tool":0,"color":"#000000","width":5,"startX":0,"startY":0,"dx":[],"dy":[]}`)
+
+	mockCache.On("GetUserStrokeCount", ctx, user.Id).Return(10, nil)
+	mockCache.On("IsPageComplete", ctx, mock.Anything).Return(true, nil)
+	mockCache.On("GetPageStrokeCountFromZCard", ctx, mock.Anything).Return(int64(100), nil)
+	mockCache.On("GetUserPages", ctx, user.Id).Return([]string{"a.com", "b.com"}, true, nil)
+	mockCache.On("IncrementUserStrokeCount", mock.Anything, user.Id).Return(int64(11), nil).Maybe()
+	mockCache.On("AddStroke", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(int64(1), nil).Maybe()
+	mockCache.On("Publish", mock.Anything, mock.Anything, mock.Anything).Return(nil).Maybe()
+
+	// At the cap, a new page is rejected while the user's pages still take strokes
+	_, err := svc.DrawStroke(ctx, service.DrawParams{User: user, PageKey: "c.com", Layer: models.LayerPublic, Stroke: models.Stroke{Content: content}})
+	assert.ErrorIs(t, err, service.ErrPageCreationLimit)
+
+	_, err = svc.DrawStroke(ctx, service.DrawParams{User: user, PageKey: "a.com", Layer: models.LayerPublic, Stroke: models.Stroke{Content: content}})
+	assert.NoError(t, err)
+}
+
+func TestDrawStroke_PageCreationLimitRecomputesUncachedPages(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	svc.Config.MaxUserPages = 1
+	ctx := context.Background()
+	user := models.User{Id: "user1"}
+	content := []byte(`{"tool":0,"color":"#000000","width":5,"startX":0,"startY":0,"dx":[],"dy":[]}`)
+
+	mockCache.On("GetUserStrokeCount", ctx, user.Id).Return(10, nil)
+	mockCache.On("IsPageComplete", ctx, "b.com").Return(true, nil)
+	mockCache.On("GetPageStrokeCountFromZCard", ctx, "b.com").Return(int64(0), nil)
+	mockCache.On("GetUserPages", ctx, user.Id).Return([]string(nil), false, nil)
+	mockStore.On("GetUserPages", ctx, user.Id).Return([]string{"a.com"}, nil).Once()
+	mockCache.On("SetUserPages", ctx, user.Id, []string{"a.com"}, mock.Anything).Return(nil).Once()
+
+	_, err := svc.DrawStroke(ctx, service.DrawParams{User: user, PageKey: "b.com", Layer: models.LayerPublic, Stroke: models.Stroke{Content: content}})
+	assert.ErrorIs(t, err, service.ErrPageCreationLimit)
+	mockStore.AssertExpectations(t)
+	mockCache.AssertExpectations(t)
+}
+
+func TestDrawStroke_AsyncSideEffectsOutliveCallerContext(t *testing.T) {
+	svc, _, mockCache, _, strokeBatcher, _ := setupService(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	pageKey := "example.com"
+
+	mockCache.On("GetUserStrokeCount", mock.Anything, "user1").Return(0, nil)
+	mockCache.On("IsPageComplete", mock.Anything, pageKey).Return(true, nil)
+	mockCache.On("GetPageStrokeCountFromZCard", mock.Anything, pageKey).Return(int64(0), nil)
+
+	// Hold the side-effects until the caller's ctx was cancelled, like a websocket handler that returned
+	returned := make(chan struct{})
+	mockCache.On("IncrementUserStrokeCount", mock.Anything, "user1").Run(func(args mock.Arguments) {
+		<-returned
+	}).Return(int64(1), nil)
+	// The context is checked when it is used, async side-effects cancel their own once they are done
+	type ctxState struct {
+		err         error
+		hasDeadline bool
+	}
+	captureCtx := func(ch chan ctxState) func(mock.Arguments) {
+		return func(args mock.Arguments) {
+			ctx := args.Get(0).(context.Context)
+			_, hasDeadline := ctx.Deadline()
+			ch <- ctxState{err: ctx.Err(), hasDeadline: hasDeadline}
+		}
+	}
+	addStrokeCtx := make(chan ctxState, 1)
+	mockCache.On("AddStroke", mock.Anything, pageKey, mock.Anything, mock.Anything, mock.Anything).Run(captureCtx(addStrokeCtx)).Return(int64(1), nil)
+	publishCtx := make(chan ctxState, 1)
+	mockCache.On("Publish", mock.Anything, "page:"+pageKey, mock.Anything).Run(captureCtx(publishCtx)).Return(nil)
+
+	_, err := svc.DrawStroke(ctx, service.DrawParams{
+		User:    models.User{Id: "user1", Provider: "google", ProviderId: "123"},
+		PageKey: pageKey,
+		Layer:   models.LayerPublic,
+		Stroke:  models.Stroke{Content: []byte(`{"tool":0,"color":"#000000","width":5,"startX":0,"startY":0,"dx":[],"dy":[]}`)},
+	})
+	assert.NoError(t, err)
+	cancel()
+	close(returned)
+	<-strokeBatcher.WriteCh
+
+	for name, ch := range map[string]chan ctxState{"AddStroke": addStrokeCtx, "Publish": publishCtx} {
+		select {
+		case state := <-ch:
+			assert.NoError(t, state.err, "%s ran with a cancelled context", name)
+			assert.True(t, state.hasDeadline, "%s ran without a timeout", name)
+		case <-time.After(1 * time.Second):
+			assert.Fail(t, "timed out waiting for "+name)
+		}
+	}
+}
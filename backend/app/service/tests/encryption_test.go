@@ -3,6 +3,7 @@ package service_test
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"strings"
 	"testing"
@@ -12,6 +13,7 @@ import (
 	"github.com/stretchr/testify/mock"
 	"github.com/zlnvch/webverse/models"
 	"github.com/zlnvch/webverse/service"
+	"github.com/zlnvch/webverse/store"
 )
 
 // Helper to generate base64 string of specific byte length
@@ -66,6 +68,47 @@ func TestSetEncryptionKeys_Success(t *testing.T) {
 	mockMQ.AssertNotCalled(t, "Send", mock.Anything, mock.Anything)
 }
 
+func TestSetEncryptionKeys_PublishKeyMaterial(t *testing.T) {
+	for _, publishKeyMaterial := range []bool{false, true} {
+		svc, mockStore, mockCache, _, _, _ := setupService(t)
+		svc.Config.PublishKeyMaterial = publishKeyMaterial
+		ctx := context.Background()
+
+		user := models.User{Id: "user1"}
+		keys := service.EncryptionKeys{
+			SaltKEK:       "somesalt",
+			EncryptedDEK1: makeBase64(48),
+			NonceDEK1:     makeBase64(24),
+			EncryptedDEK2: makeBase64(48),
+			NonceDEK2:     makeBase64(24),
+		}
+
+		mockStore.On("SetUserEncryptionKeys", ctx, mock.Anything, true).Return(1, nil)
+
+		published := make(chan []byte, 1)
+		mockCache.On("Publish", mock.Anything, "user-keys-updated", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+			published <- args.Get(2).([]byte)
+		})
+
+		_, err := svc.SetEncryptionKeys(ctx, user, keys, true)
+		assert.NoError(t, err)
+
+		select {
+		case msgBytes := <-published:
+			var msg service.UserKeysUpdatedMessage
+			assert.NoError(t, json.Unmarshal(msgBytes, &msg))
+			assert.Equal(t, 1, msg.KeyVersion)
+			if publishKeyMaterial {
+				assert.Equal(t, &keys, msg.Keys)
+			} else {
+				assert.Nil(t, msg.Keys)
+			}
+		case <-time.After(1 * time.Second):
+			assert.Fail(t, "timed out waiting for Publish")
+		}
+	}
+}
+
 func TestSetEncryptionKeys_Validation(t *testing.T) {
 	svc, _, _, _, _, _ := setupService(t)
 	ctx := context.Background()
@@ -100,6 +143,32 @@ func TestSetEncryptionKeys_InvalidBase64(t *testing.T) {
 	assert.Contains(t, err.Error(), "invalid Base64")
 }
 
+func TestSetEncryptionKeys_ConfiguredNonceBits(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	svc.Config.NonceBits = 96
+	ctx := context.Background()
+
+	keys := service.EncryptionKeys{
+		SaltKEK:       "salt",
+		EncryptedDEK1: makeBase64(48),
+		NonceDEK1:     makeBase64(24),
+		EncryptedDEK2: makeBase64(48),
+		NonceDEK2:     makeBase64(24),
+	}
+
+	// 192-bit nonces are rejected once the deployment uses AES-GCM
+	_, err := svc.SetEncryptionKeys(ctx, models.User{Id: "user1"}, keys, true)
+	assert.EqualError(t, err, "NonceDEK1: invalid length, got 192 bits, want 96 bits")
+
+	keys.NonceDEK1 = makeBase64(12)
+	keys.NonceDEK2 = makeBase64(12)
+	mockStore.On("SetUserEncryptionKeys", ctx, mock.Anything, true).Return(1, nil)
+	mockCache.On("Publish", mock.Anything, "user-keys-updated", mock.Anything).Return(nil).Maybe()
+
+	_, err = svc.SetEncryptionKeys(ctx, models.User{Id: "user1"}, keys, true)
+	assert.NoError(t, err)
+}
+
 func TestSetEncryptionKeys_KeyReplacement(t *testing.T) {
 	svc, mockStore, mockCache, mockMQ, _, _ := setupService(t)
 	ctx := context.Background()
@@ -323,3 +392,146 @@ func TestDeleteEncryptionKeys_AsyncMQSendFails(t *testing.T) {
 	// Should still succeed (async errors don't affect return)
 	assert.NoError(t, err)
 }
+
+func TestUserKeysUpdatedMessage_Supersedes(t *testing.T) {
+	type keyState struct {
+		keyVersion  int
+		keysDeleted bool
+	}
+	apply := func(state keyState, msgs ...service.UserKeysUpdatedMessage) keyState {
+		for _, msg := range msgs {
+			if msg.Supersedes(state.keyVersion, state.keysDeleted) {
+				state = keyState{msg.KeyVersion, msg.KeysDeleted}
+			}
+		}
+		return state
+	}
+
+	set := func(v int) service.UserKeysUpdatedMessage {
+		return service.UserKeysUpdatedMessage{UserId: "user1", KeyVersion: v}
+	}
+	deleted := func(v int) service.UserKeysUpdatedMessage {
+		return service.UserKeysUpdatedMessage{UserId: "user1", KeyVersion: v, KeysDeleted: true}
+	}
+
+	t.Run("in order", func(t *testing.T) {
+		// Keys at 1, deleted, then new keys at 2
+		assert.Equal(t, keyState{2, false}, apply(keyState{1, false}, deleted(1), set(2)))
+	})
+
+	t.Run("older deletion after newer keys", func(t *testing.T) {
+		// The deletion of version 1 arrives after the keys set at version 2
+		assert.Equal(t, keyState{2, false}, apply(keyState{1, false}, set(2), deleted(1)))
+	})
+
+	t.Run("deletion at the same version", func(t *testing.T) {
+		assert.Equal(t, keyState{3, true}, apply(keyState{3, false}, deleted(3)))
+	})
+
+	t.Run("stale rotation after deletion", func(t *testing.T) {
+		// A rotation keeps the version, its message arriving late must not undo the deletion
+		assert.Equal(t, keyState{3, true}, apply(keyState{3, false}, deleted(3), set(3)))
+	})
+
+	t.Run("rotation at the same version", func(t *testing.T) {
+		assert.True(t, set(3).Supersedes(3, false))
+	})
+
+	t.Run("older keys ignored", func(t *testing.T) {
+		assert.Equal(t, keyState{4, false}, apply(keyState{4, false}, set(2), deleted(3)))
+	})
+
+	t.Run("new keys after connecting with deleted keys", func(t *testing.T) {
+		assert.Equal(t, keyState{2, false}, apply(keyState{1, true}, deleted(1), set(2)))
+	})
+}
+
+func TestRotateKEK_DoesNotDeleteStrokes(t *testing.T) {
+	svc, mockStore, mockCache, mockMQ, _, _ := setupService(t)
+	ctx := context.Background()
+
+	user := models.User{
+		Id:            "user1",
+		KeyVersion:    3,
+		SaltKEK:       "old_kek_salt",
+		EncryptedDEK1: "old_dek1",
+	}
+	rewrapped := service.WrappedDEKs{
+		EncryptedDEK1: makeBase64(48),
+		NonceDEK1:     makeBase64(24),
+		EncryptedDEK2: makeBase64(48),
+		NonceDEK2:     makeBase64(24),
+	}
+
+	// The key version is kept
+	mockStore.On("RotateUserKEK", ctx, mock.MatchedBy(func(u models.User) bool {
+		return u.SaltKEK == "new_kek_salt" && u.EncryptedDEK1 == rewrapped.EncryptedDEK1 && u.NonceDEK2 == rewrapped.NonceDEK2
+	}), 3).Return(nil)
+	publishDone := wrapMockWithSignal(mockCache.On("Publish", mock.Anything, "user-keys-updated", mock.Anything).Return(nil))
+
+	keyVersion, err := svc.RotateKEK(ctx, user, 3, "new_kek_salt", rewrapped)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, keyVersion)
+
+	select {
+	case <-publishDone:
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "timed out waiting for Publish")
+	}
+
+	// The data keys are unchanged, so strokes encrypted with them stay readable
+	mockMQ.AssertNotCalled(t, "Send", mock.Anything, mock.Anything)
+}
+
+func TestRotateKEK_Validation(t *testing.T) {
+	svc, mockStore, _, _, _, _ := setupService(t)
+	ctx := context.Background()
+
+	user := models.User{Id: "user1", KeyVersion: 1, SaltKEK: "old_kek_salt"}
+	rewrapped := service.WrappedDEKs{
+		EncryptedDEK1: makeBase64(48),
+		NonceDEK1:     makeBase64(24),
+		EncryptedDEK2: makeBase64(48),
+		NonceDEK2:     makeBase64(24),
+	}
+
+	_, err := svc.RotateKEK(ctx, user, 1, "", rewrapped)
+	assert.EqualError(t, err, "SaltKEK: missing")
+
+	invalid := rewrapped
+	invalid.EncryptedDEK2 = makeBase64(32)
+	_, err = svc.RotateKEK(ctx, user, 1, "new_kek_salt", invalid)
+	assert.EqualError(t, err, "EncryptedDEK2: invalid length, got 256 bits, want 384 bits")
+
+	// Cannot rotate keys that don't exist
+	_, err = svc.RotateKEK(ctx, models.User{Id: "user1"}, 0, "new_kek_salt", rewrapped)
+	assert.ErrorIs(t, err, service.ErrNoKeysToRotate)
+
+	mockStore.AssertNotCalled(t, "RotateUserKEK", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestRotateKEK_KeyVersionMismatch(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+
+	user := models.User{Id: "user1", KeyVersion: 2, SaltKEK: "old_kek_salt"}
+	rewrapped := service.WrappedDEKs{
+		EncryptedDEK1: makeBase64(48),
+		NonceDEK1:     makeBase64(24),
+		EncryptedDEK2: makeBase64(48),
+		NonceDEK2:     makeBase64(24),
+	}
+
+	// The client wrapped version 1 but the keys were replaced since
+	_, err := svc.RotateKEK(ctx, user, 1, "new_kek_salt", rewrapped)
+	assert.ErrorIs(t, err, service.ErrKeyVersionMismatch)
+	mockStore.AssertNotCalled(t, "RotateUserKEK", mock.Anything, mock.Anything, mock.Anything)
+
+	// The keys were replaced after the user was read
+	mockStore.On("RotateUserKEK", ctx, mock.Anything, 2).Return(store.ErrConditionFailed)
+	_, err = svc.RotateKEK(ctx, user, 2, "new_kek_salt", rewrapped)
+	assert.ErrorIs(t, err, service.ErrKeyVersionMismatch)
+
+	time.Sleep(50 * time.Millisecond)
+	mockCache.AssertNotCalled(t, "Publish", mock.Anything, "user-keys-updated", mock.Anything)
+}
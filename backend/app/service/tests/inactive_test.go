@@ -0,0 +1,130 @@
+package service_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/zlnvch/webverse/models"
+	"github.com/zlnvch/webverse/service"
+)
+
+const day = 24 * time.Hour
+
+func TestDeleteInactiveUsers_SelectionCriteria(t *testing.T) {
+	svc, mockStore, mockCache, mockMQ, _, _ := setupService(t)
+	svc.Config.InactiveUserMinAge = 180 * day
+	svc.Config.InactiveUserIdle = 365 * day
+	svc.Config.AdminUserIds = []string{"admin"}
+	ctx := context.Background()
+	now := time.Now()
+	ago := func(d time.Duration) int64 { return now.Add(-d).Unix() }
+
+	users := []models.User{
+		// Never drew
+		{Id: "no-strokes", Provider: "github", ProviderId: "1", Created: ago(400 * day)},
+		// Drew long ago
+		{Id: "idle", Provider: "github", ProviderId: "2", Created: ago(800 * day), StrokeCount: 5, LastActive: ago(400 * day)},
+		// Drew recently
+		{Id: "active", Provider: "github", ProviderId: "3", Created: ago(800 * day), StrokeCount: 5, LastActive: ago(10 * day)},
+		// Has strokes, but drew before LastActive was tracked
+		{Id: "untracked", Provider: "github", ProviderId: "4", Created: ago(800 * day), StrokeCount: 5},
+		// No counted strokes yet, but just drew
+		{Id: "uncounted", Provider: "github", ProviderId: "5", Created: ago(400 * day), LastActive: ago(time.Hour)},
+		{Id: "admin", Provider: "github", ProviderId: "6", Created: ago(400 * day)},
+	}
+	mockStore.On("GetUsersCreatedBetween", ctx, int64(0), mock.Anything, mock.Anything, "").Return(users[:3], "cursor1", nil).Once()
+	mockStore.On("GetUsersCreatedBetween", ctx, int64(0), mock.Anything, mock.Anything, "cursor1").Return(users[3:], "", nil).Once()
+	mockStore.On("DeleteUser", ctx, "github", mock.Anything).Return(nil)
+	mockCache.On("ClearRecentPages", mock.Anything, mock.Anything).Return(nil).Maybe()
+	mockCache.On("Publish", mock.Anything, "user-deleted", mock.Anything).Return(nil).Maybe()
+	mockMQ.On("Send", mock.Anything, mock.Anything).Return(nil).Maybe()
+
+	deleted, err := svc.DeleteInactiveUsers(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+	mockStore.AssertCalled(t, "DeleteUser", ctx, "github", "1")
+	mockStore.AssertCalled(t, "DeleteUser", ctx, "github", "2")
+	mockStore.AssertNumberOfCalls(t, "DeleteUser", 2)
+
+	// Only users created before the min age are scanned
+	createdBefore := mockStore.Calls[0].Arguments.Get(2).(int64)
+	assert.InDelta(t, ago(180*day), createdBefore, 5)
+}
+
+func TestDeleteInactiveUsers_IdleDisabledSparesUsersWithStrokes(t *testing.T) {
+	svc, mockStore, mockCache, mockMQ, _, _ := setupService(t)
+	svc.Config.InactiveUserMinAge = 180 * day
+	ctx := context.Background()
+	created := time.Now().Add(-800 * day).Unix()
+
+	users := []models.User{
+		{Id: "no-strokes", Provider: "google", ProviderId: "1", Created: created},
+		{Id: "idle", Provider: "google", ProviderId: "2", Created: created, StrokeCount: 1, LastActive: created},
+	}
+	mockStore.On("GetUsersCreatedBetween", ctx, int64(0), mock.Anything, mock.Anything, "").Return(users, "", nil)
+	mockStore.On("DeleteUser", ctx, "google", "1").Return(nil).Once()
+	mockCache.On("ClearRecentPages", mock.Anything, mock.Anything).Return(nil).Maybe()
+	mockCache.On("Publish", mock.Anything, "user-deleted", mock.Anything).Return(nil).Maybe()
+	mockMQ.On("Send", mock.Anything, mock.Anything).Return(nil).Maybe()
+
+	deleted, err := svc.DeleteInactiveUsers(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	mockStore.AssertExpectations(t)
+}
+
+func TestDrawStroke_UpdatesLastActive(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+	user := models.User{Id: "user1", Provider: "google", ProviderId: "123"}
+
+	mockCache.On("GetUserStrokeCount", ctx, user.Id).Return(10, nil)
+	mockCache.On("IsPageComplete", ctx, "example.com").Return(true, nil)
+	mockCache.On("GetPageStrokeCountFromZCard", ctx, "example.com").Return(int64(100), nil)
+	mockCache.On("IncrementUserStrokeCount", mock.Anything, user.Id).Return(int64(11), nil)
+	mockCache.On("AddStroke", mock.Anything, "example.com", mock.Anything, mock.Anything, mock.Anything).Return(int64(7), nil)
+	mockCache.On("Publish", mock.Anything, "page:example.com", mock.Anything).Return(nil)
+	unsetDefault(&mockStore.Mock, "UpdateUserLastActive")
+	updated := make(chan int64, 2)
+	mockStore.On("UpdateUserLastActive", mock.Anything, "google", "123", mock.Anything).Run(func(args mock.Arguments) {
+		updated <- args.Get(3).(int64)
+	}).Return(nil)
+
+	draw := func(x int) {
+		_, err := svc.DrawStroke(ctx, service.DrawParams{
+			User:    user,
+			PageKey: "example.com",
+			Layer:   models.LayerPublic,
+			Stroke:  models.Stroke{Content: fmt.Appendf(nil, `{"tool":0,"color":"#000000","width":5,"startX":%d,"startY":0,"dx":[],"dy":[]}`, x)},
+		})
+		assert.NoError(t, err)
+	}
+
+	draw(0)
+	select {
+	case lastActive := <-updated:
+		assert.InDelta(t, time.Now().Unix(), lastActive, 5)
+	case <-time.After(1 * time.Second):
+		t.Fatal("last active time was not updated")
+	}
+
+	// Written once per hour
+	draw(1)
+	select {
+	case <-updated:
+		t.Fatal("last active time was updated twice within the hour")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestNewService_InactiveUserCleanupRequiresMinAge(t *testing.T) {
+	config := service.DefaultConfig()
+	config.InactiveUserCleanupInterval = time.Hour
+
+	_, err := service.NewService(nil, nil, nil, nil, nil, nil, [][]byte{[]byte("secret")}, config)
+	assert.EqualError(t, err, "inactive user min age must be positive")
+}
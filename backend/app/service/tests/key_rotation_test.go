@@ -0,0 +1,144 @@
+package service_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	cachemocks "github.com/zlnvch/webverse/cache/mocks"
+	"github.com/zlnvch/webverse/models"
+	"github.com/zlnvch/webverse/mq"
+	mqmocks "github.com/zlnvch/webverse/mq/mocks"
+	"github.com/zlnvch/webverse/service"
+	"github.com/zlnvch/webverse/store/memstore"
+	"github.com/zlnvch/webverse/worker"
+)
+
+// End to end: SetEncryptionKeys queues the deletion, and the MQ consumer runs it against the memstore
+func TestKeyRotation_OnlyDeletesOldPrivateLayer(t *testing.T) {
+	ctx := context.Background()
+	memStore := memstore.NewMemWebverseStore()
+	mockCache := new(cachemocks.MockCache)
+	mockCache.On("Publish", mock.Anything, mock.Anything, mock.Anything).Return(nil).Maybe()
+	mockMQ := new(mqmocks.MockMQ)
+
+	counterBatcher := worker.NewCounterBatcher(memStore, 60000, worker.DefaultCounterFlushUsers)
+	strokeBatcher := worker.NewStrokeBatcher(memStore, 60000, worker.DefaultStrokeBufferSize, counterBatcher, nil)
+	svc, err := service.NewService(memStore, mockCache, mockMQ, strokeBatcher, counterBatcher, nil, [][]byte{[]byte("secret")}, service.DefaultConfig())
+	assert.NoError(t, err)
+
+	user, err := memStore.CreateUser(ctx, models.User{Provider: "github", ProviderId: "1", Username: "alice"})
+	assert.NoError(t, err)
+	keys := service.EncryptionKeys{
+		SaltKEK:       makeBase64(16),
+		EncryptedDEK1: makeBase64(48),
+		NonceDEK1:     makeBase64(24),
+		EncryptedDEK2: makeBase64(48),
+		NonceDEK2:     makeBase64(24),
+	}
+
+	sent := make(chan string, 1)
+	mockMQ.On("Send", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		sent <- args.String(1)
+	}).Return(nil)
+
+	// First keys, nothing to delete
+	version, err := svc.SetEncryptionKeys(ctx, user, keys, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, version)
+	user, _ = memStore.GetUser(ctx, "github", "1")
+
+	privateKey1 := "YWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWE="
+	privateKey2 := "YmJiYmJiYmJiYmJiYmJiYmJiYmJiYmJiYmJiYmJiYmI="
+	_, err = memStore.WriteStrokeBatch(ctx, []models.StrokeRecord{
+		{PageKey: "example.com", Layer: models.LayerPublic, Stroke: models.Stroke{Id: "00000000-0000-7000-8000-000000000001", UserId: user.Id}},
+		{PageKey: privateKey1, Layer: models.LayerPrivate, LayerId: "1", Stroke: models.Stroke{Id: "00000000-0000-7000-8000-000000000002", UserId: user.Id}},
+		{PageKey: privateKey1, Layer: models.LayerPrivate, LayerId: "1", Stroke: models.Stroke{Id: "00000000-0000-7000-8000-000000000003", UserId: user.Id}},
+		// Another user on the same key version
+		{PageKey: privateKey2, Layer: models.LayerPrivate, LayerId: "1", Stroke: models.Stroke{Id: "00000000-0000-7000-8000-000000000004", UserId: "user2"}},
+		// An older key version whose deletion is still pending is not this rotation's business
+		{PageKey: privateKey1, Layer: models.LayerPrivate, LayerId: "10", Stroke: models.Stroke{Id: "00000000-0000-7000-8000-000000000005", UserId: user.Id}},
+	})
+	assert.NoError(t, err)
+
+	// Overwrite the keys (POST), version 1 strokes can no longer be decrypted
+	version, err = svc.SetEncryptionKeys(ctx, user, keys, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, version)
+
+	var body string
+	select {
+	case body = <-sent:
+	case <-time.After(1 * time.Second):
+		t.Fatal("timed out waiting for the delete message")
+	}
+
+	// Strokes drawn with the new keys before the deletion runs
+	_, err = memStore.WriteStrokeBatch(ctx, []models.StrokeRecord{
+		{PageKey: privateKey1, Layer: models.LayerPrivate, LayerId: "2", Stroke: models.Stroke{Id: "00000000-0000-7000-8000-000000000006", UserId: user.Id}},
+	})
+	assert.NoError(t, err)
+
+	msg := &mq.Message{Id: "receipt-1", MessageId: "1", Body: body}
+	mockMQ.On("Receive", mock.Anything, mock.Anything).Return(msg, nil).Once()
+	mockMQ.On("Receive", mock.Anything, mock.Anything).Return(nil, context.Canceled)
+	mockMQ.On("Delete", mock.Anything, msg).Return(nil).Once()
+	mockCache.On("IsMessageProcessed", mock.Anything, "1").Return(false, nil)
+	mockCache.On("MarkMessageProcessed", mock.Anything, "1", mock.Anything).Return(nil)
+	mockCache.On("SetUserDeletionCount", mock.Anything, user.Id, "Private#1", 2).Return(2, nil)
+	mockCache.On("ClearUserDeletionCount", mock.Anything, user.Id, "Private#1").Return(nil)
+	worker.NewMQConsumer(mockMQ, memStore, mockCache, counterBatcher).Run(ctx)
+	mockMQ.AssertExpectations(t)
+
+	strokeIds := func(pageKey string) []string {
+		strokes, err := memStore.GetStrokeRecords(ctx, pageKey, 1100)
+		assert.NoError(t, err)
+		ids := []string{}
+		for _, stroke := range strokes {
+			ids = append(ids, stroke.Id)
+		}
+		return ids
+	}
+	assert.Equal(t, []string{"00000000-0000-7000-8000-000000000001"}, strokeIds("example.com"))
+	assert.Equal(t, []string{"00000000-0000-7000-8000-000000000005", "00000000-0000-7000-8000-000000000006"}, strokeIds(privateKey1))
+	assert.Equal(t, []string{"00000000-0000-7000-8000-000000000004"}, strokeIds(privateKey2))
+
+	// The user's counter only loses the two deleted strokes
+	select {
+	case update := <-counterBatcher.UpdateCh:
+		assert.Equal(t, -2, update.Delta)
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "timed out waiting for the counter update")
+	}
+}
+
+func TestKeyRotation_PUT_DeletesNothing(t *testing.T) {
+	svc, mockStore, mockCache, mockMQ, _, _ := setupService(t)
+	ctx := context.Background()
+
+	user := models.User{Id: "user1", KeyVersion: 1, SaltKEK: "existing_salt"}
+	keys := service.EncryptionKeys{
+		SaltKEK:       "newsalt",
+		EncryptedDEK1: makeBase64(48),
+		NonceDEK1:     makeBase64(24),
+		EncryptedDEK2: makeBase64(48),
+		NonceDEK2:     makeBase64(24),
+	}
+
+	// Rotating re-wraps the same data keys, so existing strokes stay readable
+	mockStore.On("SetUserEncryptionKeys", ctx, mock.Anything, false).Return(1, nil)
+	publishDone := wrapMockWithSignal(mockCache.On("Publish", mock.Anything, "user-keys-updated", mock.Anything).Return(nil))
+
+	_, err := svc.SetEncryptionKeys(ctx, user, keys, false)
+	assert.NoError(t, err)
+
+	select {
+	case <-publishDone:
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "timed out waiting for Publish")
+	}
+	time.Sleep(50 * time.Millisecond)
+	mockMQ.AssertNotCalled(t, "Send", mock.Anything, mock.Anything)
+}
@@ -0,0 +1,172 @@
+package service_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/zlnvch/webverse/models"
+	"github.com/zlnvch/webverse/service"
+	"github.com/zlnvch/webverse/store"
+)
+
+// Helper that builds a public pen stroke of the given width with points additional points
+func penStroke(width int, points int) []byte {
+	deltas := strings.TrimSuffix(strings.Repeat("1,", points), ",")
+	return []byte(fmt.Sprintf(`{"tool":0,"color":"#000000","width":%d,"startX":0,"startY":0,"dx":[%s],"dy":[%s]}`, width, deltas, deltas))
+}
+
+func TestStrokeLimits_WithPageSettings(t *testing.T) {
+	global := service.DefaultStrokeLimits()
+	page := global.WithPageSettings(models.PageSettings{MaxWidth: 3, MaxPoints: 1500})
+
+	// Thinner pens only on the page
+	assert.NoError(t, global.ValidateStrokeContent(penStroke(5, 0)))
+	assert.EqualError(t, page.ValidateStrokeContent(penStroke(5, 0)), "invalid width")
+	assert.NoError(t, page.ValidateStrokeContent(penStroke(3, 0)))
+
+	// More points only on the page
+	assert.EqualError(t, global.ValidateStrokeContent(penStroke(5, 1200)), "stroke too long")
+	assert.NoError(t, page.ValidateStrokeContent(penStroke(3, 1200)))
+	assert.EqualError(t, page.ValidateStrokeContent(penStroke(3, 1501)), "stroke too long")
+
+	// The eraser keeps its bounds
+	assert.NoError(t, page.ValidateStrokeContent([]byte(`{"tool":1,"width":40,"startX":0,"startY":0,"dx":[],"dy":[]}`)))
+
+	// Zero fields keep the global limits, and the global limits are left untouched
+	assert.Equal(t, global, global.WithPageSettings(models.PageSettings{}))
+	assert.Equal(t, uint8(20), service.DefaultStrokeLimits().ToolWidths[service.ToolPen].Max)
+	assert.Equal(t, uint8(20), global.ToolWidths[service.ToolPen].Max)
+}
+
+func TestStrokeLimits_ValidatePageSettings(t *testing.T) {
+	limits := service.DefaultStrokeLimits()
+	limits.MinPoints = 3
+
+	assert.NoError(t, limits.ValidatePageSettings(models.PageSettings{}))
+	assert.NoError(t, limits.ValidatePageSettings(models.PageSettings{MaxWidth: 1, MaxPoints: 2}))
+	assert.Error(t, limits.ValidatePageSettings(models.PageSettings{MaxPoints: 1}))
+	assert.Error(t, limits.ValidatePageSettings(models.PageSettings{MaxPoints: -1}))
+	assert.Error(t, limits.ValidatePageSettings(models.PageSettings{MaxPoints: 10001}))
+}
+
+func TestDrawStroke_PageSettingsRejects(t *testing.T) {
+	svc, mockStore, _, _, _, _ := setupService(t)
+	svc.Config.PageSettings = true
+	ctx := context.Background()
+
+	mockStore.On("GetPageSettings", ctx, "fine.example.com").Return(models.PageSettings{MaxWidth: 3}, nil).Once()
+
+	// Accepted by the global limits, too wide for the page
+	_, err := svc.DrawStroke(ctx, service.DrawParams{
+		User:    models.User{Id: "user1"},
+		PageKey: "fine.example.com",
+		Layer:   models.LayerPublic,
+		Stroke:  models.Stroke{Content: penStroke(5, 0)},
+	})
+	assert.EqualError(t, err, "invalid width")
+	mockStore.AssertExpectations(t)
+}
+
+func TestDrawStroke_PageSettingsAccepts(t *testing.T) {
+	svc, mockStore, mockCache, _, strokeBatcher, _ := setupService(t)
+	svc.Config.PageSettings = true
+	ctx := context.Background()
+	pageKey := "fine.example.com"
+
+	mockStore.On("GetPageSettings", ctx, pageKey).Return(models.PageSettings{MaxPoints: 1500}, nil).Once()
+	mockCache.On("GetUserStrokeCount", ctx, "user1").Return(10, nil)
+	mockCache.On("IsPageComplete", ctx, pageKey).Return(true, nil)
+	mockCache.On("GetPageStrokeCountFromZCard", ctx, pageKey).Return(int64(100), nil)
+	mockCache.On("IncrementUserStrokeCount", mock.Anything, "user1").Return(int64(11), nil).Maybe()
+	mockCache.On("AddStroke", mock.Anything, pageKey, mock.Anything, mock.Anything, mock.Anything).Return(int64(1), nil).Maybe()
+	mockCache.On("Publish", mock.Anything, mock.Anything, mock.Anything).Return(nil).Maybe()
+
+	// Too long for the global limits, within the page's
+	strokeId, err := svc.DrawStroke(ctx, service.DrawParams{
+		User:    models.User{Id: "user1"},
+		PageKey: pageKey,
+		Layer:   models.LayerPublic,
+		Stroke:  models.Stroke{Content: penStroke(5, 1200)},
+	})
+	assert.NoError(t, err)
+
+	select {
+	case item := <-strokeBatcher.WriteCh:
+		assert.Equal(t, strokeId, item.Record.Stroke.Id)
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "timed out waiting for stroke batcher")
+	}
+}
+
+func TestDrawStroke_PageSettingsFallBack(t *testing.T) {
+	params := service.DrawParams{
+		User:    models.User{Id: "user1"},
+		PageKey: "example.com",
+		Layer:   models.LayerPublic,
+		Stroke:  models.Stroke{Content: penStroke(5, 1200)},
+	}
+
+	// Pages without settings use the global limits
+	svc, mockStore, _, _, _, _ := setupService(t)
+	svc.Config.PageSettings = true
+	mockStore.On("GetPageSettings", mock.Anything, "example.com").Return(models.PageSettings{}, store.ErrItemNotFound).Once()
+	_, err := svc.DrawStroke(context.Background(), params)
+	assert.EqualError(t, err, "stroke too long")
+
+	// Disabled, the settings are never read
+	svc, mockStore, _, _, _, _ = setupService(t)
+	_, err = svc.DrawStroke(context.Background(), params)
+	assert.EqualError(t, err, "stroke too long")
+	mockStore.AssertNotCalled(t, "GetPageSettings", mock.Anything, mock.Anything)
+}
+
+func TestSetPageSettings(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	svc.Config.AdminUserIds = []string{"admin"}
+	ctx := context.Background()
+	admin := models.User{Id: "admin"}
+	settings := models.PageSettings{MaxWidth: 3, MaxPoints: 1500}
+
+	assert.ErrorIs(t, svc.SetPageSettings(ctx, models.User{Id: "user1"}, "example.com", settings), service.ErrNotAdmin)
+	assert.Error(t, svc.SetPageSettings(ctx, admin, "https://example.com", settings))
+	assert.Error(t, svc.SetPageSettings(ctx, admin, "example.com", models.PageSettings{MaxPoints: -1}))
+	mockStore.AssertNotCalled(t, "SetPageSettings", mock.Anything, mock.Anything, mock.Anything)
+
+	mockStore.On("SetPageSettings", ctx, "example.com", settings).Return(nil).Once()
+	assert.NoError(t, svc.SetPageSettings(ctx, admin, "example.com", settings))
+	mockStore.AssertExpectations(t)
+	// Draws see the new settings without waiting for the cached ones to expire
+	mockCache.AssertCalled(t, "SetPageSettings", ctx, "example.com", settings, time.Minute)
+}
+
+func TestDrawStroke_PageSettingsCached(t *testing.T) {
+	params := service.DrawParams{
+		User:    models.User{Id: "user1"},
+		PageKey: "fine.example.com",
+		Layer:   models.LayerPublic,
+		Stroke:  models.Stroke{Content: penStroke(5, 0)},
+	}
+
+	// Served from the cache, the store is not read
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	svc.Config.PageSettings = true
+	unsetDefault(&mockCache.Mock, "GetPageSettings")
+	mockCache.On("GetPageSettings", mock.Anything, "fine.example.com").Return(models.PageSettings{MaxWidth: 3}, true, nil)
+	_, err := svc.DrawStroke(context.Background(), params)
+	assert.EqualError(t, err, "invalid width")
+	mockStore.AssertNotCalled(t, "GetPageSettings", mock.Anything, mock.Anything)
+
+	// A page without settings is cached as zero settings, so the next draw doesn't read the store either
+	svc, mockStore, mockCache, _, _, _ = setupService(t)
+	svc.Config.PageSettings = true
+	mockStore.On("GetPageSettings", mock.Anything, "fine.example.com").Return(models.PageSettings{}, store.ErrItemNotFound).Once()
+	params.Stroke.Content = penStroke(5, 1200)
+	_, err = svc.DrawStroke(context.Background(), params)
+	assert.EqualError(t, err, "stroke too long")
+	mockCache.AssertCalled(t, "SetPageSettings", mock.Anything, "fine.example.com", models.PageSettings{}, time.Minute)
+}
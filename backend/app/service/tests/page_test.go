@@ -6,10 +6,16 @@ import (
 	"errors"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/zlnvch/webverse/cache"
+	"github.com/zlnvch/webverse/metrics"
 	"github.com/zlnvch/webverse/models"
+	"github.com/zlnvch/webverse/service"
+	"github.com/zlnvch/webverse/store"
+	"github.com/zlnvch/webverse/worker"
 )
 
 func TestLoadPage_CacheComplete(t *testing.T) {
@@ -33,7 +39,7 @@ func TestLoadPage_CacheComplete(t *testing.T) {
 	assert.Len(t, strokes, 1)
 	assert.Equal(t, stroke.Id, strokes[0].Id)
 
-	mockStore.AssertNotCalled(t, "GetStrokeRecords", mock.Anything, mock.Anything)
+	mockStore.AssertNotCalled(t, "GetVisibleStrokeRecords", mock.Anything, mock.Anything, mock.Anything)
 }
 
 func TestLoadPage_CacheInvalidStroke(t *testing.T) {
@@ -57,6 +63,30 @@ func TestLoadPage_CacheInvalidStroke(t *testing.T) {
 	assert.Equal(t, stroke.Id, strokes[0].Id)
 }
 
+func TestLoadPage_CacheMalformedStrokeId(t *testing.T) {
+	svc, _, mockCache, _, _, _ := setupService(t)
+	registry := metrics.NewRegistry()
+	svc.Metrics = registry
+	ctx := context.Background()
+	pageKey := "example.com"
+
+	mockCache.On("IsPageComplete", ctx, pageKey).Return(true, nil)
+
+	// Valid JSON, but the ids are not UUIDv7s or the content is missing
+	stroke := models.Stroke{Id: "018e38d7-0000-7000-8000-000000000000", Content: []byte("data")}
+	strokeBytes, _ := json.Marshal(stroke)
+	badId, _ := json.Marshal(models.Stroke{Id: "not-a-uuid", Content: []byte("data")})
+	v4Id, _ := json.Marshal(models.Stroke{Id: "018e38d7-0000-4000-8000-000000000000", Content: []byte("data")})
+	noContent, _ := json.Marshal(models.Stroke{Id: "018e38d7-0000-7000-8000-000000000001"})
+
+	mockCache.On("GetStrokes", ctx, pageKey).Return([][]byte{strokeBytes, badId, v4Id, noContent}, nil)
+
+	strokes, err := svc.LoadPage(ctx, pageKey, models.LayerPublic)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.Stroke{stroke}, strokes)
+	assert.Equal(t, int64(3), registry.Counter("service.corrupt_cached_strokes"))
+}
+
 func TestLoadPage_CacheIncomplete_Merge(t *testing.T) {
 	svc, mockStore, mockCache, _, _, _ := setupService(t)
 	ctx := context.Background()
@@ -78,7 +108,7 @@ func TestLoadPage_CacheIncomplete_Merge(t *testing.T) {
 	mockCache.On("IsPageComplete", ctx, pageKey).Return(false, nil)
 
 	// 3. Store returns Older stroke
-	mockStore.On("GetStrokeRecords", ctx, pageKey).Return([]models.Stroke{s1}, nil)
+	mockStore.On("GetVisibleStrokeRecords", ctx, pageKey, mock.Anything).Return([]models.Stroke{s1}, nil)
 
 	// 4. Expect Backfill to Redis (s1 should be added)
 	// Seed Count
@@ -107,7 +137,7 @@ func TestLoadPage_MergeWithDuplicates(t *testing.T) {
 
 	mockCache.On("GetStrokes", ctx, pageKey).Return([][]byte{s2Bytes}, nil)
 	mockCache.On("IsPageComplete", ctx, pageKey).Return(false, nil)
-	mockStore.On("GetStrokeRecords", ctx, pageKey).Return([]models.Stroke{s1}, nil)
+	mockStore.On("GetVisibleStrokeRecords", ctx, pageKey, mock.Anything).Return([]models.Stroke{s1}, nil)
 
 	mockCache.On("SetPageStrokeCount", ctx, pageKey, 1).Return(nil)
 	mockCache.On("AddStrokesBatch", ctx, pageKey, mock.Anything).Return(nil)
@@ -118,6 +148,27 @@ func TestLoadPage_MergeWithDuplicates(t *testing.T) {
 	assert.Equal(t, id, strokes[0].Id)
 }
 
+func TestLoadPage_MergeSameIdDifferentContent(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+	pageKey := "example.com"
+
+	// The cached copy wins over the stored one when their contents differ
+	id := "00000000-0000-7000-8000-000000000001"
+	dbStroke := models.Stroke{Id: id, UserId: "user1", Content: []byte("stored")}
+	redisStroke := models.Stroke{Id: id, UserId: "user1", Content: []byte("cached")}
+	redisBytes, _ := json.Marshal(redisStroke)
+
+	mockCache.On("GetStrokes", ctx, pageKey).Return([][]byte{redisBytes}, nil)
+	mockCache.On("IsPageComplete", ctx, pageKey).Return(false, nil)
+	mockStore.On("GetVisibleStrokeRecords", ctx, pageKey, mock.Anything).Return([]models.Stroke{dbStroke}, nil)
+	mockCache.On("AddStrokesBatch", ctx, pageKey, mock.Anything).Return(nil)
+
+	strokes, err := svc.LoadPage(ctx, pageKey, models.LayerPublic)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.Stroke{redisStroke}, strokes)
+}
+
 func TestLoadPage_MergeOnlyDBStrokes(t *testing.T) {
 	svc, mockStore, mockCache, _, _, _ := setupService(t)
 	ctx := context.Background()
@@ -131,7 +182,7 @@ func TestLoadPage_MergeOnlyDBStrokes(t *testing.T) {
 
 	mockCache.On("GetStrokes", ctx, pageKey).Return([][]byte{}, nil) // No cache strokes
 	mockCache.On("IsPageComplete", ctx, pageKey).Return(false, nil)
-	mockStore.On("GetStrokeRecords", ctx, pageKey).Return([]models.Stroke{s1, s2}, nil)
+	mockStore.On("GetVisibleStrokeRecords", ctx, pageKey, mock.Anything).Return([]models.Stroke{s1, s2}, nil)
 
 	mockCache.On("SetPageStrokeCount", ctx, pageKey, 2).Return(nil)
 	mockCache.On("AddStrokesBatch", ctx, pageKey, mock.Anything).Return(nil)
@@ -141,6 +192,32 @@ func TestLoadPage_MergeOnlyDBStrokes(t *testing.T) {
 	assert.Len(t, strokes, 2)
 }
 
+func TestLoadPage_ExcludesHiddenStrokes(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+	pageKey := "example.com"
+
+	visible := models.Stroke{Id: "00000000-0000-7000-8000-000000000001", Content: []byte("data1")}
+
+	// Hidden strokes are filtered in the store query, so they don't use up the limit
+	mockCache.On("GetStrokes", ctx, pageKey).Return([][]byte{}, nil)
+	mockCache.On("IsPageComplete", ctx, pageKey).Return(false, nil)
+	mockStore.On("GetVisibleStrokeRecords", ctx, pageKey, int32(svc.Config.MaxPageStrokesReturned)).Return([]models.Stroke{visible}, nil)
+	var cached []cache.StrokeCacheItem
+	mockCache.On("AddStrokesBatch", ctx, pageKey, mock.Anything).Run(func(args mock.Arguments) {
+		cached = args.Get(2).([]cache.StrokeCacheItem)
+	}).Return(nil)
+
+	strokes, err := svc.LoadPage(ctx, pageKey, models.LayerPublic)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.Stroke{visible}, strokes)
+
+	// Never cached either, so later loads from the cache leave it out too
+	assert.Len(t, cached, 1)
+	assert.Equal(t, visible.Id, cached[0].StrokeId)
+	mockStore.AssertNotCalled(t, "GetStrokeRecords", mock.Anything, mock.Anything, mock.Anything)
+}
+
 func TestLoadPage_MergeOnlyRedisStrokes(t *testing.T) {
 	svc, mockStore, mockCache, _, _, _ := setupService(t)
 	ctx := context.Background()
@@ -152,7 +229,7 @@ func TestLoadPage_MergeOnlyRedisStrokes(t *testing.T) {
 
 	mockCache.On("GetStrokes", ctx, pageKey).Return([][]byte{sBytes}, nil)
 	mockCache.On("IsPageComplete", ctx, pageKey).Return(false, nil)
-	mockStore.On("GetStrokeRecords", ctx, pageKey).Return([]models.Stroke{}, nil) // No DB strokes
+	mockStore.On("GetVisibleStrokeRecords", ctx, pageKey, mock.Anything).Return([]models.Stroke{}, nil) // No DB strokes
 
 	mockCache.On("SetPageStrokeCount", ctx, pageKey, 1).Return(nil)
 	mockCache.On("AddStrokesBatch", ctx, pageKey, mock.Anything).Return(nil)
@@ -167,20 +244,22 @@ func TestLoadPage_TruncatesLargeResult(t *testing.T) {
 	svc, mockStore, mockCache, _, _, _ := setupService(t)
 	ctx := context.Background()
 	pageKey := "example.com"
+	limit := svc.Config.MaxPageStrokesReturned
 
-	// Generate 1200 unique strokes
-	dbStrokes := make([]models.Stroke, 600)
-	redisStrokes := make([]models.Stroke, 600)
+	// Generate more unique strokes than the limit, half of them only in each source
+	half := (limit + 100) / 2
+	dbStrokes := make([]models.Stroke, half)
+	redisStrokes := make([]models.Stroke, half)
 
-	for i := 0; i < 600; i++ {
+	for i := 0; i < half; i++ {
 		// Create unique IDs with different suffixes
-		dbId := fmt.Sprintf("%012x-0000-7000-8000-%012x", i, i)
-		redisId := fmt.Sprintf("%012x-0000-7000-8000-%012x", i+600, i+600)
+		dbId := fmt.Sprintf("%08x-0000-7000-8000-%012x", i, i)
+		redisId := fmt.Sprintf("%08x-0000-7000-8000-%012x", i+half, i+half)
 		dbStrokes[i] = models.Stroke{Id: dbId, Content: []byte("data")}
 		redisStrokes[i] = models.Stroke{Id: redisId, Content: []byte("data")}
 	}
 
-	redisBytes := make([][]byte, 600)
+	redisBytes := make([][]byte, half)
 	for i, s := range redisStrokes {
 		b, _ := json.Marshal(s)
 		redisBytes[i] = b
@@ -188,14 +267,156 @@ func TestLoadPage_TruncatesLargeResult(t *testing.T) {
 
 	mockCache.On("GetStrokes", ctx, pageKey).Return(redisBytes, nil)
 	mockCache.On("IsPageComplete", ctx, pageKey).Return(false, nil)
-	mockStore.On("GetStrokeRecords", ctx, pageKey).Return(dbStrokes, nil)
+	mockStore.On("GetVisibleStrokeRecords", ctx, pageKey, int32(limit)).Return(dbStrokes, nil)
 
 	mockCache.On("SetPageStrokeCount", ctx, pageKey, mock.AnythingOfType("int")).Return(nil)
 	mockCache.On("AddStrokesBatch", ctx, pageKey, mock.Anything).Return(nil)
+	mockCache.On("SetPageComplete", ctx, pageKey).Return(nil)
+
+	strokes, err := svc.LoadPage(ctx, pageKey, models.LayerPublic)
+	assert.NoError(t, err)
+	assert.Len(t, strokes, limit) // Truncated to the configured limit
+}
+
+func TestLoadPage_TruncatesToConfiguredLimit(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	svc.Config.MaxPageStrokesReturned = 10
+	ctx := context.Background()
+	pageKey := "example.com"
+
+	dbStrokes := make([]models.Stroke, 25)
+	for i := range dbStrokes {
+		dbStrokes[i] = models.Stroke{Id: fmt.Sprintf("%08x-0000-7000-8000-%012x", i, i), Content: []byte("data")}
+	}
+
+	mockCache.On("GetStrokes", ctx, pageKey).Return([][]byte{}, nil)
+	mockCache.On("IsPageComplete", ctx, pageKey).Return(false, nil)
+	mockStore.On("GetVisibleStrokeRecords", ctx, pageKey, int32(10)).Return(dbStrokes, nil)
+	mockCache.On("AddStrokesBatch", ctx, pageKey, mock.Anything).Return(nil)
+
+	strokes, err := svc.LoadPage(ctx, pageKey, models.LayerPublic)
+	assert.NoError(t, err)
+	assert.Len(t, strokes, 10)
+	assert.Equal(t, dbStrokes[15].Id, strokes[0].Id)
+}
+
+func TestLoadPage_EvictsOldestPagePastCap(t *testing.T) {
+	svc, _, mockCache, _, _, _ := setupService(t)
+	registry := metrics.NewRegistry()
+	svc.Metrics = registry
+	svc.Config.MaxCachedPages = 2
+	ctx := context.Background()
+
+	mockCache.On("GetStrokes", ctx, mock.Anything).Return([][]byte{}, nil)
+	mockCache.On("IsPageComplete", ctx, mock.Anything).Return(true, nil)
+	mockCache.On("TouchPage", ctx, "a.com", mock.Anything).Return(int64(1), nil).Once()
+	mockCache.On("TouchPage", ctx, "b.com", mock.Anything).Return(int64(2), nil).Once()
+	mockCache.On("TouchPage", ctx, "c.com", mock.Anything).Return(int64(3), nil).Once()
+	mockCache.On("EvictOldestPages", ctx, 2).Return([]string{"a.com"}, nil).Once()
+	mockCache.On("InvalidatePages", ctx, []string{"a.com"}).Return(nil).Once()
+
+	// Up to the cap nothing is evicted, the third page pushes out the least recently loaded
+	for _, pageKey := range []string{"a.com", "b.com", "c.com"} {
+		_, err := svc.LoadPage(ctx, pageKey, models.LayerPublic)
+		assert.NoError(t, err)
+	}
+
+	mockCache.AssertExpectations(t)
+	assert.Equal(t, int64(1), registry.Counter("service.evicted_pages"))
+}
+
+func TestLoadPage_PageCapDisabled(t *testing.T) {
+	svc, _, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+
+	mockCache.On("GetStrokes", ctx, "example.com").Return([][]byte{}, nil)
+	mockCache.On("IsPageComplete", ctx, "example.com").Return(true, nil)
+
+	_, err := svc.LoadPage(ctx, "example.com", models.LayerPublic)
+	assert.NoError(t, err)
+	mockCache.AssertNotCalled(t, "TouchPage", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestLoadPage_OversizedSources(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+	pageKey := "example.com"
+
+	// Both sources are larger than the limit on their own, with interleaved ids
+	// and the newest 500 strokes only in the cache
+	dbStrokes := make([]models.Stroke, 0, 2000)
+	redisBytes := make([][]byte, 0, 2500)
+	for i := 0; i < 2500; i++ {
+		stroke := models.Stroke{Id: fmt.Sprintf("%08x-0000-7000-8000-%012x", i, i), Content: []byte("data")}
+		if i%2 == 0 && i < 2000 {
+			dbStrokes = append(dbStrokes, stroke)
+		} else {
+			b, _ := json.Marshal(stroke)
+			redisBytes = append(redisBytes, b)
+		}
+	}
+
+	mockCache.On("GetStrokes", ctx, pageKey).Return(redisBytes, nil)
+	mockCache.On("IsPageComplete", ctx, pageKey).Return(false, nil)
+	mockStore.On("GetVisibleStrokeRecords", ctx, pageKey, mock.Anything).Return(dbStrokes, nil)
+	mockCache.On("AddStrokesBatch", ctx, pageKey, mock.Anything).Return(nil)
+	mockCache.On("SetPageComplete", ctx, pageKey).Return(nil)
 
 	strokes, err := svc.LoadPage(ctx, pageKey, models.LayerPublic)
 	assert.NoError(t, err)
-	assert.Len(t, strokes, 1100) // Truncated to 1100
+	assert.Len(t, strokes, 1100)
+	// The newest 1100 of all 2500, in order
+	for i, stroke := range strokes {
+		assert.Equal(t, fmt.Sprintf("%08x-0000-7000-8000-%012x", 1400+i, 1400+i), stroke.Id)
+	}
+}
+
+func TestLoadPage_FullPageMarkedComplete(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+	pageKey := "example.com"
+
+	dbStrokes := make([]models.Stroke, 1000)
+	redisBytes := make([][]byte, 1000)
+	for i := range dbStrokes {
+		dbStrokes[i] = models.Stroke{Id: fmt.Sprintf("%08x-0000-7000-8000-%012x", i, i), Content: []byte("data")}
+		redisBytes[i], _ = json.Marshal(dbStrokes[i])
+	}
+
+	// First load goes to the store, the second one is served from the cache
+	mockCache.On("IsPageComplete", ctx, pageKey).Return(false, nil).Once()
+	mockCache.On("IsPageComplete", ctx, pageKey).Return(true, nil)
+	mockCache.On("GetStrokes", ctx, pageKey).Return([][]byte{}, nil).Once()
+	mockCache.On("GetStrokes", ctx, pageKey).Return(redisBytes, nil)
+	mockStore.On("GetVisibleStrokeRecords", ctx, pageKey, mock.Anything).Return(dbStrokes, nil).Once()
+	mockCache.On("AddStrokesBatch", ctx, pageKey, mock.Anything).Return(nil)
+	mockCache.On("SetPageComplete", ctx, pageKey).Return(nil)
+
+	strokes, err := svc.LoadPage(ctx, pageKey, models.LayerPublic)
+	assert.NoError(t, err)
+	assert.Len(t, strokes, 1000)
+	mockCache.AssertCalled(t, "SetPageComplete", ctx, pageKey)
+
+	strokes, err = svc.LoadPage(ctx, pageKey, models.LayerPublic)
+	assert.NoError(t, err)
+	assert.Len(t, strokes, 1000)
+	mockStore.AssertNumberOfCalls(t, "GetVisibleStrokeRecords", 1)
+}
+
+func TestLoadPage_PartialPageNotMarkedComplete(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+	pageKey := "example.com"
+
+	stroke := models.Stroke{Id: "00000000-0000-7000-8000-000000000001", Content: []byte("data")}
+	mockCache.On("IsPageComplete", ctx, pageKey).Return(false, nil)
+	mockCache.On("GetStrokes", ctx, pageKey).Return([][]byte{}, nil)
+	mockStore.On("GetVisibleStrokeRecords", ctx, pageKey, mock.Anything).Return([]models.Stroke{stroke}, nil)
+	mockCache.On("AddStrokesBatch", ctx, pageKey, mock.Anything).Return(nil)
+
+	_, err := svc.LoadPage(ctx, pageKey, models.LayerPublic)
+	assert.NoError(t, err)
+	mockCache.AssertNotCalled(t, "SetPageComplete", mock.Anything, mock.Anything)
 }
 
 func TestLoadPage_EmptyBothSources(t *testing.T) {
@@ -205,7 +426,7 @@ func TestLoadPage_EmptyBothSources(t *testing.T) {
 
 	mockCache.On("GetStrokes", ctx, pageKey).Return([][]byte{}, nil)
 	mockCache.On("IsPageComplete", ctx, pageKey).Return(false, nil)
-	mockStore.On("GetStrokeRecords", ctx, pageKey).Return([]models.Stroke{}, nil)
+	mockStore.On("GetVisibleStrokeRecords", ctx, pageKey, mock.Anything).Return([]models.Stroke{}, nil)
 
 	mockCache.On("SetPageStrokeCount", ctx, pageKey, 0).Return(nil)
 	// AddStrokesBatch should NOT be called with empty slice
@@ -225,7 +446,7 @@ func TestLoadPage_StoreError(t *testing.T) {
 
 	mockCache.On("GetStrokes", ctx, pageKey).Return([][]byte{}, nil)
 	mockCache.On("IsPageComplete", ctx, pageKey).Return(false, nil)
-	mockStore.On("GetStrokeRecords", ctx, pageKey).Return([]models.Stroke{}, errors.New("db connection failed"))
+	mockStore.On("GetVisibleStrokeRecords", ctx, pageKey, mock.Anything).Return([]models.Stroke{}, errors.New("db connection failed"))
 
 	_, err := svc.LoadPage(ctx, pageKey, models.LayerPublic)
 	assert.Error(t, err)
@@ -239,7 +460,7 @@ func TestLoadPage_CacheGetStrokesError(t *testing.T) {
 
 	mockCache.On("GetStrokes", ctx, pageKey).Return([][]byte{}, errors.New("cache error"))
 	mockCache.On("IsPageComplete", ctx, pageKey).Return(false, nil)
-	mockStore.On("GetStrokeRecords", ctx, pageKey).Return([]models.Stroke{}, nil)
+	mockStore.On("GetVisibleStrokeRecords", ctx, pageKey, mock.Anything).Return([]models.Stroke{}, nil)
 
 	mockCache.On("SetPageStrokeCount", ctx, pageKey, 0).Return(nil)
 	mockCache.On("SetPageComplete", ctx, pageKey).Return(nil)
@@ -283,3 +504,482 @@ func TestLoadPage_PrivateLayer_ValidKey(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Len(t, strokes, 1)
 }
+
+func TestMigratePage_NotAdmin(t *testing.T) {
+	svc, mockStore, _, _, _, _ := setupService(t)
+	ctx := context.Background()
+
+	_, err := svc.MigratePage(ctx, models.User{Id: "user1"}, "old.com", "new.com", models.LayerPublic, true)
+	assert.ErrorIs(t, err, service.ErrNotAdmin)
+	mockStore.AssertNotCalled(t, "GetStrokeRecords", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestMigratePage_ChunksAndSkipsExisting(t *testing.T) {
+	svc, mockStore, mockCache, _, _, counterBatcher := setupService(t)
+	svc.Config.AdminUserIds = []string{"admin1"}
+	admin := models.User{Id: "admin1"}
+	ctx := context.Background()
+
+	// 30 strokes on the old page, the first one was already migrated by a previous run
+	source := make([]models.Stroke, 30)
+	for i := range source {
+		source[i] = models.Stroke{Id: fmt.Sprintf("00000000-0000-7000-8000-%012d", i), UserId: "author", Content: []byte("data")}
+	}
+	mockStore.On("GetStrokeRecords", ctx, "old.com", mock.Anything).Return(source, nil)
+	mockStore.On("GetStrokeRecords", ctx, "new.com", mock.Anything).Return(source[:1], nil)
+
+	var written []models.StrokeRecord
+	mockStore.On("WriteStrokeBatch", ctx, mock.Anything).Run(func(args mock.Arguments) {
+		batch := args.Get(1).([]models.StrokeRecord)
+		assert.LessOrEqual(t, len(batch), 25)
+		written = append(written, batch...)
+	}).Return([]models.StrokeRecord{}, nil)
+	mockStore.On("DeleteStroke", ctx, "old.com", mock.Anything, "author").Return(nil)
+	mockCache.On("InvalidatePages", ctx, []string{"old.com", "new.com"}).Return(nil)
+	// The old page leaves the author's page list
+	mockCache.On("InvalidateUserPages", ctx, "author", "").Return(nil)
+	// 29 strokes moved, the one already migrated is only deleted
+	mockCache.On("AddUserStrokeCount", ctx, "author", -1).Return(nil)
+	mockStore.On("GetUserById", ctx, "author").Return(models.User{Id: "author", Provider: "github", ProviderId: "123"}, nil)
+
+	migrated, err := svc.MigratePage(ctx, admin, "old.com", "new.com", models.LayerPublic, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 29, migrated)
+
+	mockStore.AssertNumberOfCalls(t, "WriteStrokeBatch", 2)
+	assert.Len(t, written, 29)
+	for _, record := range written {
+		assert.Equal(t, "new.com", record.PageKey)
+		assert.Equal(t, "author", record.Stroke.UserId)
+		assert.NotEqual(t, source[0].Id, record.Stroke.Id)
+	}
+	mockStore.AssertNumberOfCalls(t, "DeleteStroke", 30)
+	mockCache.AssertExpectations(t)
+
+	update := <-counterBatcher.UpdateCh
+	assert.Equal(t, worker.CounterUpdate{UserId: "author", UserProvider: "github", UserProviderId: "123", Delta: -1}, update)
+}
+
+func TestMigratePage_KeepSource(t *testing.T) {
+	svc, mockStore, mockCache, _, _, counterBatcher := setupService(t)
+	svc.Config.AdminUserIds = []string{"admin1"}
+	ctx := context.Background()
+
+	source := []models.Stroke{{Id: "00000000-0000-7000-8000-000000000001", UserId: "author"}}
+	mockStore.On("GetStrokeRecords", ctx, "old.com", mock.Anything).Return(source, nil)
+	mockStore.On("GetStrokeRecords", ctx, "new.com", mock.Anything).Return([]models.Stroke{}, nil)
+	mockStore.On("WriteStrokeBatch", ctx, mock.Anything).Return([]models.StrokeRecord{}, nil)
+	mockCache.On("InvalidatePages", ctx, []string{"old.com", "new.com"}).Return(nil)
+	mockCache.On("InvalidateUserPages", ctx, "author", "new.com").Return(nil)
+	mockCache.On("AddUserStrokeCount", ctx, "author", 1).Return(nil)
+	mockStore.On("GetUserById", ctx, "author").Return(models.User{Id: "author", Provider: "github", ProviderId: "123"}, nil)
+
+	migrated, err := svc.MigratePage(ctx, models.User{Id: "admin1"}, "old.com", "new.com", models.LayerPublic, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, migrated)
+	mockStore.AssertNotCalled(t, "DeleteStroke", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+
+	// The copy counts towards its author's quota
+	mockCache.AssertExpectations(t)
+	update := <-counterBatcher.UpdateCh
+	assert.Equal(t, 1, update.Delta)
+	assert.Equal(t, "github", update.UserProvider)
+}
+
+func TestMigratePage_PrivateLayerRejected(t *testing.T) {
+	svc, _, _, _, _, _ := setupService(t)
+	svc.Config.AdminUserIds = []string{"admin1"}
+
+	privateKey := "YWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWE="
+	_, err := svc.MigratePage(context.Background(), models.User{Id: "admin1"}, privateKey, "new.com", models.LayerPrivate, false)
+	assert.Error(t, err)
+}
+
+func TestPausePage_NotAdmin(t *testing.T) {
+	svc, _, mockCache, _, _, _ := setupService(t)
+
+	_, err := svc.PausePage(context.Background(), models.User{Id: "user1"}, "example.com", models.LayerPublic, time.Minute)
+	assert.ErrorIs(t, err, service.ErrNotAdmin)
+	mockCache.AssertNotCalled(t, "SetPagePaused", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestPausePage_SetsFlagAndBroadcasts(t *testing.T) {
+	svc, _, mockCache, _, _, _ := setupService(t)
+	svc.Config.AdminUserIds = []string{"admin1"}
+	ctx := context.Background()
+
+	// Durations above the max are clamped to 24 hours
+	mockCache.On("SetPagePaused", ctx, "example.com", 24*time.Hour).Return(nil)
+	publishDone := wrapMockWithSignal(mockCache.On("Publish", mock.Anything, "page:example.com", mock.MatchedBy(func(msg []byte) bool {
+		var event service.PageEventMessage
+		return json.Unmarshal(msg, &event) == nil && event.Type == "page_paused" && event.Data.Until > 0
+	})).Return(nil))
+
+	until, err := svc.PausePage(ctx, models.User{Id: "admin1"}, "example.com", models.LayerPublic, 48*time.Hour)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), until, time.Minute)
+
+	select {
+	case <-publishDone:
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "timed out waiting for page_paused publish")
+	}
+}
+
+func TestResumePage_ClearsFlagAndBroadcasts(t *testing.T) {
+	svc, _, mockCache, _, _, _ := setupService(t)
+	svc.Config.AdminUserIds = []string{"admin1"}
+	ctx := context.Background()
+
+	mockCache.On("ClearPagePaused", ctx, "example.com").Return(nil)
+	publishDone := wrapMockWithSignal(mockCache.On("Publish", mock.Anything, "page:example.com", mock.MatchedBy(func(msg []byte) bool {
+		var event service.PageEventMessage
+		return json.Unmarshal(msg, &event) == nil && event.Type == "page_resumed"
+	})).Return(nil))
+
+	err := svc.ResumePage(ctx, models.User{Id: "admin1"}, "example.com", models.LayerPublic)
+	assert.NoError(t, err)
+
+	select {
+	case <-publishDone:
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "timed out waiting for page_resumed publish")
+	}
+}
+
+func TestEvictPage_InvalidatesAndBroadcasts(t *testing.T) {
+	svc, _, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+
+	mockCache.On("InvalidatePages", ctx, []string{"example.com"}).Return(nil)
+	publishDone := wrapMockWithSignal(mockCache.On("Publish", mock.Anything, "page:example.com", mock.MatchedBy(func(msg []byte) bool {
+		var event service.PageEventMessage
+		return json.Unmarshal(msg, &event) == nil && event.Type == "page_evicted" && event.Data.PageKey == "example.com"
+	})).Return(nil))
+
+	err := svc.EvictPage(ctx, "example.com")
+	assert.NoError(t, err)
+
+	select {
+	case <-publishDone:
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "timed out waiting for page_evicted publish")
+	}
+}
+
+func TestEvictPage_InvalidateFails(t *testing.T) {
+	svc, _, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+
+	mockCache.On("InvalidatePages", ctx, []string{"example.com"}).Return(errors.New("redis down"))
+
+	err := svc.EvictPage(ctx, "example.com")
+	assert.EqualError(t, err, "redis down")
+
+	// Clients are not told to reload a page that is still cached
+	time.Sleep(50 * time.Millisecond)
+	mockCache.AssertNotCalled(t, "Publish", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestClearPage_DeletesOnlyPublicLayer(t *testing.T) {
+	svc, mockStore, mockCache, _, _, counterBatcher := setupService(t)
+	svc.Config.AdminUserIds = []string{"admin1"}
+	admin := models.User{Id: "admin1"}
+	ctx := context.Background()
+
+	mockStore.On("DeletePageStrokesByLayer", ctx, "example.com", "Public").Return(map[string]int{"author": 2}, nil)
+	mockCache.On("InvalidatePages", ctx, []string{"example.com"}).Return(nil)
+	// The cleared page leaves the author's page list and its strokes their quota
+	mockCache.On("InvalidateUserPages", ctx, "author", "").Return(nil)
+	mockCache.On("AddUserStrokeCount", ctx, "author", -2).Return(nil)
+	mockStore.On("GetUserById", ctx, "author").Return(models.User{Id: "author", Provider: "github", ProviderId: "123"}, nil)
+	publishDone := wrapMockWithSignal(mockCache.On("Publish", mock.Anything, "page:example.com", mock.Anything).Return(nil))
+
+	deleted, err := svc.ClearPage(ctx, admin, "example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+	mockCache.AssertCalled(t, "InvalidateUserPages", ctx, "author", "")
+	mockCache.AssertCalled(t, "AddUserStrokeCount", ctx, "author", -2)
+	update := <-counterBatcher.UpdateCh
+	assert.Equal(t, worker.CounterUpdate{UserId: "author", UserProvider: "github", UserProviderId: "123", Delta: -2}, update)
+
+	select {
+	case <-publishDone:
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "timed out waiting for page_evicted publish")
+	}
+	mockStore.AssertNotCalled(t, "DeleteUserStrokes", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestClearPage_PartialDeleteStillAdjustsCounts(t *testing.T) {
+	svc, mockStore, mockCache, _, _, counterBatcher := setupService(t)
+	svc.Config.AdminUserIds = []string{"admin1"}
+	ctx := context.Background()
+
+	// Throttled part way through, the strokes deleted so far are reported
+	mockStore.On("DeletePageStrokesByLayer", ctx, "example.com", "Public").Return(map[string]int{"author": 1}, errors.New("throttled"))
+	mockCache.On("InvalidateUserPages", ctx, "author", "").Return(nil)
+	mockCache.On("AddUserStrokeCount", ctx, "author", -1).Return(nil)
+	mockStore.On("GetUserById", ctx, "author").Return(models.User{Id: "author", Provider: "github", ProviderId: "123"}, nil)
+
+	deleted, err := svc.ClearPage(ctx, models.User{Id: "admin1"}, "example.com")
+	assert.Error(t, err)
+	assert.Equal(t, 1, deleted)
+	update := <-counterBatcher.UpdateCh
+	assert.Equal(t, -1, update.Delta)
+	mockCache.AssertNotCalled(t, "InvalidatePages", mock.Anything, mock.Anything)
+}
+
+func TestClearPage_NotAdmin(t *testing.T) {
+	svc, mockStore, _, _, _, _ := setupService(t)
+	ctx := context.Background()
+
+	_, err := svc.ClearPage(ctx, models.User{Id: "user1"}, "example.com")
+	assert.ErrorIs(t, err, service.ErrNotAdmin)
+	mockStore.AssertNotCalled(t, "DeletePageStrokesByLayer", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestGetRecentPages_ClampsLimit(t *testing.T) {
+	svc, _, mockCache, _, _, _ := setupService(t)
+	svc.Config.MaxRecentPages = 5
+	ctx := context.Background()
+	user := models.User{Id: "user1"}
+
+	// Newest first, as returned by the cache
+	recent := []cache.RecentPage{
+		{PageKey: "b.com", LastDrawn: 2000},
+		{PageKey: "a.com", LastDrawn: 1000},
+	}
+	mockCache.On("GetRecentPages", ctx, "user1", 5).Return(recent, nil)
+	mockCache.On("GetRecentPages", ctx, "user1", 2).Return(recent, nil)
+
+	// Missing and too large limits fall back to the configured max
+	pages, err := svc.GetRecentPages(ctx, user, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, recent, pages)
+	_, err = svc.GetRecentPages(ctx, user, 100)
+	assert.NoError(t, err)
+	mockCache.AssertNumberOfCalls(t, "GetRecentPages", 2)
+	mockCache.AssertCalled(t, "GetRecentPages", ctx, "user1", 5)
+
+	_, err = svc.GetRecentPages(ctx, user, 2)
+	assert.NoError(t, err)
+	mockCache.AssertCalled(t, "GetRecentPages", ctx, "user1", 2)
+}
+
+func TestGetPageStatus_Complete(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+
+	mockCache.On("IsPageComplete", ctx, "example.com").Return(true, nil)
+	mockCache.On("GetPageStrokeCountFromZCard", ctx, "example.com").Return(int64(1000), nil)
+
+	status, err := svc.GetPageStatus(ctx, "example.com", models.LayerPublic)
+	assert.NoError(t, err)
+	assert.Equal(t, service.PageStatus{StrokeCount: 1000, MaxStrokes: 1000, Full: true, Complete: true}, status)
+	mockStore.AssertNotCalled(t, "GetVisibleStrokeRecords", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestGetPageStatus_LoadsIncompletePage(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+
+	// Not in cache: loaded from the store before counting
+	mockCache.On("IsPageComplete", ctx, "example.com").Return(false, nil)
+	mockCache.On("GetStrokes", ctx, "example.com").Return([][]byte{}, nil)
+	mockStore.On("GetVisibleStrokeRecords", ctx, "example.com", mock.Anything).Return([]models.Stroke{
+		{Id: "00000000-0000-7000-8000-000000000001", Content: []byte("data")},
+	}, nil)
+	mockCache.On("AddStrokesBatch", ctx, "example.com", mock.Anything).Return(nil)
+	mockCache.On("GetPageStrokeCountFromZCard", ctx, "example.com").Return(int64(1), nil)
+
+	status, err := svc.GetPageStatus(ctx, "example.com", models.LayerPublic)
+	assert.NoError(t, err)
+	assert.Equal(t, service.PageStatus{StrokeCount: 1, MaxStrokes: 1000, Full: false, Complete: true}, status)
+	mockStore.AssertCalled(t, "GetVisibleStrokeRecords", ctx, "example.com", mock.Anything)
+}
+
+func TestGetPageStatus_InvalidKey(t *testing.T) {
+	svc, _, mockCache, _, _, _ := setupService(t)
+
+	_, err := svc.GetPageStatus(context.Background(), "https://example.com", models.LayerPublic)
+	assert.Error(t, err)
+	mockCache.AssertNotCalled(t, "IsPageComplete", mock.Anything, mock.Anything)
+}
+
+func TestGetPageStatus_NormalizesKey(t *testing.T) {
+	svc, _, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+
+	mockCache.On("IsPageComplete", ctx, "example.com").Return(true, nil)
+	mockCache.On("GetPageStrokeCountFromZCard", ctx, "example.com").Return(int64(1), nil)
+
+	_, err := svc.GetPageStatus(ctx, "Example.COM", models.LayerPublic)
+	assert.NoError(t, err)
+	mockCache.AssertCalled(t, "IsPageComplete", ctx, "example.com")
+}
+
+func TestSyncPageSeq_NormalizesKey(t *testing.T) {
+	svc, _, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+
+	mockCache.On("GetStrokesAfterSeq", ctx, "example.com", int64(5)).Return(cache.StrokesAfterSeq{LastSeq: 5}, nil)
+
+	_, err := svc.SyncPageSeq(ctx, "Example.COM", models.LayerPublic, 5)
+	assert.NoError(t, err)
+	mockCache.AssertCalled(t, "GetStrokesAfterSeq", ctx, "example.com", int64(5))
+}
+
+func TestSyncPageSeq_ReturnsStrokesAfterSeq(t *testing.T) {
+	svc, _, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+	pageKey := "example.com"
+
+	cached := []cache.SequencedStroke{}
+	for seq := int64(6); seq <= 8; seq++ {
+		stroke := models.Stroke{Id: fmt.Sprintf("%08x-0000-7000-8000-%012x", seq, seq), Content: []byte("data")}
+		strokeBytes, _ := json.Marshal(stroke)
+		cached = append(cached, cache.SequencedStroke{Seq: seq, Data: strokeBytes})
+	}
+	// Seq 9 undid a stroke drawn before seq 5, the client still shows it
+	mockCache.On("GetStrokesAfterSeq", ctx, pageKey, int64(5)).Return(cache.StrokesAfterSeq{
+		Strokes:    cached,
+		RemovedIds: []string{"00000000-0000-7000-8000-000000000002"},
+		LastSeq:    9,
+	}, nil)
+
+	missed, err := svc.SyncPageSeq(ctx, pageKey, models.LayerPublic, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(9), missed.Seq)
+	assert.Equal(t, []string{"00000000-0000-7000-8000-000000000002"}, missed.RemovedIds)
+	if assert.Len(t, missed.Strokes, 3) {
+		for i, stroke := range missed.Strokes {
+			seq := int64(6 + i)
+			assert.Equal(t, seq, stroke.Seq)
+			assert.Equal(t, fmt.Sprintf("%08x-0000-7000-8000-%012x", seq, seq), stroke.Stroke.Id)
+		}
+	}
+}
+
+func TestSyncPageSeq_Gap(t *testing.T) {
+	svc, _, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+
+	mockCache.On("GetStrokesAfterSeq", ctx, "example.com", int64(5)).Return(cache.StrokesAfterSeq{}, cache.ErrSequenceGap)
+
+	_, err := svc.SyncPageSeq(ctx, "example.com", models.LayerPublic, 5)
+	assert.ErrorIs(t, err, cache.ErrSequenceGap)
+
+	_, err = svc.SyncPageSeq(ctx, "example.com", models.LayerPublic, -1)
+	assert.Error(t, err)
+	mockCache.AssertNumberOfCalls(t, "GetStrokesAfterSeq", 1)
+}
+
+func TestLoadPage_RetriesThrottledStoreRead(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+	pageKey := "example.com"
+
+	stroke := models.Stroke{Id: "00000000-0000-7000-8000-000000000001", Content: []byte("data")}
+	mockCache.On("GetStrokes", ctx, pageKey).Return([][]byte{}, nil)
+	mockCache.On("IsPageComplete", ctx, pageKey).Return(false, nil)
+	mockStore.On("GetVisibleStrokeRecords", ctx, pageKey, mock.Anything).Return([]models.Stroke(nil), fmt.Errorf("query failed: %w", store.ErrThrottled)).Once()
+	mockStore.On("GetVisibleStrokeRecords", ctx, pageKey, mock.Anything).Return([]models.Stroke{stroke}, nil).Once()
+	mockCache.On("AddStrokesBatch", ctx, pageKey, mock.Anything).Return(nil)
+
+	strokes, err := svc.LoadPage(ctx, pageKey, models.LayerPublic)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.Stroke{stroke}, strokes)
+	mockStore.AssertNumberOfCalls(t, "GetVisibleStrokeRecords", 2)
+}
+
+func TestLoadPage_DoesNotRetryTerminalStoreError(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+	pageKey := "example.com"
+
+	mockCache.On("GetStrokes", ctx, pageKey).Return([][]byte{}, nil)
+	mockCache.On("IsPageComplete", ctx, pageKey).Return(false, nil)
+	mockStore.On("GetVisibleStrokeRecords", ctx, pageKey, mock.Anything).Return([]models.Stroke(nil), assert.AnError)
+
+	_, err := svc.LoadPage(ctx, pageKey, models.LayerPublic)
+	assert.ErrorIs(t, err, assert.AnError)
+	mockStore.AssertNumberOfCalls(t, "GetVisibleStrokeRecords", 1)
+}
+
+func TestLoadPage_GivesUpAfterRepeatedThrottling(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+	pageKey := "example.com"
+
+	mockCache.On("GetStrokes", ctx, pageKey).Return([][]byte{}, nil)
+	mockCache.On("IsPageComplete", ctx, pageKey).Return(false, nil)
+	mockStore.On("GetVisibleStrokeRecords", ctx, pageKey, mock.Anything).Return([]models.Stroke(nil), store.ErrThrottled)
+
+	_, err := svc.LoadPage(ctx, pageKey, models.LayerPublic)
+	assert.ErrorIs(t, err, store.ErrThrottled)
+	mockStore.AssertNumberOfCalls(t, "GetVisibleStrokeRecords", 3)
+}
+
+func TestGetUserPages_KeepsRecentlyDrawnPagesMissingFromStore(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+	user := models.User{Id: "user1"}
+
+	// The set was not cached when example.com was drawn on, and its stroke isn't written yet
+	mockCache.On("GetUserPages", ctx, user.Id).Return([]string{"example.com", "a.com"}, false, nil)
+	mockStore.On("GetUserPages", ctx, user.Id).Return([]string{"a.com", "b.com"}, nil)
+	mockCache.On("SetUserPages", ctx, user.Id, []string{"a.com", "b.com", "example.com"}, time.Minute).Return(nil)
+
+	pages, _, err := svc.GetUserPages(ctx, user, 10, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.com", "b.com", "example.com"}, pages)
+	mockCache.AssertExpectations(t)
+}
+
+func TestGetUserPages_CachesStoreResultAndPaginates(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+	user := models.User{Id: "user1"}
+
+	storePages := []string{"c.com", "a.com", "b.com"}
+	mockCache.On("GetUserPages", ctx, user.Id).Return([]string{}, false, nil)
+	mockStore.On("GetUserPages", ctx, user.Id).Return(storePages, nil)
+	mockCache.On("SetUserPages", ctx, user.Id, storePages, time.Minute).Return(nil)
+
+	pages, cursor, err := svc.GetUserPages(ctx, user, 2, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.com", "b.com"}, pages)
+	assert.Equal(t, "b.com", cursor)
+
+	pages, cursor, err = svc.GetUserPages(ctx, user, 2, cursor)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"c.com"}, pages)
+	assert.Empty(t, cursor)
+	mockCache.AssertCalled(t, "SetUserPages", ctx, user.Id, storePages, time.Minute)
+}
+
+func TestGetUserPages_ServedFromCache(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+	user := models.User{Id: "user1"}
+
+	mockCache.On("GetUserPages", ctx, user.Id).Return([]string{"b.com", "a.com"}, true, nil)
+
+	pages, cursor, err := svc.GetUserPages(ctx, user, 0, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.com", "b.com"}, pages)
+	assert.Empty(t, cursor)
+	mockStore.AssertNotCalled(t, "GetUserPages", mock.Anything, mock.Anything)
+}
+
+func TestUserDisplaySeed(t *testing.T) {
+	seed := service.UserDisplaySeed("user1")
+	assert.Equal(t, seed, service.UserDisplaySeed("user1"))
+	assert.NotEqual(t, seed, service.UserDisplaySeed("user2"))
+	assert.NotEqual(t, service.UserDisplaySeed("user2"), service.UserDisplaySeed("user3"))
+
+	seeds := service.UserDisplaySeeds([]models.Stroke{{Id: "s1", UserId: "user1"}, {Id: "s2", UserId: "user2"}, {Id: "s3", UserId: "user1"}})
+	assert.Equal(t, map[string]uint32{"user1": seed, "user2": service.UserDisplaySeed("user2")}, seeds)
+	assert.Empty(t, service.UserDisplaySeeds(nil))
+}
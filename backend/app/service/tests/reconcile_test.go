@@ -0,0 +1,118 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/zlnvch/webverse/cache"
+	"github.com/zlnvch/webverse/metrics"
+	"github.com/zlnvch/webverse/models"
+)
+
+func TestReconcilePages_ReloadsDriftedPage(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	registry := metrics.NewRegistry()
+	svc.Metrics = registry
+	svc.Config.ReconcileInterval = time.Minute
+	ctx := context.Background()
+	pageKey := "example.com"
+
+	// An old stroke the batcher dropped, and one just drawn that may still be pending
+	oldStroke, _ := json.Marshal(models.Stroke{Id: "00000000-0000-7000-8000-000000000001", Content: []byte("data")})
+	recentId := uuid.Must(uuid.NewV7()).String()
+	recentStroke, _ := json.Marshal(models.Stroke{Id: recentId, Content: []byte("data")})
+	dbStrokes := make([]models.Stroke, 10)
+	for i := range dbStrokes {
+		dbStrokes[i] = models.Stroke{Id: fmt.Sprintf("%08x-0000-7000-8000-%012x", i+2, i+2), Content: []byte("data")}
+	}
+
+	mockCache.On("GetTouchedPages", ctx, mock.Anything, 50).Return([]string{pageKey}, nil)
+	mockCache.On("IsPageComplete", ctx, pageKey).Return(true, nil)
+	mockCache.On("GetPageStrokeCountFromZCard", ctx, pageKey).Return(int64(100), nil)
+	mockStore.On("CountPageStrokes", ctx, pageKey).Return(10, nil)
+	mockCache.On("GetStrokes", ctx, pageKey).Return([][]byte{oldStroke, recentStroke}, nil)
+	mockCache.On("InvalidatePages", ctx, []string{pageKey}).Return(nil).Once()
+	mockStore.On("GetVisibleStrokeRecords", ctx, pageKey, mock.Anything).Return(dbStrokes, nil).Once()
+	mockCache.On("AddStrokesBatch", ctx, pageKey, mock.MatchedBy(func(items []cache.StrokeCacheItem) bool {
+		return len(items) == 10
+	})).Return(nil).Once()
+	mockCache.On("AddStrokesBatch", ctx, pageKey, mock.MatchedBy(func(items []cache.StrokeCacheItem) bool {
+		return len(items) == 1 && items[0].StrokeId == recentId
+	})).Return(nil).Once()
+
+	reloaded, err := svc.ReconcilePages(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, reloaded)
+	mockCache.AssertExpectations(t)
+	assert.Equal(t, int64(1), registry.Counter("service.reconciled_pages"))
+}
+
+func TestReconcilePages_IgnoresDriftWithinThreshold(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	svc.Config.ReconcileInterval = time.Minute
+	ctx := context.Background()
+
+	mockCache.On("GetTouchedPages", ctx, mock.Anything, 50).Return([]string{"example.com"}, nil)
+	mockCache.On("IsPageComplete", ctx, "example.com").Return(true, nil)
+	mockCache.On("GetPageStrokeCountFromZCard", ctx, "example.com").Return(int64(120), nil)
+	mockStore.On("CountPageStrokes", ctx, "example.com").Return(100, nil)
+
+	reloaded, err := svc.ReconcilePages(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, reloaded)
+	mockCache.AssertNotCalled(t, "InvalidatePages", mock.Anything, mock.Anything)
+}
+
+func TestReconcilePages_StoredCountCappedAtLoadLimit(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	svc.Config.ReconcileInterval = time.Minute
+	ctx := context.Background()
+
+	// A page awaiting trimming holds more strokes than a load caches
+	mockCache.On("GetTouchedPages", ctx, mock.Anything, 50).Return([]string{"example.com"}, nil)
+	mockCache.On("IsPageComplete", ctx, "example.com").Return(true, nil)
+	mockCache.On("GetPageStrokeCountFromZCard", ctx, "example.com").Return(int64(1100), nil)
+	mockStore.On("CountPageStrokes", ctx, "example.com").Return(1400, nil)
+
+	reloaded, err := svc.ReconcilePages(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, reloaded)
+	mockCache.AssertNotCalled(t, "InvalidatePages", mock.Anything, mock.Anything)
+}
+
+func TestReconcilePages_SkipsIncompletePage(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	svc.Config.ReconcileInterval = time.Minute
+	ctx := context.Background()
+
+	mockCache.On("GetTouchedPages", ctx, mock.Anything, 50).Return([]string{"example.com"}, nil)
+	mockCache.On("IsPageComplete", ctx, "example.com").Return(false, nil)
+
+	reloaded, err := svc.ReconcilePages(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, reloaded)
+	mockStore.AssertNotCalled(t, "CountPageStrokes", mock.Anything, mock.Anything)
+	mockCache.AssertNotCalled(t, "InvalidatePages", mock.Anything, mock.Anything)
+}
+
+func TestLoadPage_TracksPageForReconciliation(t *testing.T) {
+	svc, _, mockCache, _, _, _ := setupService(t)
+	svc.Config.ReconcileInterval = time.Minute
+	ctx := context.Background()
+
+	mockCache.On("GetStrokes", ctx, "example.com").Return([][]byte{}, nil)
+	mockCache.On("IsPageComplete", ctx, "example.com").Return(true, nil)
+	mockCache.On("TouchPage", ctx, "example.com", mock.Anything).Return(int64(5000), nil).Once()
+
+	_, err := svc.LoadPage(ctx, "example.com", models.LayerPublic)
+	assert.NoError(t, err)
+	mockCache.AssertExpectations(t)
+	// Without a page cap nothing is evicted
+	mockCache.AssertNotCalled(t, "EvictOldestPages", mock.Anything, mock.Anything)
+}
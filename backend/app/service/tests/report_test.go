@@ -0,0 +1,95 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/zlnvch/webverse/models"
+	"github.com/zlnvch/webverse/service"
+	"github.com/zlnvch/webverse/store"
+)
+
+const reportedStrokeId = "00000000-0000-7000-8000-000000000001"
+
+func TestReportStroke_ThresholdHides(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	svc.Config.ReportHideThreshold = 3
+	ctx := context.Background()
+	reporter := models.User{Id: "user1"}
+
+	mockStore.On("GetStroke", ctx, "example.com", reportedStrokeId).Return(models.Stroke{Id: reportedStrokeId, UserId: "user2"}, nil)
+	mockStore.On("AddStrokeReport", ctx, mock.MatchedBy(func(r models.StrokeReport) bool {
+		return r.PageKey == "example.com" && r.StrokeId == reportedStrokeId && r.ReporterId == "user1" && r.Reason == "spam"
+	})).Return(3, nil).Once()
+	mockStore.On("SetStrokeHidden", ctx, "example.com", reportedStrokeId, true).Return(nil).Once()
+	removed := wrapMockWithSignal(mockCache.On("RemoveStroke", mock.Anything, "example.com", reportedStrokeId).Return(nil).Once())
+	published := make(chan []byte, 1)
+	mockCache.On("Publish", mock.Anything, "page:example.com", mock.Anything).Run(func(args mock.Arguments) {
+		published <- args.Get(2).([]byte)
+	}).Return(nil).Once()
+
+	assert.NoError(t, svc.ReportStroke(ctx, reporter, "example.com", reportedStrokeId, " spam "))
+
+	select {
+	case <-removed:
+	case <-time.After(1 * time.Second):
+		t.Fatal("hidden stroke was not removed from the cache")
+	}
+	select {
+	case msgBytes := <-published:
+		var msg service.DeleteStrokeMessage
+		assert.NoError(t, json.Unmarshal(msgBytes, &msg))
+		assert.Equal(t, "delete_stroke", msg.Type)
+		assert.Equal(t, reportedStrokeId, msg.Data.StrokeId)
+		assert.Equal(t, "user2", msg.Data.UserId)
+	case <-time.After(1 * time.Second):
+		t.Fatal("delete_stroke was not published")
+	}
+	mockStore.AssertExpectations(t)
+}
+
+func TestReportStroke_OtherCountsDontHide(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		threshold int
+		reports   int
+	}{
+		{"below threshold", 3, 2},
+		{"past threshold", 3, 4},
+		{"disabled", 0, 100},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			svc, mockStore, mockCache, _, _, _ := setupService(t)
+			svc.Config.ReportHideThreshold = tc.threshold
+			ctx := context.Background()
+
+			mockStore.On("GetStroke", ctx, "example.com", reportedStrokeId).Return(models.Stroke{Id: reportedStrokeId, UserId: "user2"}, nil)
+			mockStore.On("AddStrokeReport", ctx, mock.Anything).Return(tc.reports, nil).Once()
+
+			assert.NoError(t, svc.ReportStroke(ctx, models.User{Id: "user1"}, "example.com", reportedStrokeId, ""))
+			mockStore.AssertNotCalled(t, "SetStrokeHidden", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+			mockCache.AssertNotCalled(t, "RemoveStroke", mock.Anything, mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestReportStroke_Rejected(t *testing.T) {
+	svc, mockStore, _, _, _, _ := setupService(t)
+	ctx := context.Background()
+	reporter := models.User{Id: "user1"}
+
+	mockStore.On("GetStroke", ctx, "example.com", reportedStrokeId).Return(models.Stroke{Id: reportedStrokeId, UserId: "user1"}, nil)
+	mockStore.On("GetStroke", ctx, "other.com", reportedStrokeId).Return(models.Stroke{}, store.ErrItemNotFound)
+
+	assert.ErrorIs(t, svc.ReportStroke(ctx, reporter, "example.com", reportedStrokeId, ""), service.ErrReportOwnStroke)
+	assert.ErrorIs(t, svc.ReportStroke(ctx, reporter, "other.com", reportedStrokeId, ""), service.ErrStrokeNotFound)
+	assert.EqualError(t, svc.ReportStroke(ctx, reporter, "example.com", "not-a-uuid", ""), "invalid stroke id")
+	assert.EqualError(t, svc.ReportStroke(ctx, reporter, "example.com", reportedStrokeId, strings.Repeat("a", 201)), "report reason too long")
+	assert.Error(t, svc.ReportStroke(ctx, reporter, "https://example.com", reportedStrokeId, ""))
+	mockStore.AssertNotCalled(t, "AddStrokeReport", mock.Anything, mock.Anything)
+}
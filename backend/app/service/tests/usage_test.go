@@ -0,0 +1,64 @@
+package service_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/zlnvch/webverse/cache"
+	"github.com/zlnvch/webverse/models"
+)
+
+func TestGetUsage_ComputesAndCaches(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+	user := models.User{Id: "user1"}
+
+	mockCache.On("GetUserUsage", ctx, "user1").Return(cache.UserUsage{}, nil)
+	mockStore.On("GetUserStrokeCount", ctx, "user1", "").Return(10, nil)
+	mockStore.On("GetUserPages", ctx, "user1").Return([]string{"a.com", "b.com"}, nil)
+
+	var cached cache.UserUsage
+	mockCache.On("SetUserUsage", ctx, "user1", mock.Anything, 10*time.Minute).Run(func(args mock.Arguments) {
+		cached = args.Get(2).(cache.UserUsage)
+	}).Return(nil)
+
+	usage, err := svc.GetUsage(ctx, user)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, usage.StrokeCount)
+	assert.Equal(t, 2, usage.PageCount)
+	assert.Equal(t, int64(10*1024), usage.EstimatedBytes)
+	assert.NotZero(t, usage.Computed)
+	assert.Equal(t, usage, cached)
+}
+
+func TestGetUsage_CacheHit(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+	user := models.User{Id: "user1"}
+
+	cached := cache.UserUsage{StrokeCount: 3, PageCount: 1, EstimatedBytes: 3072, Computed: 1000}
+	mockCache.On("GetUserUsage", ctx, "user1").Return(cached, nil)
+
+	usage, err := svc.GetUsage(ctx, user)
+	assert.NoError(t, err)
+	assert.Equal(t, cached, usage)
+
+	mockStore.AssertNotCalled(t, "GetUserStrokeCount", mock.Anything, mock.Anything, mock.Anything)
+	mockStore.AssertNotCalled(t, "GetUserPages", mock.Anything, mock.Anything)
+}
+
+func TestGetUsage_StoreError(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+	user := models.User{Id: "user1"}
+
+	mockCache.On("GetUserUsage", ctx, "user1").Return(cache.UserUsage{}, nil)
+	mockStore.On("GetUserStrokeCount", ctx, "user1", "").Return(0, assert.AnError)
+
+	_, err := svc.GetUsage(ctx, user)
+	assert.ErrorIs(t, err, assert.AnError)
+	mockCache.AssertNotCalled(t, "SetUserUsage", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
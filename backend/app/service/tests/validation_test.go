@@ -1,11 +1,14 @@
 package service_test
 
 import (
+	"context"
 	"encoding/json"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/zlnvch/webverse/models"
 	"github.com/zlnvch/webverse/service"
 )
 
@@ -25,6 +28,31 @@ func TestValidateStrokeContent(t *testing.T) {
 			`{bad}`,
 			"invalid content format",
 		},
+		{
+			"Empty Object",
+			`{}`,
+			"empty stroke content",
+		},
+		{
+			"Empty Object With Whitespace",
+			` {  } `,
+			"empty stroke content",
+		},
+		{
+			"Null",
+			`null`,
+			"empty stroke content",
+		},
+		{
+			"No Content",
+			``,
+			"empty stroke content",
+		},
+		{
+			"Not An Object",
+			`[]`,
+			"invalid content format",
+		},
 		{
 			"Invalid Tool",
 			`{"tool":10,"color":"#ff0000","width":5,"startX":0,"startY":0,"dx":[],"dy":[]}`,
@@ -50,6 +78,66 @@ func TestValidateStrokeContent(t *testing.T) {
 			`{"tool":0,"color":"#ff0000","width":21,"startX":0,"startY":0,"dx":[],"dy":[]}`,
 			"invalid width",
 		},
+		{
+			"Eraser Width Above Pen Max (Valid)",
+			`{"tool":1,"color":"#ff0000","width":35,"startX":0,"startY":0,"dx":[],"dy":[]}`,
+			"",
+		},
+		{
+			"Eraser Width Too Large",
+			`{"tool":1,"color":"#ff0000","width":51,"startX":0,"startY":0,"dx":[],"dy":[]}`,
+			"invalid width",
+		},
+		{
+			"Eraser Without Color (Valid)",
+			`{"tool":1,"width":10,"startX":0,"startY":0,"dx":[1],"dy":[1]}`,
+			"",
+		},
+		{
+			"Eraser Invalid Color",
+			`{"tool":1,"color":"transparent","width":10,"startX":0,"startY":0,"dx":[],"dy":[]}`,
+			"invalid color",
+		},
+		{
+			"Eraser Width Too Small",
+			`{"tool":1,"width":0,"startX":0,"startY":0,"dx":[],"dy":[]}`,
+			"invalid width",
+		},
+		{
+			"Eraser Mismatched Points",
+			`{"tool":1,"width":10,"startX":0,"startY":0,"dx":[1,2],"dy":[1]}`,
+			"mismatched stroke points",
+		},
+		{
+			"Pen Without Color",
+			`{"tool":0,"width":5,"startX":0,"startY":0,"dx":[],"dy":[]}`,
+			"invalid color",
+		},
+		{
+			"Negative Tool",
+			`{"tool":-1,"color":"#ff0000","width":5,"startX":0,"startY":0,"dx":[],"dy":[]}`,
+			"invalid tool",
+		},
+		{
+			"Pen Width Above Pen Max",
+			`{"tool":0,"color":"#ff0000","width":35,"startX":0,"startY":0,"dx":[],"dy":[]}`,
+			"invalid width",
+		},
+		{
+			"Mismatched Points (More Dx)",
+			`{"tool":0,"color":"#ff0000","width":5,"startX":0,"startY":0,"dx":[1,2],"dy":[1]}`,
+			"mismatched stroke points",
+		},
+		{
+			"Mismatched Points (Missing Dy)",
+			`{"tool":0,"color":"#ff0000","width":5,"startX":0,"startY":0,"dx":[1]}`,
+			"mismatched stroke points",
+		},
+		{
+			"Matched Points (Valid)",
+			`{"tool":0,"color":"#ff0000","width":5,"startX":0,"startY":0,"dx":[1,2],"dy":[3,4]}`,
+			"",
+		},
 		{
 			"Empty Arrays (Valid)",
 			`{"tool":0,"color":"#ff0000","width":5,"startX":0,"startY":0,"dx":[],"dy":[]}`,
@@ -85,9 +173,131 @@ func TestValidateStrokeContent(t *testing.T) {
 		err := service.ValidateStrokeContent(b)
 		assert.Error(t, err)
 		assert.Equal(t, "stroke too long", err.Error())
+
+		// Erasers have the same point limit
+		content.Tool = 1
+		b, _ = json.Marshal(content)
+		err = service.ValidateStrokeContent(b)
+		assert.Error(t, err)
+		assert.Equal(t, "stroke too long", err.Error())
 	})
 }
 
+func TestStrokeLimits_CustomToolWidths(t *testing.T) {
+	limits := service.DefaultStrokeLimits()
+	limits.ToolWidths[service.ToolEraser] = service.WidthBounds{Min: 10, Max: 100}
+
+	eraserWide := []byte(`{"tool":1,"color":"#ff0000","width":80,"startX":0,"startY":0,"dx":[],"dy":[]}`)
+	eraserThin := []byte(`{"tool":1,"color":"#ff0000","width":5,"startX":0,"startY":0,"dx":[],"dy":[]}`)
+	penDefault := []byte(`{"tool":0,"color":"#ff0000","width":20,"startX":0,"startY":0,"dx":[],"dy":[]}`)
+
+	assert.NoError(t, limits.ValidateStrokeContent(eraserWide))
+	assert.EqualError(t, limits.ValidateStrokeContent(eraserThin), "invalid width")
+	assert.NoError(t, limits.ValidateStrokeContent(penDefault))
+
+	// Package-level validation keeps using the defaults
+	assert.EqualError(t, service.ValidateStrokeContent(eraserWide), "invalid width")
+}
+
+func TestStrokeLimits_AllowedColors(t *testing.T) {
+	limits := service.DefaultStrokeLimits()
+	limits.AllowedColors = []string{"#FF0000", "#00ff00"}
+
+	allowed := []byte(`{"tool":0,"color":"#ff0000","width":5,"startX":0,"startY":0,"dx":[],"dy":[]}`)
+	allowedUpper := []byte(`{"tool":0,"color":"#00FF00","width":5,"startX":0,"startY":0,"dx":[],"dy":[]}`)
+	disallowed := []byte(`{"tool":0,"color":"#0000ff","width":5,"startX":0,"startY":0,"dx":[],"dy":[]}`)
+	eraser := []byte(`{"tool":1,"color":"#0000ff","width":5,"startX":0,"startY":0,"dx":[],"dy":[]}`)
+	malformed := []byte(`{"tool":0,"color":"red","width":5,"startX":0,"startY":0,"dx":[],"dy":[]}`)
+
+	assert.NoError(t, limits.ValidateStrokeContent(allowed))
+	assert.NoError(t, limits.ValidateStrokeContent(allowedUpper))
+	assert.EqualError(t, limits.ValidateStrokeContent(disallowed), "color not allowed")
+	assert.NoError(t, limits.ValidateStrokeContent(eraser))
+	assert.EqualError(t, limits.ValidateStrokeContent(malformed), "invalid color")
+
+	// Default limits allow any valid color
+	assert.NoError(t, service.ValidateStrokeContent(disallowed))
+}
+
+func TestStrokeLimits_MinPoints(t *testing.T) {
+	dot := []byte(`{"tool":0,"color":"#ff0000","width":5,"startX":0,"startY":0,"dx":[],"dy":[]}`)
+	line := []byte(`{"tool":0,"color":"#ff0000","width":5,"startX":0,"startY":0,"dx":[1],"dy":[1]}`)
+	eraserDot := []byte(`{"tool":1,"width":5,"startX":0,"startY":0,"dx":[],"dy":[]}`)
+
+	// Unset, dots are accepted
+	limits := service.DefaultStrokeLimits()
+	assert.NoError(t, limits.ValidateStrokeContent(dot))
+	assert.NoError(t, limits.ValidateStrokeContent(eraserDot))
+
+	limits.MinPoints = 2
+	assert.EqualError(t, limits.ValidateStrokeContent(dot), "too few stroke points")
+	assert.EqualError(t, limits.ValidateStrokeContent(eraserDot), "too few stroke points")
+	assert.NoError(t, limits.ValidateStrokeContent(line))
+}
+
+func TestValidateStroke_DryRun(t *testing.T) {
+	svc, mockStore, mockCache, mockMQ, _, _ := setupService(t)
+	validContent := `{"tool":0,"color":"#ff0000","width":5,"startX":0,"startY":0,"dx":[],"dy":[]}`
+	privateKey := "YWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWE="
+
+	tests := []struct {
+		name    string
+		pageKey string
+		layer   models.LayerType
+		content string
+		wantErr string
+	}{
+		{"Valid", "example.com", models.LayerPublic, validContent, ""},
+		{"Invalid Page Key", "https://example.com", models.LayerPublic, validContent, "public page key must not contain protocol"},
+		{"Invalid Content Format", "example.com", models.LayerPublic, `{bad}`, "invalid content format"},
+		{"Empty Public Content", "example.com", models.LayerPublic, `{}`, "empty stroke content"},
+		{"Invalid Tool", "example.com", models.LayerPublic, `{"tool":10,"color":"#ff0000","width":5,"dx":[],"dy":[]}`, "invalid tool"},
+		{"Invalid Color", "example.com", models.LayerPublic, `{"tool":0,"color":"red","width":5,"dx":[],"dy":[]}`, "invalid color"},
+		{"Invalid Width", "example.com", models.LayerPublic, `{"tool":0,"color":"#ff0000","width":0,"dx":[],"dy":[]}`, "invalid width"},
+		{"Private Content Not Validated", privateKey, models.LayerPrivate, "ciphertext", ""},
+		{"Invalid Private Page Key", "example.com", models.LayerPrivate, "ciphertext", "invalid private page key encoding"},
+		{"Invalid Layer", "example.com", models.LayerType(2), validContent, "invalid layer"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := svc.ValidateStroke(tc.pageKey, tc.layer, []byte(tc.content))
+			if tc.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.wantErr)
+			}
+		})
+	}
+
+	// A dry run never touches the store, cache or queue
+	mockStore.AssertExpectations(t)
+	mockCache.AssertExpectations(t)
+	mockMQ.AssertExpectations(t)
+	assert.Empty(t, mockStore.Calls)
+	assert.Empty(t, mockCache.Calls)
+	assert.Empty(t, mockMQ.Calls)
+}
+
+func TestValidateStroke_RejectPlaintextPrivate(t *testing.T) {
+	svc, _, _, _, _, _ := setupService(t)
+	privateKey := "YWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWE="
+	plaintext := []byte(`{"tool":0,"color":"#ff0000","width":5,"startX":0,"startY":0,"dx":[1],"dy":[1]}`)
+	ciphertext := []byte{0x8f, 0x02, 0x7b, 0xe1, 0x00, 0x5c, 0x9a, 0x7b, 0x22, 0x41}
+
+	// Opt-in: private content is opaque by default
+	assert.NoError(t, svc.ValidateStroke(privateKey, models.LayerPrivate, plaintext))
+
+	svc.Config.RejectPlaintextPrivate = true
+	assert.EqualError(t, svc.ValidateStroke(privateKey, models.LayerPrivate, plaintext), "private stroke content appears unencrypted")
+	assert.EqualError(t, svc.ValidateStroke(privateKey, models.LayerPrivate, []byte(" {} ")), "private stroke content appears unencrypted")
+	assert.NoError(t, svc.ValidateStroke(privateKey, models.LayerPrivate, ciphertext))
+	// Starts like a JSON object but isn't one
+	assert.NoError(t, svc.ValidateStroke(privateKey, models.LayerPrivate, []byte("{\x8f\x02")))
+	// Public strokes are plaintext by definition
+	assert.NoError(t, svc.ValidateStroke("example.com", models.LayerPublic, plaintext))
+}
+
 func TestValidatePageKey_Public(t *testing.T) {
 	tests := []struct {
 		key     string
@@ -109,6 +319,16 @@ func TestValidatePageKey_Public(t *testing.T) {
 		{"example.com:8080", false, "must not contain port"},
 		{"google.com", true, ""},
 		{"[2001:db8::1]", false, "must contain a dot"},
+		{strings.Repeat("a", 250) + ".com", false, "host is too long"},
+		{strings.Repeat("a", 249) + ".com", true, ""},
+		{"a." + strings.Repeat("b", 10000), false, "is too long"},
+		{"example.com/" + strings.Repeat("p", 2100), false, "is too long"},
+		{"example.com/\x00path", false, "non-printable"},
+		{"exa\tmple.com", false, "non-printable"},
+		{"example.com/\x7f", false, "non-printable"},
+		{"example.com/\u200b", false, "non-printable"},
+		{"example.com/\xff\xfe", false, "non-printable"},
+		{"example.com/caf\u00e9", true, ""},
 	}
 
 	for _, tc := range tests {
@@ -139,6 +359,168 @@ func TestValidatePageKey_Private(t *testing.T) {
 	assert.Error(t, service.ValidatePageKey("!!!notbase64!!!", true))
 }
 
+func TestPageKeyPolicy_AllowPrivateHosts(t *testing.T) {
+	privateHosts := []string{"localhost", "localhost/dashboard", "127.0.0.1", "192.168.1.1/admin", "intranet", "[2001:db8::1]"}
+
+	// Off by default
+	svc, _, _, _, _, _ := setupService(t)
+	for _, key := range privateHosts {
+		assert.Error(t, svc.CheckPageKey(key, false), "Key: %s", key)
+	}
+
+	svc.Config.PageKeyPolicy.AllowPrivateHosts = true
+	for _, key := range privateHosts {
+		assert.NoError(t, svc.CheckPageKey(key, false), "Key: %s", key)
+	}
+
+	// The remaining format checks still apply
+	assert.EqualError(t, svc.CheckPageKey("http://localhost", false), "public page key must not contain protocol")
+	assert.EqualError(t, svc.CheckPageKey("localhost:3000", false), "public page key must not contain port")
+	assert.EqualError(t, svc.CheckPageKey("intranet?q=1", false), "public page key must not contain query or fragment")
+}
+
+func TestPageKeyPolicy_Blocklist(t *testing.T) {
+	policy := service.PageKeyPolicy{Blocklist: []string{"bank.com", "*.gov", "*.Example.org"}}
+
+	tests := []struct {
+		key     string
+		blocked bool
+	}{
+		{"bank.com", true},
+		{"bank.com/login", true},
+		{"BANK.com", true},
+		{"online.bank.com", false}, // Exact entries don't match subdomains
+		{"notbank.com", false},
+		{"irs.gov", true},
+		{"www2.irs.gov/forms", true},
+		{"gov.uk", false},
+		{"sub.example.org", true},
+		{"example.org", false}, // Wildcard entries only match subdomains
+		{"google.com", false},
+	}
+
+	for _, tc := range tests {
+		err := policy.Check(tc.key, false)
+		if tc.blocked {
+			assert.EqualError(t, err, "page key is blocked", "Key: %s", tc.key)
+		} else {
+			assert.NoError(t, err, "Key: %s", tc.key)
+		}
+	}
+}
+
+func TestCheckPageKey_PrivateBypassesBlocklist(t *testing.T) {
+	svc, _, _, _, _, _ := setupService(t)
+	svc.Config.PageKeyPolicy.Blocklist = []string{"*.gov"}
+	privateKey := "YWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWE="
+
+	assert.NoError(t, svc.CheckPageKey(privateKey, true))
+	assert.EqualError(t, svc.CheckPageKey("irs.gov", false), "page key is blocked")
+	// Format validation still runs first
+	assert.EqualError(t, svc.CheckPageKey("https://irs.gov", false), "public page key must not contain protocol")
+}
+
+func TestPageKeyPolicy_Allowlist(t *testing.T) {
+	policy := service.PageKeyPolicy{Allowlist: []string{"docs.example.com", "*.wiki.org"}}
+
+	assert.NoError(t, policy.Check("docs.example.com/page", false))
+	assert.NoError(t, policy.Check("en.wiki.org", false))
+	assert.EqualError(t, policy.Check("example.com", false), "page key is not allowed")
+	assert.EqualError(t, policy.Check("wiki.org", false), "page key is not allowed")
+
+	// Private keys are gated by their own flag, not the allowlist
+	privateKey := "YWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWE="
+	assert.NoError(t, policy.Check(privateKey, true))
+	policy.DisablePrivate = true
+	assert.EqualError(t, policy.Check(privateKey, true), "private pages are disabled")
+	assert.NoError(t, policy.Check("en.wiki.org", false))
+}
+
+func TestNormalizePageKey_Host(t *testing.T) {
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{"example.com", "example.com"},
+		{"Example.COM", "example.com"},
+		{"Docs.Example.com/Guide/Intro", "docs.example.com/Guide/Intro"}, // Paths are case-sensitive
+		{"example.com/a//b/", "example.com/a//b/"},                       // Paths are only normalized if enabled
+	}
+
+	for _, tc := range tests {
+		assert.Equal(t, tc.expected, service.NormalizePageKey(tc.key, false), "Key: %s", tc.key)
+	}
+
+	// Private keys are case-sensitive base64
+	privateKey := "YWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWE="
+	assert.Equal(t, privateKey, service.NormalizePageKey(privateKey, true))
+}
+
+func TestPageKeyPolicy_NormalizePaths(t *testing.T) {
+	policy := service.PageKeyPolicy{NormalizePaths: true}
+
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{"Example.com/", "example.com"},
+		{"example.com/Docs/", "example.com/Docs"},
+		{"example.com//Docs///Page//", "example.com/Docs/Page"},
+		{"example.com/Docs/Page", "example.com/Docs/Page"},
+	}
+
+	for _, tc := range tests {
+		normalized := policy.NormalizePageKey(tc.key, false)
+		assert.Equal(t, tc.expected, normalized, "Key: %s", tc.key)
+		assert.NoError(t, policy.ValidatePageKey(normalized, false), "Key: %s", tc.key)
+	}
+}
+
+func TestLoadPage_NormalizesHost(t *testing.T) {
+	svc, _, mockCache, _, _, _ := setupService(t)
+	ctx := context.Background()
+
+	mockCache.On("GetStrokes", ctx, "example.com/Page").Return([][]byte{}, nil)
+	mockCache.On("IsPageComplete", ctx, "example.com/Page").Return(true, nil)
+
+	_, err := svc.LoadPage(ctx, "EXAMPLE.com/Page", models.LayerPublic)
+	assert.NoError(t, err)
+	mockCache.AssertCalled(t, "GetStrokes", ctx, "example.com/Page")
+	mockCache.AssertNotCalled(t, "GetStrokes", ctx, "EXAMPLE.com/Page")
+}
+
+func TestNewService_AllowlistAndBlocklistExclusive(t *testing.T) {
+	config := service.DefaultConfig()
+	config.PageKeyPolicy = service.PageKeyPolicy{Blocklist: []string{"bank.com"}, Allowlist: []string{"example.com"}}
+
+	_, err := service.NewService(nil, nil, nil, nil, nil, nil, [][]byte{[]byte("secret")}, config)
+	assert.EqualError(t, err, "page key allowlist and blocklist are mutually exclusive")
+}
+
+func TestDrawStroke_BlockedPageKey(t *testing.T) {
+	svc, _, mockCache, _, _, _ := setupService(t)
+	svc.Config.PageKeyPolicy.Blocklist = []string{"bank.com"}
+
+	params := service.DrawParams{
+		User:    models.User{Id: "user1"},
+		PageKey: "bank.com",
+		Layer:   models.LayerPublic,
+		Stroke:  models.Stroke{Content: []byte(`{"tool":0,"color":"#000000","width":1,"startX":0,"startY":0,"dx":[],"dy":[]}`)},
+	}
+	_, err := svc.DrawStroke(context.Background(), params)
+	assert.EqualError(t, err, "page key is blocked")
+	mockCache.AssertNotCalled(t, "GetUserStrokeCount", mock.Anything, mock.Anything)
+}
+
+func TestLoadPage_BlockedPageKey(t *testing.T) {
+	svc, _, mockCache, _, _, _ := setupService(t)
+	svc.Config.PageKeyPolicy.Blocklist = []string{"*.gov"}
+
+	_, err := svc.LoadPage(context.Background(), "irs.gov", models.LayerPublic)
+	assert.EqualError(t, err, "page key is blocked")
+	mockCache.AssertNotCalled(t, "GetStrokes", mock.Anything, mock.Anything)
+}
+
 // Fuzz tests for input validation functions
 // These tests use randomized input to find edge cases and vulnerabilities
 
@@ -151,6 +533,8 @@ func FuzzValidateStrokeContent(f *testing.F) {
 	f.Add([]byte(`{invalid json}`))
 	f.Add([]byte{})
 	f.Add([]byte(`{"tool":0,"color":"#000000","width":5,"points":[`)) // Large array
+	f.Add([]byte(`{"tool":0,"color":"#000000","width":5,"startX":0,"startY":0,"dx":[1,2,3],"dy":[1]}`)) // Mismatched points
+	f.Add([]byte(`{"tool":0,"color":"#000000","width":5,"startX":0,"startY":0,"dx":[1]}`)) // Missing dy
 
 	f.Fuzz(func(t *testing.T, input []byte) {
 		// The function should never panic
@@ -176,6 +560,10 @@ func FuzzValidatePageKey_Public(f *testing.F) {
 	f.Add([]byte("")) // Empty
 	f.Add([]byte("a.b")) // Minimal valid
 	f.Add([]byte(strings.Repeat("a", 1000))) // Very long key
+	f.Add([]byte("a." + strings.Repeat("b", 10000))) // Invalid - host over 253 characters
+	f.Add([]byte("example.com/\x00")) // Invalid - control character
+	f.Add([]byte("example.com/\xff")) // Invalid - not UTF-8
+	f.Add([]byte("example.com/\u202e")) // Invalid - non-printable format character
 
 	f.Fuzz(func(t *testing.T, input []byte) {
 		// Should never panic
@@ -0,0 +1,62 @@
+package service_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/zlnvch/webverse/models"
+	"github.com/zlnvch/webverse/service"
+	"github.com/zlnvch/webverse/store"
+	"github.com/zlnvch/webverse/webhook"
+)
+
+// Webhook that records the events it is notified of
+type recordingWebhook struct {
+	events chan webhook.Event
+}
+
+func (w *recordingWebhook) Notify(event webhook.Event) {
+	w.events <- event
+}
+
+func TestUndoStroke_NotifiesWebhook(t *testing.T) {
+	svc, mockStore, mockCache, _, _, _ := setupService(t)
+	hook := &recordingWebhook{events: make(chan webhook.Event, 1)}
+	svc.Webhook = hook
+	ctx := context.Background()
+
+	mockStore.On("DeleteStroke", ctx, "example.com", "stroke1", "user1").Return(nil)
+	mockCache.On("RemoveStroke", mock.Anything, mock.Anything, mock.Anything).Return(nil).Maybe()
+	mockCache.On("DecrementUserStrokeCount", mock.Anything, mock.Anything).Return(nil).Maybe()
+	mockCache.On("Publish", mock.Anything, mock.Anything, mock.Anything).Return(nil).Maybe()
+
+	err := svc.UndoStroke(ctx, service.UndoParams{User: models.User{Id: "user1"}, PageKey: "example.com", Layer: models.LayerPublic, StrokeId: "stroke1"})
+	assert.NoError(t, err)
+
+	select {
+	case event := <-hook.events:
+		assert.Equal(t, "undo", event.Type)
+		assert.Equal(t, "example.com", event.PageKey)
+		assert.Equal(t, "stroke1", event.StrokeId)
+		assert.Equal(t, "user1", event.UserId)
+	case <-time.After(1 * time.Second):
+		t.Fatal("webhook was not notified")
+	}
+}
+
+func TestUndoStroke_FailedUndoDoesNotNotifyWebhook(t *testing.T) {
+	svc, mockStore, _, _, _, _ := setupService(t)
+	hook := &recordingWebhook{events: make(chan webhook.Event, 1)}
+	svc.Webhook = hook
+	ctx := context.Background()
+
+	// Someone else's stroke
+	mockStore.On("DeleteStroke", ctx, "example.com", "stroke1", "user1").Return(store.ErrConditionFailed)
+
+	err := svc.UndoStroke(ctx, service.UndoParams{User: models.User{Id: "user1"}, PageKey: "example.com", Layer: models.LayerPublic, StrokeId: "stroke1"})
+	assert.ErrorIs(t, err, store.ErrConditionFailed)
+	assert.Empty(t, hook.events)
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/zlnvch/webverse/cache"
+	"github.com/zlnvch/webverse/models"
+)
+
+const (
+	// Average size of a stored stroke item: the encoded points plus its keys and attributes
+	// Used instead of reading every stroke of the user to add up their sizes
+	estimatedStrokeBytes = 1024
+
+	// How long a usage estimate is served before it is recounted
+	userUsageTTL = 10 * time.Minute
+)
+
+// GetUsage estimates how much data the user has stored, across all pages and layers
+func (s *Service) GetUsage(ctx context.Context, user models.User) (cache.UserUsage, error) {
+	if usage, err := s.Cache.GetUserUsage(ctx, user.Id); err != nil {
+		log.Printf("Failed to get cached usage for user %s: %v", user.Id, err)
+	} else if usage.Computed > 0 {
+		return usage, nil
+	}
+
+	strokeCount, err := s.Store.GetUserStrokeCount(ctx, user.Id, "")
+	if err != nil {
+		return cache.UserUsage{}, err
+	}
+
+	pages, err := s.Store.GetUserPages(ctx, user.Id)
+	if err != nil {
+		return cache.UserUsage{}, err
+	}
+
+	usage := cache.UserUsage{
+		StrokeCount:    strokeCount,
+		PageCount:      len(pages),
+		EstimatedBytes: int64(strokeCount) * estimatedStrokeBytes,
+		Computed:       time.Now().UnixMilli(),
+	}
+
+	if err := s.Cache.SetUserUsage(ctx, user.Id, usage, userUsageTTL); err != nil {
+		log.Printf("Failed to cache usage for user %s: %v", user.Id, err)
+	}
+
+	return usage, nil
+}
@@ -1,12 +1,18 @@
 package service
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"maps"
 	"net/url"
 	"regexp"
 	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/zlnvch/webverse/models"
 )
 
 type Tool int
@@ -32,41 +38,251 @@ type strokeContent struct {
 	Dy     []int32 `json:"dy"`
 }
 
+const (
+	// maxPublicPageKeyLength bounds a public page key including its path
+	maxPublicPageKeyLength = 2048
+	// maxHostnameLength is the longest domain name RFC 1035 allows in its text form
+	maxHostnameLength = 253
+)
+
 var hexColorRegex = regexp.MustCompile(`^#[0-9A-Fa-f]{6}$`)
 var ipv4Regex = regexp.MustCompile(`^\d{1,3}(\.\d{1,3}){3}$`)
 
 const (
 	minWidth        = 1
 	maxWidth        = 20
+	maxEraserWidth  = 50
 	maxStrokePoints = 1000
+	// Upper bound of a page's MaxPoints override. The websocket message size limit still applies
+	maxPageStrokePoints = 10000
 )
 
+type WidthBounds struct {
+	Min uint8
+	Max uint8
+}
+
+// StrokeLimits bounds the content of public strokes
+// Tools missing from ToolWidths fall back to the pen bounds
+type StrokeLimits struct {
+	ToolWidths map[Tool]WidthBounds
+	// Restricts the palette of public strokes, e.g. to brand colors
+	// Empty allows any valid hex color
+	AllowedColors []string
+	// Fewest points a stroke can have, counting its start point, e.g. 2 rejects dots
+	// Every current tool draws along points. A tool without them, like a fill, would be exempt
+	// Zero accepts any stroke. Private strokes are encrypted, so it only applies to public ones
+	MinPoints int
+	// Most points a stroke can have, not counting its start point. Zero uses the built-in 1000
+	MaxPoints int
+}
+
+func DefaultStrokeLimits() StrokeLimits {
+	return StrokeLimits{
+		ToolWidths: map[Tool]WidthBounds{
+			ToolPen:    {Min: minWidth, Max: maxWidth},
+			ToolEraser: {Min: minWidth, Max: maxEraserWidth},
+		},
+	}
+}
+
+// normalizeColor brings a hex color to the form AllowedColors are compared in
+func normalizeColor(color string) string {
+	return strings.ToLower(color)
+}
+
+func (limits StrokeLimits) colorAllowed(color string) bool {
+	if len(limits.AllowedColors) == 0 {
+		return true
+	}
+	color = normalizeColor(color)
+	for _, allowed := range limits.AllowedColors {
+		if normalizeColor(allowed) == color {
+			return true
+		}
+	}
+	return false
+}
+
+func (limits StrokeLimits) maxPoints() int {
+	if limits.MaxPoints > 0 {
+		return limits.MaxPoints
+	}
+	return maxStrokePoints
+}
+
+// WithPageSettings returns the limits with a page's overrides applied
+// MaxWidth only changes the pen, the eraser keeps its own bounds
+func (limits StrokeLimits) WithPageSettings(settings models.PageSettings) StrokeLimits {
+	if settings.MaxWidth > 0 {
+		bounds := limits.widthBounds(ToolPen)
+		bounds.Max = settings.MaxWidth
+		// Copy the map, the receiver's is shared with the global config
+		toolWidths := maps.Clone(limits.ToolWidths)
+		if toolWidths == nil {
+			toolWidths = make(map[Tool]WidthBounds)
+		}
+		toolWidths[ToolPen] = bounds
+		limits.ToolWidths = toolWidths
+	}
+	if settings.MaxPoints > 0 {
+		limits.MaxPoints = settings.MaxPoints
+	}
+	return limits
+}
+
+// ValidatePageSettings checks that a page's overrides can be applied on top of the given limits
+func (limits StrokeLimits) ValidatePageSettings(settings models.PageSettings) error {
+	if settings.MaxWidth > 0 && settings.MaxWidth < limits.widthBounds(ToolPen).Min {
+		return errors.New("page max width is below the pen's min width")
+	}
+	if settings.MaxPoints < 0 || settings.MaxPoints > maxPageStrokePoints {
+		return errors.New("page max points out of range")
+	}
+	if settings.MaxPoints > 0 && 1+settings.MaxPoints < limits.MinPoints {
+		return errors.New("page max points is below the min points")
+	}
+	return nil
+}
+
+func (limits StrokeLimits) widthBounds(tool Tool) WidthBounds {
+	if bounds, ok := limits.ToolWidths[tool]; ok {
+		return bounds
+	}
+	return WidthBounds{Min: minWidth, Max: maxWidth}
+}
+
+// ValidateStrokeContent validates stroke content against the default limits
 func ValidateStrokeContent(contentBytes []byte) error {
+	return DefaultStrokeLimits().ValidateStrokeContent(contentBytes)
+}
+
+func (limits StrokeLimits) ValidateStrokeContent(contentBytes []byte) error {
+	// Would unmarshal into zero values and fail on whichever field happens to be checked first
+	if isEmptyContent(contentBytes) {
+		return errors.New("empty stroke content")
+	}
+
 	var content strokeContent
 	if err := json.Unmarshal(contentBytes, &content); err != nil {
 		return errors.New("invalid content format")
 	}
 
-	if content.Tool < 0 || content.Tool >= ToolCount {
+	switch content.Tool {
+	case ToolPen:
+		if !hexColorRegex.MatchString(content.Color) {
+			return errors.New("invalid color")
+		}
+		if !limits.colorAllowed(content.Color) {
+			return errors.New("color not allowed")
+		}
+
+	case ToolEraser:
+		// The eraser's color is never rendered, so it can be left out and is not restricted to AllowedColors
+		// If it is sent, it must still be a valid color so stored content stays well-formed
+		if content.Color != "" && !hexColorRegex.MatchString(content.Color) {
+			return errors.New("invalid color")
+		}
+
+	default:
 		return errors.New("invalid tool")
 	}
 
-	if !hexColorRegex.MatchString(content.Color) {
-		return errors.New("invalid color")
+	return limits.validateStrokeShape(content)
+}
+
+// looksLikePlaintextStroke reports whether private stroke content is a JSON object that parses as
+// public stroke content. Ciphertext is effectively random bytes, which are practically never one
+func looksLikePlaintextStroke(contentBytes []byte) bool {
+	trimmed := bytes.TrimSpace(contentBytes)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return false
 	}
+	var content strokeContent
+	return json.Unmarshal(trimmed, &content) == nil
+}
 
-	if content.Width < minWidth || content.Width > maxWidth {
+// isEmptyContent reports whether the content is missing, null or an empty JSON object
+func isEmptyContent(contentBytes []byte) bool {
+	trimmed := bytes.TrimSpace(contentBytes)
+	if len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null")) {
+		return true
+	}
+	if len(trimmed) < 2 || trimmed[0] != '{' || trimmed[len(trimmed)-1] != '}' {
+		return false
+	}
+	return len(bytes.TrimSpace(trimmed[1:len(trimmed)-1])) == 0
+}
+
+// validateStrokeShape checks the width and points, which are limited for every tool
+func (limits StrokeLimits) validateStrokeShape(content strokeContent) error {
+	bounds := limits.widthBounds(content.Tool)
+	if content.Width < bounds.Min || content.Width > bounds.Max {
 		return errors.New("invalid width")
 	}
 
-	if len(content.Dx) > maxStrokePoints || len(content.Dy) > maxStrokePoints {
+	if len(content.Dx) > limits.maxPoints() || len(content.Dy) > limits.maxPoints() {
 		return errors.New("stroke too long")
 	}
 
+	// Each point is a (dx, dy) pair
+	if len(content.Dx) != len(content.Dy) {
+		return errors.New("mismatched stroke points")
+	}
+
+	if 1+len(content.Dx) < limits.MinPoints {
+		return errors.New("too few stroke points")
+	}
+
 	return nil
 }
 
+// NormalizePageKey lowercases the host of a public page key, so that differently cased
+// variants of a page map to one key. The path is left as is, URL paths are case-sensitive
+// Private keys are HMACs of the URL and are returned unchanged
+func NormalizePageKey(pageKey string, isPrivate bool) string {
+	return normalizePageKey(pageKey, isPrivate, false)
+}
+
+// NormalizePageKey normalizes the page key, also removing trailing and repeated slashes
+// from the path if the policy normalizes paths
+func (policy PageKeyPolicy) NormalizePageKey(pageKey string, isPrivate bool) string {
+	return normalizePageKey(pageKey, isPrivate, policy.NormalizePaths)
+}
+
+func normalizePageKey(pageKey string, isPrivate bool, normalizePaths bool) string {
+	if isPrivate {
+		return pageKey
+	}
+
+	host, path, hasPath := strings.Cut(pageKey, "/")
+	host = strings.ToLower(host)
+	if !hasPath {
+		return host
+	}
+	if normalizePaths {
+		for strings.Contains(path, "//") {
+			path = strings.ReplaceAll(path, "//", "/")
+		}
+		path = strings.Trim(path, "/")
+		if path == "" {
+			return host
+		}
+	}
+	return host + "/" + path
+}
+
+// ValidatePageKey validates the page key format, public keys must be public domains
 func ValidatePageKey(pageKey string, isPrivate bool) error {
+	return validatePageKey(pageKey, isPrivate, false)
+}
+
+// ValidatePageKey validates the page key format, also accepting private hosts if the policy allows them
+func (policy PageKeyPolicy) ValidatePageKey(pageKey string, isPrivate bool) error {
+	return validatePageKey(pageKey, isPrivate, policy.AllowPrivateHosts)
+}
+
+func validatePageKey(pageKey string, isPrivate bool, allowPrivateHosts bool) error {
 	if isPrivate {
 		// Private keys are base64-encoded 32-byte HMACs
 		decoded, err := base64.StdEncoding.DecodeString(pageKey)
@@ -80,6 +296,12 @@ func ValidatePageKey(pageKey string, isPrivate bool) error {
 	}
 
 	// Public keys: normalized URLs
+	if len(pageKey) > maxPublicPageKeyLength {
+		return errors.New("public page key is too long")
+	}
+	if !isPrintable(pageKey) {
+		return errors.New("public page key must not contain control or non-printable characters")
+	}
 	if strings.Contains(pageKey, "://") {
 		return errors.New("public page key must not contain protocol")
 	}
@@ -102,6 +324,14 @@ func ValidatePageKey(pageKey string, isPrivate bool) error {
 	if u.Port() != "" {
 		return errors.New("public page key must not contain port")
 	}
+	if len(u.Hostname()) > maxHostnameLength {
+		return errors.New("public page key host is too long")
+	}
+
+	// Intranet hosts (localhost, dotless names, IPs) are only accepted when explicitly enabled
+	if allowPrivateHosts {
+		return nil
+	}
 
 	hostname := u.Hostname()
 
@@ -121,3 +351,85 @@ func ValidatePageKey(pageKey string, isPrivate bool) error {
 
 	return nil
 }
+
+// isPrintable reports whether s is valid UTF-8 made only of printable characters
+func isPrintable(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// PageKeyPolicy restricts which pages can be drawn on and loaded
+// List entries are exact hosts ("bank.com") or wildcard suffixes ("*.gov" matches any subdomain of gov)
+// Blocklist and Allowlist are mutually exclusive
+type PageKeyPolicy struct {
+	// Public pages whose host matches are rejected
+	Blocklist []string
+	// When non-empty, only public pages whose host matches are accepted
+	Allowlist []string
+	// Private keys are HMACs of the URL, so the server doesn't know their host and
+	// neither list applies to them. They can only be disabled altogether
+	DisablePrivate bool
+	// Accept public page keys on localhost, IP addresses and dotless intranet hosts
+	// Protocol, port, query and fragment are still rejected
+	AllowPrivateHosts bool
+	// Remove trailing and repeated slashes from public page paths before validation,
+	// instead of rejecting them. Hosts are always lowercased
+	NormalizePaths bool
+}
+
+func (policy PageKeyPolicy) Validate() error {
+	if len(policy.Blocklist) > 0 && len(policy.Allowlist) > 0 {
+		return errors.New("page key allowlist and blocklist are mutually exclusive")
+	}
+	return nil
+}
+
+// Check applies the policy to a page key that already passed the policy's ValidatePageKey
+func (policy PageKeyPolicy) Check(pageKey string, isPrivate bool) error {
+	if isPrivate {
+		if policy.DisablePrivate {
+			return errors.New("private pages are disabled")
+		}
+		return nil
+	}
+
+	host, _, _ := strings.Cut(pageKey, "/")
+	host = strings.ToLower(host)
+	if hostMatchesAny(host, policy.Blocklist) {
+		return errors.New("page key is blocked")
+	}
+	if len(policy.Allowlist) > 0 && !hostMatchesAny(host, policy.Allowlist) {
+		return errors.New("page key is not allowed")
+	}
+	return nil
+}
+
+func hostMatchesAny(host string, entries []string) bool {
+	for _, entry := range entries {
+		entry = strings.ToLower(entry)
+		if suffix, ok := strings.CutPrefix(entry, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == entry {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckPageKey validates the page key format and applies the configured page key policy
+// Used wherever a page is loaded, subscribed to or drawn on
+func (s *Service) CheckPageKey(pageKey string, isPrivate bool) error {
+	if err := s.Config.PageKeyPolicy.ValidatePageKey(pageKey, isPrivate); err != nil {
+		return err
+	}
+	return s.Config.PageKeyPolicy.Check(pageKey, isPrivate)
+}
@@ -2,23 +2,29 @@ package dynamo
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"strconv"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/gofrs/uuid/v5"
 
 	"github.com/zlnvch/webverse/models"
+	"github.com/zlnvch/webverse/store"
 )
 
 type DynamoWebverseStore struct {
 	client    *dynamodb.Client
 	tableName string
+	config    DynamoConfig
 }
 
-func NewDynamoWebverseStore(ctx context.Context, devMode bool, dynamodbEndpoint string, tableName string) (*DynamoWebverseStore, error) {
+func NewDynamoWebverseStore(ctx context.Context, devMode bool, dynamodbEndpoint string, tableName string, config DynamoConfig) (*DynamoWebverseStore, error) {
 	client, err := newDynamoDBClient(context.Background(), devMode, dynamodbEndpoint)
 	if err != nil {
 		return nil, err
@@ -37,10 +43,16 @@ func NewDynamoWebverseStore(ctx context.Context, devMode bool, dynamodbEndpoint
 		}
 	}
 	if !foundTable {
-		return nil, fmt.Errorf("given table name '%s' not found in dynamodb", tableName)
+		if !devMode {
+			return nil, fmt.Errorf("given table name '%s' not found in dynamodb", tableName)
+		}
+		log.Printf("Table '%s' not found in dynamodb, creating it", tableName)
+		if err := ensureTable(client, ctx, tableName); err != nil {
+			return nil, fmt.Errorf("failed to create table '%s': %w", tableName, err)
+		}
 	}
 
-	return &DynamoWebverseStore{client: client, tableName: tableName}, nil
+	return &DynamoWebverseStore{client: client, tableName: tableName, config: config}, nil
 }
 
 func (dynamoStore *DynamoWebverseStore) CreateUser(ctx context.Context, user models.User) (models.User, error) {
@@ -71,10 +83,91 @@ func (dynamoStore *DynamoWebverseStore) GetUser(ctx context.Context, provider st
 	return user, nil
 }
 
-func (dynamoStore *DynamoWebverseStore) GetStrokeRecords(ctx context.Context, pageKey string) ([]models.Stroke, error) {
-	// Fetch newest 1100 strokes (ScanIndexForward: false)
-	// There should be only 1000 or a little more, but just to be safe, we will enforce 1100 limit here
-	dynamoStrokes, err := queryAllByPK[dynamoStroke](dynamoStore, ctx, "STROKE#"+pageKey, false, 1100)
+// GetUserById resolves an internal user id through GSI_UserId
+// Only the fields projected into the index are set, never the encryption keys or stroke count
+func (dynamoStore *DynamoWebverseStore) GetUserById(ctx context.Context, id string) (models.User, error) {
+	output, err := dynamoStore.client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(dynamoStore.tableName),
+		IndexName:              aws.String("GSI_UserId"),
+		KeyConditionExpression: aws.String("Id = :id"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":id": &types.AttributeValueMemberS{Value: id},
+		},
+		Limit: aws.Int32(1),
+	})
+	if err != nil {
+		return models.User{}, fmt.Errorf("query GSI failed: %w", markThrottled(err))
+	}
+	if len(output.Items) == 0 {
+		return models.User{}, store.ErrItemNotFound
+	}
+
+	var du dynamoUser
+	if err := attributevalue.UnmarshalMap(output.Items[0], &du); err != nil {
+		return models.User{}, fmt.Errorf("failed to unmarshal user: %w", err)
+	}
+	return userFromDynamo(du), nil
+}
+
+// GetUsersCreatedBetween returns up to limit users created between start and end (Unix seconds, inclusive), oldest first
+// Pass the returned cursor to get the next page, it is empty after the last one
+// Only the fields projected into GSI_Created are set, never the encryption keys
+func (dynamoStore *DynamoWebverseStore) GetUsersCreatedBetween(ctx context.Context, start int64, end int64, limit int, cursor string) ([]models.User, string, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(dynamoStore.tableName),
+		IndexName:              aws.String("GSI_Created"),
+		KeyConditionExpression: aws.String("SK = :sk AND Created BETWEEN :start AND :end"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":sk":    &types.AttributeValueMemberS{Value: "PROFILE"},
+			":start": &types.AttributeValueMemberN{Value: strconv.FormatInt(start, 10)},
+			":end":   &types.AttributeValueMemberN{Value: strconv.FormatInt(end, 10)},
+		},
+		Limit: aws.Int32(int32(limit)),
+	}
+	if cursor != "" {
+		startKey, err := decodeCreatedCursor(cursor)
+		if err != nil {
+			return nil, "", store.ErrInvalidCursor
+		}
+		input.ExclusiveStartKey = startKey
+	}
+
+	output, err := dynamoStore.client.Query(ctx, input)
+	if err != nil {
+		return nil, "", fmt.Errorf("query GSI failed: %w", err)
+	}
+
+	var dynamoUsers []dynamoUser
+	if err := attributevalue.UnmarshalListOfMaps(output.Items, &dynamoUsers); err != nil {
+		return nil, "", fmt.Errorf("failed to unmarshal users: %w", err)
+	}
+	users := make([]models.User, 0, len(dynamoUsers))
+	for _, du := range dynamoUsers {
+		users = append(users, userFromDynamo(du))
+	}
+
+	nextCursor := ""
+	if len(output.LastEvaluatedKey) > 0 {
+		if nextCursor, err = encodeCreatedCursor(output.LastEvaluatedKey); err != nil {
+			return nil, "", err
+		}
+	}
+	return users, nextCursor, nil
+}
+
+// GetStrokeRecords returns the newest limit strokes of the page, use GetAllStrokeRecords for the rest
+func (dynamoStore *DynamoWebverseStore) GetStrokeRecords(ctx context.Context, pageKey string, limit int32) ([]models.Stroke, error) {
+	return dynamoStore.getStrokeRecords(ctx, pageKey, limit, "")
+}
+
+func (dynamoStore *DynamoWebverseStore) GetVisibleStrokeRecords(ctx context.Context, pageKey string, limit int32) ([]models.Stroke, error) {
+	// Hidden is only present on hidden strokes. The query keeps paging until it has limit visible ones
+	return dynamoStore.getStrokeRecords(ctx, pageKey, limit, "attribute_not_exists(Hidden)")
+}
+
+func (dynamoStore *DynamoWebverseStore) getStrokeRecords(ctx context.Context, pageKey string, limit int32, filter string) ([]models.Stroke, error) {
+	// Fetch newest strokes (ScanIndexForward: false)
+	dynamoStrokes, err := queryAllByPK[dynamoStroke](dynamoStore, ctx, "STROKE#"+pageKey, false, limit, filter)
 	if err != nil {
 		return []models.Stroke{}, err
 	}
@@ -88,6 +181,47 @@ func (dynamoStore *DynamoWebverseStore) GetStrokeRecords(ctx context.Context, pa
 	return strokes, nil
 }
 
+// GetAllStrokeRecords walks every stroke of the page, oldest first, unlike GetStrokeRecords which only returns the newest
+// Pass the returned cursor to get the next page, it is empty after the last one
+func (dynamoStore *DynamoWebverseStore) GetAllStrokeRecords(ctx context.Context, pageKey string, cursor string, limit int32) ([]models.Stroke, string, error) {
+	pk := "STROKE#" + pageKey
+
+	var startKey map[string]types.AttributeValue
+	if cursor != "" {
+		var err error
+		if startKey, err = decodeStrokeCursor(cursor, pk); err != nil {
+			return nil, "", store.ErrInvalidCursor
+		}
+	}
+
+	dynamoStrokes, lastKey, err := queryPageByPK[dynamoStroke](dynamoStore, ctx, pk, true, limit, startKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	strokes := make([]models.Stroke, 0, len(dynamoStrokes))
+	for _, ds := range dynamoStrokes {
+		strokes = append(strokes, strokeFromDynamo(ds))
+	}
+
+	nextCursor := ""
+	if lastKey != nil {
+		if nextCursor, err = encodeStrokeCursor(lastKey); err != nil {
+			return nil, "", err
+		}
+	}
+	return strokes, nextCursor, nil
+}
+
+func (dynamoStore *DynamoWebverseStore) GetStroke(ctx context.Context, pageKey string, strokeId string) (models.Stroke, error) {
+	ds, err := getItem[dynamoStroke](dynamoStore, ctx, "STROKE#"+pageKey, strokeId, false)
+	if err != nil {
+		return models.Stroke{}, err
+	}
+
+	return strokeFromDynamo(ds), nil
+}
+
 func (dynamoStore *DynamoWebverseStore) WriteStrokeBatch(ctx context.Context, strokes []models.StrokeRecord) ([]models.StrokeRecord, error) {
 	// Convert strokes to Dynamo structs and then to WriteRequests
 	var writeRequests []types.WriteRequest
@@ -126,7 +260,16 @@ func (dynamoStore *DynamoWebverseStore) DeleteUser(ctx context.Context, provider
 }
 
 func (dynamoStore *DynamoWebverseStore) DeleteUserStrokes(ctx context.Context, userId string, layer string) error {
-	return batchDeleteByGSIThrottled(dynamoStore, ctx, "GSI_UserStrokes", "UserId", "Layer", userId, layer, time.Duration(50*time.Millisecond))
+	_, err := batchDeleteByGSIThrottled(dynamoStore, ctx, "GSI_UserStrokes", "UserId", "Layer", userId, layer, dynamoStore.config.NewDeleteThrottle(), nil)
+	return err
+}
+
+// DeletePageStrokesByLayer deletes the page's strokes in one layer and returns how many of each user's were deleted
+// GSI_PageStrokes projects the UserId next to the keys, so the deleted strokes can be counted per author
+func (dynamoStore *DynamoWebverseStore) DeletePageStrokesByLayer(ctx context.Context, pageKey string, layer string) (map[string]int, error) {
+	deletedByUser := make(map[string]int)
+	_, err := batchDeleteByGSIThrottled(dynamoStore, ctx, "GSI_PageStrokes", "PK", "Layer", "STROKE#"+pageKey, layer, dynamoStore.config.NewDeleteThrottle(), deletedByUser)
+	return deletedByUser, err
 }
 
 func (dynamoStore *DynamoWebverseStore) GetUserPages(ctx context.Context, userId string) ([]string, error) {
@@ -162,12 +305,173 @@ func (dynamoStore *DynamoWebverseStore) GetUserStrokeCount(ctx context.Context,
 	return countByGSI(dynamoStore, ctx, "GSI_UserStrokes", "UserId", userId, "Layer", layer)
 }
 
+func (dynamoStore *DynamoWebverseStore) CountPageStrokes(ctx context.Context, pageKey string) (int, error) {
+	// Every stroke has a Layer, so the page index holds all of them
+	return countByGSI(dynamoStore, ctx, "GSI_PageStrokes", "PK", "STROKE#"+pageKey, "", "")
+}
+
 func (dynamoStore *DynamoWebverseStore) SetUserEncryptionKeys(ctx context.Context, user models.User, incrementKeyVersion bool) (int, error) {
 	du := userToDynamo(user)
 	du, err := updateItem(dynamoStore, ctx, du, []string{"SaltKEK", "EncryptedDEK1", "NonceDEK1", "EncryptedDEK2", "NonceDEK2"}, "KeyVersion", incrementKeyVersion)
 	return du.KeyVersion, err
 }
 
+func (dynamoStore *DynamoWebverseStore) RotateUserKEK(ctx context.Context, user models.User, expectedKeyVersion int) error {
+	du := userToDynamo(user)
+	_, err := dynamoStore.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(dynamoStore.tableName),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: du.PK},
+			"SK": &types.AttributeValueMemberS{Value: du.SK},
+		},
+		UpdateExpression: aws.String("SET SaltKEK = :salt, EncryptedDEK1 = :dek1, NonceDEK1 = :nonce1, EncryptedDEK2 = :dek2, NonceDEK2 = :nonce2"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":salt":      &types.AttributeValueMemberS{Value: du.SaltKEK},
+			":dek1":      &types.AttributeValueMemberS{Value: du.EncryptedDEK1},
+			":nonce1":    &types.AttributeValueMemberS{Value: du.NonceDEK1},
+			":dek2":      &types.AttributeValueMemberS{Value: du.EncryptedDEK2},
+			":nonce2":    &types.AttributeValueMemberS{Value: du.NonceDEK2},
+			":version":   &types.AttributeValueMemberN{Value: strconv.Itoa(expectedKeyVersion)},
+			":emptySalt": &types.AttributeValueMemberS{Value: ""},
+		},
+		// Deleted keys keep their version but clear the salt, so both are checked
+		ConditionExpression: aws.String("KeyVersion = :version AND SaltKEK <> :emptySalt"),
+	})
+	if err != nil {
+		var cce *types.ConditionalCheckFailedException
+		if errors.As(err, &cce) {
+			return store.ErrConditionFailed
+		}
+		return markThrottled(fmt.Errorf("UpdateItem failed: %w", err))
+	}
+	return nil
+}
+
+func (dynamoStore *DynamoWebverseStore) UpdateUsername(ctx context.Context, provider string, providerId string, username string) error {
+	du := userToDynamo(models.User{Provider: provider, ProviderId: providerId, Username: username})
+	_, err := updateItem(dynamoStore, ctx, du, []string{"Username"}, "", false)
+	return err
+}
+
+func (dynamoStore *DynamoWebverseStore) UpdateUserLastActive(ctx context.Context, provider string, providerId string, lastActive int64) error {
+	du := userToDynamo(models.User{Provider: provider, ProviderId: providerId, LastActive: lastActive})
+	_, err := updateItem(dynamoStore, ctx, du, []string{"LastActive"}, "", false)
+	return err
+}
+
+func (dynamoStore *DynamoWebverseStore) AddStrokeReport(ctx context.Context, report models.StrokeReport) (int, error) {
+	dr := strokeReportToDynamo(report)
+	// A repeated report by the same user keeps the first one
+	if _, _, err := ensureItem(dynamoStore, ctx, dr); err != nil {
+		return 0, markThrottled(err)
+	}
+	return countByPK(dynamoStore, ctx, dr.PK)
+}
+
+func (dynamoStore *DynamoWebverseStore) SetStrokeHidden(ctx context.Context, pageKey string, strokeId string, hidden bool) error {
+	// Unhiding removes the attribute, so it is only present on hidden strokes
+	updateExpr := "REMOVE Hidden"
+	var exprAttrValues map[string]types.AttributeValue
+	if hidden {
+		updateExpr = "SET Hidden = :hidden"
+		exprAttrValues = map[string]types.AttributeValue{":hidden": &types.AttributeValueMemberBOOL{Value: true}}
+	}
+
+	_, err := dynamoStore.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(dynamoStore.tableName),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: "STROKE#" + pageKey},
+			"SK": &types.AttributeValueMemberS{Value: strokeId},
+		},
+		UpdateExpression:          aws.String(updateExpr),
+		ExpressionAttributeValues: exprAttrValues,
+		ConditionExpression:       aws.String("attribute_exists(PK)"),
+	})
+	if err != nil {
+		var cce *types.ConditionalCheckFailedException
+		if errors.As(err, &cce) {
+			return store.ErrItemNotFound
+		}
+		return markThrottled(fmt.Errorf("UpdateItem failed: %w", err))
+	}
+	return nil
+}
+
+func (dynamoStore *DynamoWebverseStore) GetPageSettings(ctx context.Context, pageKey string) (models.PageSettings, error) {
+	dps, err := getItem[dynamoPageSettings](dynamoStore, ctx, "PAGE#"+pageKey, "SETTINGS", false)
+	if err != nil {
+		return models.PageSettings{}, markThrottled(err)
+	}
+	return pageSettingsFromDynamo(dps), nil
+}
+
+func (dynamoStore *DynamoWebverseStore) SetPageSettings(ctx context.Context, pageKey string, settings models.PageSettings) error {
+	avMap, err := attributevalue.MarshalMap(pageSettingsToDynamo(pageKey, settings))
+	if err != nil {
+		return fmt.Errorf("marshal error: %w", err)
+	}
+
+	// Unconditional put, the settings replace whatever the page had
+	_, err = dynamoStore.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(dynamoStore.tableName),
+		Item:      avMap,
+	})
+	if err != nil {
+		return markThrottled(fmt.Errorf("PutItem failed: %w", err))
+	}
+	return nil
+}
+
+// Close is a no-op: the AWS SDK client holds no resources that need releasing
+func (dynamoStore *DynamoWebverseStore) Close() error {
+	return nil
+}
+
+func (dynamoStore *DynamoWebverseStore) WriteStrokeWithCounter(ctx context.Context, record models.StrokeRecord, provider string, providerId string) error {
+	avMap, err := attributevalue.MarshalMap(strokeRecordToDynamo(record))
+	if err != nil {
+		return fmt.Errorf("marshal error: %w", err)
+	}
+
+	userPK := "USER#" + provider + "#" + providerId
+	_, err = dynamoStore.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				Put: &types.Put{
+					TableName: aws.String(dynamoStore.tableName),
+					Item:      avMap,
+				},
+			},
+			{
+				// Strict mode, same as IncrementUserStrokeCount: never create partial user records
+				Update: &types.Update{
+					TableName: aws.String(dynamoStore.tableName),
+					Key: map[string]types.AttributeValue{
+						"PK": &types.AttributeValueMemberS{Value: userPK},
+						"SK": &types.AttributeValueMemberS{Value: "PROFILE"},
+					},
+					UpdateExpression:          aws.String("SET #c = #c + :val"),
+					ConditionExpression:       aws.String("attribute_exists(PK)"),
+					ExpressionAttributeNames:  map[string]string{"#c": "StrokeCount"},
+					ExpressionAttributeValues: map[string]types.AttributeValue{":val": &types.AttributeValueMemberN{Value: "1"}},
+				},
+			},
+		},
+		// Stroke ids are unique, so retrying a transaction whose outcome is unknown can't count the stroke twice
+		// The token only covers retries through this method, a plain put would count the stroke again
+		ClientRequestToken: aws.String(record.Stroke.Id),
+	})
+	if err != nil {
+		var canceled *types.TransactionCanceledException
+		if errors.As(err, &canceled) && len(canceled.CancellationReasons) == 2 &&
+			aws.ToString(canceled.CancellationReasons[1].Code) == "ConditionalCheckFailed" {
+			return fmt.Errorf("%w: PK=%s, SK=PROFILE", store.ErrItemNotFound, userPK)
+		}
+		return fmt.Errorf("TransactWriteItems failed: %w", markThrottled(err))
+	}
+	return nil
+}
+
 func (dynamoStore *DynamoWebverseStore) IncrementUserStrokeCount(ctx context.Context, provider string, providerId string, count int) error {
 	// Strict mode: only increment if user exists (prevents partial records after delete)
 	return incrementCounter(dynamoStore, ctx, "USER#"+provider+"#"+providerId, "PROFILE", "StrokeCount", count, false)
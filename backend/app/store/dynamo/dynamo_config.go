@@ -0,0 +1,58 @@
+package dynamo
+
+import "time"
+
+// DynamoConfig holds the tunables of the DynamoDB store
+type DynamoConfig struct {
+	// Initial delay between delete batches when bulk deleting a user's strokes
+	// On-demand tables can go lower, provisioned tables may need more to stay within capacity
+	DeleteThrottle time.Duration
+	// Bounds of the adaptive delete delay: it grows when DynamoDB returns unprocessed
+	// items (the table is throttling us) and shrinks again while it doesn't
+	MinDeleteThrottle time.Duration
+	MaxDeleteThrottle time.Duration
+}
+
+func DefaultDynamoConfig() DynamoConfig {
+	return DynamoConfig{
+		DeleteThrottle:    50 * time.Millisecond,
+		MinDeleteThrottle: 10 * time.Millisecond,
+		MaxDeleteThrottle: 2 * time.Second,
+	}
+}
+
+// AdaptiveThrottle is the delay between delete batches of a bulk delete
+// It doubles after every batch that came back with unprocessed items, and shrinks by
+// a quarter after every batch that went through on the first try
+type AdaptiveThrottle struct {
+	initial time.Duration
+	min     time.Duration
+	max     time.Duration
+	delay   time.Duration
+}
+
+func (config DynamoConfig) NewDeleteThrottle() *AdaptiveThrottle {
+	return &AdaptiveThrottle{
+		initial: config.DeleteThrottle,
+		min:     config.MinDeleteThrottle,
+		max:     max(config.MaxDeleteThrottle, config.DeleteThrottle),
+		delay:   config.DeleteThrottle,
+	}
+}
+
+func (throttle *AdaptiveThrottle) Delay() time.Duration {
+	return throttle.delay
+}
+
+// Observe adjusts the delay after a batch, throttled is whether DynamoDB returned unprocessed items
+func (throttle *AdaptiveThrottle) Observe(throttled bool) {
+	if throttled {
+		grown := throttle.delay * 2
+		if grown == 0 {
+			grown = max(throttle.initial, throttle.min, time.Millisecond)
+		}
+		throttle.delay = min(grown, throttle.max)
+		return
+	}
+	throttle.delay = max(throttle.delay-throttle.delay/4, throttle.min)
+}
@@ -1,8 +1,14 @@
 package dynamo
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"strings"
 
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
 	"github.com/zlnvch/webverse/models"
 )
 
@@ -15,6 +21,7 @@ type dynamoUser struct {
 	Username      string `dynamodbav:"Username"`
 	Created       int64  `dynamodbav:"Created"`
 	StrokeCount   int    `dynamodbav:"StrokeCount"`
+	LastActive    int64  `dynamodbav:"LastActive,omitempty"`
 	KeyVersion    int    `dynamodbav:"KeyVersion"`
 	SaltKEK       string `dynamodbav:"SaltKEK"`
 	EncryptedDEK1 string `dynamodbav:"EncryptedDEK1"`
@@ -34,6 +41,7 @@ func userToDynamo(u models.User) dynamoUser {
 		Username:      u.Username,
 		Created:       u.Created,
 		StrokeCount:   u.StrokeCount,
+		LastActive:    u.LastActive,
 		KeyVersion:    u.KeyVersion,
 		SaltKEK:       u.SaltKEK,
 		EncryptedDEK1: u.EncryptedDEK1,
@@ -52,6 +60,7 @@ func userFromDynamo(du dynamoUser) models.User {
 		ProviderId:    du.ProviderId,
 		Created:       du.Created,
 		StrokeCount:   du.StrokeCount,
+		LastActive:    du.LastActive,
 		KeyVersion:    du.KeyVersion,
 		SaltKEK:       du.SaltKEK,
 		EncryptedDEK1: du.EncryptedDEK1,
@@ -68,6 +77,8 @@ type dynamoStroke struct {
 	Layer         string `dynamodbav:"Layer"`
 	Nonce         string `dynamodbav:"Nonce"`
 	StrokeContent []byte `dynamodbav:"StrokeContent"`
+	// Set by moderation, left out of the item for strokes that were never hidden
+	Hidden bool `dynamodbav:"Hidden,omitempty"`
 }
 
 // Map domain StrokeRecord -> Dynamo
@@ -87,6 +98,7 @@ func strokeRecordToDynamo(sr models.StrokeRecord) dynamoStroke {
 		Nonce:         sr.Stroke.Nonce,
 		Layer:         layer,
 		StrokeContent: sr.Stroke.Content,
+		Hidden:        sr.Stroke.Hidden,
 	}
 }
 
@@ -97,10 +109,13 @@ func strokeRecordFromDynamo(ds dynamoStroke) models.StrokeRecord {
 	if ds.Layer == "Public" {
 		layer = models.LayerPublic
 	} else if strings.HasPrefix(ds.Layer, "Private#") {
+		// Unprocessed batch items are written again from these records, so a private stroke
+		// must stay under its Private#<KeyVersion> layer or key rotation would not delete it
+		layer = models.LayerPrivate
 		layerId = ds.Layer[8:]
 	}
 
-	stroke := models.Stroke{Id: ds.SK, UserId: ds.UserId, Nonce: ds.Nonce, Content: ds.StrokeContent}
+	stroke := models.Stroke{Id: ds.SK, UserId: ds.UserId, Nonce: ds.Nonce, Content: ds.StrokeContent, Hidden: ds.Hidden}
 
 	return models.StrokeRecord{
 		PageKey: ds.PK[7:],
@@ -117,5 +132,116 @@ func strokeFromDynamo(ds dynamoStroke) models.Stroke {
 		UserId:  ds.UserId,
 		Nonce:   ds.Nonce,
 		Content: ds.StrokeContent,
+		Hidden:  ds.Hidden,
+	}
+}
+
+// Reports live in a partition per stroke, keyed by reporter so each user counts once
+// The reporter is not stored as UserId, which would put reports in GSI_UserStrokes
+type dynamoStrokeReport struct {
+	PK         string `dynamodbav:"PK"`
+	SK         string `dynamodbav:"SK"`
+	ReporterId string `dynamodbav:"ReporterId"`
+	Reason     string `dynamodbav:"Reason"`
+	ReportedAt int64  `dynamodbav:"ReportedAt"`
+}
+
+func strokeReportPK(pageKey string, strokeId string) string {
+	return "REPORT#" + pageKey + "#" + strokeId
+}
+
+func strokeReportToDynamo(r models.StrokeReport) dynamoStrokeReport {
+	return dynamoStrokeReport{
+		PK:         strokeReportPK(r.PageKey, r.StrokeId),
+		SK:         r.ReporterId,
+		ReporterId: r.ReporterId,
+		Reason:     r.Reason,
+		ReportedAt: r.Created,
+	}
+}
+
+// Page settings live in their own partition, so stroke queries on STROKE#<pageKey> never see them
+type dynamoPageSettings struct {
+	PK        string `dynamodbav:"PK"`
+	SK        string `dynamodbav:"SK"`
+	MaxWidth  uint8  `dynamodbav:"MaxWidth"`
+	MaxPoints int    `dynamodbav:"MaxPoints"`
+}
+
+func pageSettingsToDynamo(pageKey string, ps models.PageSettings) dynamoPageSettings {
+	return dynamoPageSettings{
+		PK:        "PAGE#" + pageKey,
+		SK:        "SETTINGS",
+		MaxWidth:  ps.MaxWidth,
+		MaxPoints: ps.MaxPoints,
+	}
+}
+
+func pageSettingsFromDynamo(dps dynamoPageSettings) models.PageSettings {
+	return models.PageSettings{MaxWidth: dps.MaxWidth, MaxPoints: dps.MaxPoints}
+}
+
+// createdCursor is the LastEvaluatedKey of a GSI_Created query, handed to clients as an opaque string
+type createdCursor struct {
+	PK      string `dynamodbav:"PK" json:"pk"`
+	SK      string `dynamodbav:"SK" json:"sk"`
+	Created int64  `dynamodbav:"Created" json:"created"`
+}
+
+func encodeCreatedCursor(key map[string]types.AttributeValue) (string, error) {
+	var cursor createdCursor
+	if err := attributevalue.UnmarshalMap(key, &cursor); err != nil {
+		return "", err
+	}
+	cursorBytes, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(cursorBytes), nil
+}
+
+func decodeCreatedCursor(encoded string) (map[string]types.AttributeValue, error) {
+	cursorBytes, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	var cursor createdCursor
+	if err := json.Unmarshal(cursorBytes, &cursor); err != nil {
+		return nil, err
+	}
+	return attributevalue.MarshalMap(cursor)
+}
+
+// strokeCursor is the LastEvaluatedKey of a query over a page's strokes, handed to clients as an opaque string
+type strokeCursor struct {
+	PK string `dynamodbav:"PK" json:"pk"`
+	SK string `dynamodbav:"SK" json:"sk"`
+}
+
+func encodeStrokeCursor(key map[string]types.AttributeValue) (string, error) {
+	var cursor strokeCursor
+	if err := attributevalue.UnmarshalMap(key, &cursor); err != nil {
+		return "", err
+	}
+	cursorBytes, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(cursorBytes), nil
+}
+
+// decodeStrokeCursor only accepts cursors of the given PK, so a cursor can't be used to read another page
+func decodeStrokeCursor(encoded string, pk string) (map[string]types.AttributeValue, error) {
+	cursorBytes, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	var cursor strokeCursor
+	if err := json.Unmarshal(cursorBytes, &cursor); err != nil {
+		return nil, err
+	}
+	if cursor.PK != pk || cursor.SK == "" {
+		return nil, errors.New("cursor is for another page")
 	}
+	return attributevalue.MarshalMap(cursor)
 }
@@ -58,6 +58,81 @@ func getTables(client *dynamodb.Client, ctx context.Context) ([]string, error) {
 	return output.TableNames, nil
 }
 
+// ensureTable creates the table with the same schema as init-scripts/dynamodb-init.sh and waits until
+// it is ACTIVE. Only meant for local development, prod tables are managed by the CloudFormation stack
+func ensureTable(client *dynamodb.Client, ctx context.Context, tableName string) error {
+	_, err := client.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("PK"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("SK"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("UserId"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("Layer"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("Created"), AttributeType: types.ScalarAttributeTypeN},
+			{AttributeName: aws.String("Id"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("PK"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("SK"), KeyType: types.KeyTypeRange},
+		},
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String("GSI_UserStrokes"),
+				KeySchema: []types.KeySchemaElement{
+					{AttributeName: aws.String("UserId"), KeyType: types.KeyTypeHash},
+					{AttributeName: aws.String("Layer"), KeyType: types.KeyTypeRange},
+				},
+				Projection: &types.Projection{ProjectionType: types.ProjectionTypeKeysOnly},
+			},
+			{
+				IndexName: aws.String("GSI_PageStrokes"),
+				KeySchema: []types.KeySchemaElement{
+					{AttributeName: aws.String("PK"), KeyType: types.KeyTypeHash},
+					{AttributeName: aws.String("Layer"), KeyType: types.KeyTypeRange},
+				},
+				Projection: &types.Projection{
+					ProjectionType:   types.ProjectionTypeInclude,
+					NonKeyAttributes: []string{"UserId"},
+				},
+			},
+			{
+				IndexName: aws.String("GSI_Created"),
+				KeySchema: []types.KeySchemaElement{
+					{AttributeName: aws.String("SK"), KeyType: types.KeyTypeHash},
+					{AttributeName: aws.String("Created"), KeyType: types.KeyTypeRange},
+				},
+				Projection: &types.Projection{
+					ProjectionType:   types.ProjectionTypeInclude,
+					NonKeyAttributes: []string{"Id", "Username", "Provider", "ProviderId", "StrokeCount"},
+				},
+			},
+			{
+				IndexName: aws.String("GSI_UserId"),
+				KeySchema: []types.KeySchemaElement{
+					{AttributeName: aws.String("Id"), KeyType: types.KeyTypeHash},
+				},
+				Projection: &types.Projection{
+					ProjectionType:   types.ProjectionTypeInclude,
+					NonKeyAttributes: []string{"Username", "Provider", "ProviderId", "Created"},
+				},
+			},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		// Another instance may have created it in the meantime
+		var inUse *types.ResourceInUseException
+		if !errors.As(err, &inUse) {
+			return err
+		}
+	}
+
+	waiter := dynamodb.NewTableExistsWaiter(client, func(o *dynamodb.TableExistsWaiterOptions) {
+		o.MinDelay = 1 * time.Second
+	})
+	return waiter.Wait(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(tableName)}, 2*time.Minute)
+}
+
 // getItem retrieves an item of type T from DynamoDB by PK and SK
 func getItem[T any](dynamoStore *DynamoWebverseStore, ctx context.Context, pk string, sk string, consistentRead bool) (T, error) {
 	var zero T
@@ -151,8 +226,20 @@ func ensureItem[T any](dynamoStore *DynamoWebverseStore, ctx context.Context, it
 	return item, true, nil // Newly inserted
 }
 
+// markThrottled wraps DynamoDB's throttling errors with store.ErrThrottled, so callers can retry them
+// without depending on the AWS error types
+func markThrottled(err error) error {
+	var provisioned *types.ProvisionedThroughputExceededException
+	var requestLimit *types.RequestLimitExceeded
+	var throttling *types.ThrottlingException
+	if errors.As(err, &provisioned) || errors.As(err, &requestLimit) || errors.As(err, &throttling) {
+		return fmt.Errorf("%w: %w", store.ErrThrottled, err)
+	}
+	return err
+}
+
 // queryAllByPK returns all items of type T with the given PK, ordered by SK, with a limit.
-func queryAllByPK[T any](dynamoStore *DynamoWebverseStore, ctx context.Context, pk string, scanIndexForward bool, limit int32) ([]T, error) {
+func queryAllByPK[T any](dynamoStore *DynamoWebverseStore, ctx context.Context, pk string, scanIndexForward bool, limit int32, filter string) ([]T, error) {
 	var results []T
 
 	input := &dynamodb.QueryInput{
@@ -163,6 +250,10 @@ func queryAllByPK[T any](dynamoStore *DynamoWebverseStore, ctx context.Context,
 		},
 		ScanIndexForward: aws.Bool(scanIndexForward),
 	}
+	// Applied after each page is read, so pages may come back short and more are read to reach limit
+	if filter != "" {
+		input.FilterExpression = aws.String(filter)
+	}
 
 	if limit > 0 {
 		input.Limit = aws.Int32(limit)
@@ -179,7 +270,7 @@ func queryAllByPK[T any](dynamoStore *DynamoWebverseStore, ctx context.Context,
 
 		page, err := paginator.NextPage(ctx)
 		if err != nil {
-			return nil, fmt.Errorf("query failed: %w", err)
+			return nil, fmt.Errorf("query failed: %w", markThrottled(err))
 		}
 
 		var pageItems []T
@@ -197,6 +288,39 @@ func queryAllByPK[T any](dynamoStore *DynamoWebverseStore, ctx context.Context,
 	return results, nil
 }
 
+// queryPageByPK returns one page of up to limit items of type T with the given PK, ordered by SK,
+// starting after startKey, and the key to start the next page from (nil after the last page).
+func queryPageByPK[T any](dynamoStore *DynamoWebverseStore, ctx context.Context, pk string, scanIndexForward bool, limit int32, startKey map[string]types.AttributeValue) ([]T, map[string]types.AttributeValue, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(dynamoStore.tableName),
+		KeyConditionExpression: aws.String("PK = :pk"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk": &types.AttributeValueMemberS{Value: pk},
+		},
+		ScanIndexForward:  aws.Bool(scanIndexForward),
+		ExclusiveStartKey: startKey,
+	}
+
+	if limit > 0 {
+		input.Limit = aws.Int32(limit)
+	}
+
+	output, err := dynamoStore.client.Query(ctx, input)
+	if err != nil {
+		return nil, nil, fmt.Errorf("query failed: %w", err)
+	}
+
+	var items []T
+	if err := attributevalue.UnmarshalListOfMaps(output.Items, &items); err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal page items: %w", err)
+	}
+
+	if len(output.LastEvaluatedKey) == 0 {
+		return items, nil, nil
+	}
+	return items, output.LastEvaluatedKey, nil
+}
+
 // queryAllByGSI returns the main table PK strings for all items in a GSI with the given PK.
 func queryAllByGSI(dynamoStore *DynamoWebverseStore, ctx context.Context, indexName string, pkField string, pkValue string) ([]string, error) {
 	var results []string
@@ -235,6 +359,45 @@ func queryAllByGSI(dynamoStore *DynamoWebverseStore, ctx context.Context, indexN
 	return results, nil
 }
 
+// queryAllByGSIKey returns all items of type T in a GSI with the given PK and SK
+// The GSI must project the attributes T needs
+func queryAllByGSIKey[T any](dynamoStore *DynamoWebverseStore, ctx context.Context, indexName string, pkField string, skField string, pkValue string, skValue string) ([]T, error) {
+	var results []T
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(dynamoStore.tableName),
+		IndexName:              aws.String(indexName),
+		KeyConditionExpression: aws.String("#pk = :pk AND #sk = :sk"),
+		ExpressionAttributeNames: map[string]string{
+			"#pk": pkField,
+			"#sk": skField,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk": &types.AttributeValueMemberS{Value: pkValue},
+			":sk": &types.AttributeValueMemberS{Value: skValue},
+		},
+	}
+
+	// Use pagination to retrieve all items
+	paginator := dynamodb.NewQueryPaginator(dynamoStore.client, input)
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("query GSI failed: %w", err)
+		}
+
+		var pageItems []T
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &pageItems); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal page items: %w", err)
+		}
+
+		results = append(results, pageItems...)
+	}
+
+	return results, nil
+}
+
 // countByGSI counts items matching a GSI query without fetching them
 // If sortKeyValue is empty, counts all items for the partition key
 // If sortKeyValue is provided, counts only items matching the sort key
@@ -278,19 +441,51 @@ func countByGSI(dynamoStore *DynamoWebverseStore, ctx context.Context, indexName
 	return int(totalCount), nil
 }
 
+// countByPK counts the items with the given PK without reading them
+func countByPK(dynamoStore *DynamoWebverseStore, ctx context.Context, pk string) (int, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(dynamoStore.tableName),
+		Select:                 types.SelectCount,
+		KeyConditionExpression: aws.String("PK = :pk"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk": &types.AttributeValueMemberS{Value: pk},
+		},
+	}
+
+	var totalCount int32
+	paginator := dynamodb.NewQueryPaginator(dynamoStore.client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("count failed: %w", markThrottled(err))
+		}
+		totalCount += page.Count
+	}
+
+	return int(totalCount), nil
+}
+
 // writeBatchRequests handles batch writes (Put or Delete) with retries
 // Returns any unprocessed items as []T
 func writeBatchRequests[T any](dynamoStore *DynamoWebverseStore, ctx context.Context, requests []types.WriteRequest) ([]T, error) {
+	unprocessed, _, err := writeBatchRequestsWithRetries[T](dynamoStore, ctx, requests)
+	return unprocessed, err
+}
+
+// writeBatchRequestsWithRetries is writeBatchRequests that also reports whether DynamoDB
+// returned unprocessed items (i.e. throttled the batch) at least once
+func writeBatchRequestsWithRetries[T any](dynamoStore *DynamoWebverseStore, ctx context.Context, requests []types.WriteRequest) ([]T, bool, error) {
 	if len(requests) == 0 {
-		return nil, nil
+		return nil, false, nil
 	}
 
 	backoff := 50 * time.Millisecond
+	retried := false
 
 	for {
 		select {
 		case <-ctx.Done():
-			return unmarshalUnprocessed[T](requests), ctx.Err()
+			return unmarshalUnprocessed[T](requests), retried, ctx.Err()
 		default:
 		}
 
@@ -300,22 +495,23 @@ func writeBatchRequests[T any](dynamoStore *DynamoWebverseStore, ctx context.Con
 			},
 		})
 		if err != nil {
-			return unmarshalUnprocessed[T](requests), fmt.Errorf("BatchWriteItem failed: %w", err)
+			return unmarshalUnprocessed[T](requests), retried, fmt.Errorf("BatchWriteItem failed: %w", err)
 		}
 
 		unprocessed := resp.UnprocessedItems[dynamoStore.tableName]
 		if len(unprocessed) == 0 {
-			return nil, nil // all items processed successfully
+			return nil, retried, nil // all items processed successfully
 		}
 
 		// Prepare next retry set
 		requests = unprocessed
+		retried = true
 
 		timer := time.NewTimer(backoff)
 		select {
 		case <-ctx.Done():
 			timer.Stop()
-			return unmarshalUnprocessed[T](requests), ctx.Err()
+			return unmarshalUnprocessed[T](requests), retried, ctx.Err()
 		case <-timer.C:
 		}
 
@@ -394,15 +590,19 @@ func deleteItemWithCondition(dynamoStore *DynamoWebverseStore, ctx context.Conte
 	return nil
 }
 
-// batchDeleteByGSIThrottled queries items by GSI and deletes them in batches until none remain.
+// batchDeleteByGSIThrottled queries items by GSI and deletes them in batches until none remain, returning how many were deleted.
+// If deletedByUser is not nil, the deleted items are also counted per UserId, which the index must project.
+// The delay between batches adapts to how much DynamoDB throttles the deletes.
 // Query pages are larger for efficiency, but deletion is done in 25-item batches with throttling.
 func batchDeleteByGSIThrottled(
 	dynamoStore *DynamoWebverseStore,
 	ctx context.Context,
 	indexName, gsiPKField, gsiSKField, gsiPK, gsiSK string,
-	throttle time.Duration,
-) error {
+	throttle *AdaptiveThrottle,
+	deletedByUser map[string]int,
+) (int, error) {
 	var lastEvaluatedKey map[string]types.AttributeValue
+	deleted := 0
 
 	const queryPageSize int32 = 200
 
@@ -437,21 +637,27 @@ func batchDeleteByGSIThrottled(
 
 		resp, err := dynamoStore.client.Query(ctx, input)
 		if err != nil {
-			return fmt.Errorf("query GSI failed: %w", err)
+			return deleted, fmt.Errorf("query GSI failed: %w", err)
 		}
 
 		if len(resp.Items) == 0 {
-			return nil
+			return deleted, nil
 		}
 
 		// Prepare DeleteRequests
 		delRequests := make([]types.WriteRequest, 0, len(resp.Items))
+		userIds := make([]string, 0, len(resp.Items))
 		for _, item := range resp.Items {
 			pkAttr, okPK := item["PK"]
 			skAttr, okSK := item["SK"]
 			if !okPK || !okSK {
 				continue
 			}
+			userId := ""
+			if userIdAttr, ok := item["UserId"].(*types.AttributeValueMemberS); ok {
+				userId = userIdAttr.Value
+			}
+			userIds = append(userIds, userId)
 			delRequests = append(delRequests, types.WriteRequest{
 				DeleteRequest: &types.DeleteRequest{
 					Key: map[string]types.AttributeValue{
@@ -463,7 +669,7 @@ func batchDeleteByGSIThrottled(
 		}
 
 		if len(delRequests) == 0 {
-			return fmt.Errorf("query returned items without PK/SK")
+			return deleted, fmt.Errorf("query returned items without PK/SK")
 		}
 
 		// Batch delete in chunks of 25 with throttling
@@ -475,22 +681,30 @@ func batchDeleteByGSIThrottled(
 
 			startTime := time.Now()
 
-			_, err := writeBatchRequests[map[string]types.AttributeValue](
+			_, throttled, err := writeBatchRequestsWithRetries[map[string]types.AttributeValue](
 				dynamoStore,
 				ctx,
 				delRequests[i:end],
 			)
 			if err != nil {
-				return fmt.Errorf("batch delete failed: %w", err)
+				return deleted, fmt.Errorf("batch delete failed: %w", err)
+			}
+			deleted += end - i
+			if deletedByUser != nil {
+				for _, userId := range userIds[i:end] {
+					deletedByUser[userId]++
+				}
 			}
 
-			// Throttle between batches
+			// Throttle between batches, backing off while DynamoDB is pushing back
+			throttle.Observe(throttled)
+			delay := throttle.Delay()
 			elapsed := time.Since(startTime)
-			if elapsed < throttle {
+			if elapsed < delay {
 				select {
 				case <-ctx.Done():
-					return ctx.Err()
-				case <-time.After(throttle - elapsed):
+					return deleted, ctx.Err()
+				case <-time.After(delay - elapsed):
 				}
 			}
 		}
@@ -502,7 +716,7 @@ func batchDeleteByGSIThrottled(
 		}
 	}
 
-	return nil
+	return deleted, nil
 }
 
 // updateItem updates an existing item in DynamoDB.
@@ -667,7 +881,7 @@ func incrementCounter(
 	if err != nil {
 		var cce *types.ConditionalCheckFailedException
 		if errors.As(err, &cce) {
-			return fmt.Errorf("item does not exist: PK=%s, SK=%s, field=%s", pk, sk, counterField)
+			return fmt.Errorf("%w: PK=%s, SK=%s, field=%s", store.ErrItemNotFound, pk, sk, counterField)
 		}
 		return fmt.Errorf("increment counter failed: %w", err)
 	}
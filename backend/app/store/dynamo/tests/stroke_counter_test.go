@@ -0,0 +1,111 @@
+package dynamo_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zlnvch/webverse/models"
+	"github.com/zlnvch/webverse/store"
+	"github.com/zlnvch/webverse/store/dynamo"
+)
+
+type transactWriteItemsInput struct {
+	ClientRequestToken string
+	TransactItems      []struct {
+		Put *struct {
+			Item map[string]attributeValue
+		}
+		Update *struct {
+			Key                 map[string]attributeValue
+			UpdateExpression    string
+			ConditionExpression string
+		}
+	}
+}
+
+// newTransactDynamo serves TransactWriteItems, passing each request on and answering with the given
+// status and body
+func newTransactDynamo(t *testing.T, requests chan<- transactWriteItemsInput, status int, body string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		switch r.Header.Get("X-Amz-Target") {
+		case "DynamoDB_20120810.ListTables":
+			json.NewEncoder(w).Encode(map[string]any{"TableNames": []string{"webverse"}})
+
+		case "DynamoDB_20120810.TransactWriteItems":
+			var input transactWriteItemsInput
+			if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			requests <- input
+			w.WriteHeader(status)
+			w.Write([]byte(body))
+
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+var counterRecord = models.StrokeRecord{
+	PageKey: "example.com",
+	Layer:   models.LayerPublic,
+	Stroke:  models.Stroke{Id: "00000000-0000-7000-8000-000000000001", UserId: "user1"},
+}
+
+func TestWriteStrokeWithCounter_PutsStrokeAndIncrementsUserInOneTransaction(t *testing.T) {
+	requests := make(chan transactWriteItemsInput, 1)
+	server := newTransactDynamo(t, requests, http.StatusOK, "{}")
+
+	ctx := context.Background()
+	webverseStore, err := dynamo.NewDynamoWebverseStore(ctx, true, server.URL, "webverse", dynamo.DefaultDynamoConfig())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, webverseStore.WriteStrokeWithCounter(ctx, counterRecord, "github", "1"))
+	input := <-requests
+	if !assert.Len(t, input.TransactItems, 2) {
+		return
+	}
+
+	put := input.TransactItems[0].Put
+	if assert.NotNil(t, put) {
+		assert.Equal(t, "STROKE#example.com", put.Item["PK"].S)
+		assert.Equal(t, counterRecord.Stroke.Id, put.Item["SK"].S)
+		assert.Equal(t, "user1", put.Item["UserId"].S)
+	}
+	update := input.TransactItems[1].Update
+	if assert.NotNil(t, update) {
+		assert.Equal(t, "USER#github#1", update.Key["PK"].S)
+		assert.Equal(t, "PROFILE", update.Key["SK"].S)
+		assert.Equal(t, "SET #c = #c + :val", update.UpdateExpression)
+		assert.Equal(t, "attribute_exists(PK)", update.ConditionExpression)
+	}
+	assert.Equal(t, counterRecord.Stroke.Id, input.ClientRequestToken)
+}
+
+func TestWriteStrokeWithCounter_MissingUser(t *testing.T) {
+	requests := make(chan transactWriteItemsInput, 1)
+	server := newTransactDynamo(t, requests, http.StatusBadRequest, `{
+		"__type": "com.amazonaws.dynamodb.v20120810#TransactionCanceledException",
+		"message": "Transaction cancelled",
+		"CancellationReasons": [{"Code": "None"}, {"Code": "ConditionalCheckFailed"}]
+	}`)
+
+	ctx := context.Background()
+	webverseStore, err := dynamo.NewDynamoWebverseStore(ctx, true, server.URL, "webverse", dynamo.DefaultDynamoConfig())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	err = webverseStore.WriteStrokeWithCounter(ctx, counterRecord, "github", "1")
+	assert.ErrorIs(t, err, store.ErrItemNotFound)
+}
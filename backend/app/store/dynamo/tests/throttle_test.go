@@ -0,0 +1,63 @@
+package dynamo_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zlnvch/webverse/store/dynamo"
+)
+
+func TestDeleteThrottle_ReadFromConfig(t *testing.T) {
+	config := dynamo.DefaultDynamoConfig()
+	config.DeleteThrottle = 200 * time.Millisecond
+
+	throttle := config.NewDeleteThrottle()
+	assert.Equal(t, 200*time.Millisecond, throttle.Delay())
+}
+
+func TestDeleteThrottle_BacksOffOnUnprocessedItems(t *testing.T) {
+	config := dynamo.DynamoConfig{
+		DeleteThrottle:    50 * time.Millisecond,
+		MinDeleteThrottle: 10 * time.Millisecond,
+		MaxDeleteThrottle: 150 * time.Millisecond,
+	}
+	throttle := config.NewDeleteThrottle()
+
+	throttle.Observe(true)
+	assert.Equal(t, 100*time.Millisecond, throttle.Delay())
+
+	// Capped at the max
+	throttle.Observe(true)
+	assert.Equal(t, 150*time.Millisecond, throttle.Delay())
+}
+
+func TestDeleteThrottle_SpeedsUpWithoutUnprocessedItems(t *testing.T) {
+	config := dynamo.DynamoConfig{
+		DeleteThrottle:    40 * time.Millisecond,
+		MinDeleteThrottle: 20 * time.Millisecond,
+		MaxDeleteThrottle: time.Second,
+	}
+	throttle := config.NewDeleteThrottle()
+
+	throttle.Observe(false)
+	assert.Equal(t, 30*time.Millisecond, throttle.Delay())
+
+	// Floored at the min
+	for range 10 {
+		throttle.Observe(false)
+	}
+	assert.Equal(t, 20*time.Millisecond, throttle.Delay())
+
+	// Recovers from the floor when throttled again
+	throttle.Observe(true)
+	assert.Equal(t, 40*time.Millisecond, throttle.Delay())
+}
+
+func TestDeleteThrottle_ZeroDelayCanBackOff(t *testing.T) {
+	throttle := dynamo.DynamoConfig{MaxDeleteThrottle: time.Second}.NewDeleteThrottle()
+	assert.Equal(t, time.Duration(0), throttle.Delay())
+
+	throttle.Observe(true)
+	assert.Greater(t, throttle.Delay(), time.Duration(0))
+}
@@ -0,0 +1,179 @@
+package dynamo_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zlnvch/webverse/store"
+	"github.com/zlnvch/webverse/store/dynamo"
+)
+
+type attributeValue struct {
+	S string `json:"S,omitempty"`
+	N string `json:"N,omitempty"`
+}
+
+type fakeUser struct {
+	pk      string
+	id      string
+	created int64
+}
+
+func (u fakeUser) item() map[string]attributeValue {
+	return map[string]attributeValue{
+		"PK":       {S: u.pk},
+		"SK":       {S: "PROFILE"},
+		"Id":       {S: u.id},
+		"Username": {S: "user-" + u.id},
+		"Created":  {N: strconv.FormatInt(u.created, 10)},
+	}
+}
+
+// newFakeDynamo serves just enough of the DynamoDB API for GSI_Created queries over users,
+// applying the key condition, Limit and ExclusiveStartKey like DynamoDB does
+func newFakeDynamo(t *testing.T, users []fakeUser, queries *atomic.Int32) *httptest.Server {
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].created != users[j].created {
+			return users[i].created < users[j].created
+		}
+		return users[i].pk < users[j].pk
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		switch r.Header.Get("X-Amz-Target") {
+		case "DynamoDB_20120810.ListTables":
+			json.NewEncoder(w).Encode(map[string]any{"TableNames": []string{"webverse"}})
+
+		case "DynamoDB_20120810.Query":
+			queries.Add(1)
+			var input struct {
+				IndexName                 string
+				Limit                     int
+				ExpressionAttributeValues map[string]attributeValue
+				ExclusiveStartKey         map[string]attributeValue
+			}
+			if err := json.NewDecoder(r.Body).Decode(&input); err != nil || input.IndexName != "GSI_Created" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			start, _ := strconv.ParseInt(input.ExpressionAttributeValues[":start"].N, 10, 64)
+			end, _ := strconv.ParseInt(input.ExpressionAttributeValues[":end"].N, 10, 64)
+
+			items := []map[string]attributeValue{}
+			var lastEvaluatedKey map[string]attributeValue
+			started := input.ExclusiveStartKey == nil
+			for _, u := range users {
+				if !started {
+					started = u.pk == input.ExclusiveStartKey["PK"].S
+					continue
+				}
+				if u.created < start || u.created > end {
+					continue
+				}
+				items = append(items, u.item())
+				if len(items) == input.Limit {
+					lastEvaluatedKey = map[string]attributeValue{
+						"PK":      {S: u.pk},
+						"SK":      {S: "PROFILE"},
+						"Created": {N: strconv.FormatInt(u.created, 10)},
+					}
+					break
+				}
+			}
+			resp := map[string]any{"Items": items, "Count": len(items)}
+			if lastEvaluatedKey != nil {
+				resp["LastEvaluatedKey"] = lastEvaluatedKey
+			}
+			json.NewEncoder(w).Encode(resp)
+
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestGetUsersCreatedBetween_FiltersAndPaginates(t *testing.T) {
+	users := []fakeUser{
+		{pk: "USER#github#1", id: "before", created: 99},
+		{pk: "USER#github#2", id: "first", created: 100},
+		{pk: "USER#github#3", id: "second", created: 150},
+		{pk: "USER#google#4", id: "third", created: 150},
+		{pk: "USER#github#5", id: "last", created: 200},
+		{pk: "USER#github#6", id: "after", created: 201},
+	}
+	var queries atomic.Int32
+	server := newFakeDynamo(t, users, &queries)
+
+	ctx := context.Background()
+	webverseStore, err := dynamo.NewDynamoWebverseStore(ctx, true, server.URL, "webverse", dynamo.DefaultDynamoConfig())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Both ends of the range are inclusive
+	ids := []string{}
+	cursor := ""
+	for page := 0; page < 10; page++ {
+		pageUsers, nextCursor, err := webverseStore.GetUsersCreatedBetween(ctx, 100, 200, 2, cursor)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.LessOrEqual(t, len(pageUsers), 2)
+		for _, u := range pageUsers {
+			ids = append(ids, u.Id)
+		}
+		if nextCursor == "" {
+			break
+		}
+		cursor = nextCursor
+	}
+
+	assert.Equal(t, []string{"first", "second", "third", "last"}, ids)
+	// Two full pages, then an empty one after the last full page's cursor
+	assert.Equal(t, int32(3), queries.Load())
+}
+
+func TestGetUsersCreatedBetween_InvalidCursor(t *testing.T) {
+	var queries atomic.Int32
+	server := newFakeDynamo(t, nil, &queries)
+
+	ctx := context.Background()
+	webverseStore, err := dynamo.NewDynamoWebverseStore(ctx, true, server.URL, "webverse", dynamo.DefaultDynamoConfig())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, _, err = webverseStore.GetUsersCreatedBetween(ctx, 0, 100, 10, "not a cursor")
+	assert.ErrorIs(t, err, store.ErrInvalidCursor)
+	assert.Equal(t, int32(0), queries.Load())
+}
+
+func TestGetAllStrokeRecords_RejectsCursorOfAnotherPage(t *testing.T) {
+	var queries atomic.Int32
+	server := newFakeDynamo(t, nil, &queries)
+
+	ctx := context.Background()
+	webverseStore, err := dynamo.NewDynamoWebverseStore(ctx, true, server.URL, "webverse", dynamo.DefaultDynamoConfig())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	cursorBytes, _ := json.Marshal(map[string]string{"pk": "STROKE#other.com", "sk": "00000000-0000-7000-8000-000000000001"})
+	_, _, err = webverseStore.GetAllStrokeRecords(ctx, "example.com", base64.RawURLEncoding.EncodeToString(cursorBytes), 100)
+	assert.ErrorIs(t, err, store.ErrInvalidCursor)
+
+	_, _, err = webverseStore.GetAllStrokeRecords(ctx, "example.com", "not a cursor", 100)
+	assert.ErrorIs(t, err, store.ErrInvalidCursor)
+	assert.Equal(t, int32(0), queries.Load())
+}
@@ -0,0 +1,163 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/zlnvch/webverse/metrics"
+	"github.com/zlnvch/webverse/models"
+)
+
+// InstrumentedStore records the latency of every store operation as "store.<operation>", and counts its
+// failures as "store.<operation>.errors". ErrItemNotFound is an expected outcome and not counted
+type InstrumentedStore struct {
+	inner   WebverseStore
+	metrics metrics.Metrics
+}
+
+// NewInstrumentedStore wraps inner, returning its results unchanged
+func NewInstrumentedStore(inner WebverseStore, m metrics.Metrics) *InstrumentedStore {
+	return &InstrumentedStore{inner: inner, metrics: metrics.OrNoop(m)}
+}
+
+func (s *InstrumentedStore) observe(operation string, start time.Time, err *error) {
+	s.metrics.Observe("store."+operation, time.Since(start))
+	if *err != nil && !errors.Is(*err, ErrItemNotFound) {
+		s.metrics.Inc("store."+operation+".errors", 1)
+	}
+}
+
+func (s *InstrumentedStore) CreateUser(ctx context.Context, user models.User) (created models.User, err error) {
+	defer s.observe("create_user", time.Now(), &err)
+	return s.inner.CreateUser(ctx, user)
+}
+
+func (s *InstrumentedStore) GetUser(ctx context.Context, provider string, providerId string) (user models.User, err error) {
+	defer s.observe("get_user", time.Now(), &err)
+	return s.inner.GetUser(ctx, provider, providerId)
+}
+
+func (s *InstrumentedStore) GetUserById(ctx context.Context, id string) (user models.User, err error) {
+	defer s.observe("get_user_by_id", time.Now(), &err)
+	return s.inner.GetUserById(ctx, id)
+}
+
+func (s *InstrumentedStore) GetUsersCreatedBetween(ctx context.Context, start int64, end int64, limit int, cursor string) (users []models.User, nextCursor string, err error) {
+	defer s.observe("get_users_created_between", time.Now(), &err)
+	return s.inner.GetUsersCreatedBetween(ctx, start, end, limit, cursor)
+}
+
+func (s *InstrumentedStore) GetStrokeRecords(ctx context.Context, pageKey string, limit int32) (strokes []models.Stroke, err error) {
+	defer s.observe("get_stroke_records", time.Now(), &err)
+	return s.inner.GetStrokeRecords(ctx, pageKey, limit)
+}
+
+func (s *InstrumentedStore) GetVisibleStrokeRecords(ctx context.Context, pageKey string, limit int32) (strokes []models.Stroke, err error) {
+	defer s.observe("get_visible_stroke_records", time.Now(), &err)
+	return s.inner.GetVisibleStrokeRecords(ctx, pageKey, limit)
+}
+
+func (s *InstrumentedStore) GetAllStrokeRecords(ctx context.Context, pageKey string, cursor string, limit int32) (strokes []models.Stroke, nextCursor string, err error) {
+	defer s.observe("get_all_stroke_records", time.Now(), &err)
+	return s.inner.GetAllStrokeRecords(ctx, pageKey, cursor, limit)
+}
+
+func (s *InstrumentedStore) GetStroke(ctx context.Context, pageKey string, strokeId string) (stroke models.Stroke, err error) {
+	defer s.observe("get_stroke", time.Now(), &err)
+	return s.inner.GetStroke(ctx, pageKey, strokeId)
+}
+
+func (s *InstrumentedStore) WriteStrokeBatch(ctx context.Context, strokes []models.StrokeRecord) (unprocessed []models.StrokeRecord, err error) {
+	defer s.observe("write_stroke_batch", time.Now(), &err)
+	return s.inner.WriteStrokeBatch(ctx, strokes)
+}
+
+func (s *InstrumentedStore) DeleteStroke(ctx context.Context, pageKey string, strokeId string, userId string) (err error) {
+	defer s.observe("delete_stroke", time.Now(), &err)
+	return s.inner.DeleteStroke(ctx, pageKey, strokeId, userId)
+}
+
+func (s *InstrumentedStore) DeleteUser(ctx context.Context, provider string, providerId string) (err error) {
+	defer s.observe("delete_user", time.Now(), &err)
+	return s.inner.DeleteUser(ctx, provider, providerId)
+}
+
+func (s *InstrumentedStore) DeleteUserStrokes(ctx context.Context, userId string, layer string) (err error) {
+	defer s.observe("delete_user_strokes", time.Now(), &err)
+	return s.inner.DeleteUserStrokes(ctx, userId, layer)
+}
+
+func (s *InstrumentedStore) DeletePageStrokesByLayer(ctx context.Context, pageKey string, layer string) (deletedByUser map[string]int, err error) {
+	defer s.observe("delete_page_strokes_by_layer", time.Now(), &err)
+	return s.inner.DeletePageStrokesByLayer(ctx, pageKey, layer)
+}
+
+func (s *InstrumentedStore) GetUserPages(ctx context.Context, userId string) (pageKeys []string, err error) {
+	defer s.observe("get_user_pages", time.Now(), &err)
+	return s.inner.GetUserPages(ctx, userId)
+}
+
+func (s *InstrumentedStore) GetUserStrokeCount(ctx context.Context, userId string, layer string) (count int, err error) {
+	defer s.observe("get_user_stroke_count", time.Now(), &err)
+	return s.inner.GetUserStrokeCount(ctx, userId, layer)
+}
+
+func (s *InstrumentedStore) CountPageStrokes(ctx context.Context, pageKey string) (count int, err error) {
+	defer s.observe("count_page_strokes", time.Now(), &err)
+	return s.inner.CountPageStrokes(ctx, pageKey)
+}
+
+func (s *InstrumentedStore) SetUserEncryptionKeys(ctx context.Context, user models.User, incrementKeyVersion bool) (count int, err error) {
+	defer s.observe("set_user_encryption_keys", time.Now(), &err)
+	return s.inner.SetUserEncryptionKeys(ctx, user, incrementKeyVersion)
+}
+
+func (s *InstrumentedStore) RotateUserKEK(ctx context.Context, user models.User, expectedKeyVersion int) (err error) {
+	defer s.observe("rotate_user_kek", time.Now(), &err)
+	return s.inner.RotateUserKEK(ctx, user, expectedKeyVersion)
+}
+
+func (s *InstrumentedStore) UpdateUsername(ctx context.Context, provider string, providerId string, username string) (err error) {
+	defer s.observe("update_username", time.Now(), &err)
+	return s.inner.UpdateUsername(ctx, provider, providerId, username)
+}
+
+func (s *InstrumentedStore) UpdateUserLastActive(ctx context.Context, provider string, providerId string, lastActive int64) (err error) {
+	defer s.observe("update_user_last_active", time.Now(), &err)
+	return s.inner.UpdateUserLastActive(ctx, provider, providerId, lastActive)
+}
+
+func (s *InstrumentedStore) AddStrokeReport(ctx context.Context, report models.StrokeReport) (count int, err error) {
+	defer s.observe("add_stroke_report", time.Now(), &err)
+	return s.inner.AddStrokeReport(ctx, report)
+}
+
+func (s *InstrumentedStore) SetStrokeHidden(ctx context.Context, pageKey string, strokeId string, hidden bool) (err error) {
+	defer s.observe("set_stroke_hidden", time.Now(), &err)
+	return s.inner.SetStrokeHidden(ctx, pageKey, strokeId, hidden)
+}
+
+func (s *InstrumentedStore) GetPageSettings(ctx context.Context, pageKey string) (settings models.PageSettings, err error) {
+	defer s.observe("get_page_settings", time.Now(), &err)
+	return s.inner.GetPageSettings(ctx, pageKey)
+}
+
+func (s *InstrumentedStore) SetPageSettings(ctx context.Context, pageKey string, settings models.PageSettings) (err error) {
+	defer s.observe("set_page_settings", time.Now(), &err)
+	return s.inner.SetPageSettings(ctx, pageKey, settings)
+}
+
+func (s *InstrumentedStore) IncrementUserStrokeCount(ctx context.Context, provider string, providerId string, count int) (err error) {
+	defer s.observe("increment_user_stroke_count", time.Now(), &err)
+	return s.inner.IncrementUserStrokeCount(ctx, provider, providerId, count)
+}
+
+func (s *InstrumentedStore) WriteStrokeWithCounter(ctx context.Context, record models.StrokeRecord, provider string, providerId string) (err error) {
+	defer s.observe("write_stroke_with_counter", time.Now(), &err)
+	return s.inner.WriteStrokeWithCounter(ctx, record, provider, providerId)
+}
+
+func (s *InstrumentedStore) Close() error {
+	return s.inner.Close()
+}
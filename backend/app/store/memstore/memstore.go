@@ -0,0 +1,519 @@
+package memstore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+
+	"github.com/zlnvch/webverse/models"
+	"github.com/zlnvch/webverse/store"
+)
+
+// MemWebverseStore is an in-memory implementation of store.WebverseStore
+// It mirrors the semantics of the DynamoDB store (conditional deletes, GSI-style
+// user lookups, unprocessed batch items) so it can be used for local development
+// and end-to-end tests of the service and hub without AWS
+type MemWebverseStore struct {
+	mu sync.RWMutex
+	// Key: "provider#providerId" (mirrors the USER# partition key)
+	users map[string]models.User
+	// Key: pageKey -> strokeId (mirrors the STROKE# partition key and SK)
+	pages map[string]map[string]memStroke
+	// Key: "pageKey#strokeId" -> reporterId (mirrors the REPORT# partition key and SK)
+	reports map[string]map[string]models.StrokeReport
+	// Key: pageKey (mirrors the PAGE# partition key)
+	pageSettings map[string]models.PageSettings
+
+	// Number of items at the end of each batch to report as unprocessed
+	// 0 disables the simulation
+	simulatedUnprocessed int
+}
+
+type memStroke struct {
+	record models.StrokeRecord
+	// Layer attribute as stored in DynamoDB ("Public" or "Private#<LayerId>")
+	layer string
+}
+
+func NewMemWebverseStore() *MemWebverseStore {
+	return &MemWebverseStore{
+		users:        make(map[string]models.User),
+		pages:        make(map[string]map[string]memStroke),
+		reports:      make(map[string]map[string]models.StrokeReport),
+		pageSettings: make(map[string]models.PageSettings),
+	}
+}
+
+// SetSimulatedUnprocessed makes every subsequent WriteStrokeBatch call leave the last
+// count items of the batch unwritten and return them as unprocessed, like a throttled
+// BatchWriteItem would. Set to 0 to turn the simulation off.
+func (memStore *MemWebverseStore) SetSimulatedUnprocessed(count int) {
+	memStore.mu.Lock()
+	defer memStore.mu.Unlock()
+	memStore.simulatedUnprocessed = count
+}
+
+func userKey(provider string, providerId string) string {
+	return provider + "#" + providerId
+}
+
+func layerString(sr models.StrokeRecord) string {
+	switch sr.Layer {
+	case models.LayerPublic:
+		return "Public"
+	case models.LayerPrivate:
+		return "Private#" + sr.LayerId
+	}
+	return ""
+}
+
+func (memStore *MemWebverseStore) CreateUser(ctx context.Context, user models.User) (models.User, error) {
+	memStore.mu.Lock()
+	defer memStore.mu.Unlock()
+
+	key := userKey(user.Provider, user.ProviderId)
+	if existing, ok := memStore.users[key]; ok {
+		return existing, nil
+	}
+
+	userId, err := uuid.NewV4()
+	if err != nil {
+		return models.User{}, err
+	}
+	user.Id = userId.String()
+	user.Created = time.Now().Unix()
+
+	memStore.users[key] = user
+	return user, nil
+}
+
+func (memStore *MemWebverseStore) GetUser(ctx context.Context, provider string, providerId string) (models.User, error) {
+	memStore.mu.RLock()
+	defer memStore.mu.RUnlock()
+
+	user, ok := memStore.users[userKey(provider, providerId)]
+	if !ok {
+		return models.User{}, store.ErrItemNotFound
+	}
+	return user, nil
+}
+
+func (memStore *MemWebverseStore) GetUserById(ctx context.Context, id string) (models.User, error) {
+	memStore.mu.RLock()
+	defer memStore.mu.RUnlock()
+
+	for _, user := range memStore.users {
+		if user.Id == id {
+			return user, nil
+		}
+	}
+	return models.User{}, store.ErrItemNotFound
+}
+
+func (memStore *MemWebverseStore) GetUsersCreatedBetween(ctx context.Context, start int64, end int64, limit int, cursor string) ([]models.User, string, error) {
+	memStore.mu.RLock()
+	defer memStore.mu.RUnlock()
+
+	users := []models.User{}
+	for _, user := range memStore.users {
+		if user.Created >= start && user.Created <= end {
+			users = append(users, user)
+		}
+	}
+	// Same order as GSI_Created, users created in the same second are ordered by their primary key
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].Created != users[j].Created {
+			return users[i].Created < users[j].Created
+		}
+		return userKey(users[i].Provider, users[i].ProviderId) < userKey(users[j].Provider, users[j].ProviderId)
+	})
+
+	// The cursor is the offset of the next page
+	offset := 0
+	if cursor != "" {
+		var err error
+		if offset, err = strconv.Atoi(cursor); err != nil || offset < 0 {
+			return nil, "", store.ErrInvalidCursor
+		}
+	}
+	if offset > len(users) {
+		offset = len(users)
+	}
+	users = users[offset:]
+
+	nextCursor := ""
+	if len(users) > limit {
+		users = users[:limit]
+		nextCursor = strconv.Itoa(offset + limit)
+	}
+	return users, nextCursor, nil
+}
+
+func (memStore *MemWebverseStore) GetStrokeRecords(ctx context.Context, pageKey string, limit int32) ([]models.Stroke, error) {
+	return memStore.getStrokeRecords(pageKey, limit, true)
+}
+
+func (memStore *MemWebverseStore) GetVisibleStrokeRecords(ctx context.Context, pageKey string, limit int32) ([]models.Stroke, error) {
+	return memStore.getStrokeRecords(pageKey, limit, false)
+}
+
+func (memStore *MemWebverseStore) getStrokeRecords(pageKey string, limit int32, includeHidden bool) ([]models.Stroke, error) {
+	memStore.mu.RLock()
+	defer memStore.mu.RUnlock()
+
+	page := memStore.pages[pageKey]
+	ids := make([]string, 0, len(page))
+	for id, s := range page {
+		if includeHidden || !s.record.Stroke.Hidden {
+			ids = append(ids, id)
+		}
+	}
+	// Stroke ids are UUIDv7, so lexical order is chronological order (same as the SK)
+	sort.Strings(ids)
+
+	// Newest strokes first like the DynamoDB store, so the limit drops the oldest
+	if limit > 0 && len(ids) > int(limit) {
+		ids = ids[len(ids)-int(limit):]
+	}
+
+	strokes := make([]models.Stroke, 0, len(ids))
+	for _, id := range ids {
+		strokes = append(strokes, page[id].record.Stroke)
+	}
+	return strokes, nil
+}
+
+func (memStore *MemWebverseStore) GetAllStrokeRecords(ctx context.Context, pageKey string, cursor string, limit int32) ([]models.Stroke, string, error) {
+	memStore.mu.RLock()
+	defer memStore.mu.RUnlock()
+
+	page := memStore.pages[pageKey]
+	ids := make([]string, 0, len(page))
+	for id := range page {
+		// Like ExclusiveStartKey, the cursor is the SK of the last returned stroke
+		if id > cursor {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	nextCursor := ""
+	if limit > 0 && len(ids) > int(limit) {
+		ids = ids[:limit]
+		nextCursor = ids[len(ids)-1]
+	}
+
+	strokes := make([]models.Stroke, 0, len(ids))
+	for _, id := range ids {
+		strokes = append(strokes, page[id].record.Stroke)
+	}
+	return strokes, nextCursor, nil
+}
+
+func (memStore *MemWebverseStore) WriteStrokeBatch(ctx context.Context, strokes []models.StrokeRecord) ([]models.StrokeRecord, error) {
+	memStore.mu.Lock()
+	defer memStore.mu.Unlock()
+
+	toWrite := strokes
+	unprocessed := []models.StrokeRecord{}
+	if memStore.simulatedUnprocessed > 0 {
+		split := max(len(strokes)-memStore.simulatedUnprocessed, 0)
+		toWrite = strokes[:split]
+		unprocessed = append(unprocessed, strokes[split:]...)
+	}
+
+	for _, sr := range toWrite {
+		if memStore.pages[sr.PageKey] == nil {
+			memStore.pages[sr.PageKey] = make(map[string]memStroke)
+		}
+		memStore.pages[sr.PageKey][sr.Stroke.Id] = memStroke{record: sr, layer: layerString(sr)}
+	}
+
+	return unprocessed, nil
+}
+
+func (memStore *MemWebverseStore) GetStroke(ctx context.Context, pageKey string, strokeId string) (models.Stroke, error) {
+	memStore.mu.RLock()
+	defer memStore.mu.RUnlock()
+
+	s, ok := memStore.pages[pageKey][strokeId]
+	if !ok {
+		return models.Stroke{}, store.ErrItemNotFound
+	}
+	return s.record.Stroke, nil
+}
+
+func (memStore *MemWebverseStore) DeleteStroke(ctx context.Context, pageKey string, strokeId string, userId string) error {
+	memStore.mu.Lock()
+	defer memStore.mu.Unlock()
+
+	s, ok := memStore.pages[pageKey][strokeId]
+	if !ok {
+		return store.ErrItemNotFound
+	}
+	if s.record.Stroke.UserId != userId {
+		return store.ErrConditionFailed
+	}
+
+	delete(memStore.pages[pageKey], strokeId)
+	if len(memStore.pages[pageKey]) == 0 {
+		delete(memStore.pages, pageKey)
+	}
+	return nil
+}
+
+func (memStore *MemWebverseStore) DeleteUser(ctx context.Context, provider string, providerId string) error {
+	memStore.mu.Lock()
+	defer memStore.mu.Unlock()
+
+	// Unconditional delete, like DynamoDB DeleteItem without a condition
+	delete(memStore.users, userKey(provider, providerId))
+	return nil
+}
+
+func (memStore *MemWebverseStore) DeleteUserStrokes(ctx context.Context, userId string, layer string) error {
+	memStore.mu.Lock()
+	defer memStore.mu.Unlock()
+
+	for pageKey, page := range memStore.pages {
+		for id, s := range page {
+			if s.record.Stroke.UserId != userId {
+				continue
+			}
+			if layer != "" && s.layer != layer {
+				continue
+			}
+			delete(page, id)
+		}
+		if len(page) == 0 {
+			delete(memStore.pages, pageKey)
+		}
+	}
+	return nil
+}
+
+func (memStore *MemWebverseStore) DeletePageStrokesByLayer(ctx context.Context, pageKey string, layer string) (map[string]int, error) {
+	memStore.mu.Lock()
+	defer memStore.mu.Unlock()
+
+	page := memStore.pages[pageKey]
+	deleted := make(map[string]int)
+	for id, s := range page {
+		if s.layer == layer {
+			delete(page, id)
+			deleted[s.record.Stroke.UserId]++
+		}
+	}
+	if len(page) == 0 {
+		delete(memStore.pages, pageKey)
+	}
+	return deleted, nil
+}
+
+func (memStore *MemWebverseStore) GetUserPages(ctx context.Context, userId string) ([]string, error) {
+	memStore.mu.RLock()
+	defer memStore.mu.RUnlock()
+
+	pages := []string{}
+	for pageKey, page := range memStore.pages {
+		for _, s := range page {
+			if s.record.Stroke.UserId == userId {
+				pages = append(pages, pageKey)
+				break
+			}
+		}
+	}
+	return pages, nil
+}
+
+func (memStore *MemWebverseStore) GetUserStrokeCount(ctx context.Context, userId string, layer string) (int, error) {
+	memStore.mu.RLock()
+	defer memStore.mu.RUnlock()
+
+	count := 0
+	for _, page := range memStore.pages {
+		for _, s := range page {
+			if s.record.Stroke.UserId != userId {
+				continue
+			}
+			if layer != "" && s.layer != layer {
+				continue
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (memStore *MemWebverseStore) UpdateUsername(ctx context.Context, provider string, providerId string, username string) error {
+	memStore.mu.Lock()
+	defer memStore.mu.Unlock()
+
+	key := userKey(provider, providerId)
+	existing, ok := memStore.users[key]
+	if !ok {
+		return store.ErrItemNotFound
+	}
+
+	existing.Username = username
+	memStore.users[key] = existing
+	return nil
+}
+
+func (memStore *MemWebverseStore) UpdateUserLastActive(ctx context.Context, provider string, providerId string, lastActive int64) error {
+	memStore.mu.Lock()
+	defer memStore.mu.Unlock()
+
+	key := userKey(provider, providerId)
+	existing, ok := memStore.users[key]
+	if !ok {
+		return store.ErrItemNotFound
+	}
+
+	existing.LastActive = lastActive
+	memStore.users[key] = existing
+	return nil
+}
+
+func (memStore *MemWebverseStore) AddStrokeReport(ctx context.Context, report models.StrokeReport) (int, error) {
+	memStore.mu.Lock()
+	defer memStore.mu.Unlock()
+
+	key := report.PageKey + "#" + report.StrokeId
+	reports, ok := memStore.reports[key]
+	if !ok {
+		reports = make(map[string]models.StrokeReport)
+		memStore.reports[key] = reports
+	}
+	// A repeated report by the same user keeps the first one
+	if _, ok := reports[report.ReporterId]; !ok {
+		reports[report.ReporterId] = report
+	}
+	return len(reports), nil
+}
+
+func (memStore *MemWebverseStore) SetStrokeHidden(ctx context.Context, pageKey string, strokeId string, hidden bool) error {
+	memStore.mu.Lock()
+	defer memStore.mu.Unlock()
+
+	s, ok := memStore.pages[pageKey][strokeId]
+	if !ok {
+		return store.ErrItemNotFound
+	}
+	s.record.Stroke.Hidden = hidden
+	memStore.pages[pageKey][strokeId] = s
+	return nil
+}
+
+func (memStore *MemWebverseStore) GetPageSettings(ctx context.Context, pageKey string) (models.PageSettings, error) {
+	memStore.mu.RLock()
+	defer memStore.mu.RUnlock()
+
+	settings, ok := memStore.pageSettings[pageKey]
+	if !ok {
+		return models.PageSettings{}, store.ErrItemNotFound
+	}
+	return settings, nil
+}
+
+func (memStore *MemWebverseStore) SetPageSettings(ctx context.Context, pageKey string, settings models.PageSettings) error {
+	memStore.mu.Lock()
+	defer memStore.mu.Unlock()
+
+	memStore.pageSettings[pageKey] = settings
+	return nil
+}
+
+func (memStore *MemWebverseStore) SetUserEncryptionKeys(ctx context.Context, user models.User, incrementKeyVersion bool) (int, error) {
+	memStore.mu.Lock()
+	defer memStore.mu.Unlock()
+
+	key := userKey(user.Provider, user.ProviderId)
+	existing, ok := memStore.users[key]
+	if !ok {
+		return 0, store.ErrItemNotFound
+	}
+
+	existing.SaltKEK = user.SaltKEK
+	existing.EncryptedDEK1 = user.EncryptedDEK1
+	existing.NonceDEK1 = user.NonceDEK1
+	existing.EncryptedDEK2 = user.EncryptedDEK2
+	existing.NonceDEK2 = user.NonceDEK2
+	if incrementKeyVersion {
+		existing.KeyVersion++
+	}
+
+	memStore.users[key] = existing
+	return existing.KeyVersion, nil
+}
+
+func (memStore *MemWebverseStore) RotateUserKEK(ctx context.Context, user models.User, expectedKeyVersion int) error {
+	memStore.mu.Lock()
+	defer memStore.mu.Unlock()
+
+	key := userKey(user.Provider, user.ProviderId)
+	existing, ok := memStore.users[key]
+	if !ok || existing.KeyVersion != expectedKeyVersion || existing.SaltKEK == "" {
+		return store.ErrConditionFailed
+	}
+
+	existing.SaltKEK = user.SaltKEK
+	existing.EncryptedDEK1 = user.EncryptedDEK1
+	existing.NonceDEK1 = user.NonceDEK1
+	existing.EncryptedDEK2 = user.EncryptedDEK2
+	existing.NonceDEK2 = user.NonceDEK2
+
+	memStore.users[key] = existing
+	return nil
+}
+
+func (memStore *MemWebverseStore) IncrementUserStrokeCount(ctx context.Context, provider string, providerId string, count int) error {
+	memStore.mu.Lock()
+	defer memStore.mu.Unlock()
+
+	key := userKey(provider, providerId)
+	user, ok := memStore.users[key]
+	if !ok {
+		// Strict mode, same as the DynamoDB store: never create partial user records
+		return fmt.Errorf("%w: user %s", store.ErrItemNotFound, key)
+	}
+
+	user.StrokeCount += count
+	memStore.users[key] = user
+	return nil
+}
+
+func (memStore *MemWebverseStore) Close() error {
+	return nil
+}
+
+func (memStore *MemWebverseStore) WriteStrokeWithCounter(ctx context.Context, record models.StrokeRecord, provider string, providerId string) error {
+	memStore.mu.Lock()
+	defer memStore.mu.Unlock()
+
+	key := userKey(provider, providerId)
+	user, ok := memStore.users[key]
+	if !ok {
+		return fmt.Errorf("%w: user %s", store.ErrItemNotFound, key)
+	}
+
+	if memStore.pages[record.PageKey] == nil {
+		memStore.pages[record.PageKey] = make(map[string]memStroke)
+	}
+	memStore.pages[record.PageKey][record.Stroke.Id] = memStroke{record: record, layer: layerString(record)}
+	user.StrokeCount++
+	memStore.users[key] = user
+	return nil
+}
+
+func (memStore *MemWebverseStore) CountPageStrokes(ctx context.Context, pageKey string) (int, error) {
+	memStore.mu.RLock()
+	defer memStore.mu.RUnlock()
+
+	return len(memStore.pages[pageKey]), nil
+}
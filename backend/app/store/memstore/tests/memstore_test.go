@@ -0,0 +1,368 @@
+package memstore_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zlnvch/webverse/models"
+	"github.com/zlnvch/webverse/store"
+	"github.com/zlnvch/webverse/store/memstore"
+)
+
+func strokeRecord(pageKey string, id string, userId string, layer models.LayerType, layerId string) models.StrokeRecord {
+	return models.StrokeRecord{
+		PageKey: pageKey,
+		Layer:   layer,
+		LayerId: layerId,
+		Stroke:  models.Stroke{Id: id, UserId: userId, Content: []byte("data")},
+	}
+}
+
+func TestMemStore_CreateUser_Idempotent(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	ctx := context.Background()
+
+	created, err := memStore.CreateUser(ctx, models.User{Provider: "github", ProviderId: "1", Username: "alice"})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, created.Id)
+
+	// Second create returns the existing user
+	again, err := memStore.CreateUser(ctx, models.User{Provider: "github", ProviderId: "1", Username: "other"})
+	assert.NoError(t, err)
+	assert.Equal(t, created.Id, again.Id)
+	assert.Equal(t, "alice", again.Username)
+
+	_, err = memStore.GetUser(ctx, "github", "2")
+	assert.ErrorIs(t, err, store.ErrItemNotFound)
+}
+
+func TestMemStore_GetUserById(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	ctx := context.Background()
+
+	created, err := memStore.CreateUser(ctx, models.User{Provider: "github", ProviderId: "1", Username: "alice"})
+	assert.NoError(t, err)
+
+	user, err := memStore.GetUserById(ctx, created.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", user.Username)
+
+	// A deleted user can't be resolved anymore
+	assert.NoError(t, memStore.DeleteUser(ctx, "github", "1"))
+	_, err = memStore.GetUserById(ctx, created.Id)
+	assert.ErrorIs(t, err, store.ErrItemNotFound)
+}
+
+func TestMemStore_GetUsersCreatedBetween(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	ctx := context.Background()
+
+	for _, providerId := range []string{"1", "2", "3"} {
+		_, err := memStore.CreateUser(ctx, models.User{Provider: "github", ProviderId: providerId})
+		assert.NoError(t, err)
+	}
+	now := time.Now().Unix()
+
+	users, cursor, err := memStore.GetUsersCreatedBetween(ctx, now-60, now+60, 2, "")
+	assert.NoError(t, err)
+	assert.Len(t, users, 2)
+	assert.NotEmpty(t, cursor)
+
+	rest, cursor, err := memStore.GetUsersCreatedBetween(ctx, now-60, now+60, 2, cursor)
+	assert.NoError(t, err)
+	assert.Len(t, rest, 1)
+	assert.Empty(t, cursor)
+	assert.NotContains(t, users, rest[0])
+
+	// Outside the range
+	users, cursor, err = memStore.GetUsersCreatedBetween(ctx, now+60, now+120, 2, "")
+	assert.NoError(t, err)
+	assert.Empty(t, users)
+	assert.Empty(t, cursor)
+
+	_, _, err = memStore.GetUsersCreatedBetween(ctx, now-60, now+60, 2, "bad")
+	assert.ErrorIs(t, err, store.ErrInvalidCursor)
+}
+
+func TestMemStore_UpdateUsername(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	ctx := context.Background()
+
+	created, err := memStore.CreateUser(ctx, models.User{Provider: "github", ProviderId: "1", Username: "alice"})
+	assert.NoError(t, err)
+
+	assert.NoError(t, memStore.UpdateUsername(ctx, "github", "1", "alice2"))
+	user, err := memStore.GetUser(ctx, "github", "1")
+	assert.NoError(t, err)
+	assert.Equal(t, created.Id, user.Id)
+	assert.Equal(t, "alice2", user.Username)
+
+	assert.ErrorIs(t, memStore.UpdateUsername(ctx, "github", "2", "bob"), store.ErrItemNotFound)
+}
+
+func TestMemStore_RotateUserKEK_Conditional(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	ctx := context.Background()
+
+	_, err := memStore.CreateUser(ctx, models.User{Provider: "github", ProviderId: "1", Username: "alice"})
+	assert.NoError(t, err)
+	keyVersion, err := memStore.SetUserEncryptionKeys(ctx, models.User{Provider: "github", ProviderId: "1", SaltKEK: "salt1"}, true)
+	assert.NoError(t, err)
+
+	// Stale version
+	rotated := models.User{Provider: "github", ProviderId: "1", SaltKEK: "salt2"}
+	assert.ErrorIs(t, memStore.RotateUserKEK(ctx, rotated, keyVersion-1), store.ErrConditionFailed)
+
+	assert.NoError(t, memStore.RotateUserKEK(ctx, rotated, keyVersion))
+	user, err := memStore.GetUser(ctx, "github", "1")
+	assert.NoError(t, err)
+	assert.Equal(t, "salt2", user.SaltKEK)
+	assert.Equal(t, keyVersion, user.KeyVersion)
+
+	// Deleted keys keep their version but can't be rotated
+	_, err = memStore.SetUserEncryptionKeys(ctx, models.User{Provider: "github", ProviderId: "1"}, false)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, memStore.RotateUserKEK(ctx, rotated, keyVersion), store.ErrConditionFailed)
+}
+
+func TestMemStore_UpdateUserLastActive(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	ctx := context.Background()
+
+	_, err := memStore.CreateUser(ctx, models.User{Provider: "github", ProviderId: "1", Username: "alice"})
+	assert.NoError(t, err)
+
+	assert.NoError(t, memStore.UpdateUserLastActive(ctx, "github", "1", 1700000000))
+	user, err := memStore.GetUser(ctx, "github", "1")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1700000000), user.LastActive)
+	assert.Equal(t, "alice", user.Username)
+
+	assert.ErrorIs(t, memStore.UpdateUserLastActive(ctx, "github", "2", 1700000000), store.ErrItemNotFound)
+}
+
+func TestMemStore_DeleteStroke_Conditional(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	ctx := context.Background()
+
+	_, err := memStore.WriteStrokeBatch(ctx, []models.StrokeRecord{
+		strokeRecord("example.com", "00000000-0000-7000-8000-000000000001", "user1", models.LayerPublic, ""),
+	})
+	assert.NoError(t, err)
+
+	err = memStore.DeleteStroke(ctx, "example.com", "00000000-0000-7000-8000-000000000001", "user2")
+	assert.ErrorIs(t, err, store.ErrConditionFailed)
+
+	err = memStore.DeleteStroke(ctx, "example.com", "00000000-0000-7000-8000-000000000002", "user1")
+	assert.ErrorIs(t, err, store.ErrItemNotFound)
+
+	err = memStore.DeleteStroke(ctx, "example.com", "00000000-0000-7000-8000-000000000001", "user1")
+	assert.NoError(t, err)
+
+	strokes, err := memStore.GetStrokeRecords(ctx, "example.com", 1100)
+	assert.NoError(t, err)
+	assert.Len(t, strokes, 0)
+}
+
+func TestMemStore_GetStroke(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	ctx := context.Background()
+
+	record := strokeRecord("example.com", "00000000-0000-7000-8000-000000000001", "user1", models.LayerPublic, "")
+	_, err := memStore.WriteStrokeBatch(ctx, []models.StrokeRecord{record})
+	assert.NoError(t, err)
+
+	stroke, err := memStore.GetStroke(ctx, "example.com", record.Stroke.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, record.Stroke, stroke)
+
+	_, err = memStore.GetStroke(ctx, "other.com", record.Stroke.Id)
+	assert.ErrorIs(t, err, store.ErrItemNotFound)
+}
+
+func TestMemStore_AddStrokeReport_OncePerReporter(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	ctx := context.Background()
+
+	report := models.StrokeReport{PageKey: "example.com", StrokeId: "stroke1", ReporterId: "user1"}
+	count, err := memStore.AddStrokeReport(ctx, report)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	count, err = memStore.AddStrokeReport(ctx, report)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	report.ReporterId = "user2"
+	count, err = memStore.AddStrokeReport(ctx, report)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// Counted per stroke
+	report.StrokeId = "stroke2"
+	count, err = memStore.AddStrokeReport(ctx, report)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestMemStore_SetStrokeHidden(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	ctx := context.Background()
+
+	record := strokeRecord("example.com", "00000000-0000-7000-8000-000000000001", "user1", models.LayerPublic, "")
+	_, err := memStore.WriteStrokeBatch(ctx, []models.StrokeRecord{record})
+	assert.NoError(t, err)
+
+	assert.NoError(t, memStore.SetStrokeHidden(ctx, "example.com", record.Stroke.Id, true))
+	strokes, err := memStore.GetStrokeRecords(ctx, "example.com", 10)
+	assert.NoError(t, err)
+	assert.True(t, strokes[0].Hidden)
+
+	assert.NoError(t, memStore.SetStrokeHidden(ctx, "example.com", record.Stroke.Id, false))
+	stroke, err := memStore.GetStroke(ctx, "example.com", record.Stroke.Id)
+	assert.NoError(t, err)
+	assert.False(t, stroke.Hidden)
+
+	assert.ErrorIs(t, memStore.SetStrokeHidden(ctx, "example.com", "missing", true), store.ErrItemNotFound)
+}
+
+func TestMemStore_GetVisibleStrokeRecords(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	ctx := context.Background()
+
+	records := []models.StrokeRecord{}
+	for i := 1; i <= 4; i++ {
+		records = append(records, strokeRecord("example.com", fmt.Sprintf("00000000-0000-7000-8000-%012d", i), "user1", models.LayerPublic, ""))
+	}
+	_, err := memStore.WriteStrokeBatch(ctx, records)
+	assert.NoError(t, err)
+	// The two newest are hidden
+	assert.NoError(t, memStore.SetStrokeHidden(ctx, "example.com", records[2].Stroke.Id, true))
+	assert.NoError(t, memStore.SetStrokeHidden(ctx, "example.com", records[3].Stroke.Id, true))
+
+	// The limit counts only visible strokes, so hidden ones don't push older visible ones out
+	strokes, err := memStore.GetVisibleStrokeRecords(ctx, "example.com", 2)
+	assert.NoError(t, err)
+	assert.Len(t, strokes, 2)
+	for _, stroke := range strokes {
+		assert.False(t, stroke.Hidden)
+	}
+
+	strokes, err = memStore.GetStrokeRecords(ctx, "example.com", 2)
+	assert.NoError(t, err)
+	assert.Len(t, strokes, 2)
+	assert.True(t, strokes[0].Hidden)
+}
+
+func TestMemStore_GetAllStrokeRecords(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	ctx := context.Background()
+
+	records := []models.StrokeRecord{}
+	for i := 1; i <= 5; i++ {
+		records = append(records, strokeRecord("example.com", fmt.Sprintf("00000000-0000-7000-8000-%012d", i), "user1", models.LayerPublic, ""))
+	}
+	records = append(records, strokeRecord("other.com", "00000000-0000-7000-8000-000000000009", "user1", models.LayerPublic, ""))
+	_, err := memStore.WriteStrokeBatch(ctx, records)
+	assert.NoError(t, err)
+
+	ids := []string{}
+	cursor := ""
+	for page := 0; page < 10; page++ {
+		strokes, nextCursor, err := memStore.GetAllStrokeRecords(ctx, "example.com", cursor, 2)
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, len(strokes), 2)
+		for _, stroke := range strokes {
+			ids = append(ids, stroke.Id)
+		}
+		if nextCursor == "" {
+			break
+		}
+		cursor = nextCursor
+	}
+
+	expected := []string{}
+	for _, record := range records[:5] {
+		expected = append(expected, record.Stroke.Id)
+	}
+	assert.Equal(t, expected, ids)
+}
+
+func TestMemStore_UserStrokesByLayer(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	ctx := context.Background()
+
+	_, err := memStore.WriteStrokeBatch(ctx, []models.StrokeRecord{
+		strokeRecord("a.com", "00000000-0000-7000-8000-000000000001", "user1", models.LayerPublic, ""),
+		strokeRecord("b.com", "00000000-0000-7000-8000-000000000002", "user1", models.LayerPrivate, "1"),
+		strokeRecord("b.com", "00000000-0000-7000-8000-000000000003", "user2", models.LayerPublic, ""),
+	})
+	assert.NoError(t, err)
+
+	pages, err := memStore.GetUserPages(ctx, "user1")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a.com", "b.com"}, pages)
+
+	count, err := memStore.GetUserStrokeCount(ctx, "user1", "Private#1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	assert.NoError(t, memStore.DeleteUserStrokes(ctx, "user1", "Private#1"))
+
+	count, err = memStore.GetUserStrokeCount(ctx, "user1", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestMemStore_PageStrokesByLayer(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	ctx := context.Background()
+
+	_, err := memStore.WriteStrokeBatch(ctx, []models.StrokeRecord{
+		strokeRecord("example.com", "00000000-0000-7000-8000-000000000002", "user2", models.LayerPublic, ""),
+		strokeRecord("example.com", "00000000-0000-7000-8000-000000000001", "user1", models.LayerPublic, ""),
+		strokeRecord("example.com", "00000000-0000-7000-8000-000000000003", "user1", models.LayerPrivate, "3"),
+		strokeRecord("other.com", "00000000-0000-7000-8000-000000000004", "user1", models.LayerPublic, ""),
+	})
+	assert.NoError(t, err)
+
+	// Only the private layer's strokes on that page go
+	deleted, err := memStore.DeletePageStrokesByLayer(ctx, "example.com", "Private#3")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"user1": 1}, deleted)
+	strokes, err := memStore.GetStrokeRecords(ctx, "example.com", 1100)
+	assert.NoError(t, err)
+	assert.Len(t, strokes, 2)
+	strokes, err = memStore.GetStrokeRecords(ctx, "other.com", 1100)
+	assert.NoError(t, err)
+	assert.Len(t, strokes, 1)
+}
+
+func TestMemStore_WriteStrokeBatch_SimulatedUnprocessed(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	ctx := context.Background()
+	memStore.SetSimulatedUnprocessed(1)
+
+	batch := []models.StrokeRecord{
+		strokeRecord("a.com", "00000000-0000-7000-8000-000000000001", "user1", models.LayerPublic, ""),
+		strokeRecord("a.com", "00000000-0000-7000-8000-000000000002", "user1", models.LayerPublic, ""),
+	}
+	unprocessed, err := memStore.WriteStrokeBatch(ctx, batch)
+	assert.NoError(t, err)
+	assert.Len(t, unprocessed, 1)
+	assert.Equal(t, batch[1].Stroke.Id, unprocessed[0].Stroke.Id)
+
+	strokes, _ := memStore.GetStrokeRecords(ctx, "a.com", 1100)
+	assert.Len(t, strokes, 1)
+
+	memStore.SetSimulatedUnprocessed(0)
+	unprocessed, err = memStore.WriteStrokeBatch(ctx, unprocessed)
+	assert.NoError(t, err)
+	assert.Len(t, unprocessed, 0)
+
+	strokes, _ = memStore.GetStrokeRecords(ctx, "a.com", 1100)
+	assert.Len(t, strokes, 2)
+}
@@ -21,11 +21,36 @@ func (m *MockStore) GetUser(ctx context.Context, provider string, providerId str
 	return args.Get(0).(models.User), args.Error(1)
 }
 
-func (m *MockStore) GetStrokeRecords(ctx context.Context, pageKey string) ([]models.Stroke, error) {
-	args := m.Called(ctx, pageKey)
+func (m *MockStore) GetUserById(ctx context.Context, id string) (models.User, error) {
+	args := m.Called(ctx, id)
+	return args.Get(0).(models.User), args.Error(1)
+}
+
+func (m *MockStore) GetUsersCreatedBetween(ctx context.Context, start int64, end int64, limit int, cursor string) ([]models.User, string, error) {
+	args := m.Called(ctx, start, end, limit, cursor)
+	return args.Get(0).([]models.User), args.String(1), args.Error(2)
+}
+
+func (m *MockStore) GetStrokeRecords(ctx context.Context, pageKey string, limit int32) ([]models.Stroke, error) {
+	args := m.Called(ctx, pageKey, limit)
 	return args.Get(0).([]models.Stroke), args.Error(1)
 }
 
+func (m *MockStore) GetVisibleStrokeRecords(ctx context.Context, pageKey string, limit int32) ([]models.Stroke, error) {
+	args := m.Called(ctx, pageKey, limit)
+	return args.Get(0).([]models.Stroke), args.Error(1)
+}
+
+func (m *MockStore) GetAllStrokeRecords(ctx context.Context, pageKey string, cursor string, limit int32) ([]models.Stroke, string, error) {
+	args := m.Called(ctx, pageKey, cursor, limit)
+	return args.Get(0).([]models.Stroke), args.String(1), args.Error(2)
+}
+
+func (m *MockStore) GetStroke(ctx context.Context, pageKey string, strokeId string) (models.Stroke, error) {
+	args := m.Called(ctx, pageKey, strokeId)
+	return args.Get(0).(models.Stroke), args.Error(1)
+}
+
 func (m *MockStore) WriteStrokeBatch(ctx context.Context, strokes []models.StrokeRecord) ([]models.StrokeRecord, error) {
 	args := m.Called(ctx, strokes)
 	return args.Get(0).([]models.StrokeRecord), args.Error(1)
@@ -46,6 +71,14 @@ func (m *MockStore) DeleteUserStrokes(ctx context.Context, userId string, layer
 	return args.Error(0)
 }
 
+func (m *MockStore) DeletePageStrokesByLayer(ctx context.Context, pageKey string, layer string) (map[string]int, error) {
+	args := m.Called(ctx, pageKey, layer)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(map[string]int), args.Error(1)
+}
+
 func (m *MockStore) GetUserPages(ctx context.Context, userId string) ([]string, error) {
 	args := m.Called(ctx, userId)
 	return args.Get(0).([]string), args.Error(1)
@@ -61,7 +94,57 @@ func (m *MockStore) SetUserEncryptionKeys(ctx context.Context, user models.User,
 	return args.Int(0), args.Error(1)
 }
 
+func (m *MockStore) RotateUserKEK(ctx context.Context, user models.User, expectedKeyVersion int) error {
+	args := m.Called(ctx, user, expectedKeyVersion)
+	return args.Error(0)
+}
+
+func (m *MockStore) UpdateUsername(ctx context.Context, provider string, providerId string, username string) error {
+	args := m.Called(ctx, provider, providerId, username)
+	return args.Error(0)
+}
+
+func (m *MockStore) UpdateUserLastActive(ctx context.Context, provider string, providerId string, lastActive int64) error {
+	args := m.Called(ctx, provider, providerId, lastActive)
+	return args.Error(0)
+}
+
 func (m *MockStore) IncrementUserStrokeCount(ctx context.Context, provider string, providerId string, count int) error {
 	args := m.Called(ctx, provider, providerId, count)
 	return args.Error(0)
 }
+
+func (m *MockStore) AddStrokeReport(ctx context.Context, report models.StrokeReport) (int, error) {
+	args := m.Called(ctx, report)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockStore) SetStrokeHidden(ctx context.Context, pageKey string, strokeId string, hidden bool) error {
+	args := m.Called(ctx, pageKey, strokeId, hidden)
+	return args.Error(0)
+}
+
+func (m *MockStore) GetPageSettings(ctx context.Context, pageKey string) (models.PageSettings, error) {
+	args := m.Called(ctx, pageKey)
+	return args.Get(0).(models.PageSettings), args.Error(1)
+}
+
+func (m *MockStore) SetPageSettings(ctx context.Context, pageKey string, settings models.PageSettings) error {
+	args := m.Called(ctx, pageKey, settings)
+	return args.Error(0)
+}
+
+func (m *MockStore) CountPageStrokes(ctx context.Context, pageKey string) (int, error) {
+	args := m.Called(ctx, pageKey)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockStore) WriteStrokeWithCounter(ctx context.Context, record models.StrokeRecord, provider string, providerId string) error {
+	args := m.Called(ctx, record, provider, providerId)
+	return args.Error(0)
+}
+
+func (m *MockStore) Close() error {
+	args := m.Called()
+	return args.Error(0)
+}
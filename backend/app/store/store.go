@@ -10,20 +10,55 @@ import (
 type WebverseStore interface {
 	CreateUser(ctx context.Context, user models.User) (models.User, error)
 	GetUser(ctx context.Context, provider string, providerId string) (models.User, error)
-	GetStrokeRecords(ctx context.Context, pageKey string) ([]models.Stroke, error)
+	GetUserById(ctx context.Context, id string) (models.User, error)
+	GetUsersCreatedBetween(ctx context.Context, start int64, end int64, limit int, cursor string) ([]models.User, string, error)
+	GetStrokeRecords(ctx context.Context, pageKey string, limit int32) ([]models.Stroke, error)
+	// GetVisibleStrokeRecords is GetStrokeRecords without hidden strokes, the limit counts only the visible ones
+	GetVisibleStrokeRecords(ctx context.Context, pageKey string, limit int32) ([]models.Stroke, error)
+	GetAllStrokeRecords(ctx context.Context, pageKey string, cursor string, limit int32) ([]models.Stroke, string, error)
+	GetStroke(ctx context.Context, pageKey string, strokeId string) (models.Stroke, error)
 	WriteStrokeBatch(ctx context.Context, strokes []models.StrokeRecord) ([]models.StrokeRecord, error)
 	DeleteStroke(ctx context.Context, pageKey string, strokeId string, userId string) error
 	DeleteUser(ctx context.Context, provider string, providerId string) error
 	DeleteUserStrokes(ctx context.Context, userId string, layer string) error
+	// DeletePageStrokesByLayer deletes the page's strokes in one layer and returns how many were deleted per user id
+	// Strokes deleted before an error are still counted
+	// Used by page clears; key rotation deletes one user's layer on every page with DeleteUserStrokes instead
+	DeletePageStrokesByLayer(ctx context.Context, pageKey string, layer string) (map[string]int, error)
 	GetUserPages(ctx context.Context, userId string) ([]string, error)
 	GetUserStrokeCount(ctx context.Context, userId string, layer string) (int, error)
+	// CountPageStrokes counts the strokes stored on a page across all layers
+	CountPageStrokes(ctx context.Context, pageKey string) (int, error)
 	SetUserEncryptionKeys(ctx context.Context, user models.User, incrementKeyVersion bool) (int, error)
+	// RotateUserKEK replaces the user's KEK salt and wrapped data keys only if their keys are still at expectedKeyVersion
+	// Returns ErrConditionFailed if the keys were replaced, deleted or the user doesn't exist
+	RotateUserKEK(ctx context.Context, user models.User, expectedKeyVersion int) error
+	UpdateUsername(ctx context.Context, provider string, providerId string, username string) error
+	// UpdateUserLastActive sets when the user last drew, in Unix seconds
+	// Returns ErrItemNotFound if the user doesn't exist
+	UpdateUserLastActive(ctx context.Context, provider string, providerId string, lastActive int64) error
+	// AddStrokeReport records a report once per reporter and stroke, and returns how many users reported the stroke
+	AddStrokeReport(ctx context.Context, report models.StrokeReport) (int, error)
+	// SetStrokeHidden flags a stroke as hidden pending review, it stays stored
+	// Returns ErrItemNotFound if the stroke doesn't exist
+	SetStrokeHidden(ctx context.Context, pageKey string, strokeId string, hidden bool) error
+	// GetPageSettings returns ErrItemNotFound if the page has no settings
+	GetPageSettings(ctx context.Context, pageKey string) (models.PageSettings, error)
+	SetPageSettings(ctx context.Context, pageKey string, settings models.PageSettings) error
 
 	IncrementUserStrokeCount(ctx context.Context, provider string, providerId string, count int) error
+	// WriteStrokeWithCounter writes a stroke and counts it toward its user in one transaction,
+	// so neither happens without the other. Returns ErrItemNotFound if the user doesn't exist
+	WriteStrokeWithCounter(ctx context.Context, record models.StrokeRecord, provider string, providerId string) error
+
+	Close() error
 }
 
 // Custom error types for clarity
 var (
 	ErrItemNotFound    = errors.New("item does not exist")
 	ErrConditionFailed = errors.New("condition not met")
+	ErrInvalidCursor   = errors.New("invalid cursor")
+	// The database is pushing back on load, the same request may succeed after a short wait
+	ErrThrottled = errors.New("request throttled")
 )
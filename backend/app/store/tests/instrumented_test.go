@@ -0,0 +1,53 @@
+package store_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zlnvch/webverse/metrics"
+	"github.com/zlnvch/webverse/models"
+	"github.com/zlnvch/webverse/store"
+	"github.com/zlnvch/webverse/store/memstore"
+)
+
+func TestInstrumentedStore_DelegatesAndRecords(t *testing.T) {
+	registry := metrics.NewRegistry()
+	instrumented := store.NewInstrumentedStore(memstore.NewMemWebverseStore(), registry)
+	ctx := context.Background()
+
+	created, err := instrumented.CreateUser(ctx, models.User{Provider: "github", ProviderId: "1", Username: "alice"})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, created.Id)
+
+	user, err := instrumented.GetUser(ctx, "github", "1")
+	assert.NoError(t, err)
+	assert.Equal(t, created.Id, user.Id)
+
+	assert.Equal(t, int64(1), registry.Duration("store.create_user").Count)
+	assert.Equal(t, int64(1), registry.Duration("store.get_user").Count)
+	assert.Equal(t, int64(0), registry.Counter("store.get_user.errors"))
+}
+
+func TestInstrumentedStore_CountsErrors(t *testing.T) {
+	registry := metrics.NewRegistry()
+	instrumented := store.NewInstrumentedStore(memstore.NewMemWebverseStore(), registry)
+	ctx := context.Background()
+
+	// Not found is an expected outcome, not a store failure
+	_, err := instrumented.GetUser(ctx, "github", "missing")
+	assert.ErrorIs(t, err, store.ErrItemNotFound)
+	assert.Equal(t, int64(1), registry.Duration("store.get_user").Count)
+	assert.Equal(t, int64(0), registry.Counter("store.get_user.errors"))
+
+	_, err = instrumented.WriteStrokeBatch(ctx, []models.StrokeRecord{{
+		PageKey: "example.com",
+		Layer:   models.LayerPublic,
+		Stroke:  models.Stroke{Id: "s1", UserId: "owner", Content: []byte("data")},
+	}})
+	assert.NoError(t, err)
+
+	err = instrumented.DeleteStroke(ctx, "example.com", "s1", "someone-else")
+	assert.ErrorIs(t, err, store.ErrConditionFailed)
+	assert.Equal(t, int64(1), registry.Counter("store.delete_stroke.errors"))
+}
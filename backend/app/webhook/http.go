@@ -0,0 +1,160 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zlnvch/webverse/metrics"
+)
+
+// Header carrying "sha256=" followed by the hex HMAC-SHA256 of the timestamp, a "." and the request body,
+// keyed with the secret
+const SignatureHeader = "X-Webverse-Signature"
+
+// Header carrying the Unix seconds the delivery was signed at. It is covered by the signature,
+// so receivers can reject old deliveries as replays
+const TimestampHeader = "X-Webverse-Timestamp"
+
+const (
+	metricDelivered = "webhook.delivered"
+	metricFailed    = "webhook.failed"
+	metricDropped   = "webhook.dropped"
+)
+
+const (
+	DefaultQueueSize   = 1024
+	DefaultMaxAttempts = 4
+	DefaultRetryDelay  = 500 * time.Millisecond
+	deliveryTimeout    = 10 * time.Second
+)
+
+// HTTPDispatcher POSTs every event as JSON to each of its URLs from a queue drained by Run
+// Events are only held in memory: they are dropped when the queue is full and lost on a crash
+type HTTPDispatcher struct {
+	urls   []string
+	secret []byte
+	queue  chan Event
+	// Each delivery is tried up to MaxAttempts times, waiting RetryDelay before the first retry
+	// and twice as long before each next one. Only network errors, 429s and 5xxs are retried
+	MaxAttempts int
+	RetryDelay  time.Duration
+	Client      *http.Client
+	Metrics     metrics.Metrics
+}
+
+func NewHTTPDispatcher(urls []string, secret []byte, queueSize int) *HTTPDispatcher {
+	return &HTTPDispatcher{
+		urls:        urls,
+		secret:      secret,
+		queue:       make(chan Event, queueSize),
+		MaxAttempts: DefaultMaxAttempts,
+		RetryDelay:  DefaultRetryDelay,
+		Client:      &http.Client{Timeout: deliveryTimeout},
+		Metrics:     metrics.Noop{},
+	}
+}
+
+// Notify queues the event without blocking
+func (d *HTTPDispatcher) Notify(event Event) {
+	select {
+	case d.queue <- event:
+	default:
+		d.Metrics.Inc(metricDropped, 1)
+		log.Printf("Webhook queue is full, dropping %s event of stroke %s", event.Type, event.StrokeId)
+	}
+}
+
+// Sign returns the value of the signature header for body sent with the timestamp header
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Run delivers queued events until shutdownCtx is done. Events are delivered one at a time,
+// to all URLs concurrently, so a slow endpoint delays the others but never the draw path
+func (d *HTTPDispatcher) Run(shutdownCtx context.Context) {
+	for {
+		select {
+		case event := <-d.queue:
+			d.deliver(shutdownCtx, event)
+		case <-shutdownCtx.Done():
+			return
+		}
+	}
+}
+
+func (d *HTTPDispatcher) deliver(ctx context.Context, event Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to marshal webhook event: %v", err)
+		return
+	}
+	// Retries resend the same signature, they are over within seconds of it
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := Sign(d.secret, timestamp, body)
+
+	var wg sync.WaitGroup
+	for _, url := range d.urls {
+		wg.Go(func() {
+			if err := d.deliverWithRetry(ctx, url, body, timestamp, signature); err != nil {
+				d.Metrics.Inc(metricFailed, 1)
+				log.Printf("Webhook delivery of %s event to %s failed: %v", event.Type, url, err)
+				return
+			}
+			d.Metrics.Inc(metricDelivered, 1)
+		})
+	}
+	wg.Wait()
+}
+
+func (d *HTTPDispatcher) deliverWithRetry(ctx context.Context, url string, body []byte, timestamp string, signature string) error {
+	delay := d.RetryDelay
+	for attempt := 1; ; attempt++ {
+		retryable, err := d.post(ctx, url, body, timestamp, signature)
+		if err == nil || !retryable || attempt >= d.MaxAttempts {
+			return err
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// post reports whether a failed delivery is worth retrying
+func (d *HTTPDispatcher) post(ctx context.Context, url string, body []byte, timestamp string, signature string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, signature)
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retryable, fmt.Errorf("unexpected status %d", resp.StatusCode)
+}
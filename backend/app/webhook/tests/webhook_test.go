@@ -0,0 +1,157 @@
+package webhook_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zlnvch/webverse/models"
+	"github.com/zlnvch/webverse/webhook"
+)
+
+type receivedRequest struct {
+	body      []byte
+	timestamp string
+	signature string
+}
+
+// Helper that starts an endpoint answering with the given statuses in turn, then 200s
+func newEndpoint(t *testing.T, statuses ...int) (*httptest.Server, chan receivedRequest) {
+	received := make(chan receivedRequest, 10)
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- receivedRequest{
+			body:      body,
+			timestamp: r.Header.Get(webhook.TimestampHeader),
+			signature: r.Header.Get(webhook.SignatureHeader),
+		}
+		if call := int(calls.Add(1)); call <= len(statuses) {
+			w.WriteHeader(statuses[call-1])
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, received
+}
+
+func runDispatcher(t *testing.T, dispatcher *webhook.HTTPDispatcher) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go dispatcher.Run(ctx)
+}
+
+func receive(t *testing.T, received chan receivedRequest) receivedRequest {
+	select {
+	case req := <-received:
+		return req
+	case <-time.After(1 * time.Second):
+		t.Fatal("timed out waiting for a delivery")
+		return receivedRequest{}
+	}
+}
+
+func TestHTTPDispatcher_DeliversSignedEvent(t *testing.T) {
+	first, receivedFirst := newEndpoint(t)
+	second, receivedSecond := newEndpoint(t)
+	secret := []byte("webhook-secret")
+	dispatcher := webhook.NewHTTPDispatcher([]string{first.URL, second.URL}, secret, 10)
+	runDispatcher(t, dispatcher)
+
+	event := webhook.Event{Type: "draw", PageKey: "example.com", Layer: models.LayerPublic, StrokeId: "stroke1", UserId: "user1", Time: 1234}
+	before := time.Now().Unix()
+	dispatcher.Notify(event)
+
+	for _, received := range []chan receivedRequest{receivedFirst, receivedSecond} {
+		req := receive(t, received)
+		var got webhook.Event
+		assert.NoError(t, json.Unmarshal(req.body, &got))
+		assert.Equal(t, event, got)
+		assert.Equal(t, webhook.Sign(secret, req.timestamp, req.body), req.signature)
+
+		// Recent enough for a receiver to accept
+		timestamp, err := strconv.ParseInt(req.timestamp, 10, 64)
+		assert.NoError(t, err)
+		assert.GreaterOrEqual(t, timestamp, before)
+		assert.LessOrEqual(t, timestamp, time.Now().Unix())
+	}
+}
+
+func TestSign(t *testing.T) {
+	// echo -n '1700000000.{"type":"draw"}' | openssl dgst -sha256 -hmac secret
+	assert.Equal(t, "sha256=57fd88806ff9c90d3182d51b66a7b6aeef0d1ea5d67906457bf0f0071fcaf54d", webhook.Sign([]byte("secret"), "1700000000", []byte(`{"type":"draw"}`)))
+	assert.NotEqual(t, webhook.Sign([]byte("secret"), "1", []byte("a")), webhook.Sign([]byte("other"), "1", []byte("a")))
+	assert.NotEqual(t, webhook.Sign([]byte("secret"), "1", []byte("a")), webhook.Sign([]byte("secret"), "1", []byte("b")))
+	// A replayed body can't be given a new timestamp without the secret
+	assert.NotEqual(t, webhook.Sign([]byte("secret"), "1", []byte("a")), webhook.Sign([]byte("secret"), "2", []byte("a")))
+}
+
+func TestHTTPDispatcher_RetriesFailures(t *testing.T) {
+	server, received := newEndpoint(t, http.StatusInternalServerError, http.StatusTooManyRequests)
+	dispatcher := webhook.NewHTTPDispatcher([]string{server.URL}, []byte("secret"), 10)
+	dispatcher.RetryDelay = time.Millisecond
+	runDispatcher(t, dispatcher)
+
+	dispatcher.Notify(webhook.Event{Type: "undo", StrokeId: "stroke1"})
+
+	// Two failures, then the delivery goes through with the same signed body
+	firstAttempt := receive(t, received)
+	for range 2 {
+		retry := receive(t, received)
+		assert.Equal(t, firstAttempt.body, retry.body)
+		assert.Equal(t, firstAttempt.timestamp, retry.timestamp)
+		assert.Equal(t, firstAttempt.signature, retry.signature)
+	}
+	assert.Never(t, func() bool { return len(received) > 0 }, 50*time.Millisecond, 5*time.Millisecond)
+}
+
+func TestHTTPDispatcher_GivesUp(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		status       int
+		wantAttempts int
+	}{
+		{"retryable until max attempts", http.StatusServiceUnavailable, 3},
+		{"client error not retried", http.StatusBadRequest, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server, received := newEndpoint(t, tc.status, tc.status, tc.status, tc.status)
+			dispatcher := webhook.NewHTTPDispatcher([]string{server.URL}, []byte("secret"), 10)
+			dispatcher.MaxAttempts = 3
+			dispatcher.RetryDelay = time.Millisecond
+			runDispatcher(t, dispatcher)
+
+			dispatcher.Notify(webhook.Event{Type: "draw"})
+
+			for range tc.wantAttempts {
+				receive(t, received)
+			}
+			assert.Never(t, func() bool { return len(received) > 0 }, 50*time.Millisecond, 5*time.Millisecond)
+		})
+	}
+}
+
+func TestHTTPDispatcher_NotifyNeverBlocks(t *testing.T) {
+	// Not running, so the queue is never drained
+	dispatcher := webhook.NewHTTPDispatcher([]string{"http://127.0.0.1:1"}, []byte("secret"), 1)
+
+	done := make(chan struct{})
+	go func() {
+		for range 5 {
+			dispatcher.Notify(webhook.Event{Type: "draw"})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(1 * time.Second):
+		t.Fatal("Notify blocked on a full queue")
+	}
+}
@@ -0,0 +1,26 @@
+package webhook
+
+import "github.com/zlnvch/webverse/models"
+
+// Event is a change on a page that integrators are notified of
+type Event struct {
+	// "draw" or "undo"
+	Type     string           `json:"type"`
+	PageKey  string           `json:"pageKey"`
+	Layer    models.LayerType `json:"layer"`
+	StrokeId string           `json:"strokeId"`
+	UserId   string           `json:"userId"`
+	// Unix milliseconds of when the event happened
+	Time int64 `json:"time"`
+}
+
+// Webhook receives the events of successful draws and undos. Notify is called on the draw path,
+// so implementations must return right away and deliver asynchronously
+type Webhook interface {
+	Notify(event Event)
+}
+
+// Noop drops all events, used when no webhooks are configured
+type Noop struct{}
+
+func (Noop) Notify(event Event) {}
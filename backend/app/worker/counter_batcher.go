@@ -2,7 +2,11 @@ package worker
 
 import (
 	"context"
+	"errors"
 	"log"
+	"maps"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/zlnvch/webverse/store"
@@ -15,72 +19,243 @@ type CounterUpdate struct {
 	Delta          int
 }
 
+// CounterLog holds pending stroke count changes outside the process (the cache implements it),
+// keyed by "provider#providerId", so they survive a crash and can be written by the next server to start
+type CounterLog interface {
+	AddPendingStrokeCount(ctx context.Context, userKey string, delta int) error
+	TakePendingStrokeCount(ctx context.Context, userKey string) (int, error)
+	GetPendingStrokeCountUsers(ctx context.Context) ([]string, error)
+}
+
 type CounterBatcher struct {
 	UpdateCh           chan CounterUpdate
 	webverseStore      store.WebverseStore
 	tickerMilliseconds int
+	flushUsers         int
+	// Write-ahead log of the pending changes, nil keeps them in memory only
+	// Set before Run, which starts by writing the changes left in the log by a previous run
+	Log CounterLog
+	// Changes are added to the Log in batches this often, off the Run goroutine so a slow Log never
+	// holds up the senders of updates. A crash loses up to one interval of changes. Set before Run
+	LogInterval time.Duration
+	// Writes started by flushes, waited for before Run returns
+	writes sync.WaitGroup
 }
 
-func NewCounterBatcher(webverseStore store.WebverseStore, tickerMilliseconds int) *CounterBatcher {
+// Distinct users with pending counts that trigger a flush before the next tick
+const DefaultCounterFlushUsers = 100
+
+const counterWriteTimeout = 5 * time.Second
+
+const DefaultCounterLogInterval = 100 * time.Millisecond
+
+// NewCounterBatcher sums stroke count changes per user and writes them to the store every
+// tickerMilliseconds, or as soon as flushUsers distinct users have pending changes.
+// Without a Log, pending changes only live in memory, so a crash loses up to one interval of counts:
+// a shorter interval or a lower threshold means less drift but more store writes
+func NewCounterBatcher(webverseStore store.WebverseStore, tickerMilliseconds int, flushUsers int) *CounterBatcher {
 	return &CounterBatcher{
 		UpdateCh:           make(chan CounterUpdate, 1024),
 		webverseStore:      webverseStore,
 		tickerMilliseconds: tickerMilliseconds,
+		flushUsers:         flushUsers,
+		LogInterval:        DefaultCounterLogInterval,
 	}
 }
 
 func (b *CounterBatcher) Run(shutdownCtx context.Context) {
+	if b.Log != nil {
+		b.recoverPending()
+	}
+
 	ticker := time.NewTicker(time.Duration(b.tickerMilliseconds) * time.Millisecond)
 	defer ticker.Stop()
+	// Only ticks with a Log
+	var logTick <-chan time.Time
+	if b.Log != nil {
+		logTicker := time.NewTicker(b.LogInterval)
+		defer logTicker.Stop()
+		logTick = logTicker.C
+	}
 
 	// Key: "provider#providerId" -> count
+	// Only the changes that are not in the log, the others are taken from it on flush
 	userCounts := make(map[string]int)
-	// Map to store separated keys for the flush loop
+	// Map to store separated keys for the flush loop, holds every user with pending changes
 	type providerKeys struct {
 		p  string
 		id string
 	}
 	userKeys := make(map[string]providerKeys)
+	// Changes waiting for the next log write
+	unlogged := make(map[string]int)
+	// Users whose changes are being written to the log, nil while no write runs, at most one does
+	// A flush during the write may take from the log before the changes are in it, so the users are pending again after it
+	var logging map[string]providerKeys
+	// The changes that could not be logged, sent back by the log write
+	logDone := make(chan map[string]int, 1)
 
 	flush := func() {
+		// Not logged yet, so written straight to the store
+		for key, delta := range unlogged {
+			userCounts[key] += delta
+		}
+		unlogged = make(map[string]int)
+
 		// Flush Users
-		for key, count := range userCounts {
-			if count == 0 {
-				continue
-			}
-			pk := userKeys[key]
-			go func(p string, pid string, c int) {
-				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-				defer cancel()
-				if err := b.webverseStore.IncrementUserStrokeCount(ctx, p, pid, c); err != nil {
-					log.Printf("Failed to update stroke count for user %s#%s: %v", p, pid, err)
-				}
-			}(pk.p, pk.id, count)
+		for key, pk := range userKeys {
+			count := userCounts[key]
+			b.writes.Go(func() {
+				b.writeCount(pk.p, pk.id, count, b.Log != nil)
+			})
 		}
 		// Reset User Maps
 		userCounts = make(map[string]int)
 		userKeys = make(map[string]providerKeys)
 	}
 
-	for {
-		select {
-		case update := <-b.UpdateCh:
-			if update.UserProvider != "" && update.UserProviderId != "" {
-				key := update.UserProvider + "#" + update.UserProviderId
+	startLogWrite := func() {
+		if logging != nil || len(unlogged) == 0 {
+			return
+		}
+		logging = make(map[string]providerKeys, len(unlogged))
+		for key := range unlogged {
+			logging[key] = userKeys[key]
+		}
+		batch := unlogged
+		unlogged = make(map[string]int)
+		b.writes.Go(func() {
+			logDone <- b.logCounts(batch)
+		})
+	}
+
+	endLogWrite := func(failed map[string]int) {
+		// Kept in memory instead
+		for key, delta := range failed {
+			userCounts[key] += delta
+		}
+		maps.Copy(userKeys, logging)
+		logging = nil
+	}
+
+	add := func(update CounterUpdate) {
+		if update.UserProvider != "" && update.UserProviderId != "" {
+			key := update.UserProvider + "#" + update.UserProviderId
+			if b.Log != nil {
+				unlogged[key] += update.Delta
+			} else {
 				userCounts[key] += update.Delta
-				userKeys[key] = providerKeys{p: update.UserProvider, id: update.UserProviderId}
 			}
+			userKeys[key] = providerKeys{p: update.UserProvider, id: update.UserProviderId}
+		}
+	}
 
-			if len(userCounts) >= 100 {
+	for {
+		select {
+		case update := <-b.UpdateCh:
+			add(update)
+			if len(userKeys) >= b.flushUsers {
 				flush()
 			}
 
+		case <-logTick:
+			startLogWrite()
+
+		case failed := <-logDone:
+			endLogWrite(failed)
+
 		case <-ticker.C:
 			flush()
 
 		case <-shutdownCtx.Done():
+			// Updates sent before shutdown may still be buffered
+			for drained := false; !drained; {
+				select {
+				case update := <-b.UpdateCh:
+					add(update)
+				default:
+					drained = true
+				}
+			}
+			if logging != nil {
+				endLogWrite(<-logDone)
+			}
 			flush()
+			b.writes.Wait()
 			return
 		}
 	}
 }
+
+// logCounts adds a batch of changes to the log and returns the ones that could not be added
+func (b *CounterBatcher) logCounts(batch map[string]int) map[string]int {
+	ctx, cancel := context.WithTimeout(context.Background(), counterWriteTimeout)
+	defer cancel()
+
+	failed := make(map[string]int)
+	for key, delta := range batch {
+		if delta == 0 {
+			continue
+		}
+		if err := b.Log.AddPendingStrokeCount(ctx, key, delta); err != nil {
+			log.Printf("Failed to log stroke count change for user %s, keeping it in memory: %v", key, err)
+			failed[key] = delta
+		}
+	}
+	return failed
+}
+
+// writeCount writes the user's in-memory change plus, if takeLogged is set, the change pending in the log
+// A failed write is put back in the log so it isn't lost, unless the user no longer exists
+func (b *CounterBatcher) writeCount(provider string, providerId string, count int, takeLogged bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), counterWriteTimeout)
+	defer cancel()
+	key := provider + "#" + providerId
+
+	if takeLogged {
+		logged, err := b.Log.TakePendingStrokeCount(ctx, key)
+		if err != nil {
+			// Left in the log for the next start
+			log.Printf("Failed to take pending stroke count for user %s: %v", key, err)
+		}
+		count += logged
+	}
+	if count == 0 {
+		return
+	}
+
+	err := b.webverseStore.IncrementUserStrokeCount(ctx, provider, providerId, count)
+	if err == nil {
+		return
+	}
+	log.Printf("Failed to update stroke count for user %s: %v", key, err)
+	if b.Log == nil || errors.Is(err, store.ErrItemNotFound) {
+		return
+	}
+	if err := b.Log.AddPendingStrokeCount(ctx, key, count); err != nil {
+		log.Printf("Failed to log stroke count change for user %s, %d strokes are lost: %v", key, count, err)
+	}
+}
+
+// recoverPending writes the changes a previous run left in the log, e.g. after a crash
+// Changes are taken from the log one user at a time, so servers starting together never write a change twice
+func (b *CounterBatcher) recoverPending() {
+	ctx, cancel := context.WithTimeout(context.Background(), counterWriteTimeout)
+	defer cancel()
+	userKeys, err := b.Log.GetPendingStrokeCountUsers(ctx)
+	if err != nil {
+		log.Printf("Failed to read pending stroke counts: %v", err)
+		return
+	}
+
+	for _, key := range userKeys {
+		provider, providerId, ok := strings.Cut(key, "#")
+		if !ok {
+			continue
+		}
+		b.writeCount(provider, providerId, 0, true)
+	}
+	if len(userKeys) > 0 {
+		log.Printf("Recovered pending stroke counts of %d users", len(userKeys))
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/zlnvch/webverse/cache"
@@ -25,6 +27,9 @@ type MQConsumer struct {
 	webverseStore          store.WebverseStore
 	webverseCache          cache.WebverseCache
 	counterBatcher         *CounterBatcher
+	// How long a received message stays hidden from other consumers, i.e. the time to process it before
+	// it is redelivered. Whole seconds, more than processingMargin. Set before Run
+	VisibilityTimeout time.Duration
 }
 
 func NewMQConsumer(deleteUserStrokesQueue mq.MessageQueue, webverseStore store.WebverseStore, webverseCache cache.WebverseCache, counterBatcher *CounterBatcher) *MQConsumer {
@@ -33,15 +38,40 @@ func NewMQConsumer(deleteUserStrokesQueue mq.MessageQueue, webverseStore store.W
 		webverseStore:          webverseStore,
 		webverseCache:          webverseCache,
 		counterBatcher:         counterBatcher,
+		VisibilityTimeout:      DefaultVisibilityTimeout,
 	}
 }
 
-// Allow up to 5 minutes for the throttled batch deletion of all the user's pages
-const visibilityTimeout = 300
+// DefaultVisibilityTimeout allows up to 5 minutes for the throttled batch deletion of all the user's pages
+const DefaultVisibilityTimeout = 300 * time.Second
+
+// Processing stops this long before the visibility timeout, so a message is never processed by two consumers at once
+const processingMargin = 1 * time.Second
+
+// ProcessingTimeout is the deadline of processing a message, a little less than the visibility timeout
+func (mqConsumer MQConsumer) ProcessingTimeout() time.Duration {
+	return mqConsumer.VisibilityTimeout - processingMargin
+}
+
+// Processed markers outlive SQS's default 4 day retention, so every redelivery of a message finds its marker
+const processedMessageTTL = 4 * 24 * time.Hour
+
+// RunConcurrently runs consumers receive loops on the same queue and returns once they all stopped
+// Each message is received by a single consumer, and every consumer processes its message with its
+// own context. Counter updates of all consumers go to the one CounterBatcher through its channel
+func (mqConsumer MQConsumer) RunConcurrently(shutdownCtx context.Context, consumers int) {
+	var wg sync.WaitGroup
+	for range consumers {
+		wg.Go(func() {
+			mqConsumer.Run(shutdownCtx)
+		})
+	}
+	wg.Wait()
+}
 
 func (mqConsumer MQConsumer) Run(shutdownCtx context.Context) {
 	for {
-		msg, err := mqConsumer.deleteUserStrokesQueue.Receive(shutdownCtx, visibilityTimeout)
+		msg, err := mqConsumer.deleteUserStrokesQueue.Receive(shutdownCtx, int32(mqConsumer.VisibilityTimeout/time.Second))
 
 		if err != nil {
 			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
@@ -60,53 +90,20 @@ func (mqConsumer MQConsumer) Run(shutdownCtx context.Context) {
 			continue
 		}
 
-		// timeout should be a little less than queue visibility timeout
-		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(visibilityTimeout-1)*time.Second)
-		defer cancel()
-
-		if deleteMsg.DeleteAll {
-			// Full account delete: need to get affected pages for cache invalidation
-			pages, err := mqConsumer.webverseStore.GetUserPages(ctx, deleteMsg.UserId)
-			if err != nil {
-				log.Printf("Failed to get user pages: %v", err)
-			}
-
-			// Delete strokes
-			err = mqConsumer.webverseStore.DeleteUserStrokes(ctx, deleteMsg.UserId, "")
-
-			// Invalidate cache (so pages reload with correct counts from ZCard)
-			if err == nil && pages != nil {
-				if err := mqConsumer.webverseCache.InvalidatePages(ctx, pages); err != nil {
-					log.Printf("Failed to invalidate pages: %v", err)
-				}
-			}
+		// Redelivered after it was processed but before it was deleted, e.g. by a crash in between
+		// Keyed on the message id, a redelivery comes with a new receipt handle
+		if mqConsumer.isProcessed(msg) {
+			log.Printf("Skipping already processed message %s", msg.MessageId)
 		} else {
-			// Layer-specific delete (e.g., old encryption keys)
-			// Count strokes to decrement user counter
-			totalDeleted, countErr := mqConsumer.webverseStore.GetUserStrokeCount(ctx, deleteMsg.UserId, deleteMsg.Layer)
-			if countErr != nil {
-				log.Printf("Failed to get user stroke count for layer %s: %v", deleteMsg.Layer, countErr)
+			if err := mqConsumer.processMessage(deleteMsg); err != nil {
+				log.Printf("webverseStore delete user strokes error: %v", err)
+				continue
 			}
-
-			// Delete strokes
-			err = mqConsumer.webverseStore.DeleteUserStrokes(ctx, deleteMsg.UserId, deleteMsg.Layer)
-
-			// Decrement user counter (these are private strokes, no cache invalidation needed)
-			if err == nil && totalDeleted > 0 {
-				mqConsumer.counterBatcher.UpdateCh <- CounterUpdate{
-					UserProvider:   deleteMsg.UserProvider,
-					UserProviderId: deleteMsg.UserProviderId,
-					Delta:          -totalDeleted,
-				}
-				log.Printf("Deleted %d strokes from layer %s for user %s", totalDeleted, deleteMsg.Layer, deleteMsg.UserId)
+			if err := mqConsumer.webverseCache.MarkMessageProcessed(context.Background(), msg.MessageId, processedMessageTTL); err != nil {
+				log.Printf("mqConsumer failed to mark message %s processed: %v", msg.MessageId, err)
 			}
 		}
 
-		if err != nil {
-			log.Printf("webverseStore delete user strokes error: %v", err)
-			continue
-		}
-
 		err = mqConsumer.deleteUserStrokesQueue.Delete(context.Background(), msg)
 		if err != nil {
 			log.Printf("mqConsumer delete error: %v", err)
@@ -114,3 +111,99 @@ func (mqConsumer MQConsumer) Run(shutdownCtx context.Context) {
 		}
 	}
 }
+
+// isProcessed fails open: processing a message again is safe, only wasteful
+func (mqConsumer MQConsumer) isProcessed(msg *mq.Message) bool {
+	processed, err := mqConsumer.webverseCache.IsMessageProcessed(context.Background(), msg.MessageId)
+	if err != nil {
+		log.Printf("mqConsumer failed to check if message %s was processed: %v", msg.MessageId, err)
+		return false
+	}
+	return processed
+}
+
+// processMessage must be safe to run more than once for the same message: SQS
+// redelivers it if processing is interrupted (e.g. a crash mid-way through the
+// throttled batch delete) or the visibility timeout expires
+func (mqConsumer MQConsumer) processMessage(deleteMsg DeleteUserStrokesMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mqConsumer.ProcessingTimeout())
+	defer cancel()
+
+	if deleteMsg.DeleteAll {
+		return mqConsumer.deleteAllUserStrokes(ctx, deleteMsg)
+	}
+
+	// Layer-specific delete (e.g., old encryption keys)
+	// Count strokes to decrement user counter
+	// After an interrupted attempt this only counts the strokes that are left
+	count, err := mqConsumer.webverseStore.GetUserStrokeCount(ctx, deleteMsg.UserId, deleteMsg.Layer)
+	if err != nil {
+		return fmt.Errorf("get user stroke count failed: %w", err)
+	}
+
+	// Checkpoint the count before deleting, so a redelivery still decrements the strokes already deleted
+	totalDeleted, err := mqConsumer.webverseCache.SetUserDeletionCount(ctx, deleteMsg.UserId, deleteMsg.Layer, count)
+	if err != nil {
+		return fmt.Errorf("checkpoint user stroke count failed: %w", err)
+	}
+
+	// Delete strokes
+	if err := mqConsumer.webverseStore.DeleteUserStrokes(ctx, deleteMsg.UserId, deleteMsg.Layer); err != nil {
+		return err
+	}
+
+	// Decrement user counter (these are private strokes, no cache invalidation needed)
+	if totalDeleted > 0 {
+		mqConsumer.counterBatcher.UpdateCh <- CounterUpdate{
+			UserProvider:   deleteMsg.UserProvider,
+			UserProviderId: deleteMsg.UserProviderId,
+			Delta:          -totalDeleted,
+		}
+		log.Printf("Deleted %d strokes from layer %s for user %s", totalDeleted, deleteMsg.Layer, deleteMsg.UserId)
+	}
+
+	if err := mqConsumer.webverseCache.ClearUserDeletionCount(ctx, deleteMsg.UserId, deleteMsg.Layer); err != nil {
+		log.Printf("Failed to clear checkpointed stroke count for user %s: %v", deleteMsg.UserId, err)
+	}
+	return nil
+}
+
+// deleteAllUserStrokes deletes all strokes of a deleted account and invalidates the affected pages
+// The user profile is already gone by the time this runs, so nothing here may depend on it
+func (mqConsumer MQConsumer) deleteAllUserStrokes(ctx context.Context, deleteMsg DeleteUserStrokesMessage) error {
+	// Full account delete: need to get affected pages for cache invalidation
+	// After an interrupted attempt this only returns the pages that still have strokes
+	pages, err := mqConsumer.webverseStore.GetUserPages(ctx, deleteMsg.UserId)
+	if err != nil {
+		return fmt.Errorf("get user pages failed: %w", err)
+	}
+
+	// Checkpoint the pages before deleting, so a redelivery can still invalidate them
+	if err := mqConsumer.webverseCache.AddUserDeletionPages(ctx, deleteMsg.UserId, pages); err != nil {
+		return fmt.Errorf("checkpoint user pages failed: %w", err)
+	}
+
+	// Delete strokes
+	// Re-queries the remaining strokes, so resuming after a partial delete is safe
+	if err := mqConsumer.webverseStore.DeleteUserStrokes(ctx, deleteMsg.UserId, ""); err != nil {
+		return err
+	}
+
+	// Invalidate cache (so pages reload with correct counts from ZCard)
+	// Includes pages emptied by previous interrupted attempts
+	checkpointed, err := mqConsumer.webverseCache.GetUserDeletionPages(ctx, deleteMsg.UserId)
+	if err != nil {
+		log.Printf("Failed to get checkpointed pages for user %s: %v", deleteMsg.UserId, err)
+		checkpointed = pages
+	}
+	if len(checkpointed) > 0 {
+		if err := mqConsumer.webverseCache.InvalidatePages(ctx, checkpointed); err != nil {
+			log.Printf("Failed to invalidate pages: %v", err)
+		}
+	}
+
+	if err := mqConsumer.webverseCache.ClearUserDeletionPages(ctx, deleteMsg.UserId); err != nil {
+		log.Printf("Failed to clear checkpointed pages for user %s: %v", deleteMsg.UserId, err)
+	}
+	return nil
+}
@@ -2,9 +2,13 @@ package worker
 
 import (
 	"context"
+	"errors"
 	"log"
+	"sync/atomic"
 	"time"
 
+	"github.com/zlnvch/webverse/abuse"
+	"github.com/zlnvch/webverse/metrics"
 	"github.com/zlnvch/webverse/models"
 	"github.com/zlnvch/webverse/store"
 )
@@ -12,6 +16,8 @@ import (
 type DeleteStrokeRequest struct {
 	StrokeId string
 	UserId   string
+	// If set, told whether a pending write of the stroke was cancelled. Must have room for the answer
+	Cancelled chan<- bool
 }
 
 type BatchedStroke struct {
@@ -26,6 +32,92 @@ type StrokeBatcher struct {
 	webverseStore      store.WebverseStore
 	counterBatcher     *CounterBatcher
 	tickerMilliseconds int
+	metrics            metrics.Metrics
+	// Total strokes dropped after failed writes since startup, only accessed from Run
+	droppedStrokes int64
+	// Dropped strokes not yet added to DropLog, only accessed from Run
+	unloggedDrops int
+	// Keeps the total of dropped strokes across restarts, nil only logs it. Set before Run
+	DropLog DropLog
+	// Defaults to a no-op, set before Run
+	AbuseReporter abuse.Reporter
+	// Drop strokes when WriteCh is full instead of waiting for room, set before the first Enqueue
+	// Undos still wait for room in DeleteCh, dropping one would persist the undone stroke
+	ShedWhenFull bool
+	// Total strokes shed since startup
+	shedStrokes atomic.Int64
+	// Flushes of at most this many strokes, i.e. while draws are few, write every stroke in a transaction
+	// with its user's counter, so the count can't drift from the strokes. Larger flushes are batched,
+	// a transaction costs twice the write capacity of a batched put. 0 always batches, set before Run
+	TransactionalFlushSize int
+	// Hold new strokes this long before they are written, so a stroke undone within it is never written
+	// Cache and broadcast are unaffected. Held strokes are lost on a crash, 0 writes on the next flush, set before Run
+	GracePeriod time.Duration
+	// Called from Run with the strokes each write persisted, so their users can be told they are durable
+	// Must not block. Nil disables it, set before Run
+	OnPersisted func(items []BatchedStroke)
+}
+
+// DropLog keeps the total of dropped strokes outside the process (the cache implements it),
+// so it survives restarts and adds up the drops of every server
+type DropLog interface {
+	AddDroppedStrokes(ctx context.Context, count int) (int64, error)
+}
+
+// DefaultStrokeBufferSize absorbs bursts of draws between flushes
+// A bigger buffer rides out longer storms, but holds more acknowledged strokes that are lost on a crash
+const DefaultStrokeBufferSize = 1024
+
+// Maximum items in a DynamoDB BatchWriteItem call
+const strokeBatchSize = 25
+
+// Batch efficiency metrics
+// Fill ratio = strokes_flushed / (flushes * 25): a low ratio means the ticker flushes too eagerly,
+// a high share of size-triggered flushes means write throughput is high
+const (
+	metricStrokesFlushed = "stroke_batcher.strokes_flushed"
+	metricFlushes        = "stroke_batcher.flushes"
+	metricFlushesSize    = "stroke_batcher.flushes.size"
+	metricFlushesTicker  = "stroke_batcher.flushes.ticker"
+	metricFlushesClose   = "stroke_batcher.flushes.shutdown"
+)
+
+// Write failure metrics, any dropped stroke was acknowledged to its client but never persisted
+const (
+	metricWriteFailures  = "stroke_batcher.write_failures"
+	metricStrokesRetried = "stroke_batcher.strokes_retried"
+	metricStrokesDropped = "stroke_batcher.strokes_dropped"
+	metricStrokesShed    = "stroke_batcher.strokes_shed"
+)
+
+const metricStrokesTransactional = "stroke_batcher.strokes_transactional"
+
+// Strokes undone before they were written, which saved a write
+const metricStrokesCancelled = "stroke_batcher.strokes_cancelled"
+
+// Bounds memory when draws outpace the grace period, the oldest held strokes are then written early
+const maxHeldStrokes = 10000
+
+// Failed writes are retried on later ticks with exponential backoff, starting at one tick
+const (
+	maxWriteAttempts = 5
+	// Bounds memory while the store is down, the oldest strokes are dropped first
+	maxRetryStrokes = 1000
+	maxRetryBackoff = 1 * time.Minute
+)
+
+type heldStroke struct {
+	item      BatchedStroke
+	releaseAt time.Time
+}
+
+type retryStroke struct {
+	item     BatchedStroke
+	attempts int
+	retryAt  time.Time
+	// Failed in a transaction with its counter, which may still have committed. Retried the same way,
+	// so the transaction's idempotency token keeps the stroke from being counted twice
+	transactional bool
 }
 
 // Note: Deletes are NOT batched for persistence because DynamoDB BatchWriteItem
@@ -33,59 +125,85 @@ type StrokeBatcher struct {
 // users can only delete their own strokes (UserId check).
 // deleteCh is only used here to remove *pending* writes from the buffer
 // before they are flushed, effectively cancelling the write.
-func NewStrokeBatcher(webverseStore store.WebverseStore, tickerMilliseconds int, counterBatcher *CounterBatcher) *StrokeBatcher {
+func NewStrokeBatcher(webverseStore store.WebverseStore, tickerMilliseconds int, bufferSize int, counterBatcher *CounterBatcher, m metrics.Metrics) *StrokeBatcher {
 	return &StrokeBatcher{
-		WriteCh:            make(chan BatchedStroke, 1024), // buffer to absorb bursts
-		DeleteCh:           make(chan DeleteStrokeRequest, 1024),
+		WriteCh:            make(chan BatchedStroke, bufferSize), // buffer to absorb bursts
+		DeleteCh:           make(chan DeleteStrokeRequest, bufferSize),
 		webverseStore:      webverseStore,
 		counterBatcher:     counterBatcher,
 		tickerMilliseconds: tickerMilliseconds,
+		metrics:            metrics.OrNoop(m),
+		AbuseReporter:      abuse.Noop{},
+	}
+}
+
+// Enqueue hands a stroke to the batcher, returns false if it was shed
+// When the store can't keep up, WriteCh fills and every draw waits for room. With ShedWhenFull the stroke
+// is dropped instead: like a stroke dropped after failed writes, it was acknowledged to its client and
+// stays in the page cache until evicted, but is never persisted
+func (b *StrokeBatcher) Enqueue(item BatchedStroke) bool {
+	if !b.ShedWhenFull {
+		b.WriteCh <- item
+		return true
+	}
+	select {
+	case b.WriteCh <- item:
+		return true
+	default:
+		shed := b.shedStrokes.Add(1)
+		b.metrics.Inc(metricStrokesShed, 1)
+		log.Printf("Shed stroke %s on page %s (write buffer full), %d strokes shed since startup",
+			item.Record.Stroke.Id, item.Record.PageKey, shed)
+		return false
 	}
 }
 
 func (b *StrokeBatcher) Run(shutdownCtx context.Context) {
-	ticker := time.NewTicker(time.Duration(b.tickerMilliseconds) * time.Millisecond)
+	tick := time.Duration(b.tickerMilliseconds) * time.Millisecond
+	ticker := time.NewTicker(tick)
 	defer ticker.Stop()
 
-	batch := make([]models.StrokeRecord, 0, 25)
+	batch := make([]models.StrokeRecord, 0, strokeBatchSize)
 	// We need to keep the metadata associated with the stroke ID to pass it to counter later
-	batchMeta := make(map[string]BatchedStroke, 25)
-	batchIndices := make(map[string]int, 25)
+	batchMeta := make(map[string]BatchedStroke, strokeBatchSize)
+	batchIndices := make(map[string]int, strokeBatchSize)
+	// Strokes whose write failed, oldest first
+	retries := make([]retryStroke, 0)
+	// Strokes waiting out the grace period, oldest first
+	held := make([]heldStroke, 0)
 
-	flush := func() {
-		if len(batch) == 0 {
+	queueRetry := func(item BatchedStroke, attempts int, transactional bool) {
+		if attempts >= maxWriteAttempts {
+			b.dropStroke(item, "write failed after max attempts")
 			return
 		}
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		// Explicitly ignore cancel to satisfy linter
-		// In this case, we don't want to defer cancel(),
-		// when shutdownCtx causes this function to return
-		// any pending batch writes should finish
-		_ = cancel
-		unprocessed, err := b.webverseStore.WriteStrokeBatch(ctx, batch)
-
-		if err != nil {
-			log.Printf("Error writing stroke batch to dynamo: %v", err)
+		if len(retries) >= maxRetryStrokes {
+			b.dropStroke(retries[0].item, "retry buffer full")
+			retries = retries[1:]
 		}
+		backoff := min(tick<<(attempts-1), maxRetryBackoff)
+		retries = append(retries, retryStroke{item: item, attempts: attempts, retryAt: time.Now().Add(backoff), transactional: transactional})
+	}
 
-		// Calculate successes: Everything in batch MINUS unprocessed
-		failedMap := make(map[string]bool)
-		for _, u := range unprocessed {
-			failedMap[u.Stroke.Id] = true
+	flush := func(trigger string) {
+		if len(batch) == 0 {
+			return
 		}
+		b.metrics.Inc(metricFlushes, 1)
+		b.metrics.Inc(trigger, 1)
+		b.metrics.Inc(metricStrokesFlushed, int64(len(batch)))
 
+		items := make([]BatchedStroke, 0, len(batch))
 		for _, s := range batch {
-			if !failedMap[s.Stroke.Id] {
-				// Success!
-				// Retrieve provider info from local map
-				if meta, ok := batchMeta[s.Stroke.Id]; ok {
-					b.counterBatcher.UpdateCh <- CounterUpdate{
-						UserProvider:   meta.UserProvider,
-						UserProviderId: meta.UserProviderId,
-						Delta:          1,
-					}
-				}
-			}
+			items = append(items, batchMeta[s.Stroke.Id])
+		}
+		transactional := len(items) <= b.TransactionalFlushSize
+		write := b.writeBatch
+		if transactional {
+			write = b.writeTransactional
+		}
+		for _, item := range write(items) {
+			queueRetry(item, 1, transactional)
 		}
 
 		batch = batch[:0]
@@ -93,17 +211,83 @@ func (b *StrokeBatcher) Run(shutdownCtx context.Context) {
 		clear(batchMeta)
 	}
 
+	add := func(item BatchedStroke) {
+		batch = append(batch, item.Record)
+		batchIndices[item.Record.Stroke.Id] = len(batch) - 1
+		batchMeta[item.Record.Stroke.Id] = item
+		if len(batch) == strokeBatchSize {
+			flush(metricFlushesSize)
+		}
+	}
+
+	// release adds the held strokes whose grace period has passed to the batch, or all of them when force is set
+	release := func(force bool) {
+		now := time.Now()
+		i := 0
+		for ; i < len(held) && (force || !held[i].releaseAt.After(now)); i++ {
+			add(held[i].item)
+		}
+		held = held[i:]
+	}
+
+	// writeChunks writes due retries strokeBatchSize at a time, the way their first write failed
+	writeChunks := func(due []retryStroke, transactional bool) {
+		write := b.writeBatch
+		if transactional {
+			write = b.writeTransactional
+		}
+		for i := 0; i < len(due); i += strokeBatchSize {
+			chunk := due[i:min(i+strokeBatchSize, len(due))]
+			items := make([]BatchedStroke, 0, len(chunk))
+			attempts := make(map[string]int, len(chunk))
+			for _, r := range chunk {
+				items = append(items, r.item)
+				attempts[r.item.Record.Stroke.Id] = r.attempts
+			}
+			b.metrics.Inc(metricStrokesRetried, int64(len(items)))
+			for _, item := range write(items) {
+				queueRetry(item, attempts[item.Record.Stroke.Id]+1, transactional)
+			}
+		}
+	}
+
+	// retry writes the strokes whose backoff has passed, or all of them when force is set
+	retry := func(force bool) {
+		now := time.Now()
+		var due, dueTransactional []retryStroke
+		remaining := make([]retryStroke, 0, len(retries))
+		for _, r := range retries {
+			if force || !r.retryAt.After(now) {
+				if r.transactional {
+					dueTransactional = append(dueTransactional, r)
+				} else {
+					due = append(due, r)
+				}
+			} else {
+				remaining = append(remaining, r)
+			}
+		}
+		retries = remaining
+
+		writeChunks(dueTransactional, true)
+		writeChunks(due, false)
+	}
+
 	for {
 		select {
 		case item := <-b.WriteCh:
-			batch = append(batch, item.Record)
-			batchIndices[item.Record.Stroke.Id] = len(batch) - 1
-			batchMeta[item.Record.Stroke.Id] = item
-			if len(batch) == 25 {
-				flush()
+			if b.GracePeriod <= 0 {
+				add(item)
+				continue
+			}
+			if len(held) >= maxHeldStrokes {
+				add(held[0].item)
+				held = held[1:]
 			}
+			held = append(held, heldStroke{item: item, releaseAt: time.Now().Add(b.GracePeriod)})
 
 		case deleteReq := <-b.DeleteCh:
+			cancelled := false
 			if idx, ok := batchIndices[deleteReq.StrokeId]; ok {
 				if batch[idx].Stroke.UserId == deleteReq.UserId {
 					l := len(batch)
@@ -117,18 +301,158 @@ func (b *StrokeBatcher) Run(shutdownCtx context.Context) {
 
 					delete(batchIndices, deleteReq.StrokeId)
 					delete(batchMeta, deleteReq.StrokeId)
+					b.metrics.Inc(metricStrokesCancelled, 1)
+					cancelled = true
 				} else {
 					// This means they maliciously sent a delete message with a different user's strokeId
-					// TODO: ban user?
+					b.AbuseReporter.ReportNotOwnerDelete(deleteReq.UserId, deleteReq.StrokeId)
 				}
 			}
+			for i, h := range held {
+				if h.item.Record.Stroke.Id != deleteReq.StrokeId {
+					continue
+				}
+				if h.item.Record.Stroke.UserId == deleteReq.UserId {
+					held = append(held[:i], held[i+1:]...)
+					b.metrics.Inc(metricStrokesCancelled, 1)
+					cancelled = true
+				} else {
+					b.AbuseReporter.ReportNotOwnerDelete(deleteReq.UserId, deleteReq.StrokeId)
+				}
+				break
+			}
+			// An undone stroke must not be written by a later retry
+			for i, r := range retries {
+				if r.item.Record.Stroke.Id == deleteReq.StrokeId && r.item.Record.Stroke.UserId == deleteReq.UserId {
+					retries = append(retries[:i], retries[i+1:]...)
+					cancelled = true
+					break
+				}
+			}
+			if deleteReq.Cancelled != nil {
+				deleteReq.Cancelled <- cancelled
+			}
 
 		case <-ticker.C:
-			flush()
+			release(false)
+			flush(metricFlushesTicker)
+			retry(false)
+			b.logDrops()
 
 		case <-shutdownCtx.Done():
-			flush()
+			// Held strokes are written rather than lost, their grace period is cut short
+			release(true)
+			flush(metricFlushesClose)
+			// Last chance for strokes waiting on a retry, whatever still fails is lost
+			retry(true)
+			for _, r := range retries {
+				b.dropStroke(r.item, "shutting down")
+			}
+			b.logDrops()
 			return
 		}
 	}
 }
+
+// writeBatch writes up to strokeBatchSize strokes and counts the successful ones towards their users
+// Returns the strokes that were not written
+func (b *StrokeBatcher) writeBatch(items []BatchedStroke) []BatchedStroke {
+	records := make([]models.StrokeRecord, 0, len(items))
+	for _, item := range items {
+		records = append(records, item.Record)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	// Explicitly ignore cancel to satisfy linter
+	// In this case, we don't want to defer cancel(),
+	// when shutdownCtx causes Run to return
+	// any pending batch writes should finish
+	_ = cancel
+	unprocessed, err := b.webverseStore.WriteStrokeBatch(ctx, records)
+
+	if err != nil {
+		log.Printf("Error writing stroke batch to dynamo: %v", err)
+		b.metrics.Inc(metricWriteFailures, 1)
+		// Puts are idempotent, so the whole batch can be written again
+		return items
+	}
+
+	// Calculate successes: Everything in batch MINUS unprocessed
+	failedMap := make(map[string]bool)
+	for _, u := range unprocessed {
+		failedMap[u.Stroke.Id] = true
+	}
+
+	var failed, persisted []BatchedStroke
+	for _, item := range items {
+		if failedMap[item.Record.Stroke.Id] {
+			failed = append(failed, item)
+			continue
+		}
+		// Success!
+		persisted = append(persisted, item)
+		b.counterBatcher.UpdateCh <- CounterUpdate{
+			UserProvider:   item.UserProvider,
+			UserProviderId: item.UserProviderId,
+			Delta:          1,
+		}
+	}
+	b.persisted(persisted)
+	return failed
+}
+
+// writeTransactional writes each stroke in a transaction with its user's counter, must be called from Run
+// Returns the strokes that were not written
+func (b *StrokeBatcher) writeTransactional(items []BatchedStroke) []BatchedStroke {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b.metrics.Inc(metricStrokesTransactional, int64(len(items)))
+
+	var failed, persisted []BatchedStroke
+	for _, item := range items {
+		err := b.webverseStore.WriteStrokeWithCounter(ctx, item.Record, item.UserProvider, item.UserProviderId)
+		if errors.Is(err, store.ErrItemNotFound) {
+			// The user was deleted, and their strokes with them
+			b.dropStroke(item, "user no longer exists")
+		} else if err != nil {
+			log.Printf("Error writing stroke %s with its counter to dynamo: %v", item.Record.Stroke.Id, err)
+			b.metrics.Inc(metricWriteFailures, 1)
+			failed = append(failed, item)
+		} else {
+			persisted = append(persisted, item)
+		}
+	}
+	b.persisted(persisted)
+	return failed
+}
+
+func (b *StrokeBatcher) persisted(items []BatchedStroke) {
+	if b.OnPersisted != nil && len(items) > 0 {
+		b.OnPersisted(items)
+	}
+}
+
+func (b *StrokeBatcher) dropStroke(item BatchedStroke, reason string) {
+	b.droppedStrokes++
+	b.unloggedDrops++
+	b.metrics.Inc(metricStrokesDropped, 1)
+	log.Printf("Dropped stroke %s on page %s (%s), %d strokes dropped since startup",
+		item.Record.Stroke.Id, item.Record.PageKey, reason, b.droppedStrokes)
+}
+
+// logDrops adds the strokes dropped since the last call to DropLog, once per tick rather than per stroke
+// as drops come in bursts while the store is down. They are kept for the next tick if it fails
+func (b *StrokeBatcher) logDrops() {
+	if b.DropLog == nil || b.unloggedDrops == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), counterWriteTimeout)
+	defer cancel()
+	total, err := b.DropLog.AddDroppedStrokes(ctx, b.unloggedDrops)
+	if err != nil {
+		log.Printf("Failed to record %d dropped strokes: %v", b.unloggedDrops, err)
+		return
+	}
+	b.unloggedDrops = 0
+	log.Printf("%d strokes dropped in total", total)
+}
@@ -0,0 +1,247 @@
+package worker_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zlnvch/webverse/models"
+	"github.com/zlnvch/webverse/store/memstore"
+	"github.com/zlnvch/webverse/worker"
+)
+
+func TestCounterBatcher_FlushesAtUserThreshold(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	ctx := context.Background()
+	for i := range 3 {
+		_, err := memStore.CreateUser(ctx, models.User{Provider: "github", ProviderId: fmt.Sprint(i)})
+		assert.NoError(t, err)
+	}
+
+	// Ticker never fires during the test, so only the threshold can flush
+	counterBatcher := worker.NewCounterBatcher(memStore, 3600000, 2)
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go counterBatcher.Run(runCtx)
+
+	strokeCount := func(providerId string) int {
+		user, _ := memStore.GetUser(ctx, "github", providerId)
+		return user.StrokeCount
+	}
+
+	counterBatcher.UpdateCh <- worker.CounterUpdate{UserProvider: "github", UserProviderId: "0", Delta: 2}
+	counterBatcher.UpdateCh <- worker.CounterUpdate{UserProvider: "github", UserProviderId: "0", Delta: 1}
+	// Still one distinct user, nothing is written yet
+	assert.Never(t, func() bool { return strokeCount("0") != 0 }, 50*time.Millisecond, 5*time.Millisecond)
+
+	counterBatcher.UpdateCh <- worker.CounterUpdate{UserProvider: "github", UserProviderId: "1", Delta: 1}
+	assert.Eventually(t, func() bool {
+		return strokeCount("0") == 3 && strokeCount("1") == 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 0, strokeCount("2"))
+}
+
+// In-memory CounterLog, like the cache's pending counts hash
+type memCounterLog struct {
+	mu      sync.Mutex
+	pending map[string]int
+}
+
+func newMemCounterLog() *memCounterLog {
+	return &memCounterLog{pending: make(map[string]int)}
+}
+
+func (l *memCounterLog) AddPendingStrokeCount(ctx context.Context, userKey string, delta int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pending[userKey] += delta
+	return nil
+}
+
+func (l *memCounterLog) TakePendingStrokeCount(ctx context.Context, userKey string) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	count := l.pending[userKey]
+	delete(l.pending, userKey)
+	return count, nil
+}
+
+func (l *memCounterLog) GetPendingStrokeCountUsers(ctx context.Context) ([]string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	keys := make([]string, 0, len(l.pending))
+	for key := range l.pending {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (l *memCounterLog) get(userKey string) (int, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	count, ok := l.pending[userKey]
+	return count, ok
+}
+
+func TestCounterBatcher_LogsPendingCountsUntilFlushed(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	ctx := context.Background()
+	_, err := memStore.CreateUser(ctx, models.User{Provider: "github", ProviderId: "1"})
+	assert.NoError(t, err)
+
+	counterLog := newMemCounterLog()
+	counterBatcher := worker.NewCounterBatcher(memStore, 3600000, worker.DefaultCounterFlushUsers)
+	counterBatcher.Log = counterLog
+	runCtx, cancel := context.WithCancel(ctx)
+	go counterBatcher.Run(runCtx)
+
+	counterBatcher.UpdateCh <- worker.CounterUpdate{UserProvider: "github", UserProviderId: "1", Delta: 2}
+	counterBatcher.UpdateCh <- worker.CounterUpdate{UserProvider: "github", UserProviderId: "1", Delta: -1}
+	// A crash now would leave the change in the log
+	assert.Eventually(t, func() bool {
+		count, _ := counterLog.get("github#1")
+		return count == 1
+	}, time.Second, 5*time.Millisecond)
+
+	// Shutting down flushes, which takes the change from the log
+	cancel()
+	assert.Eventually(t, func() bool {
+		user, _ := memStore.GetUser(ctx, "github", "1")
+		return user.StrokeCount == 1
+	}, time.Second, 5*time.Millisecond)
+	_, pending := counterLog.get("github#1")
+	assert.False(t, pending)
+}
+
+// CounterLog whose writes hang until released, like a stalled Redis
+type stalledCounterLog struct {
+	*memCounterLog
+	release chan struct{}
+}
+
+func (l *stalledCounterLog) AddPendingStrokeCount(ctx context.Context, userKey string, delta int) error {
+	<-l.release
+	return l.memCounterLog.AddPendingStrokeCount(ctx, userKey, delta)
+}
+
+func TestCounterBatcher_StalledLogDoesNotBlockUpdates(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	ctx := context.Background()
+	_, err := memStore.CreateUser(ctx, models.User{Provider: "github", ProviderId: "1"})
+	assert.NoError(t, err)
+
+	counterLog := &stalledCounterLog{memCounterLog: newMemCounterLog(), release: make(chan struct{})}
+	counterBatcher := worker.NewCounterBatcher(memStore, 3600000, worker.DefaultCounterFlushUsers)
+	counterBatcher.Log = counterLog
+	counterBatcher.LogInterval = time.Millisecond
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		counterBatcher.Run(runCtx)
+		close(done)
+	}()
+
+	// More updates than UpdateCh holds, Run keeps taking them while the log write hangs
+	sent := make(chan struct{})
+	go func() {
+		for range 3000 {
+			counterBatcher.UpdateCh <- worker.CounterUpdate{UserProvider: "github", UserProviderId: "1", Delta: 1}
+		}
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(1 * time.Second):
+		t.Fatal("updates blocked on the stalled log")
+	}
+
+	// Nothing is lost once the log recovers
+	close(counterLog.release)
+	cancel()
+	<-done
+	user, _ := memStore.GetUser(ctx, "github", "1")
+	assert.Equal(t, 3000, user.StrokeCount)
+	_, pending := counterLog.get("github#1")
+	assert.False(t, pending)
+}
+
+func TestCounterBatcher_RecoversLoggedCountsOnStart(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	ctx := context.Background()
+	_, err := memStore.CreateUser(ctx, models.User{Provider: "github", ProviderId: "1"})
+	assert.NoError(t, err)
+
+	// Left behind by a server that crashed before flushing, including a user deleted since
+	counterLog := newMemCounterLog()
+	counterLog.pending["github#1"] = 5
+	counterLog.pending["github#deleted"] = 3
+
+	counterBatcher := worker.NewCounterBatcher(memStore, 3600000, worker.DefaultCounterFlushUsers)
+	counterBatcher.Log = counterLog
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go counterBatcher.Run(runCtx)
+
+	assert.Eventually(t, func() bool {
+		user, _ := memStore.GetUser(ctx, "github", "1")
+		return user.StrokeCount == 5
+	}, time.Second, 5*time.Millisecond)
+	_, pending := counterLog.get("github#1")
+	assert.False(t, pending)
+	// The deleted user's change is dropped instead of being logged again
+	_, pending = counterLog.get("github#deleted")
+	assert.False(t, pending)
+}
+
+// Store whose stroke count writes always fail
+type failingCountStore struct {
+	*memstore.MemWebverseStore
+}
+
+func (s failingCountStore) IncrementUserStrokeCount(ctx context.Context, provider string, providerId string, count int) error {
+	return errors.New("dynamodb unavailable")
+}
+
+func TestCounterBatcher_FailedWriteStaysLogged(t *testing.T) {
+	counterLog := newMemCounterLog()
+	counterBatcher := worker.NewCounterBatcher(failingCountStore{memstore.NewMemWebverseStore()}, 10, worker.DefaultCounterFlushUsers)
+	counterBatcher.Log = counterLog
+	runCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go counterBatcher.Run(runCtx)
+
+	counterBatcher.UpdateCh <- worker.CounterUpdate{UserProvider: "github", UserProviderId: "1", Delta: 4}
+
+	// Taken by a flush, then put back when the store write fails
+	assert.Never(t, func() bool {
+		count, pending := counterLog.get("github#1")
+		return pending && count != 4
+	}, 100*time.Millisecond, time.Millisecond)
+	assert.Eventually(t, func() bool {
+		count, _ := counterLog.get("github#1")
+		return count == 4
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestCounterBatcher_WritesBufferedCountsBeforeReturning(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	ctx := context.Background()
+	_, err := memStore.CreateUser(ctx, models.User{Provider: "github", ProviderId: "0"})
+	assert.NoError(t, err)
+
+	counterBatcher := worker.NewCounterBatcher(memStore, 3600000, worker.DefaultCounterFlushUsers)
+	// Queued before Run starts, so they are still in the channel when it sees the cancelled context
+	counterBatcher.UpdateCh <- worker.CounterUpdate{UserProvider: "github", UserProviderId: "0", Delta: 2}
+	counterBatcher.UpdateCh <- worker.CounterUpdate{UserProvider: "github", UserProviderId: "0", Delta: 3}
+	runCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	counterBatcher.Run(runCtx)
+
+	user, err := memStore.GetUser(ctx, "github", "0")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, user.StrokeCount)
+}
@@ -0,0 +1,307 @@
+package worker_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	cachemocks "github.com/zlnvch/webverse/cache/mocks"
+	"github.com/zlnvch/webverse/models"
+	"github.com/zlnvch/webverse/mq"
+	mqmocks "github.com/zlnvch/webverse/mq/mocks"
+	"github.com/zlnvch/webverse/store/memstore"
+	"github.com/zlnvch/webverse/worker"
+)
+
+// Store whose first DeleteUserStrokes only deletes the strokes on one page and then
+// fails, like a consumer crashing mid-way through the throttled batch delete
+type interruptingStore struct {
+	*memstore.MemWebverseStore
+	interruptAfterPage string
+}
+
+func (s *interruptingStore) DeleteUserStrokes(ctx context.Context, userId string, layer string) error {
+	if s.interruptAfterPage == "" {
+		return s.MemWebverseStore.DeleteUserStrokes(ctx, userId, layer)
+	}
+
+	strokes, _ := s.GetStrokeRecords(ctx, s.interruptAfterPage, 1100)
+	for _, stroke := range strokes {
+		s.DeleteStroke(ctx, s.interruptAfterPage, stroke.Id, userId)
+	}
+	s.interruptAfterPage = ""
+	return errors.New("interrupted")
+}
+
+func TestMQConsumer_DeleteAll_RedeliveryAfterPartialDelete(t *testing.T) {
+	ctx := context.Background()
+	memStore := memstore.NewMemWebverseStore()
+	// The user profile is already deleted, only their strokes remain
+	memStore.WriteStrokeBatch(ctx, []models.StrokeRecord{
+		strokeRecord("a.com", "00000000-0000-7000-8000-000000000001", "user1"),
+		strokeRecord("b.com", "00000000-0000-7000-8000-000000000002", "user1"),
+		strokeRecord("b.com", "00000000-0000-7000-8000-000000000003", "user2"),
+	})
+	webverseStore := &interruptingStore{MemWebverseStore: memStore, interruptAfterPage: "a.com"}
+
+	msg := &mq.Message{Id: "receipt-1", MessageId: "1", Body: `{"userId":"user1","userProvider":"github","userProviderId":"1","deleteAll":true}`}
+	mockMQ := new(mqmocks.MockMQ)
+	// Delivered twice (the first attempt fails), then the consumer shuts down
+	mockMQ.On("Receive", mock.Anything, mock.Anything).Return(msg, nil).Twice()
+	mockMQ.On("Receive", mock.Anything, mock.Anything).Return(nil, context.Canceled)
+	mockMQ.On("Delete", mock.Anything, msg).Return(nil).Once()
+
+	var checkpoints [][]string
+	mockCache := new(cachemocks.MockCache)
+	mockCache.On("AddUserDeletionPages", mock.Anything, "user1", mock.Anything).Run(func(args mock.Arguments) {
+		checkpoints = append(checkpoints, args.Get(2).([]string))
+	}).Return(nil)
+	// Redis returns the union of everything checkpointed by both attempts
+	mockCache.On("GetUserDeletionPages", mock.Anything, "user1").Return([]string{"a.com", "b.com"}, nil)
+	mockCache.On("InvalidatePages", mock.Anything, mock.Anything).Return(nil)
+	mockCache.On("ClearUserDeletionPages", mock.Anything, "user1").Return(nil)
+	// Only marked processed once an attempt succeeded
+	mockCache.On("IsMessageProcessed", mock.Anything, "1").Return(false, nil).Twice()
+	mockCache.On("MarkMessageProcessed", mock.Anything, "1", mock.Anything).Return(nil).Once()
+
+	counterBatcher := worker.NewCounterBatcher(webverseStore, 60000, worker.DefaultCounterFlushUsers)
+	mqConsumer := worker.NewMQConsumer(mockMQ, webverseStore, mockCache, counterBatcher)
+	mqConsumer.Run(ctx)
+
+	// First attempt saw both pages, the redelivery only the page that still had strokes
+	if assert.Len(t, checkpoints, 2) {
+		assert.ElementsMatch(t, []string{"a.com", "b.com"}, checkpoints[0])
+		assert.ElementsMatch(t, []string{"b.com"}, checkpoints[1])
+	}
+
+	// The page emptied by the interrupted attempt is still invalidated
+	mockCache.AssertCalled(t, "InvalidatePages", mock.Anything, []string{"a.com", "b.com"})
+	mockCache.AssertNumberOfCalls(t, "InvalidatePages", 1)
+	mockCache.AssertNumberOfCalls(t, "ClearUserDeletionPages", 1)
+	mockMQ.AssertExpectations(t)
+
+	count, _ := memStore.GetUserStrokeCount(ctx, "user1", "")
+	assert.Equal(t, 0, count)
+	strokes, _ := memStore.GetStrokeRecords(ctx, "b.com", 1100)
+	assert.Len(t, strokes, 1)
+}
+
+func TestMQConsumer_DeleteLayer_RedeliveryAfterPartialDelete(t *testing.T) {
+	ctx := context.Background()
+	memStore := memstore.NewMemWebverseStore()
+	memStore.WriteStrokeBatch(ctx, []models.StrokeRecord{
+		privateStrokeRecord("a.com", "00000000-0000-7000-8000-000000000001", "user1"),
+		privateStrokeRecord("b.com", "00000000-0000-7000-8000-000000000002", "user1"),
+		privateStrokeRecord("b.com", "00000000-0000-7000-8000-000000000003", "user1"),
+	})
+	webverseStore := &interruptingStore{MemWebverseStore: memStore, interruptAfterPage: "a.com"}
+
+	msg := &mq.Message{Id: "receipt-1", MessageId: "1", Body: `{"userId":"user1","userProvider":"github","userProviderId":"1","layer":"Private#1"}`}
+	mockMQ := new(mqmocks.MockMQ)
+	// Delivered twice (the first attempt fails), then the consumer shuts down
+	mockMQ.On("Receive", mock.Anything, mock.Anything).Return(msg, nil).Twice()
+	mockMQ.On("Receive", mock.Anything, mock.Anything).Return(nil, context.Canceled)
+	mockMQ.On("Delete", mock.Anything, msg).Return(nil).Once()
+
+	var counts []int
+	mockCache := new(cachemocks.MockCache)
+	// Redis keeps the count checkpointed by the first attempt
+	mockCache.On("SetUserDeletionCount", mock.Anything, "user1", "Private#1", mock.Anything).Run(func(args mock.Arguments) {
+		counts = append(counts, args.Int(3))
+	}).Return(3, nil)
+	mockCache.On("ClearUserDeletionCount", mock.Anything, "user1", "Private#1").Return(nil).Once()
+	mockCache.On("IsMessageProcessed", mock.Anything, "1").Return(false, nil).Twice()
+	mockCache.On("MarkMessageProcessed", mock.Anything, "1", mock.Anything).Return(nil).Once()
+
+	counterBatcher := worker.NewCounterBatcher(webverseStore, 60000, worker.DefaultCounterFlushUsers)
+	worker.NewMQConsumer(mockMQ, webverseStore, mockCache, counterBatcher).Run(ctx)
+
+	// The redelivery only counted the strokes that were left
+	assert.Equal(t, []int{3, 2}, counts)
+	mockMQ.AssertExpectations(t)
+	mockCache.AssertExpectations(t)
+
+	// A single decrement covering the strokes deleted by both attempts
+	if assert.Len(t, counterBatcher.UpdateCh, 1) {
+		update := <-counterBatcher.UpdateCh
+		assert.Equal(t, worker.CounterUpdate{UserProvider: "github", UserProviderId: "1", Delta: -3}, update)
+	}
+	count, _ := memStore.GetUserStrokeCount(ctx, "user1", "")
+	assert.Equal(t, 0, count)
+}
+
+func TestMQConsumer_SkipsAlreadyProcessedMessage(t *testing.T) {
+	ctx := context.Background()
+	memStore := memstore.NewMemWebverseStore()
+	// Left alone, the skipped message is not processed again
+	memStore.WriteStrokeBatch(ctx, []models.StrokeRecord{
+		strokeRecord("a.com", "00000000-0000-7000-8000-000000000001", "user1"),
+	})
+
+	msg := &mq.Message{Id: "receipt-1", MessageId: "1", Body: `{"userId":"user1","userProvider":"github","userProviderId":"1","deleteAll":true}`}
+	mockMQ := new(mqmocks.MockMQ)
+	mockMQ.On("Receive", mock.Anything, mock.Anything).Return(msg, nil).Once()
+	mockMQ.On("Receive", mock.Anything, mock.Anything).Return(nil, context.Canceled)
+	mockMQ.On("Delete", mock.Anything, msg).Return(nil).Once()
+
+	mockCache := new(cachemocks.MockCache)
+	mockCache.On("IsMessageProcessed", mock.Anything, "1").Return(true, nil)
+
+	counterBatcher := worker.NewCounterBatcher(memStore, 60000, worker.DefaultCounterFlushUsers)
+	worker.NewMQConsumer(mockMQ, memStore, mockCache, counterBatcher).Run(ctx)
+
+	// Removed from the queue without touching the strokes or the cache
+	mockMQ.AssertExpectations(t)
+	mockCache.AssertNotCalled(t, "AddUserDeletionPages", mock.Anything, mock.Anything, mock.Anything)
+	mockCache.AssertNotCalled(t, "InvalidatePages", mock.Anything, mock.Anything)
+	strokes, _ := memStore.GetStrokeRecords(ctx, "a.com", 1100)
+	assert.Len(t, strokes, 1)
+}
+
+// Store that counts the layer deletes it ran
+type countingStore struct {
+	*memstore.MemWebverseStore
+	deletes int
+}
+
+func (s *countingStore) DeleteUserStrokes(ctx context.Context, userId string, layer string) error {
+	s.deletes++
+	return s.MemWebverseStore.DeleteUserStrokes(ctx, userId, layer)
+}
+
+func TestMQConsumer_SkipsRedeliveryWithNewReceiptHandle(t *testing.T) {
+	webverseStore := &countingStore{MemWebverseStore: memstore.NewMemWebverseStore()}
+
+	// SQS issues a new receipt handle for every delivery of the same message
+	body := `{"userId":"user1","userProvider":"github","userProviderId":"1","layer":"Private#1"}`
+	first := &mq.Message{Id: "receipt-1", MessageId: "msg-1", Body: body}
+	redelivery := &mq.Message{Id: "receipt-2", MessageId: "msg-1", Body: body}
+	mockMQ := new(mqmocks.MockMQ)
+	mockMQ.On("Receive", mock.Anything, mock.Anything).Return(first, nil).Once()
+	mockMQ.On("Receive", mock.Anything, mock.Anything).Return(redelivery, nil).Once()
+	mockMQ.On("Receive", mock.Anything, mock.Anything).Return(nil, context.Canceled)
+	// The first delete fails, e.g. the consumer crashed after processing, so the message is redelivered
+	mockMQ.On("Delete", mock.Anything, first).Return(errors.New("connection reset")).Once()
+	mockMQ.On("Delete", mock.Anything, redelivery).Return(nil).Once()
+
+	mockCache := new(cachemocks.MockCache)
+	mockCache.On("IsMessageProcessed", mock.Anything, "msg-1").Return(false, nil).Once()
+	mockCache.On("SetUserDeletionCount", mock.Anything, "user1", "Private#1", 0).Return(0, nil).Once()
+	mockCache.On("ClearUserDeletionCount", mock.Anything, "user1", "Private#1").Return(nil).Once()
+	mockCache.On("MarkMessageProcessed", mock.Anything, "msg-1", mock.Anything).Return(nil).Once()
+	mockCache.On("IsMessageProcessed", mock.Anything, "msg-1").Return(true, nil).Once()
+
+	counterBatcher := worker.NewCounterBatcher(webverseStore, 60000, worker.DefaultCounterFlushUsers)
+	worker.NewMQConsumer(mockMQ, webverseStore, mockCache, counterBatcher).Run(context.Background())
+
+	mockMQ.AssertExpectations(t)
+	mockCache.AssertExpectations(t)
+	assert.Equal(t, 1, webverseStore.deletes)
+}
+
+// Store whose layer deletes wait until a second delete is running, so they only finish if
+// two messages are processed at the same time
+type rendezvousStore struct {
+	*memstore.MemWebverseStore
+	arrived sync.WaitGroup
+}
+
+func (s *rendezvousStore) DeleteUserStrokes(ctx context.Context, userId string, layer string) error {
+	s.arrived.Done()
+	done := make(chan struct{})
+	go func() {
+		s.arrived.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return s.MemWebverseStore.DeleteUserStrokes(ctx, userId, layer)
+	case <-time.After(time.Second):
+		return errors.New("processed alone")
+	}
+}
+
+func TestMQConsumer_RunConcurrently(t *testing.T) {
+	webverseStore := &rendezvousStore{MemWebverseStore: memstore.NewMemWebverseStore()}
+	webverseStore.arrived.Add(2)
+
+	msg1 := &mq.Message{Id: "receipt-1", MessageId: "1", Body: `{"userId":"user1","userProvider":"github","userProviderId":"1","layer":"Private#1"}`}
+	msg2 := &mq.Message{Id: "receipt-2", MessageId: "2", Body: `{"userId":"user2","userProvider":"github","userProviderId":"2","layer":"Private#1"}`}
+	mockMQ := new(mqmocks.MockMQ)
+	mockMQ.On("Receive", mock.Anything, mock.Anything).Return(msg1, nil).Once()
+	mockMQ.On("Receive", mock.Anything, mock.Anything).Return(msg2, nil).Once()
+	mockMQ.On("Receive", mock.Anything, mock.Anything).Return(nil, context.Canceled)
+	mockMQ.On("Delete", mock.Anything, msg1).Return(nil).Once()
+	mockMQ.On("Delete", mock.Anything, msg2).Return(nil).Once()
+
+	counterBatcher := worker.NewCounterBatcher(webverseStore, 60000, worker.DefaultCounterFlushUsers)
+	mockCache := new(cachemocks.MockCache)
+	mockCache.On("IsMessageProcessed", mock.Anything, mock.Anything).Return(false, nil)
+	mockCache.On("MarkMessageProcessed", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockCache.On("SetUserDeletionCount", mock.Anything, mock.Anything, "Private#1", 0).Return(0, nil)
+	mockCache.On("ClearUserDeletionCount", mock.Anything, mock.Anything, "Private#1").Return(nil)
+	mqConsumer := worker.NewMQConsumer(mockMQ, webverseStore, mockCache, counterBatcher)
+	mqConsumer.RunConcurrently(context.Background(), 2)
+
+	// Both messages were deleted from the queue, so both deletes met while running
+	mockMQ.AssertExpectations(t)
+}
+
+func strokeRecord(pageKey string, id string, userId string) models.StrokeRecord {
+	return models.StrokeRecord{
+		PageKey: pageKey,
+		Layer:   models.LayerPublic,
+		Stroke:  models.Stroke{Id: id, UserId: userId, Content: []byte("data")},
+	}
+}
+
+func privateStrokeRecord(pageKey string, id string, userId string) models.StrokeRecord {
+	record := strokeRecord(pageKey, id, userId)
+	record.Layer = models.LayerPrivate
+	record.LayerId = "1"
+	return record
+}
+
+// Store that records the deadline of the context strokes are deleted with
+type deadlineStore struct {
+	*memstore.MemWebverseStore
+	deadline time.Time
+}
+
+func (s *deadlineStore) DeleteUserStrokes(ctx context.Context, userId string, layer string) error {
+	s.deadline, _ = ctx.Deadline()
+	return s.MemWebverseStore.DeleteUserStrokes(ctx, userId, layer)
+}
+
+func TestMQConsumer_ProcessingDeadlineFollowsVisibilityTimeout(t *testing.T) {
+	webverseStore := &deadlineStore{MemWebverseStore: memstore.NewMemWebverseStore()}
+
+	msg := &mq.Message{Id: "receipt-1", MessageId: "1", Body: `{"userId":"user1","userProvider":"github","userProviderId":"1","layer":"Private#1"}`}
+	mockMQ := new(mqmocks.MockMQ)
+	mockMQ.On("Receive", mock.Anything, int32(45)).Return(msg, nil).Once()
+	mockMQ.On("Receive", mock.Anything, int32(45)).Return(nil, context.Canceled)
+	mockMQ.On("Delete", mock.Anything, msg).Return(nil).Once()
+
+	mockCache := new(cachemocks.MockCache)
+	mockCache.On("IsMessageProcessed", mock.Anything, "1").Return(false, nil)
+	mockCache.On("MarkMessageProcessed", mock.Anything, "1", mock.Anything).Return(nil)
+	mockCache.On("SetUserDeletionCount", mock.Anything, "user1", "Private#1", 0).Return(0, nil)
+	mockCache.On("ClearUserDeletionCount", mock.Anything, "user1", "Private#1").Return(nil)
+
+	counterBatcher := worker.NewCounterBatcher(webverseStore, 60000, worker.DefaultCounterFlushUsers)
+	mqConsumer := worker.NewMQConsumer(mockMQ, webverseStore, mockCache, counterBatcher)
+	assert.Equal(t, worker.DefaultVisibilityTimeout, mqConsumer.VisibilityTimeout)
+	mqConsumer.VisibilityTimeout = 45 * time.Second
+	assert.Equal(t, 44*time.Second, mqConsumer.ProcessingTimeout())
+
+	start := time.Now()
+	mqConsumer.Run(context.Background())
+
+	mockMQ.AssertExpectations(t)
+	// Processing gives up a second before the message becomes visible again
+	assert.WithinDuration(t, start.Add(44*time.Second), webverseStore.deadline, time.Second)
+}
@@ -0,0 +1,531 @@
+package worker_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zlnvch/webverse/metrics"
+	"github.com/zlnvch/webverse/models"
+	"github.com/zlnvch/webverse/store/memstore"
+	"github.com/zlnvch/webverse/worker"
+)
+
+func batchedStroke(i int) worker.BatchedStroke {
+	return worker.BatchedStroke{
+		Record: models.StrokeRecord{
+			PageKey: "example.com",
+			Layer:   models.LayerPublic,
+			Stroke:  models.Stroke{Id: fmt.Sprintf("00000000-0000-7000-8000-%012d", i), UserId: "user1"},
+		},
+		UserProvider:   "github",
+		UserProviderId: "1",
+	}
+}
+
+func TestStrokeBatcher_Metrics_SizeTriggeredFlush(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	registry := metrics.NewRegistry()
+	counterBatcher := worker.NewCounterBatcher(memStore, 60000, worker.DefaultCounterFlushUsers)
+	// Ticker never fires during the test, so only the size trigger can flush
+	strokeBatcher := worker.NewStrokeBatcher(memStore, 3600000, worker.DefaultStrokeBufferSize, counterBatcher, registry)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go strokeBatcher.Run(ctx)
+
+	for i := range 25 {
+		strokeBatcher.WriteCh <- batchedStroke(i)
+	}
+
+	assert.Eventually(t, func() bool {
+		return registry.Counter("stroke_batcher.flushes") == 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, int64(25), registry.Counter("stroke_batcher.strokes_flushed"))
+	assert.Equal(t, int64(1), registry.Counter("stroke_batcher.flushes.size"))
+	assert.Equal(t, int64(0), registry.Counter("stroke_batcher.flushes.ticker"))
+
+	strokes, _ := memStore.GetStrokeRecords(context.Background(), "example.com", 1100)
+	assert.Len(t, strokes, 25)
+}
+
+func TestStrokeBatcher_Metrics_TickerTriggeredFlush(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	registry := metrics.NewRegistry()
+	counterBatcher := worker.NewCounterBatcher(memStore, 60000, worker.DefaultCounterFlushUsers)
+	strokeBatcher := worker.NewStrokeBatcher(memStore, 10, worker.DefaultStrokeBufferSize, counterBatcher, registry)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go strokeBatcher.Run(ctx)
+
+	for i := range 3 {
+		strokeBatcher.WriteCh <- batchedStroke(i)
+	}
+
+	assert.Eventually(t, func() bool {
+		return registry.Counter("stroke_batcher.strokes_flushed") == 3
+	}, time.Second, 5*time.Millisecond)
+	assert.GreaterOrEqual(t, registry.Counter("stroke_batcher.flushes.ticker"), int64(1))
+	assert.Equal(t, int64(0), registry.Counter("stroke_batcher.flushes.size"))
+	// Empty ticks are not counted as flushes
+	assert.Equal(t, registry.Counter("stroke_batcher.flushes.ticker"), registry.Counter("stroke_batcher.flushes"))
+}
+
+// Store whose stroke writes fail until failures runs out
+type failingStore struct {
+	*memstore.MemWebverseStore
+	failures atomic.Int32
+}
+
+func (s *failingStore) WriteStrokeBatch(ctx context.Context, strokes []models.StrokeRecord) ([]models.StrokeRecord, error) {
+	if s.failures.Add(-1) >= 0 {
+		return nil, errors.New("dynamodb unavailable")
+	}
+	return s.MemWebverseStore.WriteStrokeBatch(ctx, strokes)
+}
+
+func TestStrokeBatcher_RetriesFailedWrites(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	failing := &failingStore{MemWebverseStore: memStore}
+	failing.failures.Store(2)
+	registry := metrics.NewRegistry()
+	counterBatcher := worker.NewCounterBatcher(memStore, 60000, worker.DefaultCounterFlushUsers)
+	strokeBatcher := worker.NewStrokeBatcher(failing, 10, worker.DefaultStrokeBufferSize, counterBatcher, registry)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go strokeBatcher.Run(ctx)
+
+	for i := range 3 {
+		strokeBatcher.WriteCh <- batchedStroke(i)
+	}
+
+	assert.Eventually(t, func() bool {
+		strokes, _ := memStore.GetStrokeRecords(context.Background(), "example.com", 1100)
+		return len(strokes) == 3
+	}, 2*time.Second, 5*time.Millisecond)
+	assert.Equal(t, int64(2), registry.Counter("stroke_batcher.write_failures"))
+	assert.Equal(t, int64(6), registry.Counter("stroke_batcher.strokes_retried"))
+	assert.Equal(t, int64(0), registry.Counter("stroke_batcher.strokes_dropped"))
+
+	// Users are only credited once their strokes are persisted
+	assert.Eventually(t, func() bool { return len(counterBatcher.UpdateCh) == 3 }, time.Second, 5*time.Millisecond)
+}
+
+func TestStrokeBatcher_DropsAfterMaxAttempts(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	failing := &failingStore{MemWebverseStore: memStore}
+	failing.failures.Store(1000)
+	registry := metrics.NewRegistry()
+	counterBatcher := worker.NewCounterBatcher(memStore, 60000, worker.DefaultCounterFlushUsers)
+	strokeBatcher := worker.NewStrokeBatcher(failing, 1, worker.DefaultStrokeBufferSize, counterBatcher, registry)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go strokeBatcher.Run(ctx)
+
+	strokeBatcher.WriteCh <- batchedStroke(1)
+
+	assert.Eventually(t, func() bool {
+		return registry.Counter("stroke_batcher.strokes_dropped") == 1
+	}, 2*time.Second, 5*time.Millisecond)
+	// The first write and 4 retries
+	assert.Equal(t, int64(5), registry.Counter("stroke_batcher.write_failures"))
+	assert.Len(t, counterBatcher.UpdateCh, 0)
+}
+
+func TestStrokeBatcher_UndoCancelsRetry(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	failing := &failingStore{MemWebverseStore: memStore}
+	failing.failures.Store(1)
+	registry := metrics.NewRegistry()
+	counterBatcher := worker.NewCounterBatcher(memStore, 60000, worker.DefaultCounterFlushUsers)
+	// Ticker never fires during the test, the first write is triggered by size
+	strokeBatcher := worker.NewStrokeBatcher(failing, 3600000, worker.DefaultStrokeBufferSize, counterBatcher, registry)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go strokeBatcher.Run(ctx)
+
+	for i := range 25 {
+		strokeBatcher.WriteCh <- batchedStroke(i)
+	}
+	assert.Eventually(t, func() bool {
+		return registry.Counter("stroke_batcher.write_failures") == 1
+	}, time.Second, 5*time.Millisecond)
+
+	undone := batchedStroke(3)
+	strokeBatcher.DeleteCh <- worker.DeleteStrokeRequest{StrokeId: undone.Record.Stroke.Id, UserId: "user1"}
+	assert.Eventually(t, func() bool { return len(strokeBatcher.DeleteCh) == 0 }, time.Second, time.Millisecond)
+
+	// Shutting down retries the remaining strokes one last time
+	cancel()
+	assert.Eventually(t, func() bool {
+		strokes, _ := memStore.GetStrokeRecords(context.Background(), "example.com", 1100)
+		return len(strokes) == 24
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, int64(24), registry.Counter("stroke_batcher.strokes_retried"))
+	_, err := memStore.GetStroke(context.Background(), "example.com", undone.Record.Stroke.Id)
+	assert.Error(t, err)
+}
+
+// memDropLog stands in for the cache, which outlives the batchers using it
+type memDropLog struct {
+	total atomic.Int64
+}
+
+func (l *memDropLog) AddDroppedStrokes(ctx context.Context, count int) (int64, error) {
+	return l.total.Add(int64(count)), nil
+}
+
+func TestStrokeBatcher_DropsAddUpAcrossRestarts(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	failing := &failingStore{MemWebverseStore: memStore}
+	failing.failures.Store(1000)
+	dropLog := &memDropLog{}
+
+	for restart := range 2 {
+		registry := metrics.NewRegistry()
+		counterBatcher := worker.NewCounterBatcher(memStore, 60000, worker.DefaultCounterFlushUsers)
+		strokeBatcher := worker.NewStrokeBatcher(failing, 1, worker.DefaultStrokeBufferSize, counterBatcher, registry)
+		strokeBatcher.DropLog = dropLog
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			strokeBatcher.Run(ctx)
+			close(done)
+		}()
+
+		strokeBatcher.WriteCh <- batchedStroke(restart)
+		assert.Eventually(t, func() bool {
+			return registry.Counter("stroke_batcher.strokes_dropped") == 1
+		}, 2*time.Second, 5*time.Millisecond)
+		cancel()
+		<-done
+	}
+
+	assert.Equal(t, int64(2), dropLog.total.Load())
+}
+
+type recordingReporter struct {
+	notOwnerDeletes chan string
+}
+
+func (r *recordingReporter) ReportFutureUUID(userId string, strokeId string) {}
+
+func (r *recordingReporter) ReportNotOwnerDelete(userId string, strokeId string) {
+	r.notOwnerDeletes <- userId + ":" + strokeId
+}
+
+func TestStrokeBatcher_NotOwnerDeleteReported(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	counterBatcher := worker.NewCounterBatcher(memStore, 60000, worker.DefaultCounterFlushUsers)
+	strokeBatcher := worker.NewStrokeBatcher(memStore, 3600000, worker.DefaultStrokeBufferSize, counterBatcher, nil)
+	reporter := &recordingReporter{notOwnerDeletes: make(chan string, 1)}
+	strokeBatcher.AbuseReporter = reporter
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go strokeBatcher.Run(ctx)
+
+	pending := batchedStroke(1)
+	strokeBatcher.WriteCh <- pending
+	// Run must take the write before the delete, or there is no pending stroke to check ownership against
+	assert.Eventually(t, func() bool { return len(strokeBatcher.WriteCh) == 0 }, time.Second, time.Millisecond)
+	strokeBatcher.DeleteCh <- worker.DeleteStrokeRequest{StrokeId: pending.Record.Stroke.Id, UserId: "user2"}
+
+	select {
+	case report := <-reporter.notOwnerDeletes:
+		assert.Equal(t, "user2:"+pending.Record.Stroke.Id, report)
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "timed out waiting for abuse report")
+	}
+}
+
+func TestStrokeBatcher_DeleteReportsWhetherCancelled(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	counterBatcher := worker.NewCounterBatcher(memStore, 60000, worker.DefaultCounterFlushUsers)
+	strokeBatcher := worker.NewStrokeBatcher(memStore, 3600000, worker.DefaultStrokeBufferSize, counterBatcher, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go strokeBatcher.Run(ctx)
+
+	pending := batchedStroke(1)
+	strokeBatcher.WriteCh <- pending
+	assert.Eventually(t, func() bool { return len(strokeBatcher.WriteCh) == 0 }, time.Second, time.Millisecond)
+
+	for _, tc := range []struct {
+		name, strokeId, userId string
+		want                   bool
+	}{
+		{"other user's stroke", pending.Record.Stroke.Id, "user2", false},
+		{"pending stroke", pending.Record.Stroke.Id, "user1", true},
+		{"already cancelled", pending.Record.Stroke.Id, "user1", false},
+		{"unknown stroke", batchedStroke(2).Record.Stroke.Id, "user1", false},
+	} {
+		cancelled := make(chan bool, 1)
+		strokeBatcher.DeleteCh <- worker.DeleteStrokeRequest{StrokeId: tc.strokeId, UserId: tc.userId, Cancelled: cancelled}
+		select {
+		case got := <-cancelled:
+			assert.Equal(t, tc.want, got, tc.name)
+		case <-time.After(1 * time.Second):
+			t.Fatalf("%s: timed out waiting for the answer", tc.name)
+		}
+	}
+}
+
+func TestStrokeBatcher_Enqueue_ShedsWhenFull(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	registry := metrics.NewRegistry()
+	counterBatcher := worker.NewCounterBatcher(memStore, 60000, worker.DefaultCounterFlushUsers)
+	// Not running, so nothing drains the buffer
+	strokeBatcher := worker.NewStrokeBatcher(memStore, 3600000, 2, counterBatcher, registry)
+	strokeBatcher.ShedWhenFull = true
+
+	assert.True(t, strokeBatcher.Enqueue(batchedStroke(1)))
+	assert.True(t, strokeBatcher.Enqueue(batchedStroke(2)))
+	assert.False(t, strokeBatcher.Enqueue(batchedStroke(3)))
+	assert.Len(t, strokeBatcher.WriteCh, 2)
+	assert.Equal(t, int64(1), registry.Counter("stroke_batcher.strokes_shed"))
+}
+
+func TestStrokeBatcher_Enqueue_WaitsForRoomByDefault(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	counterBatcher := worker.NewCounterBatcher(memStore, 60000, worker.DefaultCounterFlushUsers)
+	strokeBatcher := worker.NewStrokeBatcher(memStore, 3600000, 1, counterBatcher, nil)
+
+	assert.True(t, strokeBatcher.Enqueue(batchedStroke(1)))
+	enqueued := make(chan bool)
+	go func() { enqueued <- strokeBatcher.Enqueue(batchedStroke(2)) }()
+
+	select {
+	case <-enqueued:
+		assert.Fail(t, "enqueue should wait for room in the buffer")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-strokeBatcher.WriteCh
+	select {
+	case ok := <-enqueued:
+		assert.True(t, ok)
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "timed out waiting for the enqueue")
+	}
+}
+
+func TestStrokeBatcher_SmallFlushesWriteCounterInTransaction(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	registry := metrics.NewRegistry()
+	ctx := context.Background()
+	_, err := memStore.CreateUser(ctx, models.User{Provider: "github", ProviderId: "1", Username: "alice"})
+	assert.NoError(t, err)
+
+	// Not running: transactional writes count the strokes themselves, nothing goes through the counter batcher
+	counterBatcher := worker.NewCounterBatcher(memStore, 60000, worker.DefaultCounterFlushUsers)
+	strokeBatcher := worker.NewStrokeBatcher(memStore, 10, worker.DefaultStrokeBufferSize, counterBatcher, registry)
+	strokeBatcher.TransactionalFlushSize = 5
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go strokeBatcher.Run(runCtx)
+
+	strokeBatcher.WriteCh <- batchedStroke(1)
+	strokeBatcher.WriteCh <- batchedStroke(2)
+
+	assert.Eventually(t, func() bool {
+		return registry.Counter("stroke_batcher.strokes_transactional") == 2
+	}, time.Second, 5*time.Millisecond)
+	user, _ := memStore.GetUser(ctx, "github", "1")
+	assert.Equal(t, 2, user.StrokeCount)
+	strokes, _ := memStore.GetStrokeRecords(ctx, "example.com", 1100)
+	assert.Len(t, strokes, 2)
+	assert.Empty(t, counterBatcher.UpdateCh)
+}
+
+// flakyTransactionStore fails the first transactional writes, and counts the writes of each kind
+type flakyTransactionStore struct {
+	*memstore.MemWebverseStore
+	failures           atomic.Int32
+	transactionalCalls atomic.Int32
+	batchCalls         atomic.Int32
+}
+
+func (s *flakyTransactionStore) WriteStrokeWithCounter(ctx context.Context, record models.StrokeRecord, provider string, providerId string) error {
+	s.transactionalCalls.Add(1)
+	if s.failures.Add(-1) >= 0 {
+		return errors.New("transaction outcome unknown")
+	}
+	return s.MemWebverseStore.WriteStrokeWithCounter(ctx, record, provider, providerId)
+}
+
+func (s *flakyTransactionStore) WriteStrokeBatch(ctx context.Context, strokes []models.StrokeRecord) ([]models.StrokeRecord, error) {
+	s.batchCalls.Add(1)
+	return s.MemWebverseStore.WriteStrokeBatch(ctx, strokes)
+}
+
+func TestStrokeBatcher_FailedTransactionalWritesRetryInTransaction(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	ctx := context.Background()
+	_, err := memStore.CreateUser(ctx, models.User{Provider: "github", ProviderId: "1", Username: "alice"})
+	assert.NoError(t, err)
+	flaky := &flakyTransactionStore{MemWebverseStore: memStore}
+	flaky.failures.Store(1)
+
+	counterBatcher := worker.NewCounterBatcher(memStore, 60000, worker.DefaultCounterFlushUsers)
+	strokeBatcher := worker.NewStrokeBatcher(flaky, 10, worker.DefaultStrokeBufferSize, counterBatcher, nil)
+	strokeBatcher.TransactionalFlushSize = 5
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go strokeBatcher.Run(runCtx)
+
+	strokeBatcher.WriteCh <- batchedStroke(1)
+
+	// A batched put would count the stroke again if the failed transaction had committed after all
+	assert.Eventually(t, func() bool { return flaky.transactionalCalls.Load() == 2 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, int32(0), flaky.batchCalls.Load())
+	assert.Empty(t, counterBatcher.UpdateCh)
+	user, _ := memStore.GetUser(ctx, "github", "1")
+	assert.Equal(t, 1, user.StrokeCount)
+}
+
+func TestStrokeBatcher_TransactionalWriteDropsStrokesOfDeletedUsers(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	registry := metrics.NewRegistry()
+	counterBatcher := worker.NewCounterBatcher(memStore, 60000, worker.DefaultCounterFlushUsers)
+	strokeBatcher := worker.NewStrokeBatcher(memStore, 10, worker.DefaultStrokeBufferSize, counterBatcher, registry)
+	strokeBatcher.TransactionalFlushSize = 5
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go strokeBatcher.Run(ctx)
+
+	// No such user in the store
+	strokeBatcher.WriteCh <- batchedStroke(1)
+
+	assert.Eventually(t, func() bool {
+		return registry.Counter("stroke_batcher.strokes_dropped") == 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, int64(0), registry.Counter("stroke_batcher.write_failures"))
+	strokes, _ := memStore.GetStrokeRecords(context.Background(), "example.com", 1100)
+	assert.Empty(t, strokes)
+}
+
+func TestStrokeBatcher_OnPersistedReportsWrittenStrokes(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	failing := &failingStore{MemWebverseStore: memStore}
+	failing.failures.Store(1)
+	counterBatcher := worker.NewCounterBatcher(memStore, 60000, worker.DefaultCounterFlushUsers)
+	strokeBatcher := worker.NewStrokeBatcher(failing, 10, worker.DefaultStrokeBufferSize, counterBatcher, nil)
+	persisted := make(chan []worker.BatchedStroke, 10)
+	strokeBatcher.OnPersisted = func(items []worker.BatchedStroke) { persisted <- items }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go strokeBatcher.Run(ctx)
+
+	strokeBatcher.WriteCh <- batchedStroke(1)
+
+	// Only reported once the retry wrote it
+	select {
+	case items := <-persisted:
+		assert.Len(t, items, 1)
+		assert.Equal(t, batchedStroke(1).Record.Stroke.Id, items[0].Record.Stroke.Id)
+		strokes, _ := memStore.GetStrokeRecords(context.Background(), "example.com", 1100)
+		assert.Len(t, strokes, 1)
+	case <-time.After(2 * time.Second):
+		t.Fatal("persisted strokes were not reported")
+	}
+}
+
+func TestStrokeBatcher_GracePeriodSkipsUndoneStrokes(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	registry := metrics.NewRegistry()
+	counterBatcher := worker.NewCounterBatcher(memStore, 60000, worker.DefaultCounterFlushUsers)
+	strokeBatcher := worker.NewStrokeBatcher(memStore, 10, worker.DefaultStrokeBufferSize, counterBatcher, registry)
+	strokeBatcher.GracePeriod = 200 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go strokeBatcher.Run(ctx)
+
+	for i := range 3 {
+		strokeBatcher.WriteCh <- batchedStroke(i)
+	}
+	// Run must take the writes before the delete, or there is no held stroke to cancel
+	assert.Eventually(t, func() bool { return len(strokeBatcher.WriteCh) == 0 }, time.Second, time.Millisecond)
+	undone := batchedStroke(1)
+	strokeBatcher.DeleteCh <- worker.DeleteStrokeRequest{StrokeId: undone.Record.Stroke.Id, UserId: "user1"}
+
+	// Held past several ticks
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int64(0), registry.Counter("stroke_batcher.strokes_flushed"))
+	assert.Equal(t, int64(1), registry.Counter("stroke_batcher.strokes_cancelled"))
+
+	assert.Eventually(t, func() bool {
+		strokes, _ := memStore.GetStrokeRecords(context.Background(), "example.com", 1100)
+		return len(strokes) == 2
+	}, time.Second, 5*time.Millisecond)
+	_, err := memStore.GetStroke(context.Background(), "example.com", undone.Record.Stroke.Id)
+	assert.Error(t, err)
+	assert.Equal(t, int64(2), registry.Counter("stroke_batcher.strokes_flushed"))
+}
+
+func TestStrokeBatcher_GracePeriodNotOwnerDeleteReported(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	counterBatcher := worker.NewCounterBatcher(memStore, 60000, worker.DefaultCounterFlushUsers)
+	strokeBatcher := worker.NewStrokeBatcher(memStore, 10, worker.DefaultStrokeBufferSize, counterBatcher, nil)
+	strokeBatcher.GracePeriod = time.Hour
+	reporter := &recordingReporter{notOwnerDeletes: make(chan string, 1)}
+	strokeBatcher.AbuseReporter = reporter
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go strokeBatcher.Run(ctx)
+
+	held := batchedStroke(1)
+	strokeBatcher.WriteCh <- held
+	assert.Eventually(t, func() bool { return len(strokeBatcher.WriteCh) == 0 }, time.Second, time.Millisecond)
+	strokeBatcher.DeleteCh <- worker.DeleteStrokeRequest{StrokeId: held.Record.Stroke.Id, UserId: "user2"}
+
+	select {
+	case report := <-reporter.notOwnerDeletes:
+		assert.Equal(t, "user2:"+held.Record.Stroke.Id, report)
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "timed out waiting for abuse report")
+	}
+}
+
+func TestStrokeBatcher_ShutdownWritesHeldStrokes(t *testing.T) {
+	memStore := memstore.NewMemWebverseStore()
+	counterBatcher := worker.NewCounterBatcher(memStore, 60000, worker.DefaultCounterFlushUsers)
+	strokeBatcher := worker.NewStrokeBatcher(memStore, 10, worker.DefaultStrokeBufferSize, counterBatcher, nil)
+	strokeBatcher.GracePeriod = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		strokeBatcher.Run(ctx)
+		close(done)
+	}()
+
+	for i := range 3 {
+		strokeBatcher.WriteCh <- batchedStroke(i)
+	}
+	assert.Eventually(t, func() bool { return len(strokeBatcher.WriteCh) == 0 }, time.Second, time.Millisecond)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(1 * time.Second):
+		t.Fatal("stroke batcher did not stop")
+	}
+	strokes, _ := memStore.GetStrokeRecords(context.Background(), "example.com", 1100)
+	assert.Len(t, strokes, 3)
+}
@@ -12,9 +12,9 @@ echo "Creating table '$TABLE_NAME'..."
 aws dynamodb create-table \
     --endpoint-url $DYNAMODB_ENDPOINT \
     --table-name $TABLE_NAME \
-    --attribute-definitions AttributeName=PK,AttributeType=S AttributeName=SK,AttributeType=S AttributeName=UserId,AttributeType=S AttributeName=Layer,AttributeType=S \
+    --attribute-definitions AttributeName=PK,AttributeType=S AttributeName=SK,AttributeType=S AttributeName=UserId,AttributeType=S AttributeName=Layer,AttributeType=S AttributeName=Created,AttributeType=N AttributeName=Id,AttributeType=S \
     --key-schema AttributeName=PK,KeyType=HASH AttributeName=SK,KeyType=RANGE \
-    --global-secondary-indexes '[ { "IndexName": "GSI_UserStrokes", "KeySchema": [ { "AttributeName": "UserId", "KeyType": "HASH" }, { "AttributeName": "Layer", "KeyType": "RANGE" } ], "Projection": { "ProjectionType": "KEYS_ONLY" } } ]' \
+    --global-secondary-indexes '[ { "IndexName": "GSI_UserStrokes", "KeySchema": [ { "AttributeName": "UserId", "KeyType": "HASH" }, { "AttributeName": "Layer", "KeyType": "RANGE" } ], "Projection": { "ProjectionType": "KEYS_ONLY" } }, { "IndexName": "GSI_PageStrokes", "KeySchema": [ { "AttributeName": "PK", "KeyType": "HASH" }, { "AttributeName": "Layer", "KeyType": "RANGE" } ], "Projection": { "ProjectionType": "INCLUDE", "NonKeyAttributes": [ "UserId" ] } }, { "IndexName": "GSI_Created", "KeySchema": [ { "AttributeName": "SK", "KeyType": "HASH" }, { "AttributeName": "Created", "KeyType": "RANGE" } ], "Projection": { "ProjectionType": "INCLUDE", "NonKeyAttributes": [ "Id", "Username", "Provider", "ProviderId", "StrokeCount" ] } }, { "IndexName": "GSI_UserId", "KeySchema": [ { "AttributeName": "Id", "KeyType": "HASH" } ], "Projection": { "ProjectionType": "INCLUDE", "NonKeyAttributes": [ "Username", "Provider", "ProviderId", "Created" ] } } ]' \
     --billing-mode PAY_PER_REQUEST \
     || echo "Error creating table '$TABLE_NAME'"
 
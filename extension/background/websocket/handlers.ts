@@ -174,10 +174,35 @@ export async function handleNewStroke(message: any) {
     return;
   }
 
-  const { pageKey, layer, layerId, stroke } = data;
+  const { pageKey, layer, stroke } = data;
 
   console.log(`🎨 Received new_stroke for page: ${pageKey}, userId: ${stroke.userId}, layer: ${layer}`);
 
+  await forwardNewStroke(pageKey, layer, stroke);
+}
+
+// Handle new_strokes push message: the strokes drawn on a page within the server's coalescing window
+export async function handleNewStrokes(message: any) {
+  const { data } = message;
+  if (!data || !data.pageKey || !Array.isArray(data.strokes)) {
+    console.warn('⚠️ Invalid new_strokes message:', message);
+    return;
+  }
+
+  const { pageKey, layer, strokes } = data;
+
+  console.log(`🎨 Received new_strokes for page: ${pageKey}, count: ${strokes.length}, layer: ${layer}`);
+
+  // Forwarded one by one in the order they were drawn, tabs handle them like new_stroke
+  for (const { stroke } of strokes) {
+    if (stroke) {
+      await forwardNewStroke(pageKey, layer, stroke);
+    }
+  }
+}
+
+// Helper: Decrypt/decode a stroke and forward it to all tabs on its page as new_stroke
+async function forwardNewStroke(pageKey: string, layer: number, stroke: any) {
   // Decrypt/decode stroke before forwarding
   const strokeToSend = await processStroke(stroke, layer);
   if (!strokeToSend) {
@@ -159,6 +159,13 @@ export async function connectWebSocket() {
           return;
         }
 
+        // Handle new_strokes push message, sent instead of new_stroke when the server coalesces draws
+        if (message.type === 'new_strokes') {
+          const { handleNewStrokes } = await import('./handlers');
+          await handleNewStrokes(message);
+          return;
+        }
+
         // Handle delete_stroke push message
         if (message.type === 'delete_stroke') {
           const { handleDeleteStroke } = await import('./handlers');